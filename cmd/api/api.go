@@ -6,13 +6,20 @@ import (
 
 	"github.com/KAsare1/Kodefx-server/service/appointment"
 	"github.com/KAsare1/Kodefx-server/service/availability"
+	"github.com/KAsare1/Kodefx-server/service/calendar"
 	"github.com/KAsare1/Kodefx-server/service/dashboard"
+	"github.com/KAsare1/Kodefx-server/service/earnings"
 	"github.com/KAsare1/Kodefx-server/service/forum"
+	"github.com/KAsare1/Kodefx-server/service/invoices"
+	"github.com/KAsare1/Kodefx-server/service/packages"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/KAsare1/Kodefx-server/service/promotions"
 	"github.com/KAsare1/Kodefx-server/service/signals"
 	"github.com/KAsare1/Kodefx-server/service/subscription"
 	"github.com/KAsare1/Kodefx-server/service/transactions"
 	"github.com/KAsare1/Kodefx-server/service/notifications"
 	"github.com/KAsare1/Kodefx-server/service/user"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
 	service "github.com/KAsare1/Kodefx-server/service/ws"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -65,6 +72,27 @@ func (s *APIServer) Run() error {
 	notificationHandler := notification.NewNotificationHandler(s.db)
 	notificationHandler.RegisterRoutes(subrouter)
 
+	promotionHandler := promotions.NewPromotionHandler(s.db)
+	promotionHandler.RegisterRoutes(subrouter)
+
+	earningsHandler := earnings.NewEarningsHandler(s.db)
+	earningsHandler.RegisterRoutes(subrouter)
+
+	invoiceHandler := invoices.NewInvoiceHandler(s.db)
+	invoiceHandler.RegisterRoutes(subrouter)
+
+	walletHandler := wallet.NewWalletHandler(s.db)
+	walletHandler.RegisterRoutes(subrouter)
+
+	paymentHandler := payment.NewPaymentHandler(s.db)
+	paymentHandler.RegisterRoutes(subrouter)
+
+	calendarHandler := calendar.NewCalendarHandler(s.db)
+	calendarHandler.RegisterRoutes(subrouter)
+
+	packageHandler := packages.NewPackageHandler(s.db)
+	packageHandler.RegisterRoutes(subrouter)
+
 	// CORS configuration to allow all origins
 	corsMiddleware := handlers.CORS(
 		handlers.AllowedOrigins([]string{"*"}),
@@ -12,6 +12,7 @@ import (
 	"github.com/KAsare1/Kodefx-server/cmd/models"
 	"github.com/KAsare1/Kodefx-server/db"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func main() {
@@ -58,6 +59,19 @@ func performMigrations(DB *gorm.DB) error {
 		&models.User{}:              "User",
 		&models.Expert{}:            "Expert",
 		&models.Availability{}:      "Availability",
+		&models.AvailabilityRule{}:  "AvailabilityRule",
+		&models.SlotHold{}:          "SlotHold",
+		&models.RescheduleRequest{}: "RescheduleRequest",
+		&models.AppointmentChange{}: "AppointmentChange",
+		&models.AppointmentReminder{}: "AppointmentReminder",
+		&models.MeetingAttendance{}: "MeetingAttendance",
+		&models.CalendarToken{}:     "CalendarToken",
+		&models.CalendarInvite{}:    "CalendarInvite",
+		&models.SessionNote{}:       "SessionNote",
+		&models.RatingReport{}:      "RatingReport",
+		&models.WaitlistEntry{}:     "WaitlistEntry",
+		&models.SessionPackage{}:    "SessionPackage",
+		&models.PackagePurchase{}:   "PackagePurchase",
 		&models.Appointment{}:       "Appointment",
 		&models.Post{}:              "Post",
 		&models.Image{}:             "Image",
@@ -78,6 +92,17 @@ func performMigrations(DB *gorm.DB) error {
         // &models.BroadcastRequest{}: "BroadcastRequest",
         &models.NotificationHistory{}: "NotificationHistory ",
         &models.Rating{}: "Rating",
+        &models.SubscriptionPlan{}: "SubscriptionPlan",
+        &models.Coupon{}: "Coupon",
+        &models.CouponRedemption{}: "CouponRedemption",
+        &models.ReferralReward{}: "ReferralReward",
+        &models.LedgerJournal{}: "LedgerJournal",
+        &models.LedgerEntry{}: "LedgerEntry",
+        &models.Payout{}: "Payout",
+        &models.InvoiceSequence{}: "InvoiceSequence",
+        &models.Invoice{}: "Invoice",
+        &models.Wallet{}: "Wallet",
+        &models.WalletEntry{}: "WalletEntry",
 	}
 
 	log.Println("Starting database migrations...")
@@ -89,6 +114,21 @@ func performMigrations(DB *gorm.DB) error {
 		log.Printf("%s migration successful", name)
 	}
 
+	if err := migrateMoneyColumns(DB); err != nil {
+		return fmt.Errorf("error converting money columns: %w", err)
+	}
+
+	if err := seedLegacyPlans(DB); err != nil {
+		return fmt.Errorf("error seeding legacy subscription plans: %w", err)
+	}
+
+	if err := backfillSlotTimes(DB); err != nil {
+		return fmt.Errorf("error backfilling slot times: %w", err)
+	}
+
+	if err := dropLegacyRatingIndexes(DB); err != nil {
+		return fmt.Errorf("error replacing rating indexes: %w", err)
+	}
 
 	directories := []string{
 		"uploads/images",               
@@ -107,6 +147,136 @@ func performMigrations(DB *gorm.DB) error {
 }
 
 
+// moneyColumns pairs the old decimal money columns with the minor unit
+// columns that replaced them
+var moneyColumns = []struct {
+	table, from, to string
+}{
+	{"transactions", "amount", "amount_minor"},
+	{"transactions", "discount_amount", "discount_minor"},
+	{"appointments", "amount", "amount_minor"},
+	{"availabilities", "price", "price_minor"},
+	{"signal_subscriptions", "amount", "amount_minor"},
+	{"signal_subscriptions", "proration_credit", "proration_credit_minor"},
+	{"subscription_plans", "price", "price_minor"},
+	{"coupons", "max_discount", "max_discount_minor"},
+	{"coupons", "min_amount", "min_amount_minor"},
+	{"coupon_redemptions", "original_amount", "original_amount_minor"},
+	{"coupon_redemptions", "discount_amount", "discount_amount_minor"},
+	{"referral_rewards", "amount", "amount_minor"},
+	{"ledger_journals", "gross", "gross_minor"},
+	{"ledger_journals", "commission", "commission_minor"},
+	{"ledger_entries", "debit", "debit_minor"},
+	{"ledger_entries", "credit", "credit_minor"},
+	{"payouts", "amount", "amount_minor"},
+}
+
+// migrateMoneyColumns copies amounts stored as decimals into their minor unit
+// columns and drops the old columns. All existing rows are in GHS, which has
+// two decimal places.
+func migrateMoneyColumns(DB *gorm.DB) error {
+	// Fixed coupons kept their amount in value, which is now only a percentage
+	if DB.Migrator().HasColumn("coupons", "max_discount") {
+		if err := DB.Exec("UPDATE coupons SET amount_off_minor = ROUND(value * 100), value = 0 WHERE discount_type = 'fixed' AND amount_off_minor = 0").Error; err != nil {
+			return err
+		}
+	}
+
+	for _, column := range moneyColumns {
+		if !DB.Migrator().HasColumn(column.table, column.from) {
+			continue
+		}
+		log.Printf("Converting %s.%s to %s...", column.table, column.from, column.to)
+		sql := fmt.Sprintf("UPDATE %s SET %s = ROUND(%s * 100) WHERE %s = 0", column.table, column.to, column.from, column.to)
+		if err := DB.Exec(sql).Error; err != nil {
+			return err
+		}
+		if err := DB.Migrator().DropColumn(column.table, column.from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyPlans are the plan codes subscriptions used before the plan catalog
+// existed, with the durations the webhook used to apply to them
+var legacyPlans = []models.SubscriptionPlan{
+	{Code: "monthly", Name: "Monthly", DurationMonths: 1},
+	{Code: "quarterly", Name: "Quarterly", DurationMonths: 3},
+	{Code: "annual", Name: "Annual", DurationMonths: 12},
+}
+
+// seedLegacyPlans adds the legacy plans to the catalog, so subscriptions and
+// pending payments that refer to them still resolve, and normalizes the plan
+// codes stored on subscriptions. The plans are added inactive with no price;
+// an admin sets a price to sell them again. Existing plans are left as they are.
+func seedLegacyPlans(DB *gorm.DB) error {
+	if err := DB.Exec("UPDATE signal_subscriptions SET plan = LOWER(TRIM(plan)) WHERE plan <> LOWER(TRIM(plan))").Error; err != nil {
+		return err
+	}
+
+	for _, plan := range legacyPlans {
+		plan.Currency = "GHS"
+		if err := DB.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "code"}}, DoNothing: true}).
+			Create(&plan).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// slotDateColumns are the tables whose start and end times used to hold only
+// a time of day, with the day in a separate date column
+var slotDateColumns = []struct {
+	table, date string
+}{
+	{"availabilities", "date"},
+	{"appointments", "appointment_date"},
+}
+
+// backfillSlotTimes turns legacy start and end times into full instants on
+// the row's date, so overlap checks, searches and reminders see the real
+// session times. Legacy times are taken as UTC. A row is legacy when its
+// start time is not within a day of its date; newer rows keep the expert's
+// local date, which never differs from the start by more than that. Sessions
+// that end at or before their start time of day run past midnight.
+func backfillSlotTimes(DB *gorm.DB) error {
+	for _, columns := range slotDateColumns {
+		sql := fmt.Sprintf(`UPDATE %[1]s SET
+			start_time = date_trunc('day', %[2]s) + CAST(start_time AS TIME),
+			end_time = date_trunc('day', %[2]s) + CAST(end_time AS TIME) +
+				CASE WHEN CAST(end_time AS TIME) <= CAST(start_time AS TIME) THEN INTERVAL '1 day' ELSE INTERVAL '0' END
+			WHERE start_time NOT BETWEEN %[2]s - INTERVAL '1 day' AND %[2]s + INTERVAL '2 days'`, columns.table, columns.date)
+		result := DB.Exec(sql)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			log.Printf("Backfilled start and end times of %d %s", result.RowsAffected, columns.table)
+		}
+	}
+	return nil
+}
+
+// legacyRatingIndexes made a review unique per engagement even once deleted.
+// They were replaced by indexes that only cover live reviews.
+var legacyRatingIndexes = []string{"idx_ratings_appointment_id", "idx_rating_subscription_expert"}
+
+// dropLegacyRatingIndexes removes legacyRatingIndexes so a deleted review can
+// be written again
+func dropLegacyRatingIndexes(DB *gorm.DB) error {
+	for _, name := range legacyRatingIndexes {
+		if !DB.Migrator().HasIndex(&models.Rating{}, name) {
+			continue
+		}
+		if err := DB.Migrator().DropIndex(&models.Rating{}, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func createDirectoryIfNotExist(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		if err := os.MkdirAll(path, 0755); err != nil {
@@ -163,6 +333,19 @@ func clearDatabase(DB *gorm.DB, tables []interface{}) error {
             &models.PeerMessage{},
             &models.Appointment{},
             &models.Availability{},
+            &models.AvailabilityRule{},
+            &models.SlotHold{},
+            &models.RescheduleRequest{},
+            &models.AppointmentChange{},
+            &models.AppointmentReminder{},
+            &models.MeetingAttendance{},
+            &models.CalendarToken{},
+            &models.CalendarInvite{},
+            &models.SessionNote{},
+            &models.RatingReport{},
+            &models.WaitlistEntry{},
+            &models.SessionPackage{},
+            &models.PackagePurchase{},
             &models.Post{},
             &models.Image{},
             &models.CertificationFile{},
@@ -183,6 +366,17 @@ func clearDatabase(DB *gorm.DB, tables []interface{}) error {
             // &models.BroadcastRequest{},
             &models.NotificationHistory{},
             &models.Rating{},
+            &models.SubscriptionPlan{},
+            &models.ReferralReward{},
+            &models.CouponRedemption{},
+            &models.Coupon{},
+            &models.LedgerEntry{},
+            &models.LedgerJournal{},
+            &models.Payout{},
+            &models.Invoice{},
+            &models.InvoiceSequence{},
+            &models.WalletEntry{},
+            &models.Wallet{},
 
         }
     }
@@ -239,6 +433,32 @@ func runDatabaseClear() {
                 tables = append(tables, &models.Expert{})
             case "Availability":
                 tables = append(tables, &models.Availability{})
+            case "AvailabilityRule":
+                tables = append(tables, &models.AvailabilityRule{})
+            case "SlotHold":
+                tables = append(tables, &models.SlotHold{})
+            case "RescheduleRequest":
+                tables = append(tables, &models.RescheduleRequest{})
+            case "AppointmentChange":
+                tables = append(tables, &models.AppointmentChange{})
+            case "AppointmentReminder":
+                tables = append(tables, &models.AppointmentReminder{})
+            case "MeetingAttendance":
+                tables = append(tables, &models.MeetingAttendance{})
+            case "CalendarToken":
+                tables = append(tables, &models.CalendarToken{})
+            case "CalendarInvite":
+                tables = append(tables, &models.CalendarInvite{})
+            case "SessionNote":
+                tables = append(tables, &models.SessionNote{})
+            case "RatingReport":
+                tables = append(tables, &models.RatingReport{})
+            case "WaitlistEntry":
+                tables = append(tables, &models.WaitlistEntry{})
+            case "SessionPackage":
+                tables = append(tables, &models.SessionPackage{})
+            case "PackagePurchase":
+                tables = append(tables, &models.PackagePurchase{})
             case "Appointment":
                 tables = append(tables, &models.Appointment{})
             case "Post":
@@ -269,6 +489,28 @@ func runDatabaseClear() {
                 tables = append(tables, &models.Transaction{})
             case "SignalSubscription":
                 tables = append(tables, &models.SignalSubscription{})
+            case "SubscriptionPlan":
+                tables = append(tables, &models.SubscriptionPlan{})
+            case "Coupon":
+                tables = append(tables, &models.Coupon{})
+            case "CouponRedemption":
+                tables = append(tables, &models.CouponRedemption{})
+            case "ReferralReward":
+                tables = append(tables, &models.ReferralReward{})
+            case "LedgerJournal":
+                tables = append(tables, &models.LedgerJournal{})
+            case "LedgerEntry":
+                tables = append(tables, &models.LedgerEntry{})
+            case "Payout":
+                tables = append(tables, &models.Payout{})
+            case "Invoice":
+                tables = append(tables, &models.Invoice{})
+            case "InvoiceSequence":
+                tables = append(tables, &models.InvoiceSequence{})
+            case "Wallet":
+                tables = append(tables, &models.Wallet{})
+            case "WalletEntry":
+                tables = append(tables, &models.WalletEntry{})
             default:
                 log.Printf("Unknown table: %s", table)
             }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+)
+
+func TestSeedLegacyPlans(t *testing.T) {
+	db := testdb.Open(t, "main")
+	user := testdb.User(t, db, "Legacy Subscriber")
+	testdb.Plan(t, db, "monthly", 1, 12000)
+	sub := models.SignalSubscription{UserID: user.ID, Plan: " Quarterly ", Amount: 30000, Currency: "GHS", Status: "active", PaymentID: "SIG-legacy"}
+	if err := db.Create(&sub).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Seeding twice must change nothing the second time
+	for i := 0; i < 2; i++ {
+		if err := seedLegacyPlans(db); err != nil {
+			t.Fatalf("seedLegacyPlans: %v", err)
+		}
+	}
+
+	tests := []struct {
+		code   string
+		months int
+		price  int64
+		active bool
+	}{
+		{code: "monthly", months: 1, price: 12000, active: true}, // Already in the catalog, left as it was
+		{code: "quarterly", months: 3},
+		{code: "annual", months: 12},
+	}
+	for _, tt := range tests {
+		var plan models.SubscriptionPlan
+		if err := db.Where("code = ?", tt.code).First(&plan).Error; err != nil {
+			t.Errorf("plan %s not seeded: %v", tt.code, err)
+			continue
+		}
+		if plan.DurationMonths != tt.months || plan.Price != tt.price || plan.Active != tt.active {
+			t.Errorf("plan %s = %d months at %d, active %v; want %d months at %d, active %v",
+				tt.code, plan.DurationMonths, plan.Price, plan.Active, tt.months, tt.price, tt.active)
+		}
+	}
+
+	db.First(&sub, sub.ID)
+	if sub.Plan != "quarterly" {
+		t.Errorf("subscription plan = %q, want it normalized to quarterly", sub.Plan)
+	}
+}
+
+func TestMigrateMoneyColumns(t *testing.T) {
+	db := testdb.Open(t, "main")
+	expert := testdb.Expert(t, db, "Legacy Expert")
+
+	// Columns from before amounts were stored in minor units
+	for _, column := range []string{"payouts ADD COLUMN amount numeric NOT NULL DEFAULT 0", "coupons ADD COLUMN max_discount numeric NOT NULL DEFAULT 0"} {
+		if err := db.Exec("ALTER TABLE " + column).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy := models.Payout{ExpertID: expert.ID, Currency: "GHS", Status: "paid", Reference: "PO-legacy"}
+	converted := models.Payout{ExpertID: expert.ID, Amount: 500, Currency: "GHS", Status: "paid", Reference: "PO-new"}
+	fixed := models.Coupon{Code: "FIVE", DiscountType: "fixed", Value: 5, Active: true}
+	percent := models.Coupon{Code: "TEN", DiscountType: "percentage", Value: 10, Active: true}
+	for _, row := range []interface{}{&legacy, &converted, &fixed, &percent} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Exec("UPDATE payouts SET amount = 12.345 WHERE id = ?", legacy.ID)
+	db.Exec("UPDATE payouts SET amount = 99 WHERE id = ?", converted.ID)
+
+	// Migrating again finds nothing left to convert
+	for i := 0; i < 2; i++ {
+		if err := migrateMoneyColumns(db); err != nil {
+			t.Fatalf("migrateMoneyColumns: %v", err)
+		}
+	}
+
+	db.First(&legacy, legacy.ID)
+	db.First(&converted, converted.ID)
+	if legacy.Amount != 1235 || converted.Amount != 500 {
+		t.Errorf("payout amounts = %d and %d, want 1235 and the converted 500 kept", legacy.Amount, converted.Amount)
+	}
+	db.First(&fixed, fixed.ID)
+	db.First(&percent, percent.ID)
+	if fixed.AmountOff != 500 || fixed.Value != 0 || percent.Value != 10 || percent.AmountOff != 0 {
+		t.Errorf("coupons = fixed %d off (value %v), percentage %v%% (%d off)", fixed.AmountOff, fixed.Value, percent.Value, percent.AmountOff)
+	}
+	if db.Migrator().HasColumn("payouts", "amount") || db.Migrator().HasColumn("coupons", "max_discount") {
+		t.Error("decimal columns left behind")
+	}
+}
+
+func TestBackfillSlotTimes(t *testing.T) {
+	db := testdb.Open(t, "main")
+	expert := testdb.Expert(t, db, "Legacy Expert")
+	start := time.Date(2026, 3, 10, 18, 0, 0, 0, time.UTC)
+
+	// Legacy slots kept only the time of day
+	evening := testdb.Slot(t, db, expert, start, 1, 5000)
+	overnight := testdb.Slot(t, db, expert, start, 1, 5000)
+	current := testdb.Slot(t, db, expert, start, 1, 5000)
+	db.Exec("UPDATE availabilities SET start_time = '0001-01-01 18:00:00+00', end_time = '0001-01-01 19:30:00+00' WHERE id = ?", evening.ID)
+	db.Exec("UPDATE availabilities SET start_time = '0001-01-01 23:00:00+00', end_time = '0001-01-01 01:00:00+00' WHERE id = ?", overnight.ID)
+
+	for i := 0; i < 2; i++ {
+		if err := backfillSlotTimes(db); err != nil {
+			t.Fatalf("backfillSlotTimes: %v", err)
+		}
+	}
+
+	tests := []struct {
+		slot       *models.Availability
+		start, end time.Time
+	}{
+		{evening, start, start.Add(90 * time.Minute)},
+		{overnight, start.Add(5 * time.Hour), start.Add(7 * time.Hour)},
+		{current, start, start.Add(time.Hour)}, // Already a full instant, left alone
+	}
+	for _, tt := range tests {
+		db.First(tt.slot, tt.slot.ID)
+		if !tt.slot.StartTime.Equal(tt.start) || !tt.slot.EndTime.Equal(tt.end) {
+			t.Errorf("slot %d runs %v to %v, want %v to %v", tt.slot.ID, tt.slot.StartTime, tt.slot.EndTime, tt.start, tt.end)
+		}
+	}
+}
@@ -10,18 +10,30 @@ type Appointment struct {
     gorm.Model
     TraderID         uint      `gorm:"not null" json:"trader_id"`
     ExpertID         uint      `gorm:"not null" json:"expert_id"`
-    AvailabilityID   uint      `gorm:"not null" json:"availability_id"`
+    AvailabilityID   uint      `gorm:"not null;index:idx_appointment_slot_status,priority:1" json:"availability_id"`
     AppointmentDate  time.Time `gorm:"not null" json:"appointment_date"`
     StartTime        time.Time `gorm:"not null" json:"start_time"`
     EndTime          time.Time `gorm:"not null" json:"end_time"`
-    Status           string    `gorm:"default:'Pending'" json:"status"`
+    Status           string    `gorm:"default:'Pending';index:idx_appointment_slot_status,priority:2" json:"status"` // Pending, Confirmed, Completed, NoShow, ExpertNoShow, Cancelled, Expired
     PaymentStatus    string    `gorm:"not null;default:unpaid" json:"payment_status"`
-    Amount           float64   `gorm:"not null" json:"amount"`
+    Seats            int       `gorm:"not null;default:1" json:"seats"` // Seats booked in the slot
+    Amount           int64     `gorm:"column:amount_minor;not null;default:0" json:"amount_minor"` // Minor units, for all seats
+    WalletAmount     int64     `gorm:"column:wallet_minor;not null;default:0" json:"wallet_minor"` // Part of Amount paid from the wallet
+    Currency         string    `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+    LegacyAmount     float64   `gorm:"-" json:"amount"` // Deprecated: Amount in major units
     PaymentID        string    `gorm:"size:255" json:"payment_id,omitempty"`
     EventName        string    `gorm:"size:255;not null" json:"event_name"`
     Category         string    `gorm:"size:50" json:"category"`
+    MeetingProvider  string    `gorm:"size:20" json:"meeting_provider,omitempty"`
+    MeetingRoom      string    `gorm:"size:255" json:"-"` // Only given to the participants once the room opens
+    MeetingURL       string    `gorm:"size:500" json:"-"`
+    CalendarSequence int       `gorm:"not null;default:0" json:"-"` // Revision of the calendar event, raised on each change
+    ClosedAt         *time.Time `json:"closed_at,omitempty"`    // When it was marked completed or a no-show
+    ClosedByID       *uint      `json:"closed_by_id,omitempty"` // Who marked it; empty when closed automatically
+    PackagePurchaseID *uint     `gorm:"index" json:"package_purchase_id,omitempty"` // Set when booked with a package credit instead of paying
     
     Trader           *User         `gorm:"foreignKey:TraderID" json:"trader,omitempty"`
     Expert           *Expert       `gorm:"foreignKey:ExpertID" json:"expert,omitempty"`
     Availability     *Availability `gorm:"foreignKey:AvailabilityID" json:"availability,omitempty"`
+    Changes          []AppointmentChange `gorm:"foreignKey:AppointmentID" json:"changes,omitempty"` // Reschedule history, oldest first
 }
\ No newline at end of file
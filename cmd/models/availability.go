@@ -3,24 +3,63 @@ package models
 import (
 	"time"
 
+	"github.com/lib/pq"
 	"gorm.io/gorm"
 )
 
+// Availability is a bookable slot. StartTime and EndTime are stored as UTC
+// instants; Date is the slot's calendar date in the expert's time zone.
 type Availability struct {
 	gorm.Model
-	ExpertID  uint      `gorm:"column:expert_id;not null" json:"expert_id"`
+	ExpertID  uint      `gorm:"column:expert_id;not null;index:idx_availability_expert_start,priority:1" json:"expert_id"`
 	EventName string    `gorm:"column:event_name;size:255;not null" json:"event_name"`
 	Note      string    `gorm:"column:note;type:text" json:"note"`
 	Date      time.Time `gorm:"column:date;not null" json:"date"`
-	StartTime time.Time `gorm:"column:start_time;not null" json:"start_time"`
+	StartTime time.Time `gorm:"column:start_time;not null;index:idx_availability_start;index:idx_availability_expert_start,priority:2;index:idx_availability_category_start,priority:2" json:"start_time"`
 	EndTime   time.Time `gorm:"column:end_time;not null" json:"end_time"`
 	Reminder  bool      `gorm:"column:reminder;default:false" json:"reminder"`
-	Category  string    `gorm:"column:category;size:50" json:"category"`
-	Price     float64   `gorm:"column:price;not null" json:"price"`
+	Category  string    `gorm:"column:category;size:50;index:idx_availability_category_start,priority:1" json:"category"`
+	Price     int64     `gorm:"column:price_minor;not null;default:0;index" json:"price_minor"` // Minor units
+	Currency  string    `gorm:"column:currency;size:3;not null;default:'GHS'" json:"currency"`
+	Capacity  int       `gorm:"column:capacity;not null;default:1" json:"capacity"` // Seats, more than one for group sessions; Price is per seat
+	RuleID    *uint     `gorm:"column:rule_id;index" json:"rule_id,omitempty"`      // Recurrence rule this slot was generated from
+	Detached  bool      `gorm:"column:detached;default:false" json:"detached"`      // Edited on its own, so series edits leave it alone
 
-	Expert    *Expert   `gorm:"foreignKey:ExpertID" json:"-"`
+	SeatsTaken  int     `gorm:"-" json:"seats_taken"`         // Seats held by appointments that are not cancelled
+	TimeZone    string  `gorm:"-" json:"time_zone,omitempty"` // Zone StartTime and EndTime are rendered in
+	LegacyPrice float64 `gorm:"-" json:"price"`               // Deprecated: Price in major units
+
+	Expert *Expert `gorm:"foreignKey:ExpertID" json:"-"`
 }
 
 func (Availability) TableName() string {
 	return "availabilities"
-}
\ No newline at end of file
+}
+
+// AvailabilityRule generates an expert's repeating slots, e.g. weekly on
+// Monday and Wednesday from 18:00 to 19:00 until a given date. Slots are
+// materialized as Availability rows a few weeks ahead so they can be booked.
+// Times follow the wall clock in TimeZone, so slots keep their local time
+// across daylight saving changes.
+type AvailabilityRule struct {
+	gorm.Model
+	ExpertID   uint           `gorm:"index;not null" json:"expert_id"`
+	EventName  string         `gorm:"size:255;not null" json:"event_name"`
+	Note       string         `gorm:"type:text" json:"note"`
+	Category   string         `gorm:"size:50" json:"category"`
+	Reminder   bool           `gorm:"default:false" json:"reminder"`
+	Price      int64          `gorm:"column:price_minor;not null;default:0" json:"price_minor"` // Per seat, minor units
+	Currency   string         `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	Capacity   int            `gorm:"not null;default:1" json:"capacity"`
+	Frequency  string         `gorm:"size:10;not null" json:"frequency"` // daily, weekly
+	Interval   int            `gorm:"column:repeat_interval;not null;default:1" json:"interval"`
+	ByDay      pq.StringArray `gorm:"type:text[]" json:"by_day"`         // MO to SU, for weekly rules
+	StartTime  string         `gorm:"size:5;not null" json:"start_time"` // HH:MM, wall clock in TimeZone
+	EndTime    string         `gorm:"size:5;not null" json:"end_time"`   // HH:MM, the next day if before StartTime
+	TimeZone   string         `gorm:"size:64;not null;default:'UTC'" json:"time_zone"`
+	StartsOn   time.Time      `gorm:"not null" json:"starts_on"`
+	Until      *time.Time     `json:"until,omitempty"`
+	Exceptions pq.StringArray `gorm:"type:text[]" json:"exceptions"` // YYYY-MM-DD dates with no slot
+
+	MaterializedUntil *time.Time `json:"materialized_until,omitempty"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CalendarToken is the secret in a user's iCalendar feed URL. Anyone with the
+// URL can read the feed, so it can be rotated.
+type CalendarToken struct {
+	gorm.Model
+	UserID uint   `gorm:"uniqueIndex;not null" json:"user_id"`
+	Token  string `gorm:"size:64;uniqueIndex;not null" json:"-"`
+}
+
+// CalendarInvite is an .ics invite waiting to be emailed to a participant
+// when their appointment is confirmed, rescheduled or cancelled
+type CalendarInvite struct {
+	gorm.Model
+	AppointmentID uint       `gorm:"index;not null" json:"appointment_id"`
+	UserID        uint       `gorm:"index;not null" json:"user_id"`
+	Email         string     `gorm:"size:255;not null" json:"email"`
+	Kind          string     `gorm:"size:20;not null" json:"kind"` // confirmed, rescheduled, cancelled
+	EmailedAt     *time.Time `gorm:"index" json:"emailed_at,omitempty"`
+	EmailAttempts int        `gorm:"default:0" json:"-"`
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Ledger accounts
+const (
+	AccountCash            = "cash"             // Money held with the payment provider
+	AccountPlatformRevenue = "platform_revenue" // Commission and other income kept by the platform
+	AccountExpertPayable   = "expert_payable"   // Money owed to an expert, per ExpertID
+	AccountExpertDeferred  = "expert_deferred"  // Expert shares of prepaid sessions not yet earned, per ExpertID
+	AccountUserWallet      = "user_wallet"      // Wallet credit held for users, spendable on purchases
+)
+
+// LedgerJournal groups the balanced entries posted for one business event,
+// such as a successful payment or a payout
+type LedgerJournal struct {
+	gorm.Model
+	Reference   string `gorm:"size:100;uniqueIndex;not null" json:"reference"`
+	Kind        string `gorm:"size:30;not null" json:"kind"` // payment, payment_reversal, deferred_earning, deferred_return, payout, payout_reversal, wallet_credit, wallet_debit, wallet_spend
+	ExpertID    *uint  `gorm:"index" json:"expert_id,omitempty"`
+	Description string `gorm:"type:text" json:"description"`
+	Currency    string `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	Gross       int64  `gorm:"column:gross_minor;default:0" json:"gross_minor"`
+	Commission  int64  `gorm:"column:commission_minor;default:0" json:"commission_minor"`
+
+	Entries []LedgerEntry `gorm:"foreignKey:JournalID" json:"entries,omitempty"`
+}
+
+// LedgerEntry is one side of a journal. Debits and credits of a journal always balance.
+type LedgerEntry struct {
+	gorm.Model
+	JournalID uint   `gorm:"index;not null" json:"journal_id"`
+	Account   string `gorm:"size:50;index;not null" json:"account"`
+	ExpertID  *uint  `gorm:"index" json:"expert_id,omitempty"`
+	Currency  string `gorm:"size:3;index;not null;default:'GHS'" json:"currency"`
+	Debit     int64  `gorm:"column:debit_minor;default:0" json:"debit_minor"`
+	Credit    int64  `gorm:"column:credit_minor;default:0" json:"credit_minor"`
+}
+
+// Payout is an expert's request to be paid their balance
+type Payout struct {
+	gorm.Model
+	ExpertID      uint       `gorm:"index;not null" json:"expert_id"`
+	Amount        int64      `gorm:"column:amount_minor;not null;default:0" json:"amount_minor"`
+	Currency      string     `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	Status        string     `gorm:"size:20;index;not null" json:"status"` // requested, approved, processing, paid, rejected, failed
+	Reference     string     `gorm:"size:100;uniqueIndex;not null" json:"reference"`
+	TransferCode  string     `gorm:"size:100" json:"transfer_code,omitempty"`
+	Note          string     `gorm:"type:text" json:"note,omitempty"`
+	FailureReason string     `gorm:"type:text" json:"failure_reason,omitempty"`
+	ReviewedByID  *uint      `json:"reviewed_by_id,omitempty"`
+	ReviewedAt    *time.Time `json:"reviewed_at,omitempty"`
+
+	Expert *Expert `gorm:"foreignKey:ExpertID" json:"expert,omitempty"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SlotHold keeps the seats of a pending appointment reserved while the trader
+// pays. Holds that are not converted by ExpiresAt are released by a sweeper.
+type SlotHold struct {
+	gorm.Model
+	AvailabilityID uint      `gorm:"index;not null" json:"availability_id"`
+	AppointmentID  uint      `gorm:"uniqueIndex;not null" json:"appointment_id"`
+	TraderID       uint      `gorm:"index;not null" json:"trader_id"`
+	Seats          int       `gorm:"not null;default:1" json:"seats"`
+	Reference      string    `gorm:"size:100;uniqueIndex;not null" json:"reference"`
+	Status         string    `gorm:"size:20;index;not null" json:"status"` // held, converted, expired
+	ExpiresAt      time.Time `gorm:"index;not null" json:"expires_at"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// InvoiceSequence holds the last invoice number issued in a year. Numbers are
+// taken by incrementing the row inside the payment's transaction, so they stay
+// sequential and gap-free under concurrent payments.
+type InvoiceSequence struct {
+	Year       int   `gorm:"primaryKey;autoIncrement:false" json:"year"`
+	LastNumber int64 `gorm:"not null;default:0" json:"last_number"`
+}
+
+// Invoice is the numbered receipt issued for a successful payment. Amounts are
+// in minor units of Currency.
+type Invoice struct {
+	gorm.Model
+	Number        string     `gorm:"size:30;uniqueIndex;not null" json:"number"` // e.g. KFX-2026-000123
+	UserID        uint       `gorm:"index;not null" json:"user_id"`
+	TransactionID uint       `gorm:"uniqueIndex;not null" json:"transaction_id"`
+	Reference     string     `gorm:"size:100;index" json:"reference"`
+	Kind          string     `gorm:"size:30;not null" json:"kind"` // appointment, signal_subscription
+	Description   string     `gorm:"type:text" json:"description"`
+	CustomerName  string     `gorm:"size:255" json:"customer_name"`
+	CustomerEmail string     `gorm:"size:255" json:"customer_email"`
+	Currency      string     `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	Subtotal      int64      `gorm:"column:subtotal_minor;not null;default:0" json:"subtotal_minor"`
+	Discount      int64      `gorm:"column:discount_minor;not null;default:0" json:"discount_minor"`
+	Total         int64      `gorm:"column:total_minor;not null;default:0" json:"total_minor"`
+	WalletAmount  int64      `gorm:"column:wallet_minor;not null;default:0" json:"wallet_minor"` // Part of Total paid from the wallet
+	CouponCode    string     `gorm:"size:50" json:"coupon_code,omitempty"`
+	PaymentMethod string     `gorm:"size:50" json:"payment_method"`
+	IssuedAt      time.Time  `gorm:"not null" json:"issued_at"`
+	EmailedAt     *time.Time `gorm:"index" json:"emailed_at,omitempty"`
+	EmailAttempts int        `gorm:"default:0" json:"-"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MeetingAttendance is one visit by a participant to an appointment's
+// meeting room, from joining until leaving
+type MeetingAttendance struct {
+	gorm.Model
+	AppointmentID uint       `gorm:"index;not null" json:"appointment_id"`
+	UserID        uint       `gorm:"index;not null" json:"user_id"`
+	Role          string     `gorm:"size:20;not null" json:"role"` // trader, expert
+	JoinedAt      time.Time  `gorm:"not null" json:"joined_at"`
+	LeftAt        *time.Time `json:"left_at,omitempty"`
+}
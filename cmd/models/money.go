@@ -0,0 +1,60 @@
+package models
+
+import "gorm.io/gorm"
+
+// MajorUnits converts a minor-unit amount to major units for the deprecated
+// decimal JSON fields below. The utils package, which knows each currency's
+// decimals, replaces it at start up; models can't import utils, which
+// depends on it.
+var MajorUnits = func(amount int64, currency string) float64 {
+	return float64(amount) / 100
+}
+
+// The deprecated fields are filled in whenever a row is loaded or saved, so
+// clients still reading "amount" and "price" keep working while they move to
+// the minor unit fields.
+
+func (a *Appointment) AfterFind(tx *gorm.DB) error {
+	a.LegacyAmount = MajorUnits(a.Amount, a.Currency)
+	return nil
+}
+
+func (a *Appointment) AfterSave(tx *gorm.DB) error {
+	return a.AfterFind(tx)
+}
+
+func (a *Availability) AfterFind(tx *gorm.DB) error {
+	a.LegacyPrice = MajorUnits(a.Price, a.Currency)
+	return nil
+}
+
+func (a *Availability) AfterSave(tx *gorm.DB) error {
+	return a.AfterFind(tx)
+}
+
+func (t *Transaction) AfterFind(tx *gorm.DB) error {
+	t.LegacyAmount = MajorUnits(t.Amount, t.Currency)
+	return nil
+}
+
+func (t *Transaction) AfterSave(tx *gorm.DB) error {
+	return t.AfterFind(tx)
+}
+
+func (s *SignalSubscription) AfterFind(tx *gorm.DB) error {
+	s.LegacyAmount = MajorUnits(s.Amount, s.Currency)
+	return nil
+}
+
+func (s *SignalSubscription) AfterSave(tx *gorm.DB) error {
+	return s.AfterFind(tx)
+}
+
+func (p *SubscriptionPlan) AfterFind(tx *gorm.DB) error {
+	p.LegacyPrice = MajorUnits(p.Price, p.Currency)
+	return nil
+}
+
+func (p *SubscriptionPlan) AfterSave(tx *gorm.DB) error {
+	return p.AfterFind(tx)
+}
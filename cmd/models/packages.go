@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SessionPackage is a bundle of sessions with an expert sold at one price,
+// e.g. five mentoring sessions at a discount. Each session bought is a credit
+// the trader redeems to book one seat in one of the expert's slots.
+type SessionPackage struct {
+	gorm.Model
+	ExpertID     uint   `gorm:"index;not null" json:"expert_id"`
+	Name         string `gorm:"size:255;not null" json:"name"`
+	Description  string `gorm:"type:text" json:"description"`
+	Category     string `gorm:"size:50" json:"category,omitempty"` // Only slots in this category, when set
+	Sessions     int    `gorm:"not null" json:"sessions"`
+	Price        int64  `gorm:"column:price_minor;not null;default:0" json:"price_minor"` // For the whole bundle, minor units
+	Currency     string `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	ValidityDays int    `gorm:"not null;default:90" json:"validity_days"` // How long credits last after purchase
+	Active       bool   `gorm:"not null;default:true" json:"active"`
+}
+
+// PackagePurchase is a trader's purchase of a session package and the
+// credits left on it. The package's terms are copied at purchase so later
+// changes to the package don't affect it.
+type PackagePurchase struct {
+	gorm.Model
+	PackageID        uint       `gorm:"index;not null" json:"package_id"`
+	TraderID         uint       `gorm:"index;not null" json:"trader_id"`
+	ExpertID         uint       `gorm:"index;not null" json:"expert_id"`
+	Name             string     `gorm:"size:255;not null" json:"name"`
+	Category         string     `gorm:"size:50" json:"category,omitempty"`
+	Sessions         int        `gorm:"not null" json:"sessions"`
+	CreditsRemaining int        `gorm:"not null;default:0" json:"credits_remaining"`
+	RefundedCredits  int        `gorm:"not null;default:0" json:"refunded_credits"`
+	Amount           int64      `gorm:"column:amount_minor;not null;default:0" json:"amount_minor"` // Minor units
+	WalletAmount     int64      `gorm:"column:wallet_minor;not null;default:0" json:"wallet_minor"` // Part of Amount paid from the wallet
+	RefundedAmount   int64      `gorm:"column:refunded_minor;not null;default:0" json:"refunded_minor"`
+	ExpertShare      int64      `gorm:"column:expert_share_minor;not null;default:0" json:"-"` // Expert's share of the payment, earned credit by credit
+	SettledCredits   int        `gorm:"not null;default:0" json:"-"`                           // Credits whose expert share was earned or given back to the platform
+	Currency         string     `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	ValidityDays     int        `gorm:"not null" json:"validity_days"`
+	PaymentID        string     `gorm:"size:255;uniqueIndex;not null" json:"payment_id"`
+	Status           string     `gorm:"size:20;index;not null;default:'pending'" json:"status"` // pending, active, expired, refunded, failed
+	PaidAt           *time.Time `json:"paid_at,omitempty"`
+	ExpiresAt        *time.Time `gorm:"index" json:"expires_at,omitempty"`
+
+	Package *SessionPackage `gorm:"foreignKey:PackageID" json:"package,omitempty"`
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// Coupon is a promo code that discounts appointment or subscription payments
+type Coupon struct {
+	gorm.Model
+	Code         string         `gorm:"size:50;uniqueIndex;not null" json:"code"`
+	Description  string         `gorm:"type:text" json:"description"`
+	DiscountType string         `gorm:"size:20;not null" json:"discount_type"`                         // percentage, fixed
+	Value        float64        `gorm:"not null" json:"value"`                                         // Percent off, for percentage coupons
+	AmountOff    int64          `gorm:"column:amount_off_minor;default:0" json:"amount_off_minor"`     // Minor units off, for fixed coupons
+	MaxDiscount  int64          `gorm:"column:max_discount_minor;default:0" json:"max_discount_minor"` // Caps percentage discounts; 0 means no cap
+	MinAmount    int64          `gorm:"column:min_amount_minor;default:0" json:"min_amount_minor"`     // Smallest order the coupon applies to
+	Currency     string         `gorm:"size:3" json:"currency,omitempty"`                              // Required for fixed coupons; empty means any currency
+	ExpiresAt    *time.Time     `json:"expires_at,omitempty"`
+	MaxUses      int            `gorm:"default:0" json:"max_uses"`       // 0 means unlimited
+	PerUserLimit int            `gorm:"default:0" json:"per_user_limit"` // 0 means unlimited
+	Products     pq.StringArray `gorm:"type:text[]" json:"products"`     // appointment, signal_subscription or plan codes; empty means all
+	ExpertIDs    pq.Int64Array  `gorm:"type:bigint[]" json:"expert_ids"` // Experts whose appointments qualify; empty means all
+	OwnerID      *uint          `gorm:"index" json:"owner_id,omitempty"` // Only this user may redeem, used for referral credit
+	Active       bool           `gorm:"not null" json:"active"`
+}
+
+// CouponRedemption reserves a coupon for a payment reference. Reservations
+// become redeemed when the payment succeeds, or released when it is declined.
+type CouponRedemption struct {
+	gorm.Model
+	CouponID       uint   `gorm:"index;not null" json:"coupon_id"`
+	UserID         uint   `gorm:"index;not null" json:"user_id"`
+	Reference      string `gorm:"size:100;uniqueIndex;not null" json:"reference"`
+	OriginalAmount int64  `gorm:"column:original_amount_minor;not null;default:0" json:"original_amount_minor"`
+	DiscountAmount int64  `gorm:"column:discount_amount_minor;not null;default:0" json:"discount_amount_minor"`
+	Currency       string `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	Status         string `gorm:"size:20;not null;default:'pending'" json:"status"` // pending, redeemed, over_limit, released
+
+	Coupon Coupon `gorm:"foreignKey:CouponID" json:"coupon,omitempty"`
+}
+
+// ReferralReward records the credit a referrer earned from a referred user's first purchase
+type ReferralReward struct {
+	gorm.Model
+	ReferrerID    uint   `gorm:"index;not null" json:"referrer_id"`
+	RefereeID     uint   `gorm:"uniqueIndex;not null" json:"referee_id"` // Each referred user rewards their referrer once
+	Reference     string `gorm:"size:100" json:"reference"`              // Payment that triggered the reward
+	Amount        int64  `gorm:"column:amount_minor;not null;default:0" json:"amount_minor"`
+	Currency      string `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	CouponID      *uint  `json:"coupon_id,omitempty"`       // Single-use credit issued to the referrer before wallets existed
+	WalletEntryID *uint  `json:"wallet_entry_id,omitempty"` // Wallet credit issued to the referrer
+
+	Referee *User   `gorm:"foreignKey:RefereeID" json:"referee,omitempty"`
+	Coupon  *Coupon `gorm:"foreignKey:CouponID" json:"coupon,omitempty"`
+}
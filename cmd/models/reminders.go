@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AppointmentReminder records a reminder sent to one participant of an
+// appointment. The unique index lets only one server claim each reminder,
+// even across restarts.
+type AppointmentReminder struct {
+	gorm.Model
+	AppointmentID uint      `gorm:"not null;uniqueIndex:idx_appointment_reminder" json:"appointment_id"`
+	UserID        uint      `gorm:"not null;uniqueIndex:idx_appointment_reminder" json:"user_id"`
+	OffsetMinutes int       `gorm:"not null;uniqueIndex:idx_appointment_reminder" json:"offset_minutes"` // How long before StartTime
+	StartTime     time.Time `gorm:"not null;uniqueIndex:idx_appointment_reminder" json:"start_time"`     // Start time it was for, so a rescheduled appointment is reminded again
+	PushStatus    string    `gorm:"size:20" json:"push_status"`                                          // sent, failed, skipped
+	EmailStatus   string    `gorm:"size:20" json:"email_status"`
+}
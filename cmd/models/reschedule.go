@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RescheduleRequest proposes moving a booked appointment to another of the
+// expert's slots. It is raised by the trader or the expert and only takes
+// effect once the other party accepts it.
+type RescheduleRequest struct {
+	gorm.Model
+	AppointmentID  uint       `gorm:"index;not null" json:"appointment_id"`
+	RequestedByID  uint       `gorm:"not null" json:"requested_by_id"`
+	AvailabilityID uint       `gorm:"not null" json:"availability_id"` // Proposed slot
+	Reason         string     `gorm:"type:text" json:"reason"`
+	Status         string     `gorm:"size:20;index;not null;default:'pending'" json:"status"` // pending, accepted, declined, withdrawn
+	RespondedByID  *uint      `json:"responded_by_id,omitempty"`
+	RespondedAt    *time.Time `json:"responded_at,omitempty"`
+
+	Availability *Availability `gorm:"foreignKey:AvailabilityID" json:"availability,omitempty"`
+}
+
+// AppointmentChange records a move of an appointment from one slot to another
+type AppointmentChange struct {
+	gorm.Model
+	AppointmentID       uint      `gorm:"index;not null" json:"appointment_id"`
+	RescheduleRequestID *uint     `json:"reschedule_request_id,omitempty"`
+	ChangedByID         uint      `gorm:"not null" json:"changed_by_id"`
+	FromAvailabilityID  uint      `gorm:"not null" json:"from_availability_id"`
+	ToAvailabilityID    uint      `gorm:"not null" json:"to_availability_id"`
+	FromStartTime       time.Time `gorm:"not null" json:"from_start_time"`
+	ToStartTime         time.Time `gorm:"not null" json:"to_start_time"`
+	Reason              string    `gorm:"type:text" json:"reason"`
+}
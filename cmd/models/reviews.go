@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RatingReport flags a rating as abusive for an admin to review
+type RatingReport struct {
+	gorm.Model
+	RatingID     uint       `gorm:"not null;uniqueIndex:idx_rating_reporter" json:"rating_id"`
+	ReporterID   uint       `gorm:"not null;uniqueIndex:idx_rating_reporter" json:"reporter_id"`
+	Reason       string     `gorm:"type:text;not null" json:"reason"`
+	Status       string     `gorm:"size:20;index;not null;default:'open'" json:"status"` // open, upheld, dismissed
+	ResolvedByID *uint      `json:"resolved_by_id,omitempty"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty"`
+
+	Rating *Rating `gorm:"foreignKey:RatingID" json:"rating,omitempty"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "gorm.io/gorm"
+
+// SessionNote is a note an expert writes about an appointment. Private notes
+// are only seen by their author; shared notes are the session summary the
+// trader also sees.
+type SessionNote struct {
+	gorm.Model
+	AppointmentID uint   `gorm:"index;not null" json:"appointment_id"`
+	AuthorID      uint   `gorm:"not null" json:"author_id"`
+	Shared        bool   `gorm:"default:false" json:"shared"`
+	Body          string `gorm:"type:text;not null" json:"body"`
+}
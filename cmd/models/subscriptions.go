@@ -3,19 +3,49 @@ package models
 import (
 	"time"
 
+	"github.com/lib/pq"
 	"gorm.io/gorm"
 )
 
-
 type SignalSubscription struct {
 	gorm.Model
-	UserID    uint      `gorm:"index;not null" json:"user_id"`
-	Plan      string    `json:"plan"`
-	Amount    float64   `json:"amount"`
-	Status    string    `json:"status"`     
-	PaymentID string    `gorm:"unique;not null" json:"payment_id"`
-	StartDate time.Time `gorm:"index" json:"start_date"`
-	EndDate   time.Time `gorm:"index" json:"end_date"`
+	UserID       uint      `gorm:"index;not null" json:"user_id"`
+	Plan         string    `json:"plan"`
+	Amount       int64     `gorm:"column:amount_minor;not null;default:0" json:"amount_minor"` // Minor units
+	Currency     string    `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	LegacyAmount float64   `gorm:"-" json:"amount"`                                            // Deprecated: Amount in major units
+	WalletAmount int64     `gorm:"column:wallet_minor;not null;default:0" json:"wallet_minor"` // Part of Amount paid from the wallet
+	Status       string    `json:"status"`                                                     // pending, active, past_due, expired, switched, cancelled, failed
+	PaymentID    string    `gorm:"unique;not null" json:"payment_id"`
+	StartDate    time.Time `gorm:"index" json:"start_date"`
+	EndDate      time.Time `gorm:"index" json:"end_date"`
+
+	// Recurring billing
+	AutoRenew         bool      `gorm:"default:false" json:"auto_renew"`
+	AuthorizationCode string    `gorm:"size:100" json:"-"` // Saved card authorization used for renewals
+	RenewalAttempts   int       `gorm:"default:0" json:"renewal_attempts"`
+	NextRenewalAt     time.Time `gorm:"index" json:"next_renewal_at"`         // Earliest time the next renewal attempt may run
+	GraceUntil        time.Time `json:"grace_until"`                          // Access is kept until this time while past_due
+	RenewedByID       *uint     `gorm:"index" json:"renewed_by_id,omitempty"` // Subscription that continues this one
+	RenewalOfID       *uint     `gorm:"index" json:"renewal_of_id,omitempty"` // Subscription this automatic renewal continues
+
+	// Plan changes
+	ReplacesID      *uint `gorm:"index" json:"replaces_id,omitempty"`                                    // Subscription this one switches away from
+	ProrationCredit int64 `gorm:"column:proration_credit_minor;default:0" json:"proration_credit_minor"` // Unused value carried over from ReplacesID
 
 	User User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"user,omitempty"`
 }
+
+// SubscriptionPlan is a purchasable signal plan. Prices are always taken from
+// here rather than from the client.
+type SubscriptionPlan struct {
+	gorm.Model
+	Code           string         `gorm:"size:50;uniqueIndex;not null" json:"code"`
+	Name           string         `gorm:"size:255;not null" json:"name"`
+	DurationMonths int            `gorm:"not null" json:"duration_months"`
+	Price          int64          `gorm:"column:price_minor;not null;default:0" json:"price_minor"` // Minor units
+	Currency       string         `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	LegacyPrice    float64        `gorm:"-" json:"price"` // Deprecated: Price in major units
+	Features       pq.StringArray `gorm:"type:text[]" json:"features"`
+	Active         bool           `gorm:"not null" json:"active"`
+}
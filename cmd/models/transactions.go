@@ -7,9 +7,16 @@ import (
 type Transaction struct {
     gorm.Model
     UserID       uint      `gorm:"column:user_id;not null" json:"user_id"`
-    Amount       float64   `gorm:"column:amount;type:float;not null" json:"amount"` 
+    Amount       int64     `gorm:"column:amount_minor;not null;default:0" json:"amount_minor"` // Minor units, e.g. pesewas
+    Currency     string    `gorm:"column:currency;size:3;not null;default:'GHS'" json:"currency"`
+    LegacyAmount float64   `gorm:"-" json:"amount"` // Deprecated: Amount in major units
     Method       string    `gorm:"column:method;type:text;not null" json:"method"` 
     Purpose      string    `gorm:"column:purpose;type:text;not null" json:"purpose"`
+    Reference    string    `gorm:"column:reference;size:100;index" json:"reference,omitempty"` // Payment provider reference
+    CouponCode   string    `gorm:"column:coupon_code;size:50" json:"coupon_code,omitempty"`
+    DiscountAmount int64   `gorm:"column:discount_minor;default:0" json:"discount_minor"`
+    WalletAmount   int64   `gorm:"column:wallet_minor;default:0" json:"wallet_minor"` // Part of Amount paid from the wallet
+    MethodLabel    string  `gorm:"-" json:"method_label,omitempty"` // Readable Method, e.g. "MTN Mobile Money"
 
     User         User      `gorm:"foreignKey:UserID" json:"user,omitempty"`
 }
@@ -23,6 +23,9 @@ type User struct {
     ProfilePicturePath string `gorm:"column:profile_picture_path;size:255" json:"profile_picture_path"`
     EmailVerificationCode string    `gorm:"size:6"`
     VerificationExpiry    time.Time `gorm:""`
+    ReferralCode   *string   `gorm:"column:referral_code;size:20;uniqueIndex" json:"referral_code,omitempty"`
+    ReferredByID   *uint     `gorm:"column:referred_by_id;index" json:"referred_by_id,omitempty"`
+    TimeZone       string    `gorm:"column:time_zone;size:64;not null;default:'UTC'" json:"time_zone"` // IANA zone times are shown in
 
     Expert         *Expert   `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;nullable" json:"expert,omitempty"`
 }
@@ -31,9 +34,19 @@ type User struct {
 type Rating struct {
     gorm.Model
     UserID     uint    `gorm:"column:user_id;not null" json:"user_id"`           // User who gave the rating
-    ExpertID   uint    `gorm:"column:expert_id;not null" json:"expert_id"`       // Expert being rated
+    ExpertID   uint    `gorm:"column:expert_id;not null;uniqueIndex:idx_ratings_live_subscription_expert,where:deleted_at IS NULL" json:"expert_id"` // Expert being rated
     Rating     float64 `gorm:"column:rating;not null" json:"rating"`             // Rating value (1-5)
     Comment    string  `gorm:"column:comment;type:text" json:"comment"`          // Optional comment
+
+    // The engagement being reviewed; one review each, not counting deleted reviews
+    AppointmentID  *uint `gorm:"column:appointment_id;uniqueIndex:idx_ratings_live_appointment,where:deleted_at IS NULL" json:"appointment_id,omitempty"`
+    SubscriptionID *uint `gorm:"column:subscription_id;uniqueIndex:idx_ratings_live_subscription_expert,where:deleted_at IS NULL" json:"subscription_id,omitempty"`
+    Verified       bool  `gorm:"column:verified;default:false" json:"verified"` // Left for an engagement; older ratings are not
+
+    Reply      string     `gorm:"column:reply;type:text" json:"reply,omitempty"` // Expert's public response
+    RepliedAt  *time.Time `gorm:"column:replied_at" json:"replied_at,omitempty"`
+    Hidden     bool       `gorm:"column:hidden;default:false" json:"hidden"` // Removed by moderation after a report
+
     User       *User   `gorm:"foreignKey:UserID" json:"user,omitempty"`
     Expert     *Expert `gorm:"foreignKey:ExpertID" json:"expert,omitempty"`
 }
@@ -51,10 +64,28 @@ type Expert struct {
     Expertise      string    `gorm:"column:expertise;size:255" json:"expertise"`
     Bio            string    `gorm:"column:bio;type:text" json:"bio"`
     Verified       bool      `gorm:"column:verified;default:false" json:"verified"`
+    TimeZone       string    `gorm:"column:time_zone;size:64;not null;default:'UTC'" json:"time_zone"` // IANA zone the expert's slots are set in
     
     // Add these new fields for rating aggregation
-    AverageRating  float64   `gorm:"column:average_rating;default:0" json:"average_rating"`
+    AverageRating  float64   `gorm:"column:average_rating;default:0;index" json:"average_rating"`
     TotalRatings   int       `gorm:"column:total_ratings;default:0" json:"total_ratings"`
+
+    // Session outcomes, kept up to date as appointments are closed
+    CompletedSessions int    `gorm:"column:completed_sessions;default:0" json:"completed_sessions"`
+    MissedSessions    int    `gorm:"column:missed_sessions;default:0" json:"missed_sessions"` // Sessions the expert did not attend
+
+    // Booking limits; zero means no limit
+    BufferBeforeMinutes int  `gorm:"column:buffer_before_minutes;default:0" json:"buffer_before_minutes"` // Free time kept before each session
+    BufferAfterMinutes  int  `gorm:"column:buffer_after_minutes;default:0" json:"buffer_after_minutes"`   // Free time kept after each session
+    MinNoticeMinutes    int  `gorm:"column:min_notice_minutes;default:0" json:"min_notice_minutes"`       // How long before a session bookings close
+    MaxBookingsPerDay   int  `gorm:"column:max_bookings_per_day;default:0" json:"max_bookings_per_day"`   // Booked sessions per day in the expert's zone
+    BookingHorizonDays  int  `gorm:"column:booking_horizon_days;default:0" json:"booking_horizon_days"`   // How far ahead sessions can be booked
+
+    // Payout destination; the recipient code is what the payment provider transfers to
+    TransferRecipientCode string `gorm:"column:transfer_recipient_code;size:100" json:"-"`
+    PayoutAccountName     string `gorm:"column:payout_account_name;size:255" json:"-"`
+    PayoutAccountNumber   string `gorm:"column:payout_account_number;size:50" json:"-"`
+    PayoutBankCode        string `gorm:"column:payout_bank_code;size:50" json:"-"`
     
     CertificationFiles []CertificationFile `gorm:"foreignKey:ExpertID;constraint:OnDelete:CASCADE;" json:"certification_files"` 
     User           *User     `gorm:"foreignKey:UserID" json:"-"`
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WaitlistEntry is a trader waiting for a seat with a booked-out expert,
+// optionally only for slots in a date range or category. Entries are served
+// in the order they joined; when a seat frees up the next matching entry is
+// offered it and the seat is held for a limited time.
+type WaitlistEntry struct {
+	gorm.Model
+	ExpertID uint       `gorm:"index:idx_waitlist_expert_status;not null" json:"expert_id"`
+	TraderID uint       `gorm:"index;not null" json:"trader_id"`
+	From     *time.Time `gorm:"column:from_time" json:"from,omitempty"` // Only slots starting at or after
+	To       *time.Time `gorm:"column:to_time" json:"to,omitempty"`     // Only slots starting before
+	Category string     `gorm:"size:100" json:"category,omitempty"`
+	Status   string     `gorm:"size:20;index:idx_waitlist_expert_status;not null;default:'waiting'" json:"status"` // waiting, offered, claimed, missed, left
+
+	OfferedAvailabilityID *uint      `json:"offered_availability_id,omitempty"`
+	OfferAppointmentID    *uint      `json:"-"` // Pending appointment holding the offered seat
+	OfferedAt             *time.Time `json:"offered_at,omitempty"`
+	OfferExpiresAt        *time.Time `gorm:"index" json:"offer_expires_at,omitempty"`
+
+	OfferedAvailability *Availability `gorm:"foreignKey:OfferedAvailabilityID" json:"offered_availability,omitempty"`
+}
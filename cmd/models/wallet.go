@@ -0,0 +1,30 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Wallet holds a user's spendable credit in one currency
+type Wallet struct {
+	gorm.Model
+	UserID   uint   `gorm:"uniqueIndex:idx_wallet_user_currency;not null" json:"user_id"`
+	Currency string `gorm:"size:3;uniqueIndex:idx_wallet_user_currency;not null;default:'GHS'" json:"currency"`
+	Balance  int64  `gorm:"column:balance_minor;not null;default:0" json:"balance_minor"` // Includes nothing that is held for a pending payment
+}
+
+// WalletEntry is one credit or debit on a wallet. Amount is always positive;
+// Direction says which way it moved the balance.
+type WalletEntry struct {
+	gorm.Model
+	WalletID     uint   `gorm:"index;not null" json:"wallet_id"`
+	UserID       uint   `gorm:"index;not null" json:"user_id"`
+	Currency     string `gorm:"size:3;not null;default:'GHS'" json:"currency"`
+	Direction    string `gorm:"size:10;not null" json:"direction"` // credit, debit
+	Source       string `gorm:"size:30;not null" json:"source"`    // referral, promo, refund, adjustment, payment, release
+	Amount       int64  `gorm:"column:amount_minor;not null;default:0" json:"amount_minor"`
+	BalanceAfter int64  `gorm:"column:balance_after_minor;not null;default:0" json:"balance_after_minor"`
+	Reference    string `gorm:"size:100;index" json:"reference,omitempty"`
+	Description  string `gorm:"type:text" json:"description"`
+	Status       string `gorm:"size:20;index" json:"status,omitempty"` // Payment debits only: held, captured, released
+	CreatedByID  *uint  `json:"created_by_id,omitempty"`              // Admin who made a manual credit or debit
+}
@@ -7,7 +7,9 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/KAsare1/Kodefx-server/cmd/models"
 	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
 )
 
 // Key type for context values
@@ -20,52 +22,61 @@ var jwtSecretKey = []byte(os.Getenv("SECRET_KEY"))
 // Middleware to verify JWT and set userID in context
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        // Get token from Authorization header
-        authHeader := r.Header.Get("Authorization")
-        if authHeader == "" {
-            http.Error(w, "Authorization header required", http.StatusUnauthorized)
+        userID, err := UserIDFromRequest(r)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusUnauthorized)
             return
         }
 
-        // Remove "Bearer " prefix if present
-        tokenString := authHeader
-        if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-            tokenString = authHeader[7:]
-        }
+        // Create new context with user ID
+        ctx := context.WithValue(r.Context(), UserIDKey, userID)
 
-        // Parse and validate token
-        token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-            // Validate signing method
-            if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-                return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-            }
-            return jwtSecretKey, nil
-        })
+        // Call next handler with new context
+        next.ServeHTTP(w, r.WithContext(ctx))
+    }
+}
 
-        if err != nil {
-            http.Error(w, "Invalid token", http.StatusUnauthorized)
-            return
-        }
+// UserIDFromRequest verifies the request's bearer token and returns its user
+// ID. AuthMiddleware uses it, and routes that work without signing in call it
+// directly when they need to know the caller for some options. Its errors
+// are the messages AuthMiddleware responds with.
+func UserIDFromRequest(r *http.Request) (uint, error) {
+    // Get token from Authorization header
+    authHeader := r.Header.Get("Authorization")
+    if authHeader == "" {
+        return 0, fmt.Errorf("Authorization header required")
+    }
 
-        // Extract claims
-        if claims, ok := token.Claims.(*jwt.RegisteredClaims); ok && token.Valid {
-            // Convert subject (user ID) to uint
-            userID, err := strconv.ParseUint(claims.Subject, 10, 64)
-            if err != nil {
-                http.Error(w, "Invalid user ID in token", http.StatusUnauthorized)
-                return
-            }
-
-            // Create new context with user ID
-            ctx := context.WithValue(r.Context(), UserIDKey, uint(userID))
-            
-            // Call next handler with new context
-            next.ServeHTTP(w, r.WithContext(ctx))
-        } else {
-            http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-            return
+    // Remove "Bearer " prefix if present
+    tokenString := authHeader
+    if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
+        tokenString = authHeader[7:]
+    }
+
+    // Parse and validate token
+    token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
+        // Validate signing method
+        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+            return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
         }
+        return jwtSecretKey, nil
+    })
+    if err != nil {
+        return 0, fmt.Errorf("Invalid token")
+    }
+
+    // Extract claims
+    claims, ok := token.Claims.(*jwt.RegisteredClaims)
+    if !ok || !token.Valid {
+        return 0, fmt.Errorf("Invalid token claims")
+    }
+
+    // Convert subject (user ID) to uint
+    userID, err := strconv.ParseUint(claims.Subject, 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid user ID in token")
     }
+    return uint(userID), nil
 }
 
 // Helper function to get userID from context
@@ -75,4 +86,32 @@ func GetUserIDFromContext(ctx context.Context) (uint, error) {
         return 0, fmt.Errorf("user ID not found in context")
     }
     return userID, nil
-}
\ No newline at end of file
+}
+
+// AdminMiddleware verifies the JWT like AuthMiddleware and additionally
+// requires the caller to have the admin role
+func AdminMiddleware(db *gorm.DB, next http.HandlerFunc) http.HandlerFunc {
+    return AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+        userID, err := GetUserIDFromContext(r.Context())
+        if err != nil {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+
+        if !IsAdmin(db, userID) {
+            http.Error(w, "Admin access required", http.StatusForbidden)
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// IsAdmin reports whether the user has the admin role
+func IsAdmin(db *gorm.DB, userID uint) bool {
+    var user models.User
+    if err := db.Select("id", "role").First(&user, userID).Error; err != nil {
+        return false
+    }
+    return user.Role == "admin"
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"gopkg.in/gomail.v2"
+)
+
+// ErrMailNotConfigured is returned by SendEmail when SMTP_HOST is not set
+var ErrMailNotConfigured = errors.New("smtp is not configured")
+
+// Attachment is a file sent along with an email. ContentType is optional and
+// otherwise guessed from Name.
+type Attachment struct {
+	Name        string
+	Data        []byte
+	ContentType string
+}
+
+// SendEmail sends an email through the SMTP server in SMTP_HOST, SMTP_PORT,
+// SMTP_USER and SMTP_PASS. htmlBody is optional and sent as an alternative to
+// textBody.
+func SendEmail(to, subject, textBody, htmlBody string, attachments ...Attachment) error {
+	smtpHost := os.Getenv("SMTP_HOST")
+	smtpUser := os.Getenv("SMTP_USER")
+	if smtpHost == "" {
+		return ErrMailNotConfigured
+	}
+
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil {
+		return fmt.Errorf("invalid SMTP port: %v", err)
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", smtpUser)
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/plain", textBody)
+	if htmlBody != "" {
+		m.AddAlternative("text/html", htmlBody)
+	}
+	for _, attachment := range attachments {
+		data := attachment.Data
+		settings := []gomail.FileSetting{gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})}
+		if attachment.ContentType != "" {
+			settings = append(settings, gomail.SetHeader(map[string][]string{"Content-Type": {attachment.ContentType}}))
+		}
+		m.Attach(attachment.Name, settings...)
+	}
+
+	d := gomail.NewDialer(smtpHost, port, smtpUser, os.Getenv("SMTP_PASS"))
+	return d.DialAndSend(m)
+}
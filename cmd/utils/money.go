@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+)
+
+// Currency describes how amounts in an ISO 4217 currency are stored and shown
+type Currency struct {
+	Code     string
+	Exponent int    // Number of minor-unit digits, e.g. 2 for pesewas
+	Symbol   string // Prefix used when formatting
+}
+
+// currencies lists the currencies the platform accepts
+var currencies = map[string]Currency{
+	"GHS": {Code: "GHS", Exponent: 2, Symbol: "GH₵"},
+	"NGN": {Code: "NGN", Exponent: 2, Symbol: "₦"},
+	"KES": {Code: "KES", Exponent: 2, Symbol: "KSh"},
+	"ZAR": {Code: "ZAR", Exponent: 2, Symbol: "R"},
+	"USD": {Code: "USD", Exponent: 2, Symbol: "$"},
+	"XOF": {Code: "XOF", Exponent: 0, Symbol: "CFA "},
+}
+
+func init() {
+	models.MajorUnits = FromMinor
+}
+
+// DefaultCurrency returns the currency used when none is given, from
+// DEFAULT_CURRENCY and falling back to GHS
+func DefaultCurrency() string {
+	if code := NormalizeCurrency(os.Getenv("DEFAULT_CURRENCY")); code != "" && IsSupportedCurrency(code) {
+		return code
+	}
+	return "GHS"
+}
+
+// NormalizeCurrency upper-cases and trims a currency code
+func NormalizeCurrency(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// IsSupportedCurrency reports whether code is an accepted currency
+func IsSupportedCurrency(code string) bool {
+	_, ok := currencies[NormalizeCurrency(code)]
+	return ok
+}
+
+// LookupCurrency returns the currency for code, treating unknown codes as
+// two-decimal currencies so amounts are never misread
+func LookupCurrency(code string) Currency {
+	code = NormalizeCurrency(code)
+	if currency, ok := currencies[code]; ok {
+		return currency
+	}
+	return Currency{Code: code, Exponent: 2, Symbol: code + " "}
+}
+
+// ToMinor converts an amount in major units (cedis) to minor units (pesewas)
+func ToMinor(amount float64, currency string) int64 {
+	return int64(math.Round(amount * math.Pow10(LookupCurrency(currency).Exponent)))
+}
+
+// FromMinor converts an amount in minor units to major units for display or
+// for APIs that expect decimals. Stored amounts must stay in minor units.
+func FromMinor(amount int64, currency string) float64 {
+	return float64(amount) / math.Pow10(LookupCurrency(currency).Exponent)
+}
+
+// FormatMoney renders a minor-unit amount with its currency symbol and the
+// currency's number of decimals, e.g. "GH₵1,250.00"
+func FormatMoney(amount int64, currency string) string {
+	c := LookupCurrency(currency)
+	return formatMinor(amount, c, c.Symbol)
+}
+
+// FormatMoneyCode renders a minor-unit amount with its ISO code instead of the
+// symbol, e.g. "GHS 1,250.00", for output limited to plain ASCII
+func FormatMoneyCode(amount int64, currency string) string {
+	c := LookupCurrency(currency)
+	return formatMinor(amount, c, c.Code+" ")
+}
+
+// formatMinor renders amount in c's decimals after prefix
+func formatMinor(amount int64, c Currency, prefix string) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	scale := int64(math.Pow10(c.Exponent))
+	major := groupThousands(fmt.Sprintf("%d", amount/scale))
+	if c.Exponent == 0 {
+		return fmt.Sprintf("%s%s%s", sign, prefix, major)
+	}
+	return fmt.Sprintf("%s%s%s.%0*d", sign, prefix, major, c.Exponent, amount%scale)
+}
+
+// groupThousands inserts commas between groups of three digits
+func groupThousands(digits string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+	var b strings.Builder
+	lead := len(digits) % 3
+	if lead > 0 {
+		b.WriteString(digits[:lead])
+	}
+	for i := lead; i < len(digits); i += 3 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
+
+// ScaleMinor multiplies a minor-unit amount by factor, rounding to the nearest
+// minor unit. It is used for percentages and proration.
+func ScaleMinor(amount int64, factor float64) int64 {
+	return int64(math.Round(float64(amount) * factor))
+}
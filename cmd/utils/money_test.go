@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+)
+
+func TestToMinor(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     int64
+	}{
+		{amount: 12.5, currency: "GHS", want: 1250},
+		{amount: 0.1 + 0.2, currency: "GHS", want: 30}, // Not 30.000000000000004 truncated
+		{amount: 19.99, currency: "ghs", want: 1999},
+		{amount: 1.005, currency: "USD", want: 100}, // 1.005 is stored as 1.00499...
+		{amount: 2500, currency: "XOF", want: 2500},
+		{amount: 2500.6, currency: "XOF", want: 2501},
+		{amount: 3.5, currency: "ABC", want: 350}, // Unknown currencies are read as two-decimal
+		{amount: -4.2, currency: "GHS", want: -420},
+	}
+	for _, tt := range tests {
+		if got := ToMinor(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("ToMinor(%v, %s) = %d, want %d", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestFromMinor(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		currency string
+		want     float64
+	}{
+		{amount: 1250, currency: "GHS", want: 12.5},
+		{amount: 1, currency: "NGN", want: 0.01},
+		{amount: 2500, currency: "XOF", want: 2500},
+		{amount: 0, currency: "GHS", want: 0},
+	}
+	for _, tt := range tests {
+		if got := FromMinor(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FromMinor(%d, %s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+		}
+		if back := ToMinor(FromMinor(tt.amount, tt.currency), tt.currency); back != tt.amount {
+			t.Errorf("round trip of %d %s = %d", tt.amount, tt.currency, back)
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		currency string
+		want     string
+		wantCode string
+	}{
+		{amount: 125000, currency: "GHS", want: "GH₵1,250.00", wantCode: "GHS 1,250.00"},
+		{amount: 5, currency: "GHS", want: "GH₵0.05", wantCode: "GHS 0.05"},
+		{amount: 0, currency: "NGN", want: "₦0.00", wantCode: "NGN 0.00"},
+		{amount: 123456789, currency: "USD", want: "$1,234,567.89", wantCode: "USD 1,234,567.89"},
+		{amount: -1999, currency: "KES", want: "-KSh19.99", wantCode: "-KES 19.99"},
+		{amount: 1500000, currency: "XOF", want: "CFA 1,500,000", wantCode: "XOF 1,500,000"},
+		{amount: 100, currency: "abc", want: "ABC 1.00", wantCode: "ABC 1.00"},
+	}
+	for _, tt := range tests {
+		if got := FormatMoney(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FormatMoney(%d, %s) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+		if got := FormatMoneyCode(tt.amount, tt.currency); got != tt.wantCode {
+			t.Errorf("FormatMoneyCode(%d, %s) = %q, want %q", tt.amount, tt.currency, got, tt.wantCode)
+		}
+	}
+}
+
+func TestGroupThousands(t *testing.T) {
+	tests := []struct{ digits, want string }{
+		{"0", "0"},
+		{"999", "999"},
+		{"1000", "1,000"},
+		{"100000", "100,000"},
+		{"1234567", "1,234,567"},
+	}
+	for _, tt := range tests {
+		if got := groupThousands(tt.digits); got != tt.want {
+			t.Errorf("groupThousands(%s) = %s, want %s", tt.digits, got, tt.want)
+		}
+	}
+}
+
+func TestScaleMinor(t *testing.T) {
+	tests := []struct {
+		amount int64
+		factor float64
+		want   int64
+	}{
+		{amount: 10000, factor: 0.2, want: 2000},
+		{amount: 3333, factor: 0.15, want: 500},
+		{amount: 999, factor: 0.5, want: 500}, // Halves round away from zero
+		{amount: 10000, factor: 0, want: 0},
+		{amount: 10000, factor: 1, want: 10000},
+	}
+	for _, tt := range tests {
+		if got := ScaleMinor(tt.amount, tt.factor); got != tt.want {
+			t.Errorf("ScaleMinor(%d, %v) = %d, want %d", tt.amount, tt.factor, got, tt.want)
+		}
+	}
+}
+
+func TestCurrencies(t *testing.T) {
+	for _, code := range []string{"GHS", " ngn ", "XOF"} {
+		if !IsSupportedCurrency(code) {
+			t.Errorf("%q not supported", code)
+		}
+	}
+	for _, code := range []string{"", "EUR", "GH"} {
+		if IsSupportedCurrency(code) {
+			t.Errorf("%q supported", code)
+		}
+	}
+
+	tests := []struct{ env, want string }{
+		{env: "", want: "GHS"},
+		{env: "ngn", want: "NGN"},
+		{env: "EUR", want: "GHS"},
+	}
+	for _, tt := range tests {
+		t.Setenv("DEFAULT_CURRENCY", tt.env)
+		if got := DefaultCurrency(); got != tt.want {
+			t.Errorf("DefaultCurrency with %q = %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestLegacyMajorUnits(t *testing.T) {
+	// The deprecated decimal fields use each currency's own decimals
+	slot := models.Availability{Price: 2500, Currency: "XOF"}
+	slot.AfterFind(nil)
+	plan := models.SubscriptionPlan{Price: 1999, Currency: "GHS"}
+	plan.AfterFind(nil)
+	if slot.LegacyPrice != 2500 || plan.LegacyPrice != 19.99 {
+		t.Errorf("legacy prices = %v and %v, want 2500 and 19.99", slot.LegacyPrice, plan.LegacyPrice)
+	}
+
+	body, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"price":19.99`, `"price_minor":1999`} {
+		if !strings.Contains(string(body), key) {
+			t.Errorf("plan JSON %s has no %s", body, key)
+		}
+	}
+}
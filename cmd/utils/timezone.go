@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata" // Zone data for hosts without it installed
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"gorm.io/gorm"
+)
+
+// DefaultTimeZone is used for anyone who has not chosen a time zone
+const DefaultTimeZone = "UTC"
+
+// IsValidTimeZone reports whether name is an IANA time zone such as "Africa/Accra"
+func IsValidTimeZone(name string) bool {
+	// "Local" is whatever zone the server runs in, not a real place
+	if strings.TrimSpace(name) == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// LoadZone returns the location for name, falling back to UTC when it is
+// empty, unknown or "Local"
+func LoadZone(name string) *time.Location {
+	if !IsValidTimeZone(name) {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// RequestZone returns the zone times should be shown in for r: the ?tz=
+// parameter if valid, otherwise the signed-in user's zone, otherwise UTC
+func RequestZone(db *gorm.DB, r *http.Request) *time.Location {
+	if name := r.URL.Query().Get("tz"); IsValidTimeZone(name) {
+		return LoadZone(name)
+	}
+
+	if userID, err := UserIDFromRequest(r); err == nil {
+		var user models.User
+		if err := db.Select("id", "time_zone").First(&user, userID).Error; err == nil {
+			return LoadZone(user.TimeZone)
+		}
+	}
+	return time.UTC
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsValidTimeZone(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Africa/Accra", true},
+		{"America/New_York", true},
+		{"UTC", true},
+		{"", false},
+		{"  ", false},
+		{"Local", false}, // The server's zone, not a place
+		{"Mars/Olympus", false},
+		{"GMT+25", false},
+	}
+	for _, tt := range tests {
+		if got := IsValidTimeZone(tt.name); got != tt.want {
+			t.Errorf("IsValidTimeZone(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadZone(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"Europe/London", "Europe/London"},
+		{"", "UTC"},
+		{"Local", "UTC"},
+		{"Nowhere/Special", "UTC"},
+	}
+	for _, tt := range tests {
+		if got := LoadZone(tt.name).String(); got != tt.want {
+			t.Errorf("LoadZone(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequestZone(t *testing.T) {
+	tests := []struct{ query, want string }{
+		{"tz=Africa/Lagos", "Africa/Lagos"},
+		{"tz=Local", "UTC"},
+		{"tz=Bad/Zone", "UTC"},
+		{"", "UTC"}, // Signed out, so no user zone to fall back on
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/availabilities?"+tt.query, nil)
+		if got := RequestZone(nil, r).String(); got != tt.want {
+			t.Errorf("RequestZone(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Package testdb opens the Postgres database used by tests that need one.
+// Those tests are skipped unless TEST_DATABASE_URL is set, e.g.
+//
+//	TEST_DATABASE_URL=postgres://postgres@localhost:5432/kodefx_test?sslmode=disable go test ./...
+//
+// Each package is given its own schema so packages can be tested in parallel,
+// and every table is emptied when a test opens the database.
+package testdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// allModels are the tables created in each test schema
+var allModels = []interface{}{
+	&models.User{}, &models.Expert{}, &models.Availability{}, &models.AvailabilityRule{},
+	&models.SlotHold{}, &models.RescheduleRequest{}, &models.AppointmentChange{},
+	&models.AppointmentReminder{}, &models.MeetingAttendance{}, &models.CalendarToken{},
+	&models.CalendarInvite{}, &models.SessionNote{}, &models.RatingReport{},
+	&models.WaitlistEntry{}, &models.SessionPackage{}, &models.PackagePurchase{},
+	&models.Appointment{}, &models.Transaction{}, &models.SignalSubscription{},
+	&models.Rating{}, &models.SubscriptionPlan{}, &models.Coupon{}, &models.CouponRedemption{},
+	&models.ReferralReward{}, &models.LedgerJournal{}, &models.LedgerEntry{}, &models.Payout{},
+	&models.InvoiceSequence{}, &models.Invoice{}, &models.Wallet{}, &models.WalletEntry{},
+	&models.Signal{},
+}
+
+var (
+	mu       sync.Mutex
+	migrated = map[string]*gorm.DB{}
+)
+
+// Open returns a connection to schema in the test database, migrated and
+// emptied, or skips t when TEST_DATABASE_URL is not set
+func Open(t *testing.T, schema string) *gorm.DB {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	schema = "test_" + schema
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	db, ok := migrated[schema]
+	if !ok {
+		var err error
+		if db, err = connect(url, schema); err != nil {
+			t.Fatalf("opening test database: %v", err)
+		}
+		if err := db.AutoMigrate(allModels...); err != nil {
+			t.Fatalf("migrating test database: %v", err)
+		}
+		migrated[schema] = db
+	}
+
+	tables := make([]string, 0, len(allModels))
+	for _, model := range allModels {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatalf("reading table name: %v", err)
+		}
+		tables = append(tables, stmt.Schema.Table)
+	}
+	if err := db.Exec("TRUNCATE " + strings.Join(tables, ", ") + " RESTART IDENTITY CASCADE").Error; err != nil {
+		t.Fatalf("emptying test database: %v", err)
+	}
+	return db
+}
+
+// connect creates schema if needed and opens a pool whose connections all use it
+func connect(url, schema string) (*gorm.DB, error) {
+	config := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}
+
+	admin, err := gorm.Open(postgres.Open(url), config)
+	if err != nil {
+		return nil, err
+	}
+	if err := admin.Exec(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %q", schema)).Error; err != nil {
+		return nil, err
+	}
+	if sqlDB, err := admin.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	switch {
+	case !strings.Contains(url, "://"):
+		url += " search_path=" + schema
+	case strings.Contains(url, "?"):
+		url += "&search_path=" + schema
+	default:
+		url += "?search_path=" + schema
+	}
+	return gorm.Open(postgres.Open(url), config)
+}
+
+// User creates a user with a unique email
+func User(t *testing.T, db *gorm.DB, name string) *models.User {
+	t.Helper()
+
+	user := models.User{
+		FullName:     name,
+		Email:        strings.ToLower(strings.ReplaceAll(name, " ", ".")) + "@example.com",
+		PasswordHash: "x",
+		Role:         "trader",
+		Phone:        "0240000000",
+		Status:       "active",
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("creating user %s: %v", name, err)
+	}
+	return &user
+}
+
+// Expert creates an expert and the user behind them
+func Expert(t *testing.T, db *gorm.DB, name string) *models.Expert {
+	t.Helper()
+
+	user := User(t, db, name)
+	expert := models.Expert{UserID: user.ID, TimeZone: "UTC"}
+	if err := db.Create(&expert).Error; err != nil {
+		t.Fatalf("creating expert %s: %v", name, err)
+	}
+	expert.User = user
+	return &expert
+}
+
+// Slot creates a one hour slot of the expert's starting at start, priced
+// per seat in GHS
+func Slot(t *testing.T, db *gorm.DB, expert *models.Expert, start time.Time, capacity int, price int64) *models.Availability {
+	t.Helper()
+
+	slot := models.Availability{
+		ExpertID:  expert.ID,
+		EventName: "Test session",
+		Date:      time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC),
+		StartTime: start,
+		EndTime:   start.Add(time.Hour),
+		Price:     price,
+		Currency:  "GHS",
+		Capacity:  capacity,
+	}
+	if err := db.Create(&slot).Error; err != nil {
+		t.Fatalf("creating slot: %v", err)
+	}
+	return &slot
+}
+
+// Appointment returns the trader's unsaved pending booking of seats in slot,
+// paid for under reference, as a checkout creates it
+func Appointment(slot *models.Availability, traderID uint, seats int, reference string) *models.Appointment {
+	return &models.Appointment{
+		TraderID:        traderID,
+		ExpertID:        slot.ExpertID,
+		AvailabilityID:  slot.ID,
+		AppointmentDate: slot.Date,
+		StartTime:       slot.StartTime,
+		EndTime:         slot.EndTime,
+		Status:          "Pending",
+		PaymentStatus:   "pending",
+		Seats:           seats,
+		Amount:          slot.Price * int64(seats),
+		Currency:        slot.Currency,
+		PaymentID:       reference,
+		EventName:       slot.EventName,
+	}
+}
+
+// Package creates an active package of the expert's sessions priced in GHS,
+// valid for 30 days
+func Package(t *testing.T, db *gorm.DB, expert *models.Expert, sessions int, price int64) *models.SessionPackage {
+	t.Helper()
+
+	pkg := models.SessionPackage{ExpertID: expert.ID, Name: "Bundle", Sessions: sessions, Price: price, Currency: "GHS", ValidityDays: 30, Active: true}
+	if err := db.Create(&pkg).Error; err != nil {
+		t.Fatalf("creating package: %v", err)
+	}
+	return &pkg
+}
+
+// Purchase creates the trader's pending purchase of pkg, paid for under
+// reference with walletAmount of it from their wallet. The wallet hold is
+// left to the caller.
+func Purchase(t *testing.T, db *gorm.DB, pkg *models.SessionPackage, traderID uint, reference string, walletAmount int64) *models.PackagePurchase {
+	t.Helper()
+
+	purchase := models.PackagePurchase{
+		PackageID:    pkg.ID,
+		TraderID:     traderID,
+		ExpertID:     pkg.ExpertID,
+		Name:         pkg.Name,
+		Sessions:     pkg.Sessions,
+		Amount:       pkg.Price,
+		WalletAmount: walletAmount,
+		Currency:     pkg.Currency,
+		ValidityDays: pkg.ValidityDays,
+		PaymentID:    reference,
+		Status:       "pending",
+	}
+	if err := db.Create(&purchase).Error; err != nil {
+		t.Fatalf("creating purchase %s: %v", reference, err)
+	}
+	return &purchase
+}
+
+// Plan creates an active plan in GHS lasting months
+func Plan(t *testing.T, db *gorm.DB, code string, months int, price int64) *models.SubscriptionPlan {
+	t.Helper()
+
+	plan := models.SubscriptionPlan{Code: code, Name: code, DurationMonths: months, Price: price, Currency: "GHS", Active: true}
+	if err := db.Create(&plan).Error; err != nil {
+		t.Fatalf("creating plan %s: %v", code, err)
+	}
+	return &plan
+}
+
+// AsUser returns r as AuthMiddleware passes it on for a signed in user
+func AsUser(r *http.Request, userID uint) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), utils.UserIDKey, userID))
+}
+
+// Subscription creates the user's active subscription to plan running from
+// start to end
+func Subscription(t *testing.T, db *gorm.DB, userID uint, plan *models.SubscriptionPlan, start, end time.Time) *models.SignalSubscription {
+	t.Helper()
+
+	var count int64
+	db.Model(&models.SignalSubscription{}).Unscoped().Count(&count)
+	sub := models.SignalSubscription{
+		UserID:    userID,
+		Plan:      plan.Code,
+		Amount:    plan.Price,
+		Currency:  plan.Currency,
+		Status:    "active",
+		PaymentID: fmt.Sprintf("SIG-%d-%d", userID, count+1),
+		StartDate: start,
+		EndDate:   end,
+	}
+	if err := db.Create(&sub).Error; err != nil {
+		t.Fatalf("creating subscription: %v", err)
+	}
+	return &sub
+}
+
+// Race runs fn for 0 to n-1 in parallel, started together so they contend
+// for the same rows, and returns the error from each call
+func Race(n int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = fn(i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
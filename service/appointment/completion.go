@@ -0,0 +1,316 @@
+package appointment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/earnings"
+	"github.com/KAsare1/Kodefx-server/service/packages"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Outcomes a confirmed appointment is closed with
+const (
+	StatusCompleted    = "Completed"
+	StatusNoShow       = "NoShow"       // The trader did not attend
+	StatusExpertNoShow = "ExpertNoShow" // The expert did not attend, so the trader is refunded
+)
+
+const (
+	// autoCloseAfter is how long after EndTime an appointment the expert has
+	// not closed is closed automatically from meeting attendance
+	autoCloseAfter = 2 * time.Hour
+	// closeInterval is how often finished appointments are closed
+	closeInterval = 10 * time.Minute
+)
+
+// closeAppointment records the outcome of a confirmed appointment within tx
+// and updates the expert's session counts. When the expert missed the
+// session, the trader is refunded to their wallet and the expert's share is
+// taken back, unless it was already paid out. closedByID is nil when closed
+// automatically.
+func closeAppointment(tx *gorm.DB, appointment *models.Appointment, outcome string, closedByID *uint, now time.Time) error {
+	appointment.Status = outcome
+	appointment.ClosedAt = &now
+	appointment.ClosedByID = closedByID
+
+	updates := map[string]interface{}{
+		"status":       outcome,
+		"closed_at":    now,
+		"closed_by_id": closedByID,
+	}
+
+	refund := outcome == StatusExpertNoShow && appointment.PaymentStatus == "paid" && appointment.Amount > 0
+	if refund {
+		appointment.PaymentStatus = "refunded"
+		updates["payment_status"] = "refunded"
+	}
+	if err := tx.Model(appointment).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	switch outcome {
+	case StatusCompleted:
+		if err := tx.Model(&models.Expert{}).Where("id = ?", appointment.ExpertID).
+			Update("completed_sessions", gorm.Expr("completed_sessions + 1")).Error; err != nil {
+			return err
+		}
+	case StatusExpertNoShow:
+		if err := tx.Model(&models.Expert{}).Where("id = ?", appointment.ExpertID).
+			Update("missed_sessions", gorm.Expr("missed_sessions + 1")).Error; err != nil {
+			return err
+		}
+	}
+
+	// A session booked with a package credit gets its credit back
+	if outcome == StatusExpertNoShow && appointment.PackagePurchaseID != nil {
+		return packages.ReturnCredit(tx, appointment, closedByID, now)
+	}
+
+	if !refund {
+		return nil
+	}
+	description := fmt.Sprintf("Refund for missed appointment %d: %s", appointment.ID, appointment.EventName)
+	if err := earnings.ReversePayment(tx, appointment.PaymentID, description); err != nil {
+		return err
+	}
+	_, err := wallet.Credit(tx, appointment.TraderID, appointment.Amount, appointment.Currency, wallet.SourceRefund,
+		appointment.PaymentID, description, closedByID)
+	return err
+}
+
+// attendedOutcome works out how an appointment went from who joined its
+// meeting room. Appointments without a room are taken as completed. Joining
+// is only recorded through JoinMeeting, not when the room link is opened
+// from the meeting details or a calendar invite, so a missing expert is never
+// taken as a no-show: the outcome is empty and the expert or an admin closes
+// the appointment.
+func attendedOutcome(tx *gorm.DB, appointment *models.Appointment) (string, error) {
+	if appointment.MeetingRoom == "" {
+		return StatusCompleted, nil
+	}
+
+	var roles []string
+	if err := tx.Model(&models.MeetingAttendance{}).
+		Where("appointment_id = ?", appointment.ID).
+		Distinct().
+		Pluck("role", &roles).Error; err != nil {
+		return "", err
+	}
+
+	attended := map[string]bool{}
+	for _, role := range roles {
+		attended[role] = true
+	}
+	switch {
+	case !attended["expert"]:
+		return "", nil
+	case !attended["trader"]:
+		return StatusNoShow, nil
+	}
+	return StatusCompleted, nil
+}
+
+// closeFinishedAppointments closes confirmed appointments that ended more
+// than autoCloseAfter ago, using their meeting attendance. Appointments whose
+// expert isn't recorded in the room are left for the expert or an admin.
+func (h *AppointmentHandler) closeFinishedAppointments(now time.Time) (int, error) {
+	var appointments []models.Appointment
+	if err := h.db.Where("status = ? AND end_time <= ?", "Confirmed", now.Add(-autoCloseAfter)).
+		Where("meeting_room = '' OR EXISTS (SELECT 1 FROM meeting_attendances m WHERE m.appointment_id = appointments.id AND m.role = ? AND m.deleted_at IS NULL)", "expert").
+		Order("end_time").
+		Limit(100).
+		Find(&appointments).Error; err != nil {
+		return 0, err
+	}
+
+	closed := 0
+	for _, candidate := range appointments {
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			// Another server, or the expert, may have closed it meanwhile
+			var appointment models.Appointment
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("id = ? AND status = ?", candidate.ID, "Confirmed").
+				First(&appointment).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return nil
+				}
+				return err
+			}
+
+			outcome, err := attendedOutcome(tx, &appointment)
+			if err != nil || outcome == "" {
+				return err
+			}
+			if err := closeAppointment(tx, &appointment, outcome, nil, now); err != nil {
+				return err
+			}
+			closed++
+			return nil
+		})
+		if err != nil {
+			return closed, err
+		}
+	}
+	return closed, nil
+}
+
+// runCloser periodically closes appointments that have finished
+func (h *AppointmentHandler) runCloser() {
+	ticker := time.NewTicker(closeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		closed, err := h.closeFinishedAppointments(time.Now())
+		if closed > 0 {
+			log.Printf("Closed %d finished appointments", closed)
+		}
+		if err != nil {
+			log.Printf("Error closing finished appointments: %v", err)
+		}
+	}
+}
+
+// CloseAppointment marks a confirmed appointment completed or a no-show once
+// it has started. The expert may mark it completed or the trader absent;
+// admins may also mark the expert absent, which refunds the trader.
+func (h *AppointmentHandler) CloseAppointment(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	appointmentID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid appointment ID", http.StatusBadRequest)
+		return
+	}
+
+	outcome := StatusCompleted
+	if mux.Vars(r)["outcome"] == "no-show" {
+		var request struct {
+			Party string `json:"party"` // trader (default) or expert
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		switch request.Party {
+		case "", "trader":
+			outcome = StatusNoShow
+		case "expert":
+			outcome = StatusExpertNoShow
+		default:
+			http.Error(w, "Party must be trader or expert", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx := h.db.Begin()
+	var appointment models.Appointment
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Expert").First(&appointment, appointmentID).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Appointment not found", http.StatusNotFound)
+		return
+	}
+
+	isExpert := appointment.Expert != nil && appointment.Expert.UserID == userID
+	isAdmin := utils.IsAdmin(h.db, userID)
+	if !isExpert && !isAdmin {
+		tx.Rollback()
+		http.Error(w, "Only the expert can close this appointment", http.StatusForbidden)
+		return
+	}
+	if outcome == StatusExpertNoShow && !isAdmin {
+		tx.Rollback()
+		http.Error(w, "Only an admin can mark the expert as absent", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	if appointment.Status != "Confirmed" {
+		tx.Rollback()
+		http.Error(w, "Only confirmed appointments can be closed", http.StatusConflict)
+		return
+	}
+	if now.Before(appointment.StartTime) {
+		tx.Rollback()
+		http.Error(w, "The appointment has not started yet", http.StatusConflict)
+		return
+	}
+
+	if err := closeAppointment(tx, &appointment, outcome, &userID, now); err != nil {
+		tx.Rollback()
+		http.Error(w, "Error closing appointment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		http.Error(w, "Error closing appointment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(appointment)
+}
+
+// GetTraderStats counts how the trader's closed appointments went. The
+// trader and admins can see them.
+func (h *AppointmentHandler) GetTraderStats(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	traderID, err := strconv.ParseUint(mux.Vars(r)["traderId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid trader ID", http.StatusBadRequest)
+		return
+	}
+	if uint(traderID) != userID && !utils.IsAdmin(h.db, userID) {
+		http.Error(w, "You can only view your own stats", http.StatusForbidden)
+		return
+	}
+
+	var rows []struct {
+		Status string
+		Count  int
+	}
+	if err := h.db.Model(&models.Appointment{}).
+		Select("status, COUNT(*) AS count").
+		Where("trader_id = ? AND status IN ?", traderID, []string{StatusCompleted, StatusNoShow, StatusExpertNoShow}).
+		Group("status").
+		Scan(&rows).Error; err != nil {
+		http.Error(w, "Error fetching stats", http.StatusInternalServerError)
+		return
+	}
+
+	stats := map[string]int{"completed": 0, "no_show": 0, "expert_no_show": 0}
+	for _, row := range rows {
+		switch row.Status {
+		case StatusCompleted:
+			stats["completed"] = row.Count
+		case StatusNoShow:
+			stats["no_show"] = row.Count
+		case StatusExpertNoShow:
+			stats["expert_no_show"] = row.Count
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
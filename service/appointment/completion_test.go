@@ -0,0 +1,260 @@
+package appointment
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/earnings"
+	"github.com/KAsare1/Kodefx-server/service/wallet/wallettest"
+	"gorm.io/gorm"
+)
+
+// attend records role joining the appointment's meeting room
+func attend(t *testing.T, db *gorm.DB, appointment *models.Appointment, userID uint, role string) {
+	t.Helper()
+
+	attendance := models.MeetingAttendance{AppointmentID: appointment.ID, UserID: userID, Role: role, JoinedAt: appointment.StartTime}
+	if err := db.Create(&attendance).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withRoom gives the appointment a meeting room
+func withRoom(t *testing.T, db *gorm.DB, appointment *models.Appointment) {
+	t.Helper()
+
+	appointment.MeetingRoom = fmt.Sprintf("kodefx-%d", appointment.ID)
+	if err := db.Model(appointment).Update("meeting_room", appointment.MeetingRoom).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAttendedOutcome(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	expert := testdb.Expert(t, db, "Attending Expert")
+	trader := testdb.User(t, db, "Attending Trader")
+	slot := testdb.Slot(t, db, expert, time.Now().Add(-3*time.Hour).Truncate(time.Hour), 5, 5000)
+
+	noRoom := confirmed(t, db, slot, trader.ID, "APT-no-room")
+	nobody := confirmed(t, db, slot, trader.ID, "APT-nobody")
+	withRoom(t, db, nobody)
+	traderOnly := confirmed(t, db, slot, trader.ID, "APT-trader-only")
+	withRoom(t, db, traderOnly)
+	attend(t, db, traderOnly, trader.ID, "trader")
+	expertOnly := confirmed(t, db, slot, trader.ID, "APT-expert-only")
+	withRoom(t, db, expertOnly)
+	attend(t, db, expertOnly, expert.UserID, "expert")
+	both := confirmed(t, db, slot, trader.ID, "APT-both")
+	withRoom(t, db, both)
+	attend(t, db, both, expert.UserID, "expert")
+	attend(t, db, both, trader.ID, "trader")
+	attend(t, db, both, trader.ID, "trader") // Rejoined after dropping out
+
+	tests := []struct {
+		appointment *models.Appointment
+		want        string
+	}{
+		{noRoom, StatusCompleted},
+		{nobody, ""},
+		{traderOnly, ""},
+		{expertOnly, StatusNoShow},
+		{both, StatusCompleted},
+	}
+	for _, tt := range tests {
+		got, err := attendedOutcome(db, tt.appointment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: outcome = %q, want %q", tt.appointment.PaymentID, got, tt.want)
+		}
+	}
+}
+
+func TestCloseFinishedAppointments(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	h := newTestHandler(db)
+	expert := testdb.Expert(t, db, "Finished Expert")
+	trader := testdb.User(t, db, "Finished Trader")
+	start := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	slot := testdb.Slot(t, db, expert, start, 5, 5000)
+	now := slot.EndTime.Add(autoCloseAfter + time.Hour)
+
+	done := confirmed(t, db, slot, trader.ID, "APT-done")
+	absent := confirmed(t, db, slot, trader.ID, "APT-absent")
+	withRoom(t, db, absent)
+	attend(t, db, absent, expert.UserID, "expert")
+	unattended := confirmed(t, db, slot, trader.ID, "APT-unattended")
+	withRoom(t, db, unattended)
+	// Still within autoCloseAfter of its end
+	later := testdb.Slot(t, db, expert, now.Add(-autoCloseAfter), 1, 5000)
+	recent := confirmed(t, db, later, trader.ID, "APT-recent")
+
+	closed, err := h.closeFinishedAppointments(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed != 2 {
+		t.Errorf("closed %d appointments, want 2", closed)
+	}
+
+	want := map[*models.Appointment]string{
+		done:       StatusCompleted,
+		absent:     StatusNoShow,
+		unattended: "Confirmed",
+		recent:     "Confirmed",
+	}
+	for appointment, status := range want {
+		var got models.Appointment
+		db.First(&got, appointment.ID)
+		if got.Status != status {
+			t.Errorf("%s: status = %s, want %s", appointment.PaymentID, got.Status, status)
+		}
+		if status != "Confirmed" && (got.ClosedAt == nil || got.ClosedByID != nil) {
+			t.Errorf("%s: closed at %v by %v, want closed automatically", appointment.PaymentID, got.ClosedAt, got.ClosedByID)
+		}
+	}
+
+	db.First(expert, expert.ID)
+	if expert.CompletedSessions != 1 {
+		t.Errorf("CompletedSessions = %d, want 1", expert.CompletedSessions)
+	}
+
+	// Running again closes nothing more
+	if again, err := h.closeFinishedAppointments(now); err != nil || again != 0 {
+		t.Errorf("second run closed %d, error %v", again, err)
+	}
+}
+
+func TestCloseAppointment(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	h := newTestHandler(db)
+	expert := testdb.Expert(t, db, "Closing Expert")
+	trader := testdb.User(t, db, "Closing Trader")
+	admin := testdb.User(t, db, "Closing Admin")
+	db.Model(admin).Update("role", "admin")
+	slot := testdb.Slot(t, db, expert, time.Now().Add(-time.Hour).Truncate(time.Minute), 5, 5000)
+
+	closeAs := func(appointment *models.Appointment, userID uint, outcome string, party string) int {
+		vars := map[string]string{"id": fmt.Sprint(appointment.ID), "outcome": outcome}
+		return serve(h.CloseAppointment, userID, vars, map[string]string{"party": party}).Code
+	}
+	status := func(appointment *models.Appointment) string {
+		var got models.Appointment
+		db.First(&got, appointment.ID)
+		return got.Status
+	}
+
+	t.Run("expert completes", func(t *testing.T) {
+		appointment := confirmed(t, db, slot, trader.ID, "APT-complete")
+		if code := closeAs(appointment, trader.ID, "complete", ""); code != http.StatusForbidden {
+			t.Errorf("trader closing: status = %d, want %d", code, http.StatusForbidden)
+		}
+		if code := closeAs(appointment, expert.UserID, "complete", ""); code != http.StatusOK {
+			t.Fatalf("status = %d", code)
+		}
+		if got := status(appointment); got != StatusCompleted {
+			t.Errorf("status = %s, want %s", got, StatusCompleted)
+		}
+		// Closing twice is refused
+		if code := closeAs(appointment, expert.UserID, "no-show", "trader"); code != http.StatusConflict {
+			t.Errorf("closing again: status = %d, want %d", code, http.StatusConflict)
+		}
+	})
+
+	t.Run("trader absent", func(t *testing.T) {
+		appointment := confirmed(t, db, slot, trader.ID, "APT-absent")
+		if code := closeAs(appointment, expert.UserID, "no-show", "someone"); code != http.StatusBadRequest {
+			t.Errorf("unknown party: status = %d, want %d", code, http.StatusBadRequest)
+		}
+		if code := closeAs(appointment, expert.UserID, "no-show", ""); code != http.StatusOK {
+			t.Fatalf("status = %d", code)
+		}
+		if got := status(appointment); got != StatusNoShow {
+			t.Errorf("status = %s, want %s", got, StatusNoShow)
+		}
+	})
+
+	t.Run("expert absent", func(t *testing.T) {
+		t.Setenv("PLATFORM_COMMISSION_RATE", "0.2")
+		appointment := confirmed(t, db, slot, trader.ID, "APT-missed")
+		if err := earnings.RecordPayment(db, appointment.PaymentID, appointment.Amount, appointment.Currency, &expert.ID, "Payment"); err != nil {
+			t.Fatal(err)
+		}
+
+		if code := closeAs(appointment, expert.UserID, "no-show", "expert"); code != http.StatusForbidden {
+			t.Errorf("expert marking themselves absent: status = %d, want %d", code, http.StatusForbidden)
+		}
+		if code := closeAs(appointment, admin.ID, "no-show", "expert"); code != http.StatusOK {
+			t.Fatalf("status = %d", code)
+		}
+
+		var got models.Appointment
+		db.First(&got, appointment.ID)
+		if got.Status != StatusExpertNoShow || got.PaymentStatus != "refunded" || got.ClosedByID == nil || *got.ClosedByID != admin.ID {
+			t.Errorf("appointment = %s/%s closed by %v", got.Status, got.PaymentStatus, got.ClosedByID)
+		}
+		if balance := wallettest.Balance(t, db, trader.ID); balance != appointment.Amount {
+			t.Errorf("wallet balance = %d, want the %d paid", balance, appointment.Amount)
+		}
+		balance, err := earnings.ExpertBalance(db, expert.ID, "GHS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Available != 0 {
+			t.Errorf("expert balance = %+v, want the share taken back", balance)
+		}
+		db.First(expert, expert.ID)
+		if expert.MissedSessions != 1 {
+			t.Errorf("MissedSessions = %d, want 1", expert.MissedSessions)
+		}
+	})
+
+	t.Run("not started", func(t *testing.T) {
+		upcoming := testdb.Slot(t, db, expert, time.Now().Add(24*time.Hour).Truncate(time.Hour), 1, 5000)
+		appointment := confirmed(t, db, upcoming, trader.ID, "APT-upcoming")
+		if code := closeAs(appointment, expert.UserID, "complete", ""); code != http.StatusConflict {
+			t.Errorf("status = %d, want %d", code, http.StatusConflict)
+		}
+	})
+}
+
+func TestGetTraderStats(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	h := newTestHandler(db)
+	expert := testdb.Expert(t, db, "Stats Expert")
+	trader := testdb.User(t, db, "Stats Trader")
+	other := testdb.User(t, db, "Other Trader")
+	admin := testdb.User(t, db, "Stats Admin")
+	db.Model(admin).Update("role", "admin")
+	slot := testdb.Slot(t, db, expert, time.Now().Add(-48*time.Hour).Truncate(time.Hour), 10, 5000)
+
+	for i, status := range []string{StatusCompleted, StatusCompleted, StatusNoShow, StatusExpertNoShow, "Confirmed", "Cancelled"} {
+		appointment := confirmed(t, db, slot, trader.ID, fmt.Sprintf("APT-%d", i))
+		db.Model(appointment).Update("status", status)
+	}
+
+	vars := map[string]string{"traderId": fmt.Sprint(trader.ID)}
+	if code := serve(h.GetTraderStats, other.ID, vars, nil).Code; code != http.StatusForbidden {
+		t.Errorf("another trader: status = %d, want %d", code, http.StatusForbidden)
+	}
+
+	for _, userID := range []uint{trader.ID, admin.ID} {
+		w := serve(h.GetTraderStats, userID, vars, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		var stats map[string]int
+		if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats["completed"] != 2 || stats["no_show"] != 1 || stats["expert_no_show"] != 1 {
+			t.Errorf("stats = %v", stats)
+		}
+	}
+}
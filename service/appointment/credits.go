@@ -0,0 +1,117 @@
+package appointment
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/availability"
+	"github.com/KAsare1/Kodefx-server/service/calendar"
+	"github.com/KAsare1/Kodefx-server/service/packages"
+	"gorm.io/gorm"
+)
+
+// BookWithCredit books one seat in a slot for the signed-in trader by
+// redeeming a credit from one of their session packages, instead of paying
+// through checkout. The appointment is confirmed straight away.
+func (h *AppointmentHandler) BookWithCredit(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		PurchaseID     uint `json:"purchase_id"`
+		AvailabilityID uint `json:"availability_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx := h.db.Begin()
+
+	// A seat held for the trader from the waitlist is theirs to book
+	if err := availability.ClaimWaitlistOffer(tx, userID, request.AvailabilityID); err != nil {
+		tx.Rollback()
+		http.Error(w, "Error checking availability", http.StatusInternalServerError)
+		return
+	}
+
+	slot, ok := reserveSeats(w, tx, request.AvailabilityID, 1)
+	if !ok {
+		return
+	}
+	if !checkBookingLimits(w, tx, slot) {
+		return
+	}
+
+	now := time.Now()
+	purchase, err := packages.RedeemCredit(tx, request.PurchaseID, userID, slot, now)
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Package not found", http.StatusNotFound)
+			return
+		}
+		if packages.IsCreditError(err) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, "Error redeeming package credit", http.StatusInternalServerError)
+		return
+	}
+
+	// Paid for by the package, so the appointment itself carries no amount
+	appointment := models.Appointment{
+		TraderID:          userID,
+		ExpertID:          slot.ExpertID,
+		AvailabilityID:    slot.ID,
+		AppointmentDate:   slot.Date,
+		StartTime:         slot.StartTime,
+		EndTime:           slot.EndTime,
+		Status:            "Confirmed",
+		PaymentStatus:     "paid",
+		Seats:             1,
+		Currency:          slot.Currency,
+		EventName:         slot.EventName,
+		Category:          slot.Category,
+		PackagePurchaseID: &purchase.ID,
+	}
+	if err := tx.Create(&appointment).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Error creating appointment", http.StatusInternalServerError)
+		return
+	}
+	if err := packages.EarnCredit(tx, purchase, &appointment); err != nil {
+		tx.Rollback()
+		http.Error(w, "Error redeeming package credit", http.StatusInternalServerError)
+		return
+	}
+	if err := h.assignMeetingRoom(tx, &appointment); err != nil {
+		tx.Rollback()
+		http.Error(w, "Error creating meeting room", http.StatusInternalServerError)
+		return
+	}
+	if err := calendar.QueueInvites(tx, &appointment, calendar.InviteConfirmed); err != nil {
+		tx.Rollback()
+		http.Error(w, "Error queueing calendar invites", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		http.Error(w, "Error completing booking", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"appointment":       appointment,
+		"credits_remaining": purchase.CreditsRemaining,
+	})
+}
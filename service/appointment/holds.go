@@ -0,0 +1,229 @@
+package appointment
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/service/availability"
+	"github.com/KAsare1/Kodefx-server/service/calendar"
+	"github.com/KAsare1/Kodefx-server/service/promotions"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// slotHoldTTL is how long a checkout keeps its seats before they are released
+	slotHoldTTL = 15 * time.Minute
+	// holdSweepInterval is how often expired slot holds are released
+	holdSweepInterval = time.Minute
+)
+
+// Slot hold statuses
+const (
+	SlotHeld      = "held"
+	SlotConverted = "converted"
+	SlotExpired   = "expired"
+)
+
+// ErrSlotLost is returned when a payment arrives after its hold expired and
+// the seats have since been booked by someone else, or by the same trader in
+// a new checkout
+var ErrSlotLost = errors.New("the time slot was released and booked by someone else")
+
+// placeSlotHold reserves the pending appointment's seats until slotHoldTTL from now
+func placeSlotHold(tx *gorm.DB, appointment *models.Appointment, now time.Time) (*models.SlotHold, error) {
+	hold := models.SlotHold{
+		AvailabilityID: appointment.AvailabilityID,
+		AppointmentID:  appointment.ID,
+		TraderID:       appointment.TraderID,
+		Seats:          appointment.Seats,
+		Reference:      appointment.PaymentID,
+		Status:         SlotHeld,
+		ExpiresAt:      now.Add(slotHoldTTL),
+	}
+	if err := tx.Create(&hold).Error; err != nil {
+		return nil, err
+	}
+	return &hold, nil
+}
+
+// expireSlotHolds releases holds matching query that have run out: their
+// appointments are marked Expired, freeing the seats, any wallet credit set
+// aside for them is returned and a waitlist place claimed for the checkout is
+// given back. It returns the slots that had seats freed.
+func expireSlotHolds(tx *gorm.DB, now time.Time, query string, args ...interface{}) ([]uint, error) {
+	var holds []models.SlotHold
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("status = ? AND expires_at <= ?", SlotHeld, now).
+		Where(query, args...).
+		Find(&holds).Error; err != nil {
+		return nil, err
+	}
+
+	var freed []uint
+	seen := make(map[uint]bool)
+	for _, hold := range holds {
+		if err := tx.Model(&models.Appointment{}).
+			Where("id = ? AND payment_status = ?", hold.AppointmentID, "pending").
+			Updates(map[string]interface{}{"status": "Expired", "payment_status": "expired"}).Error; err != nil {
+			return nil, err
+		}
+		if err := wallet.ReleaseHold(tx, hold.Reference); err != nil {
+			return nil, err
+		}
+		if err := availability.RestoreWaitlistClaim(tx, hold.TraderID, hold.AvailabilityID); err != nil {
+			return nil, err
+		}
+		if err := tx.Model(&hold).Update("status", SlotExpired).Error; err != nil {
+			return nil, err
+		}
+		if !seen[hold.AvailabilityID] {
+			seen[hold.AvailabilityID] = true
+			freed = append(freed, hold.AvailabilityID)
+		}
+	}
+	return freed, nil
+}
+
+// convertSlotHold marks the appointment's hold as converted once it is paid.
+// A payment that arrives after the hold expired takes the seats back if they
+// are still free and the trader hasn't booked the slot again since;
+// otherwise ErrSlotLost is returned.
+func convertSlotHold(tx *gorm.DB, appointment *models.Appointment) error {
+	if appointment.Status == "Expired" {
+		var rebooked int64
+		if err := tx.Model(&models.Appointment{}).
+			Where("availability_id = ? AND trader_id = ? AND id <> ? AND status NOT IN ?",
+				appointment.AvailabilityID, appointment.TraderID, appointment.ID, availability.ReleasedStatuses).
+			Count(&rebooked).Error; err != nil {
+			return err
+		}
+		if rebooked > 0 {
+			return ErrSlotLost
+		}
+		if _, err := availability.ReserveSeats(tx, appointment.AvailabilityID, appointment.Seats); err != nil {
+			if errors.Is(err, availability.ErrSlotFull) {
+				return ErrSlotLost
+			}
+			return err
+		}
+	}
+
+	return tx.Model(&models.SlotHold{}).
+		Where("appointment_id = ? AND status IN ?", appointment.ID, []string{SlotHeld, SlotExpired}).
+		Update("status", SlotConverted).Error
+}
+
+// refundLostSlot handles a payment that can't book the appointment, either
+// because its slot was lost after the hold expired or because the wallet part
+// was released and has since been spent: the payment is recorded and the whole
+// amount collected by card is credited to the trader's wallet, and the
+// appointment is cancelled. Any seats it still held can then be offered to
+// the waitlist.
+func refundLostSlot(tx *gorm.DB, appointment *models.Appointment, amount int64, method string) error {
+	appointment.Status = "Cancelled"
+	appointment.PaymentStatus = "refunded"
+	appointment.WalletAmount = 0
+	if err := tx.Save(appointment).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.SlotHold{}).
+		Where("appointment_id = ? AND status = ?", appointment.ID, SlotHeld).
+		Update("status", SlotExpired).Error; err != nil {
+		return err
+	}
+	if err := availability.RestoreWaitlistClaim(tx, appointment.TraderID, appointment.AvailabilityID); err != nil {
+		return err
+	}
+
+	// Let both parties know the booking is off
+	if err := calendar.QueueInvites(tx, appointment, calendar.InviteCancelled); err != nil {
+		return err
+	}
+
+	transaction := models.Transaction{
+		UserID:    appointment.TraderID,
+		Amount:    amount,
+		Currency:  appointment.Currency,
+		Method:    method,
+		Purpose:   "Appointment",
+		Reference: appointment.PaymentID,
+	}
+	if err := tx.Create(&transaction).Error; err != nil {
+		return err
+	}
+
+	description := fmt.Sprintf("Refund for appointment %d: %s", appointment.ID, appointment.EventName)
+	return wallet.RefundPayment(tx, appointment.TraderID, amount, appointment.Currency, appointment.PaymentID, description)
+}
+
+// releaseDeclinedCheckout cancels an appointment whose payment was declined
+// at checkout, giving back its seats, wallet credit, coupon and any waitlist
+// place it claimed straight away
+func releaseDeclinedCheckout(tx *gorm.DB, appointment *models.Appointment) error {
+	if err := tx.Model(&models.Appointment{}).
+		Where("id = ? AND payment_status = ?", appointment.ID, "pending").
+		Updates(map[string]interface{}{"status": "Cancelled", "payment_status": "failed"}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.SlotHold{}).
+		Where("appointment_id = ? AND status = ?", appointment.ID, SlotHeld).
+		Update("status", SlotExpired).Error; err != nil {
+		return err
+	}
+	if err := wallet.ReleaseHold(tx, appointment.PaymentID); err != nil {
+		return err
+	}
+	if err := availability.RestoreWaitlistClaim(tx, appointment.TraderID, appointment.AvailabilityID); err != nil {
+		return err
+	}
+	return promotions.ReleaseReservation(tx, appointment.PaymentID)
+}
+
+// releaseDeclined releases a checkout declined after it was saved and offers
+// its seats to the waitlist. Errors are logged; the trader is told about the
+// decline either way.
+func (h *AppointmentHandler) releaseDeclined(appointment *models.Appointment) {
+	if err := h.db.Transaction(func(tx *gorm.DB) error {
+		return releaseDeclinedCheckout(tx, appointment)
+	}); err != nil {
+		log.Printf("Error releasing declined checkout %s: %v", appointment.PaymentID, err)
+		return
+	}
+	go availability.OfferWaitlist(h.db, h.notifier, appointment.AvailabilityID)
+}
+
+// runHoldSweeper periodically releases slot holds whose checkout was abandoned
+// or whose waitlist offer ran out, and offers the freed seats to the waitlist
+func (h *AppointmentHandler) runHoldSweeper() {
+	ticker := time.NewTicker(holdSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var freed []uint
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			now := time.Now()
+			if _, err := availability.ExpireWaitlistOffers(tx, now); err != nil {
+				return err
+			}
+			var err error
+			freed, err = expireSlotHolds(tx, now, "1 = 1")
+			if len(freed) > 0 {
+				log.Printf("Released expired slot holds in %d slots", len(freed))
+			}
+			return err
+		})
+		if err != nil {
+			log.Printf("Error releasing slot holds: %v", err)
+			continue
+		}
+
+		for _, availabilityID := range freed {
+			availability.OfferWaitlist(h.db, h.notifier, availabilityID)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package appointment
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/availability"
+	"github.com/KAsare1/Kodefx-server/service/meetings"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/KAsare1/Kodefx-server/service/wallet/wallettest"
+	"gorm.io/gorm"
+)
+
+// checkout creates the trader's pending appointment in slot and holds its
+// seat from at, as InitializeAppointmentPayment does
+func checkout(t *testing.T, db *gorm.DB, slot *models.Availability, traderID uint, reference string, at time.Time) *models.Appointment {
+	t.Helper()
+
+	appointment := testdb.Appointment(slot, traderID, 1, reference)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(appointment).Error; err != nil {
+			return err
+		}
+		_, err := placeSlotHold(tx, appointment, at)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("checking out %s: %v", reference, err)
+	}
+	return appointment
+}
+
+// expireAll releases every slot hold that has run out by now
+func expireAll(t *testing.T, db *gorm.DB, now time.Time) []uint {
+	t.Helper()
+
+	var freed []uint
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		freed, err = expireSlotHolds(tx, now, "1 = 1")
+		return err
+	}); err != nil {
+		t.Fatalf("expireSlotHolds: %v", err)
+	}
+	return freed
+}
+
+// holdStatus returns the status of the appointment's slot hold
+func holdStatus(t *testing.T, db *gorm.DB, appointmentID uint) string {
+	t.Helper()
+
+	var hold models.SlotHold
+	if err := db.Where("appointment_id = ?", appointmentID).First(&hold).Error; err != nil {
+		t.Fatalf("finding slot hold: %v", err)
+	}
+	return hold.Status
+}
+
+func TestExpireSlotHolds(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	now := time.Now()
+	expert := testdb.Expert(t, db, "Held Expert")
+	trader := testdb.User(t, db, "Slow Trader")
+	slot := testdb.Slot(t, db, expert, now.Add(48*time.Hour).Truncate(time.Hour), 2, 5000)
+
+	// The abandoned checkout set aside wallet credit; the recent one is still paying
+	wallettest.Hold(t, db, trader.ID, 2000, "APT-abandoned")
+	abandoned := checkout(t, db, slot, trader.ID, "APT-abandoned", now.Add(-2*slotHoldTTL))
+	paying := checkout(t, db, slot, testdb.User(t, db, "Quick Trader").ID, "APT-paying", now)
+
+	freed := expireAll(t, db, now)
+	if len(freed) != 1 || freed[0] != slot.ID {
+		t.Errorf("freed slots %v, want [%d]", freed, slot.ID)
+	}
+	// Nothing is left to expire the second time round
+	if again := expireAll(t, db, now); len(again) != 0 {
+		t.Errorf("second sweep freed %v", again)
+	}
+
+	db.First(abandoned, abandoned.ID)
+	db.First(paying, paying.ID)
+	if abandoned.Status != "Expired" || abandoned.PaymentStatus != "expired" || holdStatus(t, db, abandoned.ID) != SlotExpired {
+		t.Errorf("abandoned checkout is %s/%s", abandoned.Status, abandoned.PaymentStatus)
+	}
+	if paying.Status != "Pending" || holdStatus(t, db, paying.ID) != SlotHeld {
+		t.Errorf("checkout still paying is %s", paying.Status)
+	}
+	if balance := wallettest.Balance(t, db, trader.ID); balance != 2000 {
+		t.Errorf("wallet balance = %d, want the 2000 held returned", balance)
+	}
+	if taken, _ := availability.SeatsTaken(db, slot.ID); taken != 1 {
+		t.Errorf("%d seats taken, want 1", taken)
+	}
+}
+
+func TestReleaseDeclinedCheckout(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	now := time.Now()
+	expert := testdb.Expert(t, db, "Held Expert")
+	trader := testdb.User(t, db, "Declined Trader")
+	slot := testdb.Slot(t, db, expert, now.Add(48*time.Hour).Truncate(time.Hour), 1, 5000)
+
+	wallettest.Hold(t, db, trader.ID, 1500, "APT-declined")
+	appointment := checkout(t, db, slot, trader.ID, "APT-declined", now)
+
+	if err := db.Transaction(func(tx *gorm.DB) error { return releaseDeclinedCheckout(tx, appointment) }); err != nil {
+		t.Fatalf("releaseDeclinedCheckout: %v", err)
+	}
+
+	db.First(appointment, appointment.ID)
+	if appointment.Status != "Cancelled" || appointment.PaymentStatus != "failed" || holdStatus(t, db, appointment.ID) != SlotExpired {
+		t.Errorf("declined checkout is %s/%s", appointment.Status, appointment.PaymentStatus)
+	}
+	if balance := wallettest.Balance(t, db, trader.ID); balance != 1500 {
+		t.Errorf("wallet balance = %d, want the 1500 held returned", balance)
+	}
+	if taken, _ := availability.SeatsTaken(db, slot.ID); taken != 0 {
+		t.Errorf("%d seats still taken", taken)
+	}
+}
+
+func TestConfirmAppointmentPaymentLate(t *testing.T) {
+	tests := []struct {
+		name       string
+		expired    bool   // The hold ran out before the payment arrived
+		taken      string // Who booked the freed seat meanwhile: "other" or "same" trader
+		wantStatus string
+		wantPaid   string
+		wantHold   string
+		wantWallet int64
+	}{
+		{name: "paid within the hold", wantStatus: "Confirmed", wantPaid: "paid", wantHold: SlotConverted},
+		{name: "hold expired, seat still free", expired: true, wantStatus: "Confirmed", wantPaid: "paid", wantHold: SlotConverted},
+		{name: "hold expired, seat booked by another trader", expired: true, taken: "other", wantStatus: "Cancelled", wantPaid: "refunded", wantHold: SlotExpired, wantWallet: 5000},
+		{name: "hold expired, trader checked out again", expired: true, taken: "same", wantStatus: "Cancelled", wantPaid: "refunded", wantHold: SlotExpired, wantWallet: 5000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "appointment")
+			now := time.Now()
+			expert := testdb.Expert(t, db, "Late Expert")
+			trader := testdb.User(t, db, "Late Trader")
+			slot := testdb.Slot(t, db, expert, now.Add(48*time.Hour).Truncate(time.Hour), 1, 5000)
+			h := &AppointmentHandler{db: db, provider: payment.NewFakeProvider(), meetings: meetings.NewJitsiProvider("")}
+
+			started := now
+			if tt.expired {
+				started = now.Add(-2 * slotHoldTTL)
+			}
+			appointment := checkout(t, db, slot, trader.ID, "APT-late", started)
+
+			if tt.expired {
+				expireAll(t, db, now)
+			}
+			switch tt.taken {
+			case "other":
+				checkout(t, db, slot, testdb.User(t, db, "Quicker Trader").ID, "APT-other", now)
+			case "same":
+				checkout(t, db, slot, trader.ID, "APT-again", now)
+			}
+
+			// The webhook may be delivered more than once
+			for i := 0; i < 2; i++ {
+				if err := db.Transaction(func(tx *gorm.DB) error {
+					_, err := h.confirmAppointmentPayment(tx, appointment.PaymentID, slot.Price, payment.ChannelCard)
+					return err
+				}); err != nil {
+					t.Fatalf("confirmAppointmentPayment: %v", err)
+				}
+			}
+
+			db.First(appointment, appointment.ID)
+			if appointment.Status != tt.wantStatus || appointment.PaymentStatus != tt.wantPaid {
+				t.Errorf("appointment is %s/%s, want %s/%s", appointment.Status, appointment.PaymentStatus, tt.wantStatus, tt.wantPaid)
+			}
+			if status := holdStatus(t, db, appointment.ID); status != tt.wantHold {
+				t.Errorf("hold is %s, want %s", status, tt.wantHold)
+			}
+
+			var transactions int64
+			db.Model(&models.Transaction{}).Where("reference = ?", appointment.PaymentID).Count(&transactions)
+			if transactions != 1 {
+				t.Errorf("%d transactions recorded, want 1", transactions)
+			}
+			if balance := wallettest.Balance(t, db, trader.ID); balance != tt.wantWallet {
+				t.Errorf("wallet balance = %d, want %d", balance, tt.wantWallet)
+			}
+			if taken, _ := availability.SeatsTaken(db, slot.ID); taken > slot.Capacity {
+				t.Errorf("%d seats taken in a slot of %d", taken, slot.Capacity)
+			}
+		})
+	}
+}
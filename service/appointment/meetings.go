@@ -0,0 +1,238 @@
+package appointment
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/service/meetings"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// meetingOpensBefore is how long before StartTime the room link is shown
+	meetingOpensBefore = 10 * time.Minute
+	// meetingClosesAfter is how long after EndTime the room can still be joined
+	meetingClosesAfter = 30 * time.Minute
+)
+
+// meetingWindow returns when the appointment's room can be joined
+func meetingWindow(appointment *models.Appointment) (time.Time, time.Time) {
+	return appointment.StartTime.Add(-meetingOpensBefore), appointment.EndTime.Add(meetingClosesAfter)
+}
+
+// assignMeetingRoom gives the appointment its slot's meeting room, creating
+// the room when no appointment in the slot has one yet, so a group session
+// meets in one room. The slot is locked while the room is chosen, and the
+// appointment is only updated if it still has no room; it is then re-read so
+// every caller ends up with the same room.
+func (h *AppointmentHandler) assignMeetingRoom(tx *gorm.DB, appointment *models.Appointment) error {
+	if appointment.MeetingRoom != "" {
+		return nil
+	}
+
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").First(&models.Availability{}, appointment.AvailabilityID).Error; err != nil {
+		return err
+	}
+
+	var shared models.Appointment
+	err := tx.Where("availability_id = ? AND id <> ? AND meeting_room <> ''", appointment.AvailabilityID, appointment.ID).
+		Order("id ASC").
+		First(&shared).Error
+	switch {
+	case err == nil:
+		appointment.MeetingProvider = shared.MeetingProvider
+		appointment.MeetingRoom = shared.MeetingRoom
+		appointment.MeetingURL = shared.MeetingURL
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		room, err := h.meetings.CreateRoom(meetings.RoomRequest{
+			AvailabilityID: appointment.AvailabilityID,
+			Title:          appointment.EventName,
+			StartTime:      appointment.StartTime,
+			EndTime:        appointment.EndTime,
+		})
+		if err != nil {
+			return err
+		}
+		appointment.MeetingProvider = h.meetings.Name()
+		appointment.MeetingRoom = room.Name
+		appointment.MeetingURL = room.URL
+	default:
+		return err
+	}
+
+	if err := tx.Model(&models.Appointment{}).
+		Where("id = ? AND meeting_room = ''", appointment.ID).
+		Updates(map[string]interface{}{
+			"meeting_provider": appointment.MeetingProvider,
+			"meeting_room":     appointment.MeetingRoom,
+			"meeting_url":      appointment.MeetingURL,
+		}).Error; err != nil {
+		return err
+	}
+	return tx.Select("meeting_provider", "meeting_room", "meeting_url").First(appointment, appointment.ID).Error
+}
+
+// meetingRole is the part userID plays in the appointment
+func meetingRole(appointment *models.Appointment, userID uint) string {
+	if appointment.TraderID == userID {
+		return "trader"
+	}
+	return "expert"
+}
+
+// GetMeeting returns when the appointment's room opens, and its link once open
+func (h *AppointmentHandler) GetMeeting(w http.ResponseWriter, r *http.Request) {
+	appointment, userID, ok := h.appointmentParty(w, r, h.db)
+	if !ok {
+		return
+	}
+	if appointment.Status != "Confirmed" {
+		http.Error(w, "Only confirmed appointments have a meeting room", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	opensAt, closesAt := meetingWindow(appointment)
+	open := !now.Before(opensAt) && now.Before(closesAt)
+	response := map[string]interface{}{
+		"appointment_id": appointment.ID,
+		"opens_at":       opensAt,
+		"closes_at":      closesAt,
+		"open":           open,
+	}
+	if open {
+		if err := h.db.Transaction(func(tx *gorm.DB) error {
+			return h.assignMeetingRoom(tx, appointment)
+		}); err != nil {
+			http.Error(w, "Error creating meeting room", http.StatusInternalServerError)
+			return
+		}
+		response["provider"] = appointment.MeetingProvider
+		response["url"] = h.joinURL(appointment, userID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// joinURL is the room link for userID, carrying their name into the meeting
+func (h *AppointmentHandler) joinURL(appointment *models.Appointment, userID uint) string {
+	var user models.User
+	h.db.Select("id", "full_name").First(&user, userID)
+	return h.meetings.JoinURL(meetings.Room{Name: appointment.MeetingRoom, URL: appointment.MeetingURL}, user.FullName)
+}
+
+// JoinMeeting records that the signed-in participant entered the room and
+// returns its link. It is refused outside the meeting window.
+func (h *AppointmentHandler) JoinMeeting(w http.ResponseWriter, r *http.Request) {
+	appointment, userID, ok := h.appointmentParty(w, r, h.db)
+	if !ok {
+		return
+	}
+	if appointment.Status != "Confirmed" {
+		http.Error(w, "Only confirmed appointments have a meeting room", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	opensAt, closesAt := meetingWindow(appointment)
+	if now.Before(opensAt) {
+		http.Error(w, "The meeting room opens at "+opensAt.UTC().Format(time.RFC3339), http.StatusForbidden)
+		return
+	}
+	if !now.Before(closesAt) {
+		http.Error(w, "The meeting room has closed", http.StatusForbidden)
+		return
+	}
+
+	tx := h.db.Begin()
+	if err := h.assignMeetingRoom(tx, appointment); err != nil {
+		tx.Rollback()
+		http.Error(w, "Error creating meeting room", http.StatusInternalServerError)
+		return
+	}
+
+	// A participant rejoining without leaving, e.g. after a dropped call,
+	// closes their previous visit
+	if err := tx.Model(&models.MeetingAttendance{}).
+		Where("appointment_id = ? AND user_id = ? AND left_at IS NULL", appointment.ID, userID).
+		Update("left_at", now).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Error recording attendance", http.StatusInternalServerError)
+		return
+	}
+
+	attendance := models.MeetingAttendance{
+		AppointmentID: appointment.ID,
+		UserID:        userID,
+		Role:          meetingRole(appointment, userID),
+		JoinedAt:      now,
+	}
+	if err := tx.Create(&attendance).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Error recording attendance", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		http.Error(w, "Error recording attendance", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":        h.joinURL(appointment, userID),
+		"provider":   appointment.MeetingProvider,
+		"attendance": attendance,
+	})
+}
+
+// LeaveMeeting records that the signed-in participant left the room
+func (h *AppointmentHandler) LeaveMeeting(w http.ResponseWriter, r *http.Request) {
+	appointment, userID, ok := h.appointmentParty(w, r, h.db)
+	if !ok {
+		return
+	}
+
+	var attendance models.MeetingAttendance
+	if err := h.db.Where("appointment_id = ? AND user_id = ? AND left_at IS NULL", appointment.ID, userID).
+		Order("joined_at DESC").
+		First(&attendance).Error; err != nil {
+		http.Error(w, "You are not in this meeting", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	attendance.LeftAt = &now
+	if err := h.db.Model(&attendance).Update("left_at", now).Error; err != nil {
+		http.Error(w, "Error recording attendance", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attendance)
+}
+
+// GetAttendance lists when each participant joined and left the meeting
+func (h *AppointmentHandler) GetAttendance(w http.ResponseWriter, r *http.Request) {
+	appointment, _, ok := h.appointmentParty(w, r, h.db)
+	if !ok {
+		return
+	}
+
+	var attendance []models.MeetingAttendance
+	if err := h.db.Where("appointment_id = ?", appointment.ID).
+		Order("joined_at").
+		Find(&attendance).Error; err != nil {
+		http.Error(w, "Error fetching attendance", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attendance)
+}
@@ -0,0 +1,103 @@
+package appointment
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"gorm.io/gorm"
+)
+
+func TestMeetingWindow(t *testing.T) {
+	start := time.Date(2026, 3, 2, 18, 0, 0, 0, time.UTC)
+	opens, closes := meetingWindow(&models.Appointment{StartTime: start, EndTime: start.Add(time.Hour)})
+	if !opens.Equal(start.Add(-10*time.Minute)) || !closes.Equal(start.Add(90*time.Minute)) {
+		t.Errorf("window = %v to %v", opens, closes)
+	}
+}
+
+func TestAssignMeetingRoomRace(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	h := newTestHandler(db)
+	expert := testdb.Expert(t, db, "Group Expert")
+	slot := testdb.Slot(t, db, expert, time.Now().Add(48*time.Hour).Truncate(time.Hour), 5, 5000)
+
+	appointments := make([]*models.Appointment, 5)
+	for i := range appointments {
+		appointments[i] = confirmed(t, db, slot, testdb.User(t, db, fmt.Sprintf("Trader %d", i)).ID, fmt.Sprintf("APT-%d", i))
+	}
+
+	// Every participant opening the room at once must end up in the same one
+	errs := testdb.Race(len(appointments), func(i int) error {
+		return db.Transaction(func(tx *gorm.DB) error { return h.assignMeetingRoom(tx, appointments[i]) })
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("assignMeetingRoom %d: %v", i, err)
+		}
+	}
+
+	var rooms []string
+	db.Model(&models.Appointment{}).Distinct().Pluck("meeting_room", &rooms)
+	if len(rooms) != 1 || rooms[0] == "" {
+		t.Fatalf("rooms = %q, want one shared room", rooms)
+	}
+	for i, appointment := range appointments {
+		if appointment.MeetingRoom != rooms[0] || appointment.MeetingProvider != "jitsi" {
+			t.Errorf("appointment %d given room %q of %q", i, appointment.MeetingRoom, appointment.MeetingProvider)
+		}
+	}
+}
+
+func TestJoinMeeting(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	h := newTestHandler(db)
+	now := time.Now()
+	expert := testdb.Expert(t, db, "Meeting Expert")
+	trader := testdb.User(t, db, "Meeting Trader")
+	starting := confirmed(t, db, testdb.Slot(t, db, expert, now.Add(5*time.Minute), 1, 5000), trader.ID, "APT-soon")
+	later := confirmed(t, db, testdb.Slot(t, db, expert, now.Add(3*time.Hour), 1, 5000), trader.ID, "APT-later")
+	vars := map[string]string{"id": fmt.Sprint(starting.ID)}
+
+	if w := serve(h.JoinMeeting, trader.ID, map[string]string{"id": fmt.Sprint(later.ID)}, nil); w.Code != http.StatusForbidden {
+		t.Errorf("joining before the room opens: status = %d", w.Code)
+	}
+	if w := serve(h.GetMeeting, trader.ID, map[string]string{"id": fmt.Sprint(later.ID)}, nil); w.Code != http.StatusOK || w.Body.String() == "" {
+		t.Errorf("meeting before it opens: status = %d", w.Code)
+	}
+	if w := serve(h.LeaveMeeting, trader.ID, vars, nil); w.Code != http.StatusConflict {
+		t.Errorf("leaving before joining: status = %d", w.Code)
+	}
+
+	// The trader's call drops and they join again, then the expert joins
+	for _, userID := range []uint{trader.ID, trader.ID, expert.UserID} {
+		w := serve(h.JoinMeeting, userID, vars, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("join: status = %d: %s", w.Code, w.Body)
+		}
+		var joined struct{ URL string }
+		json.NewDecoder(w.Body).Decode(&joined)
+		if joined.URL == "" {
+			t.Error("no room link")
+		}
+	}
+	if w := serve(h.LeaveMeeting, trader.ID, vars, nil); w.Code != http.StatusOK {
+		t.Errorf("leave: status = %d", w.Code)
+	}
+
+	var attendance []models.MeetingAttendance
+	db.Where("appointment_id = ?", starting.ID).Order("id").Find(&attendance)
+	if len(attendance) != 3 {
+		t.Fatalf("%d visits recorded, want 3", len(attendance))
+	}
+	if attendance[0].LeftAt == nil || attendance[1].LeftAt == nil || attendance[2].LeftAt != nil {
+		t.Errorf("left at %v, %v, %v; want the trader's visits closed and the expert still in", attendance[0].LeftAt, attendance[1].LeftAt, attendance[2].LeftAt)
+	}
+	if attendance[0].Role != "trader" || attendance[2].Role != "expert" {
+		t.Errorf("roles = %s, %s", attendance[0].Role, attendance[2].Role)
+	}
+}
@@ -0,0 +1,153 @@
+package appointment
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/gorilla/mux"
+)
+
+// noteRequest is the body for creating or editing a session note
+type noteRequest struct {
+	Body   string `json:"body"`
+	Shared bool   `json:"shared"`
+}
+
+// isAppointmentExpert reports whether userID is the appointment's expert
+func isAppointmentExpert(appointment *models.Appointment, userID uint) bool {
+	return appointment.Expert != nil && appointment.Expert.UserID == userID
+}
+
+// CreateNote adds the expert's private note or shared session summary to an
+// appointment
+func (h *AppointmentHandler) CreateNote(w http.ResponseWriter, r *http.Request) {
+	appointment, userID, ok := h.appointmentParty(w, r, h.db)
+	if !ok {
+		return
+	}
+	if !isAppointmentExpert(appointment, userID) {
+		http.Error(w, "Only the expert can add session notes", http.StatusForbidden)
+		return
+	}
+
+	var request noteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Body) == "" {
+		http.Error(w, "Note body is required", http.StatusBadRequest)
+		return
+	}
+
+	note := models.SessionNote{
+		AppointmentID: appointment.ID,
+		AuthorID:      userID,
+		Shared:        request.Shared,
+		Body:          request.Body,
+	}
+	if err := h.db.Create(&note).Error; err != nil {
+		http.Error(w, "Error creating note", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(note)
+}
+
+// GetNotes lists an appointment's notes: the expert sees all of theirs, the
+// trader only the shared summaries
+func (h *AppointmentHandler) GetNotes(w http.ResponseWriter, r *http.Request) {
+	appointment, userID, ok := h.appointmentParty(w, r, h.db)
+	if !ok {
+		return
+	}
+
+	query := h.db.Where("appointment_id = ?", appointment.ID)
+	if isAppointmentExpert(appointment, userID) {
+		query = query.Where("shared = ? OR author_id = ?", true, userID)
+	} else {
+		query = query.Where("shared = ?", true)
+	}
+
+	var notes []models.SessionNote
+	if err := query.Order("created_at").Find(&notes).Error; err != nil {
+		http.Error(w, "Error fetching notes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notes)
+}
+
+// findOwnNote loads the note in the URL if the signed-in user wrote it
+func (h *AppointmentHandler) findOwnNote(w http.ResponseWriter, r *http.Request) (*models.SessionNote, bool) {
+	appointment, userID, ok := h.appointmentParty(w, r, h.db)
+	if !ok {
+		return nil, false
+	}
+
+	noteID, err := strconv.ParseUint(mux.Vars(r)["noteId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid note ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var note models.SessionNote
+	if err := h.db.Where("id = ? AND appointment_id = ?", noteID, appointment.ID).First(&note).Error; err != nil {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return nil, false
+	}
+	if note.AuthorID != userID {
+		http.Error(w, "You can only change your own notes", http.StatusForbidden)
+		return nil, false
+	}
+	return &note, true
+}
+
+// UpdateNote edits a note or changes whether it is shared
+func (h *AppointmentHandler) UpdateNote(w http.ResponseWriter, r *http.Request) {
+	note, ok := h.findOwnNote(w, r)
+	if !ok {
+		return
+	}
+
+	var request noteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Body) == "" {
+		http.Error(w, "Note body is required", http.StatusBadRequest)
+		return
+	}
+
+	note.Body = request.Body
+	note.Shared = request.Shared
+	if err := h.db.Model(note).Updates(map[string]interface{}{"body": note.Body, "shared": note.Shared}).Error; err != nil {
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// DeleteNote removes a note
+func (h *AppointmentHandler) DeleteNote(w http.ResponseWriter, r *http.Request) {
+	note, ok := h.findOwnNote(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Delete(note).Error; err != nil {
+		http.Error(w, "Error deleting note", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,165 @@
+package appointment
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"gorm.io/gorm/clause"
+)
+
+// reminderInterval is how often due appointment reminders are sent
+const reminderInterval = time.Minute
+
+// defaultReminderOffsets are used when APPOINTMENT_REMINDER_OFFSETS is unset
+var defaultReminderOffsets = []time.Duration{24 * time.Hour, 15 * time.Minute}
+
+// ReminderOffsets returns how long before an appointment starts its
+// reminders go out, longest first. APPOINTMENT_REMINDER_OFFSETS overrides the
+// default with a comma separated list of durations such as "24h,1h,15m".
+func ReminderOffsets() []time.Duration {
+	var offsets []time.Duration
+	for _, value := range strings.Split(os.Getenv("APPOINTMENT_REMINDER_OFFSETS"), ",") {
+		offset, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || offset < time.Minute {
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+	if len(offsets) == 0 {
+		offsets = append(offsets, defaultReminderOffsets...)
+	}
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets
+}
+
+// runReminders periodically sends the reminders that are due
+func (h *AppointmentHandler) runReminders() {
+	ticker := time.NewTicker(reminderInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.sendDueReminders(time.Now()); err != nil {
+			log.Printf("Error sending appointment reminders: %v", err)
+		}
+	}
+}
+
+// sendDueReminders reminds the trader and expert of each confirmed
+// appointment in a slot with Reminder set. An appointment starting within an
+// offset, but not within the next shorter one, is due that offset's reminder,
+// so one missed while the server was down is sent late rather than skipped.
+// The expert of a group session is reminded once, through the slot's first
+// appointment, so every server picks the same one to claim. A reminder that
+// fails is logged and the rest are still sent.
+func (h *AppointmentHandler) sendDueReminders(now time.Time) error {
+	offsets := ReminderOffsets()
+	for i, offset := range offsets {
+		earliest := now
+		if i+1 < len(offsets) {
+			earliest = now.Add(offsets[i+1])
+		}
+
+		var appointments []models.Appointment
+		if err := h.db.Preload("Trader").Preload("Expert.User").
+			Joins("JOIN availabilities ON availabilities.id = appointments.availability_id").
+			Where("availabilities.reminder = ?", true).
+			Where("appointments.status = ? AND appointments.payment_status = ?", "Confirmed", "paid").
+			Where("appointments.start_time > ? AND appointments.start_time <= ?", earliest, now.Add(offset)).
+			Order("appointments.id ASC").
+			Find(&appointments).Error; err != nil {
+			return err
+		}
+
+		expertReminded := make(map[uint]bool)
+		for _, appointment := range appointments {
+			recipients := []*models.User{appointment.Trader}
+			if appointment.Expert != nil && !expertReminded[appointment.AvailabilityID] {
+				expertReminded[appointment.AvailabilityID] = true
+				recipients = append(recipients, appointment.Expert.User)
+			}
+			for _, user := range recipients {
+				if user == nil {
+					continue
+				}
+				if err := h.sendReminder(&appointment, user, offset, now); err != nil {
+					log.Printf("Error sending reminder for appointment %d to user %d: %v", appointment.ID, user.ID, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sendReminder claims the reminder for user, then sends it by push and
+// email. A reminder another server or an earlier run claimed is skipped.
+func (h *AppointmentHandler) sendReminder(appointment *models.Appointment, user *models.User, offset time.Duration, now time.Time) error {
+	reminder := models.AppointmentReminder{
+		AppointmentID: appointment.ID,
+		UserID:        user.ID,
+		OffsetMinutes: int(offset / time.Minute),
+		StartTime:     appointment.StartTime,
+	}
+	result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&reminder)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	title, body := reminderMessage(appointment, user, now)
+
+	reminder.PushStatus = "sent"
+	data := map[string]interface{}{"type": "appointment_reminder", "appointment_id": appointment.ID}
+	if _, err := h.notifier.SendUserNotification(strconv.FormatUint(uint64(user.ID), 10), title, body, data); err != nil {
+		log.Printf("Error pushing reminder for appointment %d to user %d: %v", appointment.ID, user.ID, err)
+		reminder.PushStatus = "failed"
+	}
+
+	reminder.EmailStatus = "sent"
+	if user.Email == "" {
+		reminder.EmailStatus = "skipped"
+	} else if err := utils.SendEmail(user.Email, title, body, ""); err != nil {
+		log.Printf("Error emailing reminder for appointment %d to user %d: %v", appointment.ID, user.ID, err)
+		reminder.EmailStatus = "failed"
+	}
+
+	return h.db.Model(&reminder).Updates(map[string]interface{}{
+		"push_status":  reminder.PushStatus,
+		"email_status": reminder.EmailStatus,
+	}).Error
+}
+
+// reminderMessage builds the reminder text, with the start time in the
+// recipient's time zone
+func reminderMessage(appointment *models.Appointment, user *models.User, now time.Time) (string, string) {
+	start := appointment.StartTime.In(utils.LoadZone(user.TimeZone))
+	title := fmt.Sprintf("Reminder: %s", appointment.EventName)
+	body := fmt.Sprintf("Your session \"%s\" starts in %s, at %s.",
+		appointment.EventName, formatLeadTime(appointment.StartTime.Sub(now)), start.Format("Mon 2 Jan 2006, 15:04 MST"))
+	return title, body
+}
+
+// formatLeadTime describes d in whole hours from two hours up, otherwise in
+// minutes, e.g. "24 hours" or "15 minutes"
+func formatLeadTime(d time.Duration) string {
+	if d >= 2*time.Hour {
+		return plural(int(d.Round(time.Hour)/time.Hour), "hour")
+	}
+	return plural(int(d.Round(time.Minute)/time.Minute), "minute")
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
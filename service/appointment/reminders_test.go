@@ -0,0 +1,124 @@
+package appointment
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/signals/signalstest"
+)
+
+func TestReminderOffsets(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{env: "", want: "[24h0m0s 15m0s]"},
+		{env: "1h, 24h,15m", want: "[24h0m0s 1h0m0s 15m0s]"},
+		{env: "2h", want: "[2h0m0s]"},
+		{env: "soon,30s", want: "[24h0m0s 15m0s]"}, // Nothing usable, so the defaults
+	}
+	for _, tt := range tests {
+		t.Setenv("APPOINTMENT_REMINDER_OFFSETS", tt.env)
+		if got := fmt.Sprint(ReminderOffsets()); got != tt.want {
+			t.Errorf("ReminderOffsets with %q = %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestFormatLeadTime(t *testing.T) {
+	tests := []struct {
+		lead time.Duration
+		want string
+	}{
+		{24 * time.Hour, "24 hours"},
+		{3*time.Hour + 40*time.Minute, "4 hours"},
+		{2 * time.Hour, "2 hours"},
+		{90 * time.Minute, "90 minutes"},
+		{14*time.Minute + 50*time.Second, "15 minutes"},
+		{time.Minute, "1 minute"},
+	}
+	for _, tt := range tests {
+		if got := formatLeadTime(tt.lead); got != tt.want {
+			t.Errorf("formatLeadTime(%v) = %q, want %q", tt.lead, got, tt.want)
+		}
+	}
+}
+
+func TestReminderMessage(t *testing.T) {
+	now := time.Date(2026, 3, 2, 16, 45, 0, 0, time.UTC)
+	appointment := &models.Appointment{EventName: "Risk management", StartTime: time.Date(2026, 3, 2, 17, 0, 0, 0, time.UTC)}
+
+	title, body := reminderMessage(appointment, &models.User{TimeZone: "Africa/Lagos"}, now)
+	if title != "Reminder: Risk management" {
+		t.Errorf("title = %q", title)
+	}
+	// The start time is given in the recipient's zone
+	if want := `Your session "Risk management" starts in 15 minutes, at Mon 2 Mar 2026, 18:00 WAT.`; body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestSendDueReminders(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	t.Setenv("APPOINTMENT_REMINDER_OFFSETS", "")
+	t.Setenv("SMTP_HOST", "")
+	now := time.Now()
+	notifier := &signalstest.Notifier{}
+	h := newTestHandler(db)
+	h.notifier = notifier
+	expert := testdb.Expert(t, db, "Reminded Expert")
+
+	slot := func(start time.Time, capacity int, reminder bool) *models.Availability {
+		s := testdb.Slot(t, db, expert, start, capacity, 5000)
+		db.Model(s).Update("reminder", reminder)
+		return s
+	}
+	soon := slot(now.Add(10*time.Minute), 2, true)
+	tomorrow := slot(now.Add(20*time.Hour), 1, true)
+	unwanted := slot(now.Add(5*time.Minute), 1, false)
+
+	var traders []uint
+	for i := 0; i < 4; i++ {
+		traders = append(traders, testdb.User(t, db, fmt.Sprintf("Trader %d", i)).ID)
+	}
+	confirmed(t, db, soon, traders[0], "APT-1")
+	confirmed(t, db, soon, traders[1], "APT-2")
+	confirmed(t, db, tomorrow, traders[2], "APT-3")
+	confirmed(t, db, unwanted, traders[3], "APT-4")
+	unpaid := testdb.Appointment(tomorrow, traders[3], 1, "APT-5")
+	db.Create(unpaid)
+
+	// Later runs find the reminders already sent
+	for i := 0; i < 2; i++ {
+		if err := h.sendDueReminders(now); err != nil {
+			t.Fatalf("sendDueReminders: %v", err)
+		}
+	}
+
+	// Both traders in the group session and its expert once, then the trader
+	// and expert of tomorrow's session
+	var got []string
+	for _, n := range notifier.Sent() {
+		got = append(got, n.UserID)
+	}
+	want := []string{fmt.Sprint(traders[2]), fmt.Sprint(expert.UserID), fmt.Sprint(traders[0]), fmt.Sprint(expert.UserID), fmt.Sprint(traders[1])}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("reminded users %v, want %v", got, want)
+	}
+
+	var reminders []models.AppointmentReminder
+	db.Order("id").Find(&reminders)
+	if len(reminders) != len(want) {
+		t.Fatalf("%d reminders recorded, want %d", len(reminders), len(want))
+	}
+	if r := reminders[0]; r.OffsetMinutes != 24*60 || r.PushStatus != "sent" || r.EmailStatus != "failed" {
+		t.Errorf("tomorrow's reminder = %d minutes ahead, push %s, email %s", r.OffsetMinutes, r.PushStatus, r.EmailStatus)
+	}
+	if r := reminders[2]; r.OffsetMinutes != 15 {
+		t.Errorf("group session reminded %d minutes ahead, want 15", r.OffsetMinutes)
+	}
+}
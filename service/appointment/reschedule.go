@@ -0,0 +1,364 @@
+package appointment
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/availability"
+	"github.com/KAsare1/Kodefx-server/service/calendar"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reschedule request statuses
+const (
+	ReschedulePending   = "pending"
+	RescheduleAccepted  = "accepted"
+	RescheduleDeclined  = "declined"
+	RescheduleWithdrawn = "withdrawn"
+)
+
+// appointmentParty loads the appointment in the URL and checks that the
+// signed-in user is its trader or its expert, writing the error response if not
+func (h *AppointmentHandler) appointmentParty(w http.ResponseWriter, r *http.Request, db *gorm.DB) (*models.Appointment, uint, bool) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, 0, false
+	}
+
+	appointmentID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid appointment ID", http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	var appointment models.Appointment
+	if err := db.Preload("Expert").First(&appointment, appointmentID).Error; err != nil {
+		http.Error(w, "Appointment not found", http.StatusNotFound)
+		return nil, 0, false
+	}
+	if appointment.TraderID != userID && (appointment.Expert == nil || appointment.Expert.UserID != userID) {
+		http.Error(w, "You are not part of this appointment", http.StatusForbidden)
+		return nil, 0, false
+	}
+	return &appointment, userID, true
+}
+
+// RequestReschedule proposes moving a confirmed appointment to another slot
+func (h *AppointmentHandler) RequestReschedule(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		AvailabilityID uint   `json:"availability_id"`
+		Reason         string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx := h.db.Begin()
+	appointment, userID, ok := h.appointmentParty(w, r, tx.Clauses(clause.Locking{Strength: "UPDATE"}))
+	if !ok {
+		tx.Rollback()
+		return
+	}
+	if appointment.Status != "Confirmed" || appointment.PaymentStatus != "paid" {
+		tx.Rollback()
+		http.Error(w, "Only confirmed, paid appointments can be rescheduled", http.StatusConflict)
+		return
+	}
+	now := time.Now()
+	if !appointment.StartTime.After(now) {
+		tx.Rollback()
+		http.Error(w, "Appointments can't be rescheduled once they have started", http.StatusConflict)
+		return
+	}
+
+	var slot models.Availability
+	if err := tx.First(&slot, request.AvailabilityID).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Time slot not found", http.StatusNotFound)
+		return
+	}
+	if err := validateRescheduleSlot(appointment, &slot, now); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Check the expert's limits now so a request that can't be accepted isn't made
+	var err error
+	if slot.SeatsTaken, err = availability.SeatsTaken(tx, slot.ID); err != nil {
+		tx.Rollback()
+		http.Error(w, "Error checking availability", http.StatusInternalServerError)
+		return
+	}
+	if !checkMoveLimits(w, tx, &slot, appointment, now) {
+		return
+	}
+
+	var pending int64
+	tx.Model(&models.RescheduleRequest{}).
+		Where("appointment_id = ? AND status = ?", appointment.ID, ReschedulePending).
+		Count(&pending)
+	if pending > 0 {
+		tx.Rollback()
+		http.Error(w, "This appointment already has a pending reschedule request", http.StatusConflict)
+		return
+	}
+
+	reschedule := models.RescheduleRequest{
+		AppointmentID:  appointment.ID,
+		RequestedByID:  userID,
+		AvailabilityID: slot.ID,
+		Reason:         request.Reason,
+		Status:         ReschedulePending,
+	}
+	if err := tx.Create(&reschedule).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Error creating reschedule request", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		http.Error(w, "Error creating reschedule request", http.StatusInternalServerError)
+		return
+	}
+
+	reschedule.Availability = &slot
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(reschedule)
+}
+
+// validateRescheduleSlot checks that slot is a future slot of the same
+// expert, priced in the appointment's currency, other than its current one
+func validateRescheduleSlot(appointment *models.Appointment, slot *models.Availability, now time.Time) error {
+	if slot.ID == appointment.AvailabilityID {
+		return errors.New("The appointment is already in this time slot")
+	}
+	if slot.ExpertID != appointment.ExpertID {
+		return errors.New("The new time slot must be with the same expert")
+	}
+	if slot.Currency != appointment.Currency {
+		return errors.New("The new time slot must be priced in the appointment's currency")
+	}
+	if !slot.StartTime.After(now) {
+		return errors.New("The new time slot has already started")
+	}
+	return nil
+}
+
+// checkMoveLimits applies the expert's booking settings to moving the
+// appointment to slot, writing the error response and rolling back if it is
+// not allowed
+func checkMoveLimits(w http.ResponseWriter, tx *gorm.DB, slot *models.Availability, appointment *models.Appointment, now time.Time) bool {
+	if err := availability.CheckMoveLimits(tx, slot, appointment.ID, now); err != nil {
+		tx.Rollback()
+		if availability.IsBookingLimitError(err) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return false
+		}
+		http.Error(w, "Error checking availability", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// GetRescheduleRequests lists the appointment's reschedule requests, newest first
+func (h *AppointmentHandler) GetRescheduleRequests(w http.ResponseWriter, r *http.Request) {
+	appointment, _, ok := h.appointmentParty(w, r, h.db)
+	if !ok {
+		return
+	}
+
+	var requests []models.RescheduleRequest
+	if err := h.db.Preload("Availability").
+		Where("appointment_id = ?", appointment.ID).
+		Order("created_at DESC").
+		Find(&requests).Error; err != nil {
+		http.Error(w, "Error fetching reschedule requests", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// RespondToReschedule accepts, declines or withdraws a pending request. The
+// other party accepts or declines; the party who asked may withdraw it.
+func (h *AppointmentHandler) RespondToReschedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	action := vars["action"]
+	requestID, err := strconv.ParseUint(vars["requestId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid reschedule request ID", http.StatusBadRequest)
+		return
+	}
+
+	tx := h.db.Begin()
+	appointment, userID, ok := h.appointmentParty(w, r, tx.Clauses(clause.Locking{Strength: "UPDATE"}))
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	var reschedule models.RescheduleRequest
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND appointment_id = ?", requestID, appointment.ID).
+		First(&reschedule).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Reschedule request not found", http.StatusNotFound)
+		return
+	}
+	if reschedule.Status != ReschedulePending {
+		tx.Rollback()
+		http.Error(w, "This reschedule request has already been "+reschedule.Status, http.StatusConflict)
+		return
+	}
+
+	ownRequest := reschedule.RequestedByID == userID
+	switch action {
+	case "accept", "decline":
+		if ownRequest {
+			tx.Rollback()
+			http.Error(w, "The other party must respond to this request", http.StatusForbidden)
+			return
+		}
+	case "withdraw":
+		if !ownRequest {
+			tx.Rollback()
+			http.Error(w, "Only the party who asked can withdraw this request", http.StatusForbidden)
+			return
+		}
+	default:
+		tx.Rollback()
+		http.Error(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	previousSlotID := appointment.AvailabilityID
+	reschedule.RespondedByID = &userID
+	reschedule.RespondedAt = &now
+	switch action {
+	case "decline":
+		reschedule.Status = RescheduleDeclined
+	case "withdraw":
+		reschedule.Status = RescheduleWithdrawn
+	case "accept":
+		reschedule.Status = RescheduleAccepted
+		if !h.moveAppointment(w, tx, appointment, &reschedule, userID, now) {
+			return
+		}
+	}
+
+	if err := tx.Save(&reschedule).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Error updating reschedule request", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		http.Error(w, "Error updating reschedule request", http.StatusInternalServerError)
+		return
+	}
+
+	// The seat the appointment moved out of can go to the waitlist
+	if reschedule.Status == RescheduleAccepted {
+		go availability.OfferWaitlist(h.db, h.notifier, previousSlotID)
+	}
+
+	h.db.Preload("Availability").First(&reschedule, reschedule.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reschedule)
+}
+
+// moveAppointment moves the appointment and its seats to the requested slot
+// within tx and records the change. The original payment stays with the
+// appointment. It writes the error response and rolls back on failure.
+func (h *AppointmentHandler) moveAppointment(w http.ResponseWriter, tx *gorm.DB, appointment *models.Appointment, reschedule *models.RescheduleRequest, userID uint, now time.Time) bool {
+	if appointment.Status != "Confirmed" || appointment.PaymentStatus != "paid" {
+		tx.Rollback()
+		http.Error(w, "Only confirmed, paid appointments can be rescheduled", http.StatusConflict)
+		return false
+	}
+	if !appointment.StartTime.After(now) {
+		tx.Rollback()
+		http.Error(w, "Appointments can't be rescheduled once they have started", http.StatusConflict)
+		return false
+	}
+
+	slot, ok := reserveSeats(w, tx, reschedule.AvailabilityID, appointment.Seats)
+	if !ok {
+		return false
+	}
+	if err := validateRescheduleSlot(appointment, slot, now); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return false
+	}
+	if !checkMoveLimits(w, tx, slot, appointment, now) {
+		return false
+	}
+
+	change := models.AppointmentChange{
+		AppointmentID:       appointment.ID,
+		RescheduleRequestID: &reschedule.ID,
+		ChangedByID:         userID,
+		FromAvailabilityID:  appointment.AvailabilityID,
+		ToAvailabilityID:    slot.ID,
+		FromStartTime:       appointment.StartTime,
+		ToStartTime:         slot.StartTime,
+		Reason:              reschedule.Reason,
+	}
+	if err := tx.Create(&change).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Error rescheduling appointment", http.StatusInternalServerError)
+		return false
+	}
+
+	// The appointment joins the new slot's meeting room
+	hadRoom := appointment.MeetingRoom != ""
+	if err := tx.Model(appointment).Updates(map[string]interface{}{
+		"availability_id":   slot.ID,
+		"appointment_date":  slot.Date,
+		"start_time":        slot.StartTime,
+		"end_time":          slot.EndTime,
+		"event_name":        slot.EventName,
+		"category":          slot.Category,
+		"calendar_sequence": appointment.CalendarSequence + 1,
+		"meeting_provider":  "",
+		"meeting_room":      "",
+		"meeting_url":       "",
+	}).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Error rescheduling appointment", http.StatusInternalServerError)
+		return false
+	}
+	appointment.AvailabilityID = slot.ID
+	appointment.StartTime = slot.StartTime
+	appointment.EndTime = slot.EndTime
+	appointment.EventName = slot.EventName
+	appointment.MeetingProvider, appointment.MeetingRoom, appointment.MeetingURL = "", "", ""
+	if hadRoom {
+		if err := h.assignMeetingRoom(tx, appointment); err != nil {
+			tx.Rollback()
+			http.Error(w, "Error creating meeting room", http.StatusInternalServerError)
+			return false
+		}
+	}
+
+	// Send updated invites so calendars move the event
+	if err := calendar.QueueInvites(tx, appointment, calendar.InviteRescheduled); err != nil {
+		tx.Rollback()
+		http.Error(w, "Error rescheduling appointment", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
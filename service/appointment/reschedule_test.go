@@ -0,0 +1,175 @@
+package appointment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/availability"
+	"github.com/KAsare1/Kodefx-server/service/meetings"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// confirmed creates the trader's confirmed, paid booking of a seat in slot
+func confirmed(t *testing.T, db *gorm.DB, slot *models.Availability, traderID uint, reference string) *models.Appointment {
+	t.Helper()
+
+	appointment := testdb.Appointment(slot, traderID, 1, reference)
+	appointment.Status, appointment.PaymentStatus = "Confirmed", "paid"
+	if err := db.Create(appointment).Error; err != nil {
+		t.Fatalf("booking %s: %v", reference, err)
+	}
+	return appointment
+}
+
+// serve calls handler as userID with the route variables and JSON body given
+func serve(handler http.HandlerFunc, userID uint, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(body)
+
+	r := testdb.AsUser(httptest.NewRequest(http.MethodPost, "/", &buf), userID)
+	w := httptest.NewRecorder()
+	handler(w, mux.SetURLVars(r, vars))
+	return w
+}
+
+func newTestHandler(db *gorm.DB) *AppointmentHandler {
+	return &AppointmentHandler{db: db, provider: payment.NewFakeProvider(), meetings: meetings.NewJitsiProvider("")}
+}
+
+func TestValidateRescheduleSlot(t *testing.T) {
+	now := time.Now()
+	appointment := &models.Appointment{ExpertID: 1, AvailabilityID: 10, Currency: "GHS"}
+	slot := func(id, expertID uint, currency string, start time.Time) *models.Availability {
+		s := &models.Availability{ExpertID: expertID, Currency: currency, StartTime: start}
+		s.ID = id
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		slot    *models.Availability
+		wantErr bool
+	}{
+		{name: "another future slot", slot: slot(11, 1, "GHS", now.Add(time.Hour))},
+		{name: "the same slot", slot: slot(10, 1, "GHS", now.Add(time.Hour)), wantErr: true},
+		{name: "another expert", slot: slot(11, 2, "GHS", now.Add(time.Hour)), wantErr: true},
+		{name: "another currency", slot: slot(11, 1, "NGN", now.Add(time.Hour)), wantErr: true},
+		{name: "already started", slot: slot(11, 1, "GHS", now), wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateRescheduleSlot(appointment, tt.slot, now); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	now := time.Now()
+	h := newTestHandler(db)
+	expert := testdb.Expert(t, db, "Moving Expert")
+	trader := testdb.User(t, db, "Moving Trader")
+	outsider := testdb.User(t, db, "Outsider")
+	start := now.Add(48 * time.Hour).Truncate(time.Hour)
+	from := testdb.Slot(t, db, expert, start, 1, 5000)
+	to := testdb.Slot(t, db, expert, start.Add(24*time.Hour), 1, 5000)
+	elsewhere := testdb.Slot(t, db, testdb.Expert(t, db, "Other Expert"), start, 1, 5000)
+	appointment := confirmed(t, db, from, trader.ID, "APT-move")
+
+	vars := map[string]string{"id": fmt.Sprint(appointment.ID)}
+	request := func(userID, slotID uint) *httptest.ResponseRecorder {
+		return serve(h.RequestReschedule, userID, vars, map[string]interface{}{"availability_id": slotID, "reason": "Travelling"})
+	}
+	respond := func(userID, requestID uint, action string) *httptest.ResponseRecorder {
+		return serve(h.RespondToReschedule, userID, map[string]string{"id": vars["id"], "requestId": fmt.Sprint(requestID), "action": action}, nil)
+	}
+
+	if w := request(outsider.ID, to.ID); w.Code != http.StatusForbidden {
+		t.Errorf("outsider asking: status = %d", w.Code)
+	}
+	if w := request(trader.ID, elsewhere.ID); w.Code != http.StatusBadRequest {
+		t.Errorf("moving to another expert: status = %d", w.Code)
+	}
+
+	w := request(trader.ID, to.ID)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("request: status = %d: %s", w.Code, w.Body)
+	}
+	var reschedule models.RescheduleRequest
+	json.NewDecoder(w.Body).Decode(&reschedule)
+	if w := request(expert.UserID, to.ID); w.Code != http.StatusConflict {
+		t.Errorf("second pending request: status = %d", w.Code)
+	}
+
+	// Only the other party can accept
+	if w := respond(trader.ID, reschedule.ID, "accept"); w.Code != http.StatusForbidden {
+		t.Errorf("accepting own request: status = %d", w.Code)
+	}
+	if w := respond(expert.UserID, reschedule.ID, "withdraw"); w.Code != http.StatusForbidden {
+		t.Errorf("withdrawing the other party's request: status = %d", w.Code)
+	}
+	if w := respond(expert.UserID, reschedule.ID, "accept"); w.Code != http.StatusOK {
+		t.Fatalf("accept: status = %d: %s", w.Code, w.Body)
+	}
+	if w := respond(expert.UserID, reschedule.ID, "decline"); w.Code != http.StatusConflict {
+		t.Errorf("answering twice: status = %d", w.Code)
+	}
+
+	db.First(appointment, appointment.ID)
+	if appointment.AvailabilityID != to.ID || !appointment.StartTime.Equal(to.StartTime) || appointment.CalendarSequence != 1 {
+		t.Errorf("appointment in slot %d at %v, sequence %d; want slot %d at %v, sequence 1",
+			appointment.AvailabilityID, appointment.StartTime, appointment.CalendarSequence, to.ID, to.StartTime)
+	}
+	var change models.AppointmentChange
+	if err := db.Where("appointment_id = ?", appointment.ID).First(&change).Error; err != nil || change.FromAvailabilityID != from.ID || change.ChangedByID != expert.UserID {
+		t.Errorf("change = %+v, %v", change, err)
+	}
+	if taken, _ := availability.SeatsTaken(db, from.ID); taken != 0 {
+		t.Errorf("%d seats still taken in the old slot", taken)
+	}
+	if taken, _ := availability.SeatsTaken(db, to.ID); taken != 1 {
+		t.Errorf("%d seats taken in the new slot, want 1", taken)
+	}
+}
+
+func TestRescheduleSlotTaken(t *testing.T) {
+	db := testdb.Open(t, "appointment")
+	h := newTestHandler(db)
+	expert := testdb.Expert(t, db, "Popular Expert")
+	trader := testdb.User(t, db, "Moving Trader")
+	start := time.Now().Add(48 * time.Hour).Truncate(time.Hour)
+	from := testdb.Slot(t, db, expert, start, 1, 5000)
+	to := testdb.Slot(t, db, expert, start.Add(24*time.Hour), 1, 5000)
+	appointment := confirmed(t, db, from, trader.ID, "APT-move")
+	vars := map[string]string{"id": fmt.Sprint(appointment.ID)}
+
+	w := serve(h.RequestReschedule, trader.ID, vars, map[string]interface{}{"availability_id": to.ID})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("request: status = %d: %s", w.Code, w.Body)
+	}
+	var reschedule models.RescheduleRequest
+	json.NewDecoder(w.Body).Decode(&reschedule)
+
+	// Someone books the proposed slot before the expert answers
+	confirmed(t, db, to, testdb.User(t, db, "Quicker Trader").ID, "APT-other")
+
+	vars["requestId"], vars["action"] = fmt.Sprint(reschedule.ID), "accept"
+	if w := serve(h.RespondToReschedule, expert.UserID, vars, nil); w.Code != http.StatusConflict {
+		t.Fatalf("accepting a taken slot: status = %d", w.Code)
+	}
+
+	db.First(appointment, appointment.ID)
+	db.First(&reschedule, reschedule.ID)
+	if appointment.AvailabilityID != from.ID || reschedule.Status != ReschedulePending {
+		t.Errorf("appointment moved to slot %d, request %s; want it left in slot %d and pending", appointment.AvailabilityID, reschedule.Status, from.ID)
+	}
+}
@@ -1,11 +1,11 @@
 package appointment
 
 import (
-	"bytes"
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,21 +16,45 @@ import (
 	"time"
 
 	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/availability"
+	"github.com/KAsare1/Kodefx-server/service/calendar"
+	"github.com/KAsare1/Kodefx-server/service/earnings"
+	"github.com/KAsare1/Kodefx-server/service/invoices"
+	"github.com/KAsare1/Kodefx-server/service/meetings"
+	"github.com/KAsare1/Kodefx-server/service/packages"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/KAsare1/Kodefx-server/service/promotions"
+	"github.com/KAsare1/Kodefx-server/service/signals"
+	"github.com/KAsare1/Kodefx-server/service/subscription"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type AppointmentHandler struct {
-    db *gorm.DB
+    db       *gorm.DB
+    provider payment.Provider
+    notifier signals.NotificationSender
+    meetings meetings.Provider
 }
 
+// NewAppointmentHandler creates the handler and starts releasing abandoned
+// slot holds, sending appointment reminders and closing finished appointments
 func NewAppointmentHandler(db *gorm.DB) *AppointmentHandler {
-    return &AppointmentHandler{db: db}
+    h := &AppointmentHandler{db: db, provider: payment.NewProvider(), notifier: signals.NewNotificationSender(db), meetings: meetings.NewProvider()}
+    go h.runHoldSweeper()
+    go h.runReminders()
+    go h.runCloser()
+
+    return h
 }
 
 
 func (h *AppointmentHandler) RegisterRoutes(router *mux.Router) {
     router.HandleFunc("/appointments/book", h.BookAppointment).Methods("POST")
+    router.HandleFunc("/appointments/book-with-credit", utils.AuthMiddleware(h.BookWithCredit)).Methods("POST")
     router.HandleFunc("/appointments", h.GetAllAppointments).Methods("GET")
     router.HandleFunc("/appointments/{id}", h.GetAppointment).Methods("GET")
     // router.HandleFunc("/appointments/{id}/cancel", h.CancelAppointment).Methods("PATCH")
@@ -38,8 +62,24 @@ func (h *AppointmentHandler) RegisterRoutes(router *mux.Router) {
     router.HandleFunc("/appointments/expert/{expertId}", h.GetExpertAppointments).Methods("GET")
     router.HandleFunc("/appointments/{id}/payment", h.UpdatePaymentStatus).Methods("PATCH")
 
-    router.HandleFunc("/appointments/initialize-payment", h.InitializeAppointmentPayment).Methods("POST")
+    router.HandleFunc("/appointments/initialize-payment", utils.AuthMiddleware(h.InitializeAppointmentPayment)).Methods("POST")
     router.HandleFunc("/appointments/webhook", h.HandlePaystackWebhook).Methods("POST")
+
+    router.HandleFunc("/appointments/{id}/reschedule-requests", utils.AuthMiddleware(h.RequestReschedule)).Methods("POST")
+    router.HandleFunc("/appointments/{id}/reschedule-requests", utils.AuthMiddleware(h.GetRescheduleRequests)).Methods("GET")
+    router.HandleFunc("/appointments/{id}/reschedule-requests/{requestId}/{action:accept|decline|withdraw}", utils.AuthMiddleware(h.RespondToReschedule)).Methods("POST")
+
+    router.HandleFunc("/appointments/{id}/meeting", utils.AuthMiddleware(h.GetMeeting)).Methods("GET")
+    router.HandleFunc("/appointments/{id}/meeting/join", utils.AuthMiddleware(h.JoinMeeting)).Methods("POST")
+    router.HandleFunc("/appointments/{id}/meeting/leave", utils.AuthMiddleware(h.LeaveMeeting)).Methods("POST")
+    router.HandleFunc("/appointments/{id}/attendance", utils.AuthMiddleware(h.GetAttendance)).Methods("GET")
+
+    router.HandleFunc("/appointments/{id}/{outcome:complete|no-show}", utils.AuthMiddleware(h.CloseAppointment)).Methods("POST")
+    router.HandleFunc("/appointments/trader/{traderId}/stats", utils.AuthMiddleware(h.GetTraderStats)).Methods("GET")
+    router.HandleFunc("/appointments/{id}/notes", utils.AuthMiddleware(h.CreateNote)).Methods("POST")
+    router.HandleFunc("/appointments/{id}/notes", utils.AuthMiddleware(h.GetNotes)).Methods("GET")
+    router.HandleFunc("/appointments/{id}/notes/{noteId}", utils.AuthMiddleware(h.UpdateNote)).Methods("PUT")
+    router.HandleFunc("/appointments/{id}/notes/{noteId}", utils.AuthMiddleware(h.DeleteNote)).Methods("DELETE")
     
 }
 
@@ -51,30 +91,35 @@ func (h *AppointmentHandler) BookAppointment(w http.ResponseWriter, r *http.Requ
         TraderID       uint    `json:"trader_id"`
         AvailabilityID uint    `json:"availability_id"`
         PaymentID      string  `json:"payment_id"`
+        Seats          int     `json:"seats"`
     }
 
     if err := json.NewDecoder(r.Body).Decode(&bookingRequest); err != nil {
         http.Error(w, "Invalid request body", http.StatusBadRequest)
         return
     }
+    if bookingRequest.Seats == 0 {
+        bookingRequest.Seats = 1
+    }
 
     tx := h.db.Begin()
 
+    // A seat held for the trader from the waitlist is theirs to book, but only
+    // when the trader is the one signed in
+    if userID, err := utils.UserIDFromRequest(r); err == nil && userID == bookingRequest.TraderID {
+        if err := availability.ClaimWaitlistOffer(tx, userID, bookingRequest.AvailabilityID); err != nil {
+            tx.Rollback()
+            http.Error(w, "Error checking availability", http.StatusInternalServerError)
+            return
+        }
+    }
 
-    var availability models.Availability
-    if err := tx.First(&availability, bookingRequest.AvailabilityID).Error; err != nil {
-        tx.Rollback()
-        http.Error(w, "Time slot not found", http.StatusNotFound)
+    // Lock the slot so concurrent bookings cannot take the same seats
+    availability, ok := reserveSeats(w, tx, bookingRequest.AvailabilityID, bookingRequest.Seats)
+    if !ok {
         return
     }
-
-
-    var existingAppointment models.Appointment
-    if err := tx.Where("availability_id = ? AND status != ?", 
-        bookingRequest.AvailabilityID, "Cancelled").
-        First(&existingAppointment).Error; err == nil {
-        tx.Rollback()
-        http.Error(w, "Time slot already booked", http.StatusConflict)
+    if !checkBookingLimits(w, tx, availability) {
         return
     }
 
@@ -87,7 +132,9 @@ func (h *AppointmentHandler) BookAppointment(w http.ResponseWriter, r *http.Requ
         EndTime:         availability.EndTime,
         Status:          "Confirmed",
         PaymentStatus:   "paid",
-        Amount:          availability.Price,
+        Seats:           bookingRequest.Seats,
+        Amount:          availability.Price * int64(bookingRequest.Seats),
+        Currency:        availability.Currency,
         PaymentID:       bookingRequest.PaymentID,
         EventName:       availability.EventName,
         Category:        availability.Category,
@@ -99,6 +146,18 @@ func (h *AppointmentHandler) BookAppointment(w http.ResponseWriter, r *http.Requ
         return
     }
 
+    if err := h.assignMeetingRoom(tx, &appointment); err != nil {
+        tx.Rollback()
+        http.Error(w, "Error creating meeting room", http.StatusInternalServerError)
+        return
+    }
+
+    if err := calendar.QueueInvites(tx, &appointment, calendar.InviteConfirmed); err != nil {
+        tx.Rollback()
+        http.Error(w, "Error creating appointment", http.StatusInternalServerError)
+        return
+    }
+
     if err := tx.Commit().Error; err != nil {
         http.Error(w, "Error completing booking", http.StatusInternalServerError)
         return
@@ -159,7 +218,9 @@ func (h *AppointmentHandler) GetAppointment(w http.ResponseWriter, r *http.Reque
     }
 
     var appointment models.Appointment
-    if err := h.db.Preload("Trader").Preload("Expert").First(&appointment, appointmentID).Error; err != nil {
+    if err := h.db.Preload("Trader").Preload("Expert").Preload("Changes", func(db *gorm.DB) *gorm.DB {
+        return db.Order("created_at")
+    }).First(&appointment, appointmentID).Error; err != nil {
         http.Error(w, "Appointment not found", http.StatusNotFound)
         return
     }
@@ -349,44 +410,131 @@ type PaystackWebhookPayload struct {
     Data  struct {
         Reference  string `json:"reference"`
         Status    string `json:"status"`
-        Amount    float64 `json:"amount"`
+        Amount    int64  `json:"amount"`
+        Currency  string `json:"currency"`
     } `json:"data"`
 }
 
+// reserveSeats locks the slot within tx and checks that the requested seats
+// are free, writing the error response and rolling back if not
+func reserveSeats(w http.ResponseWriter, tx *gorm.DB, availabilityID uint, seats int) (*models.Availability, bool) {
+    if seats < 1 {
+        tx.Rollback()
+        http.Error(w, "Seats must be at least 1", http.StatusBadRequest)
+        return nil, false
+    }
+
+    // Lock the slot, then free any seats whose checkout hold has run out
+    if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.Availability{}, availabilityID).Error; err != nil {
+        tx.Rollback()
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            http.Error(w, "Time slot not found", http.StatusNotFound)
+            return nil, false
+        }
+        http.Error(w, "Error checking availability", http.StatusInternalServerError)
+        return nil, false
+    }
+    if _, err := expireSlotHolds(tx, time.Now(), "availability_id = ?", availabilityID); err != nil {
+        tx.Rollback()
+        http.Error(w, "Error checking availability", http.StatusInternalServerError)
+        return nil, false
+    }
+
+    slot, err := availability.ReserveSeats(tx, availabilityID, seats)
+    if err != nil {
+        tx.Rollback()
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            http.Error(w, "Time slot not found", http.StatusNotFound)
+            return nil, false
+        }
+        if errors.Is(err, availability.ErrSlotFull) {
+            if slot.Capacity == 1 {
+                http.Error(w, "Time slot already booked", http.StatusConflict)
+            } else {
+                http.Error(w, fmt.Sprintf("Only %d of %d seats left in this session", slot.Capacity-slot.SeatsTaken, slot.Capacity), http.StatusConflict)
+            }
+            return nil, false
+        }
+        http.Error(w, "Error checking availability", http.StatusInternalServerError)
+        return nil, false
+    }
+    return slot, true
+}
+
+// checkBookingLimits applies the expert's booking settings to a new booking
+// of slot, writing the error response and rolling back if it is not allowed
+func checkBookingLimits(w http.ResponseWriter, tx *gorm.DB, slot *models.Availability) bool {
+    if err := availability.CheckBookingLimits(tx, slot, time.Now()); err != nil {
+        tx.Rollback()
+        if availability.IsBookingLimitError(err) {
+            http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+            return false
+        }
+        http.Error(w, "Error checking availability", http.StatusInternalServerError)
+        return false
+    }
+    return true
+}
+
 func (h *AppointmentHandler) InitializeAppointmentPayment(w http.ResponseWriter, r *http.Request) {
+    // The booking, coupon and wallet are always the signed-in trader's own
+    traderID, err := utils.GetUserIDFromContext(r.Context())
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
     var initRequest struct {
-        TraderID       uint    `json:"trader_id"`
         AvailabilityID uint    `json:"availability_id"`
+        CouponCode     string  `json:"coupon_code"`
+        UseWallet      bool    `json:"use_wallet"`
+        Seats          int     `json:"seats"`
+        payment.ChannelRequest
     }
 
     if err := json.NewDecoder(r.Body).Decode(&initRequest); err != nil {
         http.Error(w, "Invalid request body", http.StatusBadRequest)
         return
     }
+    if initRequest.Seats == 0 {
+        initRequest.Seats = 1
+    }
 
     // Start transaction
     tx := h.db.Begin()
 
-    // Check availability
-    var availability models.Availability
-    if err := tx.First(&availability, initRequest.AvailabilityID).Error; err != nil {
+    // A seat held for the trader from the waitlist is theirs to book
+    if err := availability.ClaimWaitlistOffer(tx, traderID, initRequest.AvailabilityID); err != nil {
+        tx.Rollback()
+        http.Error(w, "Error checking availability", http.StatusInternalServerError)
+        return
+    }
+
+    // Lock the slot so concurrent bookings cannot take the same seats
+    availability, ok := reserveSeats(w, tx, initRequest.AvailabilityID, initRequest.Seats)
+    if !ok {
+        return
+    }
+    if !checkBookingLimits(w, tx, availability) {
+        return
+    }
+
+    if err := initRequest.ChannelRequest.Validate(availability.Currency); err != nil {
         tx.Rollback()
-        http.Error(w, "Time slot not found", http.StatusNotFound)
+        http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
 
-    // Check for existing appointments
-    var existingAppointment models.Appointment
-    if err := tx.Where("availability_id = ? AND status != ?", initRequest.AvailabilityID, "Cancelled").
-        First(&existingAppointment).Error; err == nil {
+    var trader models.User
+    if err := tx.First(&trader, traderID).Error; err != nil {
         tx.Rollback()
-        http.Error(w, "Time slot already booked", http.StatusConflict)
+        http.Error(w, "Trader not found", http.StatusNotFound)
         return
     }
 
     // Create pending appointment
     appointment := models.Appointment{
-        TraderID:        initRequest.TraderID,
+        TraderID:        traderID,
         ExpertID:        availability.ExpertID,
         AvailabilityID:  initRequest.AvailabilityID,
         AppointmentDate: availability.Date,
@@ -394,7 +542,9 @@ func (h *AppointmentHandler) InitializeAppointmentPayment(w http.ResponseWriter,
         EndTime:         availability.EndTime,
         Status:          "Pending",
         PaymentStatus:   "pending",
-        Amount:          availability.Price,
+        Seats:           initRequest.Seats,
+        Amount:          availability.Price * int64(initRequest.Seats),
+        Currency:        availability.Currency,
         EventName:       availability.EventName,
         Category:        availability.Category,
     }
@@ -405,64 +555,86 @@ func (h *AppointmentHandler) InitializeAppointmentPayment(w http.ResponseWriter,
         return
     }
 
-    // Initialize Paystack payment
-    paystackURL := "https://api.paystack.co/transaction/initialize"
-    var trader models.User
-    if err := tx.First(&trader, initRequest.TraderID).Error; err != nil {
-        tx.Rollback()
-        http.Error(w, "Trader not found", http.StatusNotFound)
-        return
-    }
-
     reference := fmt.Sprintf("APT-%d-%d", appointment.ID, time.Now().Unix())
+    appointment.PaymentID = reference
 
-    paystackReq := map[string]interface{}{
-        "email": trader.Email,
-        "amount": int64(availability.Price * 100), // Convert price to smallest unit
-        "reference": reference,
-        "metadata": map[string]interface{}{
-            "appointment_id": appointment.ID,
-            "trader_id": initRequest.TraderID,
-            "expert_id": availability.ExpertID,
-        },
+    // Apply the coupon, if any; the appointment amount is what the trader actually pays
+    var discount *promotions.Discount
+    if initRequest.CouponCode != "" {
+        var err error
+        discount, err = promotions.ReserveCoupon(tx, initRequest.CouponCode, promotions.Purchase{
+            UserID:   traderID,
+            Product:  promotions.ProductAppointment,
+            ExpertID: availability.ExpertID,
+            Amount:   appointment.Amount,
+            Currency: availability.Currency,
+        }, reference, time.Now())
+        if err != nil {
+            tx.Rollback()
+            if promotions.IsCouponError(err) {
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+            }
+            http.Error(w, "Error applying coupon", http.StatusInternalServerError)
+            return
+        }
+        appointment.Amount = discount.FinalAmount
     }
-    log.Printf("Payload to Paystack: %+v\n", paystackReq)
 
-    payloadBytes, _ := json.Marshal(paystackReq)
-    req, _ := http.NewRequest("POST", paystackURL, bytes.NewBuffer(payloadBytes))
-    req.Header.Set("Authorization", "Bearer "+os.Getenv("PAYSTACK_SECRET_KEY"))
-    req.Header.Set("Content-Type", "application/json")
+    // Cover what the wallet can; the rest is charged to the trader's card
+    if initRequest.UseWallet && appointment.Amount > 0 {
+        held, err := wallet.Hold(tx, traderID, appointment.Amount, appointment.Currency, reference,
+            fmt.Sprintf("Appointment %d: %s", appointment.ID, appointment.EventName))
+        if err != nil {
+            tx.Rollback()
+            http.Error(w, "Error applying wallet balance", http.StatusInternalServerError)
+            return
+        }
+        appointment.WalletAmount = held
+    }
+    amountDue := appointment.Amount - appointment.WalletAmount
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
+    // Update appointment with payment reference
+    if err := tx.Save(&appointment).Error; err != nil {
         tx.Rollback()
-        http.Error(w, "Error initializing payment", http.StatusInternalServerError)
+        http.Error(w, "Error updating appointment", http.StatusInternalServerError)
         return
     }
-    defer resp.Body.Close()
-
-    var paystackResp struct {
-        Status  bool `json:"status"`
-        Data    struct {
-            AuthorizationURL string `json:"authorization_url"`
-            AccessCode      string `json:"access_code"`
-            Reference      string `json:"reference"`
-        } `json:"data"`
-    }
 
-    if err := json.NewDecoder(resp.Body).Decode(&paystackResp); err != nil {
+    // Keep the seats for the trader while they pay
+    hold, err := placeSlotHold(tx, &appointment, time.Now())
+    if err != nil {
         tx.Rollback()
-        http.Error(w, "Error reading payment response", http.StatusInternalServerError)
+        http.Error(w, "Error reserving time slot", http.StatusInternalServerError)
         return
     }
 
-    // Update appointment with payment reference
-    appointment.PaymentID = reference
-    if err := tx.Save(&appointment).Error; err != nil {
-        tx.Rollback()
-        http.Error(w, "Error updating appointment", http.StatusInternalServerError)
-        return
+    response := map[string]interface{}{
+        "reference": reference,
+        "appointment_id": appointment.ID,
+        "amount_minor": appointment.Amount,
+        "amount": utils.FromMinor(appointment.Amount, appointment.Currency), // Deprecated: use amount_minor
+        "wallet_minor": appointment.WalletAmount,
+        "amount_due_minor": amountDue,
+        "currency": appointment.Currency,
+        "hold_expires_at": hold.ExpiresAt,
+    }
+    if discount != nil {
+        response["discount"] = discount
+    }
+
+    if amountDue == 0 {
+        // Fully covered by the coupon and wallet, so there is nothing to collect
+        method := "Coupon"
+        if appointment.WalletAmount > 0 {
+            method = "Wallet"
+        }
+        if _, err := h.confirmAppointmentPayment(tx, reference, 0, method); err != nil {
+            tx.Rollback()
+            http.Error(w, "Error confirming appointment", http.StatusInternalServerError)
+            return
+        }
+        response["status"] = "Confirmed"
     }
 
     if err := tx.Commit().Error; err != nil {
@@ -470,12 +642,127 @@ func (h *AppointmentHandler) InitializeAppointmentPayment(w http.ResponseWriter,
         return
     }
 
+    if amountDue > 0 {
+        // Start a card checkout or charge the trader's mobile money wallet. The
+        // checkout is saved first so a charge that goes through always finds it.
+        collection, err := payment.Collect(h.provider, initRequest.ChannelRequest, payment.InitializeRequest{
+            Email:     trader.Email,
+            Amount:    amountDue,
+            Currency:  appointment.Currency,
+            Reference: reference,
+            Metadata: map[string]interface{}{
+                "appointment_id": appointment.ID,
+                "trader_id": traderID,
+                "expert_id": availability.ExpertID,
+            },
+        })
+        if err != nil {
+            if errors.Is(err, payment.ErrChargeFailed) {
+                h.releaseDeclined(&appointment)
+                http.Error(w, err.Error(), http.StatusPaymentRequired)
+                return
+            }
+            // The charge may still go through, so the checkout is left to
+            // expire with its hold like any abandoned one
+            log.Printf("Error initializing appointment payment: %v", err)
+            http.Error(w, "Error initializing payment", http.StatusInternalServerError)
+            return
+        }
+        for key, value := range collection {
+            response[key] = value
+        }
+    }
+
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "authorization_url": paystackResp.Data.AuthorizationURL,
-        "reference": reference,
-        "appointment_id": appointment.ID,
+    json.NewEncoder(w).Encode(response)
+}
+
+// confirmAppointmentPayment confirms the appointment paid for by reference,
+// creates its meeting room and records the transaction along with any coupon
+// and wallet credit used.
+// Appointments that are already paid are returned unchanged so repeated
+// webhooks are harmless. amount is what was collected by card, in minor units
+// of the appointment's currency.
+func (h *AppointmentHandler) confirmAppointmentPayment(tx *gorm.DB, reference string, amount int64, method string) (*models.Appointment, error) {
+    var appointment models.Appointment
+    if err := tx.Where("payment_id = ?", reference).First(&appointment).Error; err != nil {
+        return nil, err
+    }
+
+    if appointment.PaymentStatus == "paid" || appointment.PaymentStatus == "refunded" {
+        return &appointment, nil
+    }
+
+    // Turn the checkout hold into the booking and take the wallet part, or
+    // refund the card payment if the slot or the wallet credit was lost
+    err := tx.Transaction(func(tx *gorm.DB) error {
+        if err := convertSlotHold(tx, &appointment); err != nil {
+            return err
+        }
+        return wallet.CaptureHold(tx, appointment.TraderID, appointment.WalletAmount, appointment.Currency, reference)
     })
+    if err != nil {
+        if errors.Is(err, ErrSlotLost) || errors.Is(err, wallet.ErrInsufficientFunds) {
+            log.Printf("Refunding appointment payment %s: %v", reference, err)
+            if err := refundLostSlot(tx, &appointment, amount, method); err != nil {
+                return nil, err
+            }
+            return &appointment, nil
+        }
+        return nil, err
+    }
+
+    // Update appointment status
+    appointment.PaymentStatus = "paid"
+    appointment.Status = "Confirmed"
+    if err := tx.Save(&appointment).Error; err != nil {
+        return nil, err
+    }
+    if err := h.assignMeetingRoom(tx, &appointment); err != nil {
+        return nil, err
+    }
+    if err := calendar.QueueInvites(tx, &appointment, calendar.InviteConfirmed); err != nil {
+        return nil, err
+    }
+
+    total := amount + appointment.WalletAmount
+    redemption, err := promotions.SettlePayment(tx, appointment.TraderID, reference, total, time.Now())
+    if err != nil {
+        return nil, err
+    }
+
+    // Create a new transaction record
+    transaction := models.Transaction{
+        UserID:       appointment.TraderID,
+        Amount:       total,
+        WalletAmount: appointment.WalletAmount,
+        Currency:     appointment.Currency,
+        Method:       method,
+        Purpose:      "Appointment",
+        Reference:    reference,
+    }
+    if redemption != nil {
+        transaction.CouponCode = redemption.Coupon.Code
+        transaction.DiscountAmount = redemption.DiscountAmount
+    }
+
+    if err := tx.Create(&transaction).Error; err != nil {
+        return nil, err
+    }
+
+    // Issue the trader's receipt
+    if _, err := invoices.IssueInvoice(tx, &transaction, invoices.KindAppointment,
+        fmt.Sprintf("Appointment: %s on %s", appointment.EventName, appointment.AppointmentDate.Format("2 January 2006"))); err != nil {
+        return nil, err
+    }
+
+    // Split the payment between the platform and the expert
+    if err := earnings.RecordPayment(tx, reference, total, appointment.Currency, &appointment.ExpertID,
+        fmt.Sprintf("Appointment %d: %s", appointment.ID, appointment.EventName)); err != nil {
+        return nil, err
+    }
+
+    return &appointment, nil
 }
 
 
@@ -504,7 +791,8 @@ func (h *AppointmentHandler) HandlePaystackWebhook(w http.ResponseWriter, r *htt
         Data  struct {
             Reference string  `json:"reference"`
             Status    string  `json:"status"`
-            Amount    float64 `json:"amount"`
+            Amount    int64   `json:"amount"` // Minor units
+            Currency  string  `json:"currency"`
             Metadata  struct {
                 PaymentType    string `json:"payment_type"`
                 AppointmentID  uint   `json:"appointment_id,omitempty"`
@@ -513,6 +801,9 @@ func (h *AppointmentHandler) HandlePaystackWebhook(w http.ResponseWriter, r *htt
                 ExpertID       uint   `json:"expert_id,omitempty"`
                 SignalPlan     string `json:"signal_plan,omitempty"`
             } `json:"metadata"`
+            Channel       string `json:"channel"` // card, mobile_money, bank, ...
+            Authorization subscription.Authorization `json:"authorization"`
+            Reason        string `json:"reason,omitempty"`
         } `json:"data"`
     }
 
@@ -521,12 +812,29 @@ func (h *AppointmentHandler) HandlePaystackWebhook(w http.ResponseWriter, r *htt
         return
     }
 
+    // Payout transfers report their outcome through the same webhook
+    if strings.HasPrefix(webhookPayload.Event, "transfer.") {
+        err := h.db.Transaction(func(tx *gorm.DB) error {
+            return earnings.HandleTransferEvent(tx, webhookPayload.Event, webhookPayload.Data.Reference, webhookPayload.Data.Reason)
+        })
+        if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+            log.Printf("Error processing %s for %s: %v", webhookPayload.Event, webhookPayload.Data.Reference, err)
+            http.Error(w, "Error updating payout", http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
     // Only process successful charge events
     if webhookPayload.Event != "charge.success" {
         w.WriteHeader(http.StatusOK)
         return
     }
 
+    // Record how the customer paid, e.g. card or mobile_money_mtn
+    method := payment.MethodFor(webhookPayload.Data.Channel, webhookPayload.Data.Authorization.Bank)
+
     tx := h.db.Begin()
 
     // Determine payment type from the reference or metadata
@@ -535,106 +843,79 @@ func (h *AppointmentHandler) HandlePaystackWebhook(w http.ResponseWriter, r *htt
         paymentType = "appointment"
     } else if strings.HasPrefix(webhookPayload.Data.Reference, "SIG-") {
         paymentType = "signal_subscription"
+    } else if strings.HasPrefix(webhookPayload.Data.Reference, "PKG-") {
+        paymentType = "session_package"
     } else if webhookPayload.Data.Metadata.PaymentType != "" {
         paymentType = webhookPayload.Data.Metadata.PaymentType
     }
 
     // Process different payment types
+    var freedSlotID uint
     switch paymentType {
     case "appointment":
-        // Find and update appointment
-        var appointment models.Appointment
-        if err := tx.Where("payment_id = ?", webhookPayload.Data.Reference).First(&appointment).Error; err != nil {
-            tx.Rollback()
-            http.Error(w, "Appointment not found", http.StatusNotFound)
-            return
-        }
-
-        // Update appointment status
-        appointment.PaymentStatus = "paid"
-        appointment.Status = "Confirmed"
-        if err := tx.Save(&appointment).Error; err != nil {
+        // Confirm the appointment and record the transaction
+        appointment, err := h.confirmAppointmentPayment(tx, webhookPayload.Data.Reference,
+            webhookPayload.Data.Amount, method)
+        if err != nil {
             tx.Rollback()
+            if errors.Is(err, gorm.ErrRecordNotFound) {
+                http.Error(w, "Appointment not found", http.StatusNotFound)
+                return
+            }
             http.Error(w, "Error updating appointment", http.StatusInternalServerError)
             return
         }
-
-        // Create a new transaction record
-        transaction := models.Transaction{
-            UserID:  appointment.TraderID,
-            Amount:  webhookPayload.Data.Amount / 100, 
-            Method:  "Paystack", 
-            Purpose: "Appointment", 
-        }
-
-        if err := tx.Create(&transaction).Error; err != nil {
-            tx.Rollback()
-            http.Error(w, "Error creating transaction", http.StatusInternalServerError)
-            return
+        if appointment.PaymentStatus == "refunded" {
+            // A refunded booking gives up any seats it still held
+            freedSlotID = appointment.AvailabilityID
         }
 
     case "signal_subscription":
-        // Get user ID from metadata or parse from reference if needed
-        userID := webhookPayload.Data.Metadata.UserID
-        
-        // If userID is 0, try to extract from reference (SIG-123-timestamp)
-        if userID == 0 && strings.HasPrefix(webhookPayload.Data.Reference, "SIG-") {
-            parts := strings.Split(webhookPayload.Data.Reference, "-")
-            if len(parts) > 1 {
-                extractedID, err := strconv.ParseUint(parts[1], 10, 32)
-                if err == nil {
-                    userID = uint(extractedID)
-                }
-            }
-        }
-        
-        // Find and update subscription
-        var subscription models.SignalSubscription
-        if err := tx.Where("payment_id = ?", webhookPayload.Data.Reference).First(&subscription).Error; err != nil {
-            tx.Rollback()
-            http.Error(w, "Subscription not found", http.StatusNotFound)
-            return
-        }
-
-        // Calculate subscription duration based on plan
-        now := time.Now()
-        var endDate time.Time
-        
-        switch subscription.Plan {
-        case "monthly":
-            endDate = now.AddDate(0, 1, 0)
-        case "quarterly":
-            endDate = now.AddDate(0, 3, 0)
-        case "annual":
-            endDate = now.AddDate(1, 0, 0)
-        default:
-            endDate = now.AddDate(0, 1, 0) // Default to monthly
-        }
-
-        // Update subscription status
-        subscription.Status = "active"
-        subscription.StartDate = now
-        subscription.EndDate = endDate
-        
-        if err := tx.Save(&subscription).Error; err != nil {
+        // Activate the subscription and record the transaction. Renewals charged by the
+        // subscription worker are already active by the time their webhook arrives.
+        _, activated, err := subscription.CompleteSubscriptionPayment(tx, webhookPayload.Data.Reference,
+            webhookPayload.Data.Amount, utils.NormalizeCurrency(webhookPayload.Data.Currency), method,
+            webhookPayload.Data.Authorization, time.Now())
+        if err != nil {
             tx.Rollback()
+            if errors.Is(err, gorm.ErrRecordNotFound) {
+                http.Error(w, "Subscription not found", http.StatusNotFound)
+                return
+            }
+            if errors.Is(err, subscription.ErrUnknownPlan) || errors.Is(err, subscription.ErrAmountMismatch) ||
+                errors.Is(err, subscription.ErrCurrencyMismatch) {
+                log.Printf("Rejected subscription payment %s: %v", webhookPayload.Data.Reference, err)
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+            }
             http.Error(w, "Error updating subscription", http.StatusInternalServerError)
             return
         }
-
-        // Create a new transaction record
-        transaction := models.Transaction{
-            UserID:  userID,
-            Amount:  webhookPayload.Data.Amount / 100, // Convert from smallest unit
-            Method:  "Paystack", 
-            Purpose: "Signal Subscription - " + subscription.Plan, 
+        if !activated {
+            log.Printf("Subscription for reference %s already processed", webhookPayload.Data.Reference)
         }
 
-        if err := tx.Create(&transaction).Error; err != nil {
+    case "session_package":
+        // Add the package's credits and record the transaction
+        _, activated, err := packages.CompletePackagePayment(tx, webhookPayload.Data.Reference,
+            webhookPayload.Data.Amount, utils.NormalizeCurrency(webhookPayload.Data.Currency), method, time.Now())
+        if err != nil {
             tx.Rollback()
-            http.Error(w, "Error creating transaction", http.StatusInternalServerError)
+            if errors.Is(err, gorm.ErrRecordNotFound) {
+                http.Error(w, "Package purchase not found", http.StatusNotFound)
+                return
+            }
+            if errors.Is(err, packages.ErrAmountMismatch) || errors.Is(err, packages.ErrCurrencyMismatch) {
+                log.Printf("Rejected package payment %s: %v", webhookPayload.Data.Reference, err)
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+            }
+            http.Error(w, "Error updating package purchase", http.StatusInternalServerError)
             return
         }
+        if !activated {
+            log.Printf("Package purchase for reference %s already processed", webhookPayload.Data.Reference)
+        }
         
     default:
         // Unknown payment type
@@ -649,5 +930,9 @@ func (h *AppointmentHandler) HandlePaystackWebhook(w http.ResponseWriter, r *htt
         return
     }
 
+    if freedSlotID != 0 {
+        go availability.OfferWaitlist(h.db, h.notifier, freedSlotID)
+    }
+
     w.WriteHeader(http.StatusOK)
 }
\ No newline at end of file
@@ -0,0 +1,217 @@
+package availability
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Upper bounds on the booking settings an expert can choose
+const (
+	maxBufferMinutes = 4 * 60
+	maxNoticeMinutes = 30 * 24 * 60
+	maxDailyBookings = 50
+	maxHorizonDays   = 365
+)
+
+// Booking limit failures, shown to the trader as they are
+var (
+	ErrBookingTooSoon    = errors.New("this session starts too soon to book; the expert needs more notice")
+	ErrBookingTooFar     = errors.New("this session is further ahead than the expert takes bookings")
+	ErrExpertDayFull     = errors.New("the expert has no more bookings left on this day")
+	ErrBookingNoBuffer   = errors.New("the expert needs a break between this and another booked session")
+	ErrBookingSlotPassed = errors.New("this session has already started")
+)
+
+// IsBookingLimitError reports whether err is a booking limit failure that
+// should be shown to the trader rather than treated as a server error
+func IsBookingLimitError(err error) bool {
+	for _, target := range []error{ErrBookingTooSoon, ErrBookingTooFar, ErrExpertDayFull, ErrBookingNoBuffer, ErrBookingSlotPassed} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// BookingSettings are an expert's limits on when they can be booked. Zero
+// means no limit.
+type BookingSettings struct {
+	BufferBeforeMinutes int `json:"buffer_before_minutes"`
+	BufferAfterMinutes  int `json:"buffer_after_minutes"`
+	MinNoticeMinutes    int `json:"min_notice_minutes"`
+	MaxBookingsPerDay   int `json:"max_bookings_per_day"`
+	BookingHorizonDays  int `json:"booking_horizon_days"`
+}
+
+// settingsOf reads the booking settings stored on the expert
+func settingsOf(expert *models.Expert) BookingSettings {
+	return BookingSettings{
+		BufferBeforeMinutes: expert.BufferBeforeMinutes,
+		BufferAfterMinutes:  expert.BufferAfterMinutes,
+		MinNoticeMinutes:    expert.MinNoticeMinutes,
+		MaxBookingsPerDay:   expert.MaxBookingsPerDay,
+		BookingHorizonDays:  expert.BookingHorizonDays,
+	}
+}
+
+// gap is the least free time between two of the expert's sessions: the
+// buffer after the first plus the buffer before the second
+func (s BookingSettings) gap() time.Duration {
+	return time.Duration(s.BufferBeforeMinutes+s.BufferAfterMinutes) * time.Minute
+}
+
+// notice is how long before a session bookings close
+func (s BookingSettings) notice() time.Duration {
+	return time.Duration(s.MinNoticeMinutes) * time.Minute
+}
+
+// expertGap returns the expert's gap between sessions, or zero if the expert
+// can't be loaded
+func expertGap(db *gorm.DB, expertID uint) time.Duration {
+	var expert models.Expert
+	if err := db.Select("id", "buffer_before_minutes", "buffer_after_minutes").First(&expert, expertID).Error; err != nil {
+		return 0
+	}
+	return settingsOf(&expert).gap()
+}
+
+// CheckBookingLimits checks a new booking of slot against its expert's
+// booking settings: minimum notice, booking horizon, buffers around other
+// booked sessions and the daily limit. Booked sessions are slots holding
+// seats; joining a session that already has bookings doesn't count against
+// the daily limit. slot.SeatsTaken must be set, as ReserveSeats does.
+func CheckBookingLimits(tx *gorm.DB, slot *models.Availability, now time.Time) error {
+	return checkLimits(tx, slot, 0, now)
+}
+
+// CheckMoveLimits is CheckBookingLimits for moving the booked appointment
+// appointmentID to slot, so the seats it is leaving don't count against it
+func CheckMoveLimits(tx *gorm.DB, slot *models.Availability, appointmentID uint, now time.Time) error {
+	return checkLimits(tx, slot, appointmentID, now)
+}
+
+// checkLimits applies the booking settings to slot, ignoring the seats held
+// by the appointment excludeID, if any. The expert row is locked until tx
+// ends so concurrent bookings into different slots of the expert are counted
+// one at a time; callers lock the slot first.
+func checkLimits(tx *gorm.DB, slot *models.Availability, excludeID uint, now time.Time) error {
+	var expert models.Expert
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&expert, slot.ExpertID).Error; err != nil {
+		return err
+	}
+	settings := settingsOf(&expert)
+
+	if !slot.StartTime.After(now) {
+		return ErrBookingSlotPassed
+	}
+	if slot.StartTime.Before(now.Add(settings.notice())) {
+		return ErrBookingTooSoon
+	}
+	if settings.BookingHorizonDays > 0 && slot.StartTime.After(now.AddDate(0, 0, settings.BookingHorizonDays)) {
+		return ErrBookingTooFar
+	}
+
+	if gap := settings.gap(); gap > 0 {
+		var nearby int64
+		if err := seatsQuery(tx).
+			Where("expert_id = ? AND availability_id <> ? AND id <> ? AND start_time < ? AND end_time > ?",
+				slot.ExpertID, slot.ID, excludeID, slot.EndTime.Add(gap), slot.StartTime.Add(-gap)).
+			Count(&nearby).Error; err != nil {
+			return err
+		}
+		if nearby > 0 {
+			return ErrBookingNoBuffer
+		}
+	}
+
+	if settings.MaxBookingsPerDay > 0 && slot.SeatsTaken == 0 {
+		loc := utils.LoadZone(expert.TimeZone)
+		from, to := dayBounds(localDate(slot.StartTime, loc), loc)
+		var sessions int64
+		if err := seatsQuery(tx).
+			Where("expert_id = ? AND availability_id <> ? AND id <> ? AND start_time >= ? AND start_time < ?",
+				slot.ExpertID, slot.ID, excludeID, from, to).
+			Distinct("availability_id").
+			Count(&sessions).Error; err != nil {
+			return err
+		}
+		if int(sessions) >= settings.MaxBookingsPerDay {
+			return ErrExpertDayFull
+		}
+	}
+	return nil
+}
+
+// GetBookingSettings returns the expert's booking limits
+func (h *AvailabilityHandler) GetBookingSettings(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, settingsOf(expert))
+}
+
+// UpdateBookingSettings changes the expert's booking limits. Fields left out
+// are unchanged. New buffers apply to slots created or moved from now on and
+// to every new booking.
+func (h *AvailabilityHandler) UpdateBookingSettings(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		BufferBeforeMinutes *int `json:"buffer_before_minutes"`
+		BufferAfterMinutes  *int `json:"buffer_after_minutes"`
+		MinNoticeMinutes    *int `json:"min_notice_minutes"`
+		MaxBookingsPerDay   *int `json:"max_bookings_per_day"`
+		BookingHorizonDays  *int `json:"booking_horizon_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	updates := map[string]interface{}{}
+	for _, field := range []struct {
+		column string
+		value  *int
+		max    int
+		label  string
+	}{
+		{"buffer_before_minutes", req.BufferBeforeMinutes, maxBufferMinutes, "Buffer before sessions"},
+		{"buffer_after_minutes", req.BufferAfterMinutes, maxBufferMinutes, "Buffer after sessions"},
+		{"min_notice_minutes", req.MinNoticeMinutes, maxNoticeMinutes, "Minimum notice"},
+		{"max_bookings_per_day", req.MaxBookingsPerDay, maxDailyBookings, "Maximum bookings per day"},
+		{"booking_horizon_days", req.BookingHorizonDays, maxHorizonDays, "Booking horizon"},
+	} {
+		if field.value == nil {
+			continue
+		}
+		if *field.value < 0 || *field.value > field.max {
+			http.Error(w, fmt.Sprintf("%s must be between 0 and %d", field.label, field.max), http.StatusBadRequest)
+			return
+		}
+		updates[field.column] = *field.value
+	}
+
+	if len(updates) > 0 {
+		if err := h.db.Model(expert).Updates(updates).Error; err != nil {
+			http.Error(w, "Error updating booking settings", http.StatusInternalServerError)
+			return
+		}
+		if err := h.db.First(expert, expert.ID).Error; err != nil {
+			http.Error(w, "Error loading booking settings", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, settingsOf(expert))
+}
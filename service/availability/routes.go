@@ -2,21 +2,30 @@ package availability
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/signals"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type AvailabilityHandler struct {
-    db *gorm.DB
+    db       *gorm.DB
+    notifier signals.NotificationSender
 }
 
+// NewAvailabilityHandler creates the handler and starts extending recurring slots
 func NewAvailabilityHandler(db *gorm.DB) *AvailabilityHandler {
-    return &AvailabilityHandler{db: db}
+    h := &AvailabilityHandler{db: db, notifier: signals.NewNotificationSender(db)}
+    go h.runMaterializer()
+
+    return h
 }
 
 
@@ -27,6 +36,24 @@ func (h *AvailabilityHandler) RegisterRoutes(router *mux.Router) {
     router.HandleFunc("/experts/{expertId}/availability/{id}", h.UpdateAvailability).Methods("PUT")
     router.HandleFunc("/experts/{expertId}/availability/{id}", h.DeleteAvailability).Methods("DELETE")
     router.HandleFunc("/experts/{expertId}/availability/date/{date}", h.GetAvailabilitiesByDate).Methods("GET")
+    router.HandleFunc("/experts/{expertId}/availability/{id}/participants", utils.AuthMiddleware(h.GetParticipants)).Methods("GET")
+    router.HandleFunc("/availability/search", h.SearchAvailability).Methods("GET")
+    router.HandleFunc("/experts/{expertId}/booking-settings", utils.AuthMiddleware(h.GetBookingSettings)).Methods("GET")
+    router.HandleFunc("/experts/{expertId}/booking-settings", utils.AuthMiddleware(h.UpdateBookingSettings)).Methods("PUT")
+
+    // Waitlists for booked-out experts
+    router.HandleFunc("/experts/{expertId}/waitlist", utils.AuthMiddleware(h.JoinWaitlist)).Methods("POST")
+    router.HandleFunc("/experts/{expertId}/waitlist", utils.AuthMiddleware(h.GetExpertWaitlist)).Methods("GET")
+    router.HandleFunc("/waitlist", utils.AuthMiddleware(h.GetMyWaitlist)).Methods("GET")
+    router.HandleFunc("/waitlist/{id}", utils.AuthMiddleware(h.LeaveWaitlist)).Methods("DELETE")
+
+    // Recurring slots
+    router.HandleFunc("/experts/{expertId}/availability-rules", utils.AuthMiddleware(h.CreateRule)).Methods("POST")
+    router.HandleFunc("/experts/{expertId}/availability-rules", utils.AuthMiddleware(h.GetRules)).Methods("GET")
+    router.HandleFunc("/experts/{expertId}/availability-rules/{ruleId}", utils.AuthMiddleware(h.GetRule)).Methods("GET")
+    router.HandleFunc("/experts/{expertId}/availability-rules/{ruleId}", utils.AuthMiddleware(h.UpdateRule)).Methods("PUT")
+    router.HandleFunc("/experts/{expertId}/availability-rules/{ruleId}", utils.AuthMiddleware(h.DeleteRule)).Methods("DELETE")
+    router.HandleFunc("/experts/{expertId}/availability-rules/{ruleId}/occurrences/{date}", utils.AuthMiddleware(h.CancelOccurrence)).Methods("DELETE")
 }
 
 
@@ -52,15 +79,44 @@ func (h *AvailabilityHandler) CreateAvailability(w http.ResponseWriter, r *http.
         return
     }
 
-    // Check for overlapping slots
+    // Prices are in minor units of the slot's currency
+    if availability.Price < 0 {
+        http.Error(w, "Price cannot be negative", http.StatusBadRequest)
+        return
+    }
+    availability.Currency = utils.NormalizeCurrency(availability.Currency)
+    if availability.Currency == "" {
+        availability.Currency = utils.DefaultCurrency()
+    }
+    if !utils.IsSupportedCurrency(availability.Currency) {
+        http.Error(w, "Unsupported currency", http.StatusBadRequest)
+        return
+    }
+    // Older clients still send the deprecated decimal price
+    if availability.Price == 0 && availability.LegacyPrice > 0 {
+        availability.Price = utils.ToMinor(availability.LegacyPrice, availability.Currency)
+    }
+
+    // One-to-one sessions have a single seat
+    if availability.Capacity == 0 {
+        availability.Capacity = 1
+    }
+    if availability.Capacity < 0 {
+        http.Error(w, "Capacity must be at least 1", http.StatusBadRequest)
+        return
+    }
+
+    // Times are instants; the slot's date is where it starts in the expert's zone
+    expertLoc := expertZone(h.db, uint(expertID))
+    normalizeSlot(&availability, expertLoc)
+
+    // Check for overlapping slots, keeping the expert's buffer between sessions
+    gap := expertGap(h.db, uint(expertID))
     var existingAvailability models.Availability
-    overlap := h.db.Where("expert_id = ? AND date = ? AND ((start_time < ? AND end_time > ?) OR (start_time < ? AND end_time > ?))",
+    overlap := h.db.Where("expert_id = ? AND start_time < ? AND end_time > ?",
         expertID,
-        availability.Date,
-        availability.EndTime,
-        availability.StartTime,
-        availability.StartTime,
-        availability.EndTime,
+        availability.EndTime.Add(gap),
+        availability.StartTime.Add(-gap),
     ).First(&existingAvailability)
 
     if overlap.Error != nil && overlap.Error != gorm.ErrRecordNotFound {
@@ -69,7 +125,7 @@ func (h *AvailabilityHandler) CreateAvailability(w http.ResponseWriter, r *http.
     }
 
     if overlap.Error == nil {
-        http.Error(w, "Time slot overlaps with existing availability", http.StatusConflict)
+        http.Error(w, "Time slot overlaps with existing availability or the buffer around it", http.StatusConflict)
         return
     }
 
@@ -82,7 +138,11 @@ func (h *AvailabilityHandler) CreateAvailability(w http.ResponseWriter, r *http.
         return
     }
 
+    // Offer the new seats to traders waiting for this expert
+    go OfferWaitlist(h.db, h.notifier, availability.ID)
+
     // Send success response
+    renderSlot(&availability, expertLoc)
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(availability)
@@ -111,12 +171,25 @@ func (h *AvailabilityHandler) GetAvailabilities(w http.ResponseWriter, r *http.R
 
     query := h.db.Model(&models.Availability{}).Where("expert_id = ?", expertID)
 
-    // Apply filters
+    // Dates are calendar days in the viewer's zone
+    loc := utils.RequestZone(h.db, r)
     if startDate != "" {
-        query = query.Where("date >= ?", startDate)
+        date, err := time.Parse("2006-01-02", startDate)
+        if err != nil {
+            http.Error(w, "Invalid start_date format. Use YYYY-MM-DD", http.StatusBadRequest)
+            return
+        }
+        from, _ := dayBounds(date, loc)
+        query = query.Where("start_time >= ?", from)
     }
     if endDate != "" {
-        query = query.Where("date <= ?", endDate)
+        date, err := time.Parse("2006-01-02", endDate)
+        if err != nil {
+            http.Error(w, "Invalid end_date format. Use YYYY-MM-DD", http.StatusBadRequest)
+            return
+        }
+        _, to := dayBounds(date, loc)
+        query = query.Where("start_time < ?", to)
     }
     if category != "" {
         query = query.Where("category = ?", category)
@@ -128,11 +201,16 @@ func (h *AvailabilityHandler) GetAvailabilities(w http.ResponseWriter, r *http.R
 
     // Get paginated results
     var availabilities []models.Availability
-    result := query.Offset((page - 1) * pageSize).Limit(pageSize).Find(&availabilities)
+    result := query.Order("start_time ASC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&availabilities)
     if result.Error != nil {
         http.Error(w, "Error retrieving availabilities", http.StatusInternalServerError)
         return
     }
+    if err := FillSeatsTaken(h.db, availabilities); err != nil {
+        http.Error(w, "Error retrieving availabilities", http.StatusInternalServerError)
+        return
+    }
+    renderSlots(availabilities, loc)
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]interface{}{
@@ -163,6 +241,11 @@ func (h *AvailabilityHandler) GetAvailability(w http.ResponseWriter, r *http.Req
         http.Error(w, "Availability not found", http.StatusNotFound)
         return
     }
+    if availability.SeatsTaken, err = SeatsTaken(h.db, availability.ID); err != nil {
+        http.Error(w, "Error retrieving availability", http.StatusInternalServerError)
+        return
+    }
+    renderSlot(&availability, utils.RequestZone(h.db, r))
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(availability)
@@ -194,21 +277,25 @@ func (h *AvailabilityHandler) UpdateAvailability(w http.ResponseWriter, r *http.
         return
     }
 
-    // Check for overlapping slots (excluding current slot)
+    if updateData.EndTime.Before(updateData.StartTime) {
+        http.Error(w, "End time must be after start time", http.StatusBadRequest)
+        return
+    }
+    expertLoc := expertZone(h.db, availability.ExpertID)
+    normalizeSlot(&updateData, expertLoc)
+
+    // Check for overlapping slots (excluding current slot), keeping the expert's buffer between sessions
+    gap := expertGap(h.db, availability.ExpertID)
     var existingAvailability models.Availability
-    overlap := h.db.Where("id != ? AND expert_id = ? AND date = ? AND ((start_time <= ? AND end_time >= ?) OR (start_time <= ? AND end_time >= ?))",
+    overlap := h.db.Where("id != ? AND expert_id = ? AND start_time < ? AND end_time > ?",
         availabilityID,
         expertID,
-        updateData.Date,
-        updateData.EndTime,
-        updateData.StartTime,
-        updateData.EndTime,
-        updateData.StartTime,
-		updateData.Price,
+        updateData.EndTime.Add(gap),
+        updateData.StartTime.Add(-gap),
     ).First(&existingAvailability)
 
     if overlap.Error == nil {
-        http.Error(w, "Time slot overlaps with existing availability", http.StatusConflict)
+        http.Error(w, "Time slot overlaps with existing availability or the buffer around it", http.StatusConflict)
         return
     }
 
@@ -220,13 +307,61 @@ func (h *AvailabilityHandler) UpdateAvailability(w http.ResponseWriter, r *http.
     availability.EndTime = updateData.EndTime
     availability.Reminder = updateData.Reminder
     availability.Category = updateData.Category
-	availability.Price = updateData.Price
+    availability.Price = updateData.Price
+    // A slot from a recurrence rule now differs from its series
+    if availability.RuleID != nil {
+        availability.Detached = true
+    }
+    if currency := utils.NormalizeCurrency(updateData.Currency); currency != "" {
+        if !utils.IsSupportedCurrency(currency) {
+            http.Error(w, "Unsupported currency", http.StatusBadRequest)
+            return
+        }
+        availability.Currency = currency
+    }
+    // Older clients still send the deprecated decimal price
+    if updateData.Price == 0 && updateData.LegacyPrice > 0 {
+        availability.Price = utils.ToMinor(updateData.LegacyPrice, availability.Currency)
+    }
 
-    if err := h.db.Save(&availability).Error; err != nil {
+    err = h.db.Transaction(func(tx *gorm.DB) error {
+        // Lock the slot like a booking does so no seats are taken while the
+        // capacity is checked
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+            Select("id").First(&models.Availability{}, availability.ID).Error; err != nil {
+            return err
+        }
+
+        // Capacity can grow, but never below the seats already booked
+        taken, err := SeatsTaken(tx, availability.ID)
+        if err != nil {
+            return err
+        }
+        availability.SeatsTaken = taken
+        if updateData.Capacity != 0 {
+            if updateData.Capacity < taken {
+                return ErrCapacityBelowBooked
+            }
+            availability.Capacity = updateData.Capacity
+        }
+
+        return tx.Save(&availability).Error
+    })
+    if err != nil {
+        if errors.Is(err, ErrCapacityBelowBooked) {
+            http.Error(w, err.Error(), http.StatusConflict)
+            return
+        }
         http.Error(w, "Error updating availability", http.StatusInternalServerError)
         return
     }
 
+    // Seats added to the slot can go to the waitlist
+    if availability.Capacity > availability.SeatsTaken {
+        go OfferWaitlist(h.db, h.notifier, availability.ID)
+    }
+    renderSlot(&availability, expertLoc)
+
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(availability)
 }
@@ -245,14 +380,41 @@ func (h *AvailabilityHandler) DeleteAvailability(w http.ResponseWriter, r *http.
         return
     }
 
-    result := h.db.Where("id = ? AND expert_id = ?", availabilityID, expertID).Delete(&models.Availability{})
-    if result.Error != nil {
-        http.Error(w, "Error deleting availability", http.StatusInternalServerError)
+    var availability models.Availability
+    if err := h.db.Where("id = ? AND expert_id = ?", availabilityID, expertID).First(&availability).Error; err != nil {
+        http.Error(w, "Availability not found", http.StatusNotFound)
         return
     }
 
-    if result.RowsAffected == 0 {
-        http.Error(w, "Availability not found", http.StatusNotFound)
+    err = h.db.Transaction(func(tx *gorm.DB) error {
+        // Slots with bookings must have them cancelled first; the slot is
+        // locked so none are made while it is checked
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+            Select("id").First(&models.Availability{}, availability.ID).Error; err != nil {
+            return err
+        }
+        taken, err := SeatsTaken(tx, availability.ID)
+        if err != nil {
+            return err
+        }
+        if taken > 0 {
+            return ErrSlotBooked
+        }
+
+        // Keep the recurrence rule from generating the slot again
+        if availability.RuleID != nil {
+            if err := addException(tx, *availability.RuleID, availability.Date); err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+                return err
+            }
+        }
+        return tx.Delete(&availability).Error
+    })
+    if err != nil {
+        if errors.Is(err, ErrSlotBooked) {
+            http.Error(w, err.Error(), http.StatusConflict)
+            return
+        }
+        http.Error(w, "Error deleting availability", http.StatusInternalServerError)
         return
     }
 
@@ -277,12 +439,95 @@ func (h *AvailabilityHandler) GetAvailabilitiesByDate(w http.ResponseWriter, r *
         return
     }
 
+    // The date is a calendar day in the viewer's zone, which may not line up
+    // with the expert's days
+    loc := utils.RequestZone(h.db, r)
+    from, to := dayBounds(date, loc)
+
     var availabilities []models.Availability
-    if err := h.db.Where("expert_id = ? AND date = ?", expertID, date).Find(&availabilities).Error; err != nil {
+    if err := h.db.Where("expert_id = ? AND start_time >= ? AND start_time < ?", expertID, from, to).
+        Order("start_time ASC").Find(&availabilities).Error; err != nil {
+        http.Error(w, "Error retrieving availabilities", http.StatusInternalServerError)
+        return
+    }
+    if err := FillSeatsTaken(h.db, availabilities); err != nil {
         http.Error(w, "Error retrieving availabilities", http.StatusInternalServerError)
         return
     }
+    renderSlots(availabilities, loc)
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(availabilities)
-}
\ No newline at end of file
+}
+
+// Participant is one booking in a slot as shown to the expert running it
+type Participant struct {
+    AppointmentID uint      `json:"appointment_id"`
+    TraderID      uint      `json:"trader_id"`
+    FullName      string    `json:"full_name"`
+    Email         string    `json:"email"`
+    Seats         int       `json:"seats"`
+    Status        string    `json:"status"`
+    PaymentStatus string    `json:"payment_status"`
+    BookedAt      time.Time `json:"booked_at"`
+}
+
+// GetParticipants lists who has booked a slot, for the expert running it or an admin
+func (h *AvailabilityHandler) GetParticipants(w http.ResponseWriter, r *http.Request) {
+    userID, err := utils.GetUserIDFromContext(r.Context())
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    vars := mux.Vars(r)
+    expertID, err := strconv.ParseUint(vars["expertId"], 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid expert ID", http.StatusBadRequest)
+        return
+    }
+
+    availabilityID, err := strconv.ParseUint(vars["id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid availability ID", http.StatusBadRequest)
+        return
+    }
+
+    var expert models.Expert
+    if err := h.db.First(&expert, expertID).Error; err != nil {
+        http.Error(w, "Expert not found", http.StatusNotFound)
+        return
+    }
+    if expert.UserID != userID && !utils.IsAdmin(h.db, userID) {
+        http.Error(w, "You don't have permission to view these participants", http.StatusForbidden)
+        return
+    }
+
+    var availability models.Availability
+    if err := h.db.Where("id = ? AND expert_id = ?", availabilityID, expertID).First(&availability).Error; err != nil {
+        http.Error(w, "Availability not found", http.StatusNotFound)
+        return
+    }
+
+    participants := []Participant{}
+    if err := h.db.Table("appointments a").
+        Joins("JOIN users u ON u.id = a.trader_id").
+        Where("a.availability_id = ? AND a.status NOT IN ? AND a.deleted_at IS NULL", availability.ID, ReleasedStatuses).
+        Select("a.id AS appointment_id, a.trader_id, u.full_name, u.email, a.seats, a.status, a.payment_status, a.created_at AS booked_at").
+        Order("a.created_at ASC").
+        Scan(&participants).Error; err != nil {
+        http.Error(w, "Error retrieving participants", http.StatusInternalServerError)
+        return
+    }
+
+    for _, participant := range participants {
+        availability.SeatsTaken += participant.Seats
+    }
+    renderSlot(&availability, utils.RequestZone(h.db, r))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "availability": availability,
+        "participants": participants,
+    })
+}
@@ -0,0 +1,768 @@
+package availability
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// materializeAhead is how far ahead recurring slots are created as bookable rows
+	materializeAhead = 8 * 7 * 24 * time.Hour
+	// materializeInterval is how often the rolling window is extended
+	materializeInterval = time.Hour
+)
+
+// Rule frequencies
+const (
+	FrequencyDaily  = "daily"
+	FrequencyWeekly = "weekly"
+)
+
+// weekdayCodes maps RRULE day codes to weekdays
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// RuleRequest is the body accepted when creating or replacing a recurrence
+// rule. The schedule can be given as an RRULE string such as
+// "FREQ=WEEKLY;BYDAY=MO,WE;UNTIL=20250630" or field by field.
+type RuleRequest struct {
+	EventName  string   `json:"event_name"`
+	Note       string   `json:"note"`
+	Category   string   `json:"category"`
+	Reminder   bool     `json:"reminder"`
+	Price      int64    `json:"price_minor"`
+	Currency   string   `json:"currency"`
+	Capacity   int      `json:"capacity"`
+	RRule      string   `json:"rrule"`
+	Frequency  string   `json:"frequency"`
+	Interval   int      `json:"interval"`
+	ByDay      []string `json:"by_day"`
+	StartTime  string   `json:"start_time"` // HH:MM
+	EndTime    string   `json:"end_time"`   // HH:MM
+	TimeZone   string   `json:"time_zone"`  // Defaults to the expert's zone
+	StartsOn   string   `json:"starts_on"`  // YYYY-MM-DD, defaults to today
+	Until      string   `json:"until"`      // YYYY-MM-DD, optional
+	Exceptions []string `json:"exceptions"` // YYYY-MM-DD dates to skip
+}
+
+// RuleResponse is a rule along with its schedule in RRULE form
+type RuleResponse struct {
+	models.AvailabilityRule
+	RRule string `json:"rrule"`
+}
+
+// newRuleResponse builds the response for rule
+func newRuleResponse(rule models.AvailabilityRule) RuleResponse {
+	return RuleResponse{AvailabilityRule: rule, RRule: formatRRule(rule)}
+}
+
+// parseRRule fills the schedule fields of req from an RRULE string
+func parseRRule(value string, req *RuleRequest) error {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	for _, part := range strings.Split(value, ";") {
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("invalid rrule part %q", part)
+		}
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			req.Frequency = strings.ToLower(val)
+		case "INTERVAL":
+			interval, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid rrule INTERVAL")
+			}
+			req.Interval = interval
+		case "BYDAY":
+			req.ByDay = strings.Split(val, ",")
+		case "UNTIL":
+			if len(val) < 8 {
+				return fmt.Errorf("invalid rrule UNTIL")
+			}
+			until, err := time.Parse("20060102", val[:8])
+			if err != nil {
+				return fmt.Errorf("invalid rrule UNTIL")
+			}
+			req.Until = until.Format("2006-01-02")
+		default:
+			return fmt.Errorf("rrule %s is not supported", key)
+		}
+	}
+	return nil
+}
+
+// formatRRule renders the rule's schedule as an RRULE string
+func formatRRule(rule models.AvailabilityRule) string {
+	parts := []string{"FREQ=" + strings.ToUpper(rule.Frequency)}
+	if rule.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", rule.Interval))
+	}
+	if len(rule.ByDay) > 0 {
+		parts = append(parts, "BYDAY="+strings.Join(rule.ByDay, ","))
+	}
+	if rule.Until != nil {
+		parts = append(parts, "UNTIL="+rule.Until.Format("20060102"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// parseClock parses HH:MM into minutes after midnight
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("times must be HH:MM")
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// apply validates req and copies it onto rule. Rules keep their zone, or the
+// expert's, unless the request names another.
+func (req *RuleRequest) apply(rule *models.AvailabilityRule, now time.Time) error {
+	if req.RRule != "" {
+		if err := parseRRule(req.RRule, req); err != nil {
+			return err
+		}
+	}
+
+	if strings.TrimSpace(req.EventName) == "" {
+		return fmt.Errorf("event_name is required")
+	}
+	if req.Price < 0 {
+		return fmt.Errorf("price cannot be negative")
+	}
+	currency := utils.NormalizeCurrency(req.Currency)
+	if currency == "" {
+		currency = utils.DefaultCurrency()
+	}
+	if !utils.IsSupportedCurrency(currency) {
+		return fmt.Errorf("unsupported currency")
+	}
+	if req.Capacity == 0 {
+		req.Capacity = 1
+	}
+	if req.Capacity < 0 {
+		return fmt.Errorf("capacity must be at least 1")
+	}
+
+	frequency := strings.ToLower(req.Frequency)
+	if frequency != FrequencyDaily && frequency != FrequencyWeekly {
+		return fmt.Errorf("frequency must be daily or weekly")
+	}
+	if req.Interval == 0 {
+		req.Interval = 1
+	}
+	if req.Interval < 0 {
+		return fmt.Errorf("interval must be at least 1")
+	}
+
+	var byDay []string
+	for _, day := range req.ByDay {
+		code := strings.ToUpper(strings.TrimSpace(day))
+		if _, ok := weekdayCodes[code]; !ok {
+			return fmt.Errorf("by_day must use MO, TU, WE, TH, FR, SA or SU")
+		}
+		byDay = append(byDay, code)
+	}
+	if frequency == FrequencyWeekly && len(byDay) == 0 {
+		return fmt.Errorf("weekly rules need at least one day in by_day")
+	}
+	if frequency == FrequencyDaily {
+		byDay = nil
+	}
+
+	start, err := parseClock(req.StartTime)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(req.EndTime)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("end_time must differ from start_time")
+	}
+
+	zone := rule.TimeZone
+	if req.TimeZone != "" {
+		if !utils.IsValidTimeZone(req.TimeZone) {
+			return fmt.Errorf("unknown time zone; use an IANA name such as Africa/Accra")
+		}
+		zone = req.TimeZone
+	}
+	if zone == "" {
+		zone = utils.DefaultTimeZone
+	}
+
+	startsOn := localDate(now, utils.LoadZone(zone))
+	if req.StartsOn != "" {
+		if startsOn, err = time.Parse("2006-01-02", req.StartsOn); err != nil {
+			return fmt.Errorf("starts_on must be YYYY-MM-DD")
+		}
+	}
+
+	var until *time.Time
+	if req.Until != "" {
+		parsed, err := time.Parse("2006-01-02", req.Until)
+		if err != nil {
+			return fmt.Errorf("until must be YYYY-MM-DD")
+		}
+		if parsed.Before(startsOn) {
+			return fmt.Errorf("until must not be before starts_on")
+		}
+		until = &parsed
+	}
+
+	var exceptions []string
+	for _, value := range req.Exceptions {
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return fmt.Errorf("exceptions must be YYYY-MM-DD dates")
+		}
+		exceptions = append(exceptions, date.Format("2006-01-02"))
+	}
+	sort.Strings(exceptions)
+
+	rule.EventName = strings.TrimSpace(req.EventName)
+	rule.Note = req.Note
+	rule.Category = req.Category
+	rule.Reminder = req.Reminder
+	rule.Price = req.Price
+	rule.Currency = currency
+	rule.Capacity = req.Capacity
+	rule.Frequency = frequency
+	rule.Interval = req.Interval
+	rule.ByDay = pq.StringArray(byDay)
+	rule.StartTime = req.StartTime
+	rule.EndTime = req.EndTime
+	rule.TimeZone = zone
+	rule.StartsOn = startsOn
+	rule.Until = until
+	rule.Exceptions = pq.StringArray(exceptions)
+	return nil
+}
+
+// occursOn reports whether the rule has a slot on day, a UTC midnight
+func occursOn(rule *models.AvailabilityRule, day time.Time) bool {
+	startsOn := dateOf(rule.StartsOn)
+	if day.Before(startsOn) || (rule.Until != nil && day.After(dateOf(*rule.Until))) {
+		return false
+	}
+	for _, exception := range rule.Exceptions {
+		if exception == day.Format("2006-01-02") {
+			return false
+		}
+	}
+
+	interval := rule.Interval
+	if interval < 1 {
+		interval = 1
+	}
+	days := int(day.Sub(startsOn).Hours() / 24)
+
+	if rule.Frequency == FrequencyDaily {
+		return days%interval == 0
+	}
+
+	matches := false
+	for _, code := range rule.ByDay {
+		if weekdayCodes[code] == day.Weekday() {
+			matches = true
+			break
+		}
+	}
+	if !matches {
+		return false
+	}
+
+	// Count whole weeks from the Monday of the week the rule starts in
+	weekStart := startsOn.AddDate(0, 0, -((int(startsOn.Weekday()) + 6) % 7))
+	weeks := int(day.Sub(weekStart).Hours()/24) / 7
+	return weeks%interval == 0
+}
+
+// occurrence builds the slot the rule generates on day. The wall clock times
+// are resolved in the rule's zone for that date, so an 18:00 slot stays at
+// 18:00 local time when daylight saving starts or ends.
+func occurrence(rule *models.AvailabilityRule, day time.Time) models.Availability {
+	loc := utils.LoadZone(rule.TimeZone)
+	start, _ := parseClock(rule.StartTime)
+	end, _ := parseClock(rule.EndTime)
+
+	endDay := day.Day()
+	if end <= start {
+		endDay++
+	}
+
+	ruleID := rule.ID
+	return models.Availability{
+		ExpertID:  rule.ExpertID,
+		EventName: rule.EventName,
+		Note:      rule.Note,
+		Date:      day,
+		StartTime: time.Date(day.Year(), day.Month(), day.Day(), 0, start, 0, 0, loc).UTC(),
+		EndTime:   time.Date(day.Year(), day.Month(), endDay, 0, end, 0, 0, loc).UTC(),
+		Reminder:  rule.Reminder,
+		Category:  rule.Category,
+		Price:     rule.Price,
+		Currency:  rule.Currency,
+		Capacity:  rule.Capacity,
+		RuleID:    &ruleID,
+	}
+}
+
+// materializeRule creates the rule's slots from today up to materializeAhead,
+// skipping dates that already have a slot from the rule and times that clash
+// with the expert's other slots, and returns the IDs of the slots created.
+// The rule row is locked so the worker and request handlers never create the
+// same slot twice.
+func materializeRule(tx *gorm.DB, ruleID uint, now time.Time) ([]uint, error) {
+	var rule models.AvailabilityRule
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&rule, ruleID).Error; err != nil {
+		return nil, err
+	}
+
+	loc := utils.LoadZone(rule.TimeZone)
+	from := localDate(now, loc)
+	if startsOn := dateOf(rule.StartsOn); startsOn.After(from) {
+		from = startsOn
+	}
+	to := localDate(now.Add(materializeAhead), loc)
+	if rule.Until != nil && dateOf(*rule.Until).Before(to) {
+		to = dateOf(*rule.Until)
+	}
+
+	var dates []time.Time
+	if err := tx.Model(&models.Availability{}).
+		Where("rule_id = ? AND date >= ? AND date <= ?", rule.ID, from, to).
+		Pluck("date", &dates).Error; err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(dates))
+	for _, date := range dates {
+		existing[date.UTC().Format("2006-01-02")] = true
+	}
+
+	gap := expertGap(tx, rule.ExpertID)
+	var created []uint
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if existing[day.Format("2006-01-02")] || !occursOn(&rule, day) {
+			continue
+		}
+
+		slot := occurrence(&rule, day)
+
+		var clashes int64
+		if err := tx.Model(&models.Availability{}).
+			Where("expert_id = ? AND start_time < ? AND end_time > ?", rule.ExpertID, slot.EndTime.Add(gap), slot.StartTime.Add(-gap)).
+			Count(&clashes).Error; err != nil {
+			return created, err
+		}
+		if clashes > 0 {
+			continue
+		}
+
+		if err := tx.Create(&slot).Error; err != nil {
+			return created, err
+		}
+		created = append(created, slot.ID)
+	}
+
+	if err := tx.Model(&rule).Update("materialized_until", to).Error; err != nil {
+		return created, err
+	}
+	return created, nil
+}
+
+// unbookedScope restricts an availability query to slots without live appointments
+func unbookedScope(db *gorm.DB) *gorm.DB {
+	return db.Where("NOT EXISTS (SELECT 1 FROM appointments a WHERE a.availability_id = availabilities.id AND a.status NOT IN ? AND a.deleted_at IS NULL)", ReleasedStatuses)
+}
+
+// clearFutureOccurrences removes the rule's slots from day onwards that nobody
+// has booked, returning how many booked slots were left in place.
+// Detached slots are only removed when includeDetached is set.
+func clearFutureOccurrences(tx *gorm.DB, ruleID uint, day time.Time, includeDetached bool) (int64, error) {
+	query := tx.Where("rule_id = ? AND date >= ?", ruleID, day).Scopes(unbookedScope)
+	if !includeDetached {
+		query = query.Where("detached = ?", false)
+	}
+	if err := query.Delete(&models.Availability{}).Error; err != nil {
+		return 0, err
+	}
+
+	var kept int64
+	err := tx.Model(&models.Availability{}).Where("rule_id = ? AND date >= ?", ruleID, day).Count(&kept).Error
+	return kept, err
+}
+
+// addException records date as having no slot so the rule does not generate it again
+func addException(tx *gorm.DB, ruleID uint, date time.Time) error {
+	var rule models.AvailabilityRule
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&rule, ruleID).Error; err != nil {
+		return err
+	}
+
+	value := dateOf(date).Format("2006-01-02")
+	for _, exception := range rule.Exceptions {
+		if exception == value {
+			return nil
+		}
+	}
+	exceptions := append(rule.Exceptions, value)
+	sort.Strings(exceptions)
+	return tx.Model(&rule).Update("exceptions", pq.StringArray(exceptions)).Error
+}
+
+// offerNewSlots offers newly created slots to the expert's waitlist
+func (h *AvailabilityHandler) offerNewSlots(ids []uint) {
+	for _, id := range ids {
+		OfferWaitlist(h.db, h.notifier, id)
+	}
+}
+
+// runMaterializer periodically extends every rule's slots into the rolling
+// window and offers the new slots to the waitlist
+func (h *AvailabilityHandler) runMaterializer() {
+	ticker := time.NewTicker(materializeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+
+		var ruleIDs []uint
+		if err := h.db.Model(&models.AvailabilityRule{}).
+			Where("until IS NULL OR until >= ?", dateOf(now)).
+			Pluck("id", &ruleIDs).Error; err != nil {
+			log.Printf("Error loading availability rules: %v", err)
+			continue
+		}
+
+		for _, ruleID := range ruleIDs {
+			var created []uint
+			err := h.db.Transaction(func(tx *gorm.DB) error {
+				var err error
+				created, err = materializeRule(tx, ruleID, now)
+				return err
+			})
+			if err != nil {
+				log.Printf("Error materializing availability rule %d: %v", ruleID, err)
+				continue
+			}
+			h.offerNewSlots(created)
+		}
+	}
+}
+
+// authorizeExpert loads the expert in the path and checks that the caller is
+// that expert or an admin
+func (h *AvailabilityHandler) authorizeExpert(w http.ResponseWriter, r *http.Request) (*models.Expert, bool) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	expertID, err := strconv.ParseUint(mux.Vars(r)["expertId"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid expert ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var expert models.Expert
+	if err := h.db.First(&expert, expertID).Error; err != nil {
+		http.Error(w, "Expert not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if expert.UserID != userID && !utils.IsAdmin(h.db, userID) {
+		http.Error(w, "You don't have permission to manage this expert's availability", http.StatusForbidden)
+		return nil, false
+	}
+	return &expert, true
+}
+
+// findRule loads the rule in the path, which must belong to expert
+func (h *AvailabilityHandler) findRule(w http.ResponseWriter, r *http.Request, expert *models.Expert) (*models.AvailabilityRule, bool) {
+	ruleID, err := strconv.ParseUint(mux.Vars(r)["ruleId"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var rule models.AvailabilityRule
+	if err := h.db.Where("id = ? AND expert_id = ?", ruleID, expert.ID).First(&rule).Error; err != nil {
+		http.Error(w, "Availability rule not found", http.StatusNotFound)
+		return nil, false
+	}
+	return &rule, true
+}
+
+// writeJSON writes payload as a JSON response
+func writeJSON(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(payload)
+}
+
+// CreateRule creates a recurrence rule and its first weeks of slots
+func (h *AvailabilityHandler) CreateRule(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	var request RuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	rule := models.AvailabilityRule{ExpertID: expert.ID, TimeZone: expert.TimeZone}
+	if err := request.apply(&rule, now); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var created []uint
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&rule).Error; err != nil {
+			return err
+		}
+		var err error
+		created, err = materializeRule(tx, rule.ID, now)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error creating availability rule for expert %d: %v", expert.ID, err)
+		http.Error(w, "Error creating availability rule", http.StatusInternalServerError)
+		return
+	}
+	h.db.First(&rule, rule.ID)
+	go h.offerNewSlots(created)
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"rule":          newRuleResponse(rule),
+		"slots_created": len(created),
+	})
+}
+
+// GetRules lists an expert's recurrence rules
+func (h *AvailabilityHandler) GetRules(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	var rules []models.AvailabilityRule
+	if err := h.db.Where("expert_id = ?", expert.ID).Order("created_at DESC").Find(&rules).Error; err != nil {
+		http.Error(w, "Error retrieving availability rules", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]RuleResponse, len(rules))
+	for i, rule := range rules {
+		response[i] = newRuleResponse(rule)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// GetRule returns a rule with its upcoming slots
+func (h *AvailabilityHandler) GetRule(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+	rule, ok := h.findRule(w, r, expert)
+	if !ok {
+		return
+	}
+
+	var slots []models.Availability
+	loc := utils.LoadZone(rule.TimeZone)
+	if err := h.db.Where("rule_id = ? AND date >= ?", rule.ID, localDate(time.Now(), loc)).
+		Order("start_time ASC").Find(&slots).Error; err != nil {
+		http.Error(w, "Error retrieving slots", http.StatusInternalServerError)
+		return
+	}
+	if err := FillSeatsTaken(h.db, slots); err != nil {
+		http.Error(w, "Error retrieving slots", http.StatusInternalServerError)
+		return
+	}
+	renderSlots(slots, loc)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rule":  newRuleResponse(*rule),
+		"slots": slots,
+	})
+}
+
+// UpdateRule replaces a rule and regenerates its upcoming slots. Slots that
+// are booked or were edited on their own are left as they are.
+func (h *AvailabilityHandler) UpdateRule(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+	rule, ok := h.findRule(w, r, expert)
+	if !ok {
+		return
+	}
+
+	var request RuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if err := request.apply(rule, now); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var kept int64
+	var created []uint
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.AvailabilityRule{}, rule.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Save(rule).Error; err != nil {
+			return err
+		}
+		var err error
+		if kept, err = clearFutureOccurrences(tx, rule.ID, localDate(now, utils.LoadZone(rule.TimeZone)), false); err != nil {
+			return err
+		}
+		created, err = materializeRule(tx, rule.ID, now)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error updating availability rule %d: %v", rule.ID, err)
+		http.Error(w, "Error updating availability rule", http.StatusInternalServerError)
+		return
+	}
+	h.db.First(rule, rule.ID)
+	go h.offerNewSlots(created)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rule":          newRuleResponse(*rule),
+		"slots_created": len(created),
+		"slots_kept":    kept,
+	})
+}
+
+// DeleteRule cancels a whole series. Upcoming slots nobody has booked are
+// removed; booked ones stay until their appointments are dealt with.
+func (h *AvailabilityHandler) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+	rule, ok := h.findRule(w, r, expert)
+	if !ok {
+		return
+	}
+
+	var kept int64
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.AvailabilityRule{}, rule.ID).Error; err != nil {
+			return err
+		}
+		var err error
+		if kept, err = clearFutureOccurrences(tx, rule.ID, localDate(time.Now(), utils.LoadZone(rule.TimeZone)), true); err != nil {
+			return err
+		}
+		return tx.Delete(rule).Error
+	})
+	if err != nil {
+		log.Printf("Error deleting availability rule %d: %v", rule.ID, err)
+		http.Error(w, "Error deleting availability rule", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":           "Availability rule deleted successfully",
+		"booked_slots_kept": kept,
+	})
+}
+
+// CancelOccurrence cancels the rule's slot on one date and stops it being
+// generated again. Slots with bookings must have them cancelled first.
+func (h *AvailabilityHandler) CancelOccurrence(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+	rule, ok := h.findRule(w, r, expert)
+	if !ok {
+		return
+	}
+
+	date, err := time.Parse("2006-01-02", mux.Vars(r)["date"])
+	if err != nil {
+		http.Error(w, "Invalid date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := addException(tx, rule.ID, date); err != nil {
+			return err
+		}
+
+		var slot models.Availability
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("rule_id = ? AND date = ?", rule.ID, date).First(&slot).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		taken, err := SeatsTaken(tx, slot.ID)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrSlotBooked
+		}
+		return tx.Delete(&slot).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrSlotBooked) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error cancelling occurrence", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Occurrence cancelled successfully",
+	})
+}
@@ -0,0 +1,210 @@
+package availability
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/lib/pq"
+)
+
+// day returns the UTC midnight of a YYYY-MM-DD date
+func day(t *testing.T, value string) time.Time {
+	t.Helper()
+
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return date
+}
+
+func TestRuleRequestApply(t *testing.T) {
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+
+	t.Run("rrule", func(t *testing.T) {
+		t.Setenv("DEFAULT_CURRENCY", "")
+		rule := models.AvailabilityRule{TimeZone: "Africa/Accra"}
+		req := RuleRequest{EventName: " Weekly review ", RRule: "RRULE:FREQ=WEEKLY;BYDAY=mo,we;INTERVAL=2;UNTIL=20260630T000000Z", StartTime: "18:00", EndTime: "19:00"}
+		if err := req.apply(&rule, now); err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+
+		if rule.EventName != "Weekly review" || rule.Currency != "GHS" || rule.Capacity != 1 || rule.TimeZone != "Africa/Accra" {
+			t.Errorf("rule = %+v", rule)
+		}
+		if !rule.StartsOn.Equal(day(t, "2026-03-02")) || rule.Until == nil || !rule.Until.Equal(day(t, "2026-06-30")) {
+			t.Errorf("rule runs from %v until %v", rule.StartsOn, rule.Until)
+		}
+		if got, want := formatRRule(rule), "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;UNTIL=20260630"; got != want {
+			t.Errorf("formatRRule = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("daily rules ignore by_day", func(t *testing.T) {
+		var rule models.AvailabilityRule
+		req := RuleRequest{EventName: "Daily", Frequency: "DAILY", ByDay: []string{"MO"}, StartTime: "23:00", EndTime: "01:00", StartsOn: "2026-04-01"}
+		if err := req.apply(&rule, now); err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		if len(rule.ByDay) != 0 || rule.TimeZone != "UTC" || rule.Interval != 1 || formatRRule(rule) != "FREQ=DAILY" {
+			t.Errorf("rule = %+v", rule)
+		}
+	})
+
+	invalid := []struct {
+		name string
+		req  RuleRequest
+	}{
+		{name: "no event name", req: RuleRequest{Frequency: "daily", StartTime: "09:00", EndTime: "10:00"}},
+		{name: "unknown frequency", req: RuleRequest{EventName: "Session", Frequency: "monthly", StartTime: "09:00", EndTime: "10:00"}},
+		{name: "unsupported rrule part", req: RuleRequest{EventName: "Session", RRule: "FREQ=DAILY;COUNT=3", StartTime: "09:00", EndTime: "10:00"}},
+		{name: "weekly without days", req: RuleRequest{EventName: "Session", Frequency: "weekly", StartTime: "09:00", EndTime: "10:00"}},
+		{name: "unknown day", req: RuleRequest{EventName: "Session", Frequency: "weekly", ByDay: []string{"XX"}, StartTime: "09:00", EndTime: "10:00"}},
+		{name: "bad time", req: RuleRequest{EventName: "Session", Frequency: "daily", StartTime: "9am", EndTime: "10:00"}},
+		{name: "no length", req: RuleRequest{EventName: "Session", Frequency: "daily", StartTime: "09:00", EndTime: "09:00"}},
+		{name: "unknown zone", req: RuleRequest{EventName: "Session", Frequency: "daily", StartTime: "09:00", EndTime: "10:00", TimeZone: "Mars/Olympus"}},
+		{name: "ends before it starts", req: RuleRequest{EventName: "Session", Frequency: "daily", StartTime: "09:00", EndTime: "10:00", StartsOn: "2026-05-01", Until: "2026-04-01"}},
+		{name: "bad exception", req: RuleRequest{EventName: "Session", Frequency: "daily", StartTime: "09:00", EndTime: "10:00", Exceptions: []string{"next week"}}},
+		{name: "negative price", req: RuleRequest{EventName: "Session", Frequency: "daily", StartTime: "09:00", EndTime: "10:00", Price: -1}},
+	}
+	for _, tt := range invalid {
+		var rule models.AvailabilityRule
+		if err := tt.req.apply(&rule, now); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestOccursOn(t *testing.T) {
+	until := day(t, "2026-03-31")
+	fortnightly := &models.AvailabilityRule{
+		Frequency:  FrequencyWeekly,
+		Interval:   2,
+		ByDay:      pq.StringArray{"MO", "WE"},
+		StartsOn:   day(t, "2026-03-02"), // A Monday
+		Until:      &until,
+		Exceptions: pq.StringArray{"2026-03-16"},
+	}
+	// Starting midweek counts weeks from that week's Monday
+	midweek := &models.AvailabilityRule{Frequency: FrequencyWeekly, Interval: 2, ByDay: pq.StringArray{"MO"}, StartsOn: day(t, "2026-03-04")}
+	everyThirdDay := &models.AvailabilityRule{Frequency: FrequencyDaily, Interval: 3, StartsOn: day(t, "2026-03-02")}
+
+	tests := []struct {
+		rule *models.AvailabilityRule
+		date string
+		want bool
+	}{
+		{fortnightly, "2026-02-23", false}, // Before it starts
+		{fortnightly, "2026-03-02", true},
+		{fortnightly, "2026-03-03", false}, // Tuesday
+		{fortnightly, "2026-03-04", true},
+		{fortnightly, "2026-03-09", false}, // Off week
+		{fortnightly, "2026-03-16", false}, // Exception
+		{fortnightly, "2026-03-18", true},
+		{fortnightly, "2026-03-30", true},
+		{fortnightly, "2026-04-13", false}, // After until
+		{midweek, "2026-03-02", false},
+		{midweek, "2026-03-09", false},
+		{midweek, "2026-03-16", true},
+		{everyThirdDay, "2026-03-04", false},
+		{everyThirdDay, "2026-03-05", true},
+		{everyThirdDay, "2026-03-29", true},
+	}
+	for _, tt := range tests {
+		if got := occursOn(tt.rule, day(t, tt.date)); got != tt.want {
+			t.Errorf("occursOn(%s, %s) = %v, want %v", formatRRule(*tt.rule), tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestOccurrence(t *testing.T) {
+	tests := []struct {
+		name      string
+		zone      string
+		start     string
+		end       string
+		date      string
+		wantStart string
+		wantEnd   string
+	}{
+		{name: "London before the clocks change", zone: "Europe/London", start: "18:00", end: "19:00", date: "2026-03-27", wantStart: "2026-03-27T18:00:00Z", wantEnd: "2026-03-27T19:00:00Z"},
+		{name: "London in summer time", zone: "Europe/London", start: "18:00", end: "19:00", date: "2026-03-30", wantStart: "2026-03-30T17:00:00Z", wantEnd: "2026-03-30T18:00:00Z"},
+		{name: "New York back on standard time", zone: "America/New_York", start: "09:00", end: "10:30", date: "2026-11-02", wantStart: "2026-11-02T14:00:00Z", wantEnd: "2026-11-02T15:30:00Z"},
+		{name: "past midnight", zone: "UTC", start: "23:00", end: "01:00", date: "2026-03-31", wantStart: "2026-03-31T23:00:00Z", wantEnd: "2026-04-01T01:00:00Z"},
+	}
+	for _, tt := range tests {
+		rule := &models.AvailabilityRule{ExpertID: 7, Frequency: FrequencyDaily, StartTime: tt.start, EndTime: tt.end, TimeZone: tt.zone, Capacity: 3}
+		rule.ID = 4
+
+		slot := occurrence(rule, day(t, tt.date))
+		if got := slot.StartTime.Format(time.RFC3339); got != tt.wantStart {
+			t.Errorf("%s: start = %s, want %s", tt.name, got, tt.wantStart)
+		}
+		if got := slot.EndTime.Format(time.RFC3339); got != tt.wantEnd {
+			t.Errorf("%s: end = %s, want %s", tt.name, got, tt.wantEnd)
+		}
+		if slot.ExpertID != 7 || slot.Capacity != 3 || slot.RuleID == nil || *slot.RuleID != 4 || !slot.Date.Equal(day(t, tt.date)) {
+			t.Errorf("%s: slot = %+v", tt.name, slot)
+		}
+	}
+}
+
+func TestMaterializeRule(t *testing.T) {
+	db := testdb.Open(t, "availability")
+	now := time.Now()
+	expert := testdb.Expert(t, db, "Regular Expert")
+
+	from := dateOf(now).AddDate(0, 0, 1)
+	until := from.AddDate(0, 0, 6)
+	rule := models.AvailabilityRule{
+		ExpertID:   expert.ID,
+		EventName:  "Morning session",
+		Currency:   "GHS",
+		Capacity:   1,
+		Frequency:  FrequencyDaily,
+		Interval:   1,
+		StartTime:  "09:00",
+		EndTime:    "10:00",
+		TimeZone:   "UTC",
+		StartsOn:   from,
+		Until:      &until,
+		Exceptions: pq.StringArray{from.AddDate(0, 0, 1).Format("2006-01-02")},
+	}
+	if err := db.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+	// A one-off slot the expert already has on the third day
+	testdb.Slot(t, db, expert, from.AddDate(0, 0, 2).Add(9*time.Hour+30*time.Minute), 1, 5000)
+
+	created, err := materializeRule(db, rule.ID, now)
+	if err != nil {
+		t.Fatalf("materializeRule: %v", err)
+	}
+	// Seven days less the exception and the clash
+	if len(created) != 5 {
+		t.Errorf("created %d slots, want 5", len(created))
+	}
+
+	// Running again, as the worker does every hour, adds nothing
+	if again, err := materializeRule(db, rule.ID, now); err != nil || len(again) != 0 {
+		t.Errorf("second run created %d slots, error %v", len(again), err)
+	}
+
+	db.First(&rule, rule.ID)
+	if rule.MaterializedUntil == nil || !rule.MaterializedUntil.Equal(until) {
+		t.Errorf("materialized until %v, want %v", rule.MaterializedUntil, until)
+	}
+
+	// Cancelling an occurrence keeps it from coming back
+	if err := addException(db, rule.ID, until); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clearFutureOccurrences(db, rule.ID, until, false); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := materializeRule(db, rule.ID, now); len(again) != 0 {
+		t.Errorf("cancelled occurrence created again")
+	}
+}
@@ -0,0 +1,262 @@
+package availability
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+// searchSorts maps the sort parameter to its ORDER BY clause
+var searchSorts = map[string]string{
+	"start_time": "availabilities.start_time ASC",
+	"price":      "availabilities.price_minor ASC, availabilities.start_time ASC",
+	"rating":     "experts.average_rating DESC, availabilities.start_time ASC",
+}
+
+// SearchExpert is the expert offering a slot in search results
+type SearchExpert struct {
+	ID            uint    `json:"id"`
+	FullName      string  `json:"full_name"`
+	Expertise     string  `json:"expertise"`
+	AverageRating float64 `json:"average_rating"`
+	TotalRatings  int     `json:"total_ratings"`
+	Verified      bool    `json:"verified"`
+}
+
+// SearchResult is a bookable slot and its expert
+type SearchResult struct {
+	models.Availability
+	SeatsLeft int          `json:"seats_left"`
+	Expert    SearchExpert `json:"expert"`
+}
+
+// searchRow is a slot as scanned from the search query
+type searchRow struct {
+	models.Availability
+	Taken         int
+	ExpertName    string
+	Expertise     string
+	AverageRating float64
+	TotalRatings  int
+	Verified      bool
+}
+
+// parseSearchTime reads an instant given as RFC 3339, or as a YYYY-MM-DD date
+// in loc, which means the start of that day, or its end when endOfDay is set
+func parseSearchTime(value string, loc *time.Location, endOfDay bool) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	start, end := dayBounds(date, loc)
+	if endOfDay {
+		return end, true
+	}
+	return start, true
+}
+
+// normalizeClock rewrites an HH:MM time with leading zeros so times compare
+// as strings
+func normalizeClock(value string) (string, bool) {
+	minutes, err := parseClock(value)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60), true
+}
+
+// SearchAvailability finds bookable slots across all experts. Filters:
+// from and to (RFC 3339 or YYYY-MM-DD), time_from and time_to (HH:MM in the
+// viewer's zone, e.g. 18:00 to 22:00 for evenings), category, expertise,
+// min_price and max_price (major units of currency), min_rating and
+// verified. Results are sorted by start_time, price or rating.
+func (h *AvailabilityHandler) SearchAvailability(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	loc := utils.RequestZone(h.db, r)
+	now := time.Now()
+
+	page, _ := strconv.Atoi(params.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(params.Get("page_size"))
+	if pageSize < 1 {
+		pageSize = defaultSearchPageSize
+	}
+	if pageSize > maxSearchPageSize {
+		pageSize = maxSearchPageSize
+	}
+
+	sort := params.Get("sort")
+	if sort == "" {
+		sort = "start_time"
+	}
+	order, ok := searchSorts[sort]
+	if !ok {
+		http.Error(w, "Sort must be start_time, price or rating", http.StatusBadRequest)
+		return
+	}
+
+	// Only slots that still have a free seat and that the expert's minimum
+	// notice and booking horizon let the trader book now; pending checkouts
+	// hold their seats until their hold expires
+	taken := seatsQuery(h.db).Select("availability_id, SUM(seats) AS seats").Group("availability_id")
+	query := h.db.Table("availabilities").
+		Joins("JOIN experts ON experts.id = availabilities.expert_id AND experts.deleted_at IS NULL").
+		Joins("JOIN users ON users.id = experts.user_id").
+		Joins("LEFT JOIN (?) AS taken ON taken.availability_id = availabilities.id", taken).
+		Where("availabilities.deleted_at IS NULL").
+		Where("availabilities.start_time > ?", now).
+		Where("availabilities.start_time >= ?::timestamptz + experts.min_notice_minutes * INTERVAL '1 minute'", now).
+		Where("experts.booking_horizon_days = 0 OR availabilities.start_time <= ?::timestamptz + experts.booking_horizon_days * INTERVAL '1 day'", now).
+		Where("availabilities.capacity > COALESCE(taken.seats, 0)")
+
+	if value := params.Get("from"); value != "" {
+		from, ok := parseSearchTime(value, loc, false)
+		if !ok {
+			http.Error(w, "Invalid from. Use RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("availabilities.start_time >= ?", from)
+	}
+	if value := params.Get("to"); value != "" {
+		to, ok := parseSearchTime(value, loc, true)
+		if !ok {
+			http.Error(w, "Invalid to. Use RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("availabilities.start_time < ?", to)
+	}
+
+	// Time of day is compared on the viewer's wall clock
+	timeFrom, timeTo := params.Get("time_from"), params.Get("time_to")
+	if timeFrom != "" || timeTo != "" {
+		if timeFrom == "" {
+			timeFrom = "00:00"
+		}
+		var ok bool
+		if timeFrom, ok = normalizeClock(timeFrom); !ok {
+			http.Error(w, "Invalid time_from. Use HH:MM", http.StatusBadRequest)
+			return
+		}
+		if timeTo == "" {
+			timeTo = "24:00"
+		} else if timeTo, ok = normalizeClock(timeTo); !ok {
+			http.Error(w, "Invalid time_to. Use HH:MM", http.StatusBadRequest)
+			return
+		}
+
+		localTime := "to_char(availabilities.start_time AT TIME ZONE ?, 'HH24:MI')"
+		if timeFrom <= timeTo {
+			query = query.Where(localTime+" >= ? AND "+localTime+" < ?", loc.String(), timeFrom, loc.String(), timeTo)
+		} else {
+			// A window past midnight, e.g. 22:00 to 02:00
+			query = query.Where("("+localTime+" >= ? OR "+localTime+" < ?)", loc.String(), timeFrom, loc.String(), timeTo)
+		}
+	}
+
+	if category := params.Get("category"); category != "" {
+		query = query.Where("LOWER(availabilities.category) = LOWER(?)", category)
+	}
+	if expertise := strings.TrimSpace(params.Get("expertise")); expertise != "" {
+		query = query.Where("experts.expertise ILIKE ?", "%"+expertise+"%")
+	}
+	if params.Get("verified") == "true" {
+		query = query.Where("experts.verified = ?", true)
+	}
+	if value := params.Get("min_rating"); value != "" {
+		rating, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			http.Error(w, "Invalid min_rating", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("experts.average_rating >= ?", rating)
+	}
+
+	// Prices are compared in one currency
+	minPrice, maxPrice := params.Get("min_price"), params.Get("max_price")
+	if minPrice != "" || maxPrice != "" {
+		currency := utils.NormalizeCurrency(params.Get("currency"))
+		if currency == "" {
+			currency = utils.DefaultCurrency()
+		}
+		if !utils.IsSupportedCurrency(currency) {
+			http.Error(w, "Unsupported currency", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("availabilities.currency = ?", currency)
+
+		for _, bound := range []struct {
+			value, op, name string
+		}{{minPrice, ">=", "min_price"}, {maxPrice, "<=", "max_price"}} {
+			if bound.value == "" {
+				continue
+			}
+			amount, err := strconv.ParseFloat(bound.value, 64)
+			if err != nil || amount < 0 {
+				http.Error(w, "Invalid "+bound.name, http.StatusBadRequest)
+				return
+			}
+			query = query.Where("availabilities.price_minor "+bound.op+" ?", utils.ToMinor(amount, currency))
+		}
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		http.Error(w, "Error searching availability", http.StatusInternalServerError)
+		return
+	}
+
+	var rows []searchRow
+	if err := query.Session(&gorm.Session{}).
+		Select("availabilities.*, COALESCE(taken.seats, 0) AS taken, users.full_name AS expert_name, " +
+			"experts.expertise, experts.average_rating, experts.total_ratings, experts.verified").
+		Order(order).
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&rows).Error; err != nil {
+		http.Error(w, "Error searching availability", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]SearchResult, len(rows))
+	for i, row := range rows {
+		slot := row.Availability
+		slot.SeatsTaken = row.Taken
+		renderSlot(&slot, loc)
+		results[i] = SearchResult{
+			Availability: slot,
+			SeatsLeft:    slot.Capacity - row.Taken,
+			Expert: SearchExpert{
+				ID:            slot.ExpertID,
+				FullName:      row.ExpertName,
+				Expertise:     row.Expertise,
+				AverageRating: row.AverageRating,
+				TotalRatings:  row.TotalRatings,
+				Verified:      row.Verified,
+			},
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"results":     results,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + int64(pageSize) - 1) / int64(pageSize),
+	})
+}
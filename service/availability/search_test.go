@@ -0,0 +1,211 @@
+package availability
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"gorm.io/gorm"
+)
+
+func TestParseSearchTime(t *testing.T) {
+	lagos, err := time.LoadLocation("Africa/Lagos")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value    string
+		endOfDay bool
+		want     string
+		wantOK   bool
+	}{
+		{value: "2026-03-02T18:30:00+02:00", want: "2026-03-02T16:30:00Z", wantOK: true},
+		{value: "2026-03-02T18:30:00+02:00", endOfDay: true, want: "2026-03-02T16:30:00Z", wantOK: true},
+		{value: "2026-03-02", want: "2026-03-01T23:00:00Z", wantOK: true},
+		{value: "2026-03-02", endOfDay: true, want: "2026-03-02T23:00:00Z", wantOK: true},
+		{value: "02/03/2026"},
+		{value: "tomorrow"},
+	}
+	for _, tt := range tests {
+		got, ok := parseSearchTime(tt.value, lagos, tt.endOfDay)
+		if ok != tt.wantOK {
+			t.Errorf("parseSearchTime(%s) ok = %v, want %v", tt.value, ok, tt.wantOK)
+			continue
+		}
+		if ok && got.UTC().Format(time.RFC3339) != tt.want {
+			t.Errorf("parseSearchTime(%s, end of day %v) = %s, want %s", tt.value, tt.endOfDay, got.UTC().Format(time.RFC3339), tt.want)
+		}
+	}
+}
+
+func TestNormalizeClock(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   string
+		wantOK bool
+	}{
+		{"18:00", "18:00", true},
+		{"9:05", "09:05", true},
+		{"00:00", "00:00", true},
+		{"24:00", "", false},
+		{"6pm", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := normalizeClock(tt.value); got != tt.want || ok != tt.wantOK {
+			t.Errorf("normalizeClock(%s) = %q, %v; want %q, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// searchFixture creates, on the day it returns:
+//   - a1, a 09:00 forex session and a2, a 19:00 forex session for two with a
+//     seat taken, with Ama, a verified forex expert rated 4.5
+//   - b1, a 20:00 crypto session and b2, a 23:30 session priced in NGN, with
+//     Kofi, a crypto expert rated 3
+//
+// and slots search leaves out: a full one, one beyond its expert's booking
+// horizon and one within its expert's minimum notice
+func searchFixture(t *testing.T, db *gorm.DB) (time.Time, map[string]uint) {
+	t.Helper()
+
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day()+3, 0, 0, 0, 0, time.UTC)
+
+	ama := testdb.Expert(t, db, "Ama Forex")
+	db.Model(ama).Updates(map[string]interface{}{"expertise": "Forex scalping", "verified": true, "average_rating": 4.5})
+	kofi := testdb.Expert(t, db, "Kofi Crypto")
+	db.Model(kofi).Updates(map[string]interface{}{"expertise": "Crypto swing trading", "average_rating": 3})
+	nearOnly := testdb.Expert(t, db, "Near Expert")
+	db.Model(nearOnly).Update("booking_horizon_days", 1)
+	earlyNotice := testdb.Expert(t, db, "Notice Expert")
+	db.Model(earlyNotice).Update("min_notice_minutes", 7*24*60)
+
+	slot := func(expert *models.Expert, clock time.Duration, capacity int, price int64, category, currency string) *models.Availability {
+		s := testdb.Slot(t, db, expert, day.Add(clock), capacity, price)
+		db.Model(s).Updates(map[string]interface{}{"category": category, "currency": currency})
+		return s
+	}
+	a1 := slot(ama, 9*time.Hour, 1, 5000, "forex", "GHS")
+	a2 := slot(ama, 19*time.Hour, 2, 15000, "forex", "GHS")
+	b1 := slot(kofi, 20*time.Hour, 1, 8000, "crypto", "GHS")
+	b2 := slot(kofi, 23*time.Hour+30*time.Minute, 1, 3000, "crypto", "NGN")
+	full := slot(kofi, 10*time.Hour, 1, 5000, "crypto", "GHS")
+	slot(nearOnly, 12*time.Hour, 1, 5000, "forex", "GHS")
+	slot(earlyNotice, 13*time.Hour, 1, 5000, "forex", "GHS")
+
+	for i, booked := range []*models.Availability{a2, full} {
+		appointment := testdb.Appointment(booked, testdb.User(t, db, []string{"Trader A", "Trader B"}[i]).ID, 1, "APT-"+booked.StartTime.Format("1504"))
+		appointment.Status, appointment.PaymentStatus = "Confirmed", "paid"
+		if err := db.Create(appointment).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return day, map[string]uint{"a1": a1.ID, "a2": a2.ID, "b1": b1.ID, "b2": b2.ID}
+}
+
+// searchResponse is the body SearchAvailability writes
+type searchResponse struct {
+	Results    []SearchResult `json:"results"`
+	Total      int64          `json:"total"`
+	TotalPages int64          `json:"total_pages"`
+}
+
+func TestSearchAvailability(t *testing.T) {
+	t.Setenv("DEFAULT_CURRENCY", "")
+	db := testdb.Open(t, "availability")
+	h := &AvailabilityHandler{db: db}
+	day, ids := searchFixture(t, db)
+	date := day.Format("2006-01-02")
+
+	search := func(t *testing.T, query string) (int, searchResponse) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		h.SearchAvailability(w, httptest.NewRequest(http.MethodGet, "/availability/search?"+query, nil))
+		var response searchResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, response
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{name: "that day", query: "", want: []string{"a1", "a2", "b1", "b2"}},
+		{name: "cheapest first", query: "&sort=price", want: []string{"b2", "a1", "b1", "a2"}},
+		{name: "best rated first", query: "&sort=rating", want: []string{"a1", "a2", "b1", "b2"}},
+		{name: "evenings", query: "&time_from=18:00&time_to=22:00", want: []string{"a2", "b1"}},
+		{name: "past midnight", query: "&time_from=22:00&time_to=02:00", want: []string{"b2"}},
+		{name: "category", query: "&category=FOREX", want: []string{"a1", "a2"}},
+		{name: "expertise", query: "&expertise=swing", want: []string{"b1", "b2"}},
+		{name: "verified", query: "&verified=true", want: []string{"a1", "a2"}},
+		{name: "rating", query: "&min_rating=4", want: []string{"a1", "a2"}},
+		{name: "price range", query: "&min_price=60&max_price=150", want: []string{"a2", "b1"}},
+		{name: "price in another currency", query: "&currency=ngn&max_price=50", want: []string{"b2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, response := search(t, "from="+date+"&to="+date+tt.query)
+			if code != http.StatusOK {
+				t.Fatalf("status = %d", code)
+			}
+			if len(response.Results) != len(tt.want) {
+				t.Fatalf("%d results, want %v", len(response.Results), tt.want)
+			}
+			for i, name := range tt.want {
+				if response.Results[i].ID != ids[name] {
+					t.Errorf("result %d = slot %d, want %s", i, response.Results[i].ID, name)
+				}
+			}
+		})
+	}
+
+	t.Run("seats and expert", func(t *testing.T) {
+		_, response := search(t, "from="+date+"&to="+date+"&category=forex&time_from=18:00")
+		if len(response.Results) != 1 {
+			t.Fatalf("results = %+v", response.Results)
+		}
+		got := response.Results[0]
+		if got.SeatsLeft != 1 || got.SeatsTaken != 1 || got.Expert.FullName != "Ama Forex" || !got.Expert.Verified || got.Expert.AverageRating != 4.5 {
+			t.Errorf("result = %+v", got)
+		}
+	})
+
+	t.Run("viewer's zone", func(t *testing.T) {
+		// 23:30 UTC is 00:30 the next day in Lagos
+		from, to := day.Format(time.RFC3339), day.AddDate(0, 0, 1).Format(time.RFC3339)
+		_, response := search(t, "from="+from+"&to="+to+"&tz=Africa/Lagos&time_from=00:00&time_to=01:00")
+		if len(response.Results) != 1 || response.Results[0].ID != ids["b2"] {
+			t.Fatalf("results = %+v, want b2", response.Results)
+		}
+		if zone := response.Results[0].TimeZone; zone != "Africa/Lagos" {
+			t.Errorf("time zone = %s, want Africa/Lagos", zone)
+		}
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		_, response := search(t, "from="+date+"&to="+date+"&page=2&page_size=1")
+		if response.Total != 4 || response.TotalPages != 4 || len(response.Results) != 1 || response.Results[0].ID != ids["a2"] {
+			t.Errorf("response = %+v", response)
+		}
+	})
+
+	t.Run("bad parameters", func(t *testing.T) {
+		for _, query := range []string{"sort=name", "from=03/02/2026", "to=later", "time_from=6pm", "time_to=25:00", "min_rating=high", "min_price=-1", "max_price=ten", "currency=XYZ&max_price=10"} {
+			if code, _ := search(t, query); code != http.StatusBadRequest {
+				t.Errorf("%s: status = %d, want %d", query, code, http.StatusBadRequest)
+			}
+		}
+	})
+}
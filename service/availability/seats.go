@@ -0,0 +1,92 @@
+package availability
+
+import (
+	"errors"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrSlotFull is returned when a slot has fewer seats left than were requested
+	ErrSlotFull = errors.New("not enough seats left in this time slot")
+	// ErrSlotBooked is returned when removing a slot that still has bookings
+	ErrSlotBooked = errors.New("this slot has bookings; cancel them first")
+	// ErrCapacityBelowBooked is returned when lowering a slot's capacity below the seats booked
+	ErrCapacityBelowBooked = errors.New("capacity cannot be lower than the seats already booked")
+)
+
+// ReleasedStatuses are the appointment statuses that no longer hold seats:
+// cancelled bookings and checkouts whose slot hold expired
+var ReleasedStatuses = []string{"Cancelled", "Expired"}
+
+// seatsQuery selects the appointments that hold seats in a slot
+func seatsQuery(db *gorm.DB) *gorm.DB {
+	return db.Model(&models.Appointment{}).Where("status NOT IN ?", ReleasedStatuses)
+}
+
+// SeatsTaken counts the seats held in a slot by appointments that are not
+// cancelled or expired
+func SeatsTaken(db *gorm.DB, availabilityID uint) (int, error) {
+	var taken int64
+	err := seatsQuery(db).
+		Where("availability_id = ?", availabilityID).
+		Select("COALESCE(SUM(seats), 0)").
+		Scan(&taken).Error
+	return int(taken), err
+}
+
+// ReserveSeats locks the slot row for the rest of tx so concurrent bookings
+// of the same slot are counted one after another, then checks that seats are
+// still free. The caller creates the appointment within the same tx.
+func ReserveSeats(tx *gorm.DB, availabilityID uint, seats int) (*models.Availability, error) {
+	var availability models.Availability
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&availability, availabilityID).Error; err != nil {
+		return nil, err
+	}
+
+	taken, err := SeatsTaken(tx, availability.ID)
+	if err != nil {
+		return nil, err
+	}
+	availability.SeatsTaken = taken
+
+	if seats < 1 || taken+seats > availability.Capacity {
+		return &availability, ErrSlotFull
+	}
+	return &availability, nil
+}
+
+// FillSeatsTaken sets SeatsTaken on each slot
+func FillSeatsTaken(db *gorm.DB, availabilities []models.Availability) error {
+	if len(availabilities) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(availabilities))
+	for i, availability := range availabilities {
+		ids[i] = availability.ID
+	}
+
+	var rows []struct {
+		AvailabilityID uint
+		Taken          int
+	}
+	if err := seatsQuery(db).
+		Where("availability_id IN ?", ids).
+		Select("availability_id, COALESCE(SUM(seats), 0) AS taken").
+		Group("availability_id").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	taken := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		taken[row.AvailabilityID] = row.Taken
+	}
+	for i := range availabilities {
+		availabilities[i].SeatsTaken = taken[availabilities[i].ID]
+	}
+	return nil
+}
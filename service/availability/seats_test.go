@@ -0,0 +1,185 @@
+package availability
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"gorm.io/gorm"
+)
+
+// book reserves seats in the slot for the trader, checks the expert's booking
+// limits and creates their appointment in its own transaction, as a checkout
+// does
+func book(db *gorm.DB, slotID, traderID uint, seats int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		slot, err := ReserveSeats(tx, slotID, seats)
+		if err != nil {
+			return err
+		}
+		if err := CheckBookingLimits(tx, slot, time.Now()); err != nil {
+			return err
+		}
+		return tx.Create(testdb.Appointment(slot, traderID, seats, fmt.Sprintf("APT-%d", traderID))).Error
+	})
+}
+
+// traders creates n traders and returns their IDs
+func traders(t *testing.T, db *gorm.DB, n int) []uint {
+	t.Helper()
+
+	ids := make([]uint, n)
+	for i := range ids {
+		ids[i] = testdb.User(t, db, fmt.Sprintf("Trader %d", i)).ID
+	}
+	return ids
+}
+
+func TestIsBookingLimitError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrBookingTooSoon, true},
+		{ErrBookingTooFar, true},
+		{ErrExpertDayFull, true},
+		{ErrBookingNoBuffer, true},
+		{ErrBookingSlotPassed, true},
+		{fmt.Errorf("booking: %w", ErrExpertDayFull), true},
+		{ErrSlotFull, false},
+		{gorm.ErrRecordNotFound, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsBookingLimitError(tt.err); got != tt.want {
+			t.Errorf("IsBookingLimitError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestReserveSeats(t *testing.T) {
+	db := testdb.Open(t, "availability")
+	expert := testdb.Expert(t, db, "Group Expert")
+	slot := testdb.Slot(t, db, expert, time.Now().Add(48*time.Hour).Truncate(time.Hour), 3, 5000)
+	ids := traders(t, db, 3)
+
+	if err := book(db, slot.ID, ids[0], 2); err != nil {
+		t.Fatalf("booking two of three seats: %v", err)
+	}
+	if err := book(db, slot.ID, ids[1], 2); !errors.Is(err, ErrSlotFull) {
+		t.Errorf("booking two more seats: error = %v, want %v", err, ErrSlotFull)
+	}
+	if err := book(db, slot.ID, ids[1], 0); !errors.Is(err, ErrSlotFull) {
+		t.Errorf("booking no seats: error = %v, want %v", err, ErrSlotFull)
+	}
+
+	// Cancelled and expired bookings give their seats back
+	db.Model(&models.Appointment{}).Where("trader_id = ?", ids[0]).Update("status", "Cancelled")
+	if err := book(db, slot.ID, ids[1], 3); err != nil {
+		t.Fatalf("booking the freed seats: %v", err)
+	}
+
+	slots := []models.Availability{*slot}
+	if err := FillSeatsTaken(db, slots); err != nil {
+		t.Fatal(err)
+	}
+	if slots[0].SeatsTaken != 3 {
+		t.Errorf("SeatsTaken = %d, want 3", slots[0].SeatsTaken)
+	}
+}
+
+func TestReserveSeatsRace(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		traders  int
+		seats    int
+		wantOK   int
+	}{
+		{name: "one seat, many traders", capacity: 1, traders: 8, seats: 1, wantOK: 1},
+		{name: "group session fills up", capacity: 5, traders: 8, seats: 1, wantOK: 5},
+		{name: "two seats each", capacity: 5, traders: 6, seats: 2, wantOK: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "availability")
+			expert := testdb.Expert(t, db, "Busy Expert")
+			slot := testdb.Slot(t, db, expert, time.Now().Add(48*time.Hour).Truncate(time.Hour), tt.capacity, 5000)
+			ids := traders(t, db, tt.traders)
+
+			ok := 0
+			for _, err := range testdb.Race(len(ids), func(i int) error { return book(db, slot.ID, ids[i], tt.seats) }) {
+				switch {
+				case err == nil:
+					ok++
+				case !errors.Is(err, ErrSlotFull):
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+			if ok != tt.wantOK {
+				t.Errorf("%d bookings went through, want %d", ok, tt.wantOK)
+			}
+
+			taken, err := SeatsTaken(db, slot.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if taken > tt.capacity {
+				t.Errorf("%d seats taken in a slot of %d", taken, tt.capacity)
+			}
+		})
+	}
+}
+
+func TestBookingLimitsRace(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits models.Expert
+		gap    time.Duration // Between the two slots
+		wantOK int
+		want   error
+	}{
+		{name: "daily limit", limits: models.Expert{MaxBookingsPerDay: 1}, gap: 2 * time.Hour, wantOK: 1, want: ErrExpertDayFull},
+		{name: "buffer between sessions", limits: models.Expert{BufferAfterMinutes: 30}, gap: 75 * time.Minute, wantOK: 1, want: ErrBookingNoBuffer},
+		{name: "no limits", gap: 2 * time.Hour, wantOK: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "availability")
+			expert := testdb.Expert(t, db, "Limited Expert")
+			if err := db.Model(expert).Updates(map[string]interface{}{
+				"max_bookings_per_day": tt.limits.MaxBookingsPerDay,
+				"buffer_after_minutes": tt.limits.BufferAfterMinutes,
+			}).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			// Two slots early on the same day, so they can't straddle midnight
+			day := time.Now().AddDate(0, 0, 3).UTC()
+			start := time.Date(day.Year(), day.Month(), day.Day(), 8, 0, 0, 0, time.UTC)
+			slotIDs := []uint{
+				testdb.Slot(t, db, expert, start, 1, 5000).ID,
+				testdb.Slot(t, db, expert, start.Add(tt.gap), 1, 5000).ID,
+			}
+			ids := traders(t, db, len(slotIDs))
+
+			ok := 0
+			for _, err := range testdb.Race(len(ids), func(i int) error { return book(db, slotIDs[i], ids[i], 1) }) {
+				switch {
+				case err == nil:
+					ok++
+				case tt.want == nil || !errors.Is(err, tt.want):
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+			if ok != tt.wantOK {
+				t.Errorf("%d bookings went through, want %d", ok, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,493 @@
+package availability
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/signals"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// waitlistOfferTTL is how long a freed seat is held for the trader it is
+// offered to; an offer never runs past the time bookings for the session close
+const waitlistOfferTTL = 30 * time.Minute
+
+// Waitlist entry statuses
+const (
+	WaitlistWaiting = "waiting"
+	WaitlistOffered = "offered"
+	WaitlistClaimed = "claimed"
+	WaitlistMissed  = "missed"
+	WaitlistLeft    = "left"
+)
+
+// Statuses of the slot hold behind an offer, as used by the appointment package
+const (
+	holdHeld    = "held"
+	holdExpired = "expired"
+)
+
+// WaitlistEntryResponse is an entry with its place in the expert's queue.
+// Position is only set while the entry is waiting.
+type WaitlistEntryResponse struct {
+	models.WaitlistEntry
+	Position int `json:"position,omitempty"`
+}
+
+// OfferSeats offers the free seats in a slot to the expert's waitlist, one
+// seat per entry in the order they joined, skipping entries whose date range
+// or category does not match, traders already booked into the slot and
+// traders who were offered the slot before and let it go. Each
+// seat is held for its trader by a pending appointment and slot hold, so it
+// can't be booked by anyone else until the offer runs out. The entries
+// offered a seat are returned so the caller can notify them after commit.
+func OfferSeats(tx *gorm.DB, availabilityID uint, now time.Time) ([]models.WaitlistEntry, error) {
+	var slot models.Availability
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&slot, availabilityID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	taken, err := SeatsTaken(tx, slot.ID)
+	if err != nil {
+		return nil, err
+	}
+	slot.SeatsTaken = taken
+
+	// Only offer seats the trader would be allowed to book
+	if err := CheckBookingLimits(tx, &slot, now); err != nil {
+		if IsBookingLimitError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// The offer ends before bookings for the session close
+	var expert models.Expert
+	if err := tx.Select("id", "min_notice_minutes").First(&expert, slot.ExpertID).Error; err != nil {
+		return nil, err
+	}
+	expiresAt := now.Add(waitlistOfferTTL)
+	if closes := slot.StartTime.Add(-settingsOf(&expert).notice()); closes.Before(expiresAt) {
+		expiresAt = closes
+	}
+
+	var offered []models.WaitlistEntry
+	for free := slot.Capacity - taken; free > 0; free-- {
+		var entry models.WaitlistEntry
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("expert_id = ? AND status = ?", slot.ExpertID, WaitlistWaiting).
+			Where("from_time IS NULL OR from_time <= ?", slot.StartTime).
+			Where("to_time IS NULL OR to_time > ?", slot.StartTime).
+			Where("category = '' OR LOWER(category) = LOWER(?)", slot.Category).
+			Where("offered_availability_id IS NULL OR offered_availability_id <> ?", slot.ID).
+			Where("trader_id NOT IN (?)", seatsQuery(tx).Select("trader_id").Where("availability_id = ?", slot.ID)).
+			Order("created_at, id").
+			First(&entry).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		appointment := models.Appointment{
+			TraderID:        entry.TraderID,
+			ExpertID:        slot.ExpertID,
+			AvailabilityID:  slot.ID,
+			AppointmentDate: slot.Date,
+			StartTime:       slot.StartTime,
+			EndTime:         slot.EndTime,
+			Status:          "Pending",
+			PaymentStatus:   "pending",
+			Seats:           1,
+			Amount:          slot.Price,
+			Currency:        slot.Currency,
+			EventName:       slot.EventName,
+			Category:        slot.Category,
+		}
+		if err := tx.Create(&appointment).Error; err != nil {
+			return nil, err
+		}
+
+		hold := models.SlotHold{
+			AvailabilityID: slot.ID,
+			AppointmentID:  appointment.ID,
+			TraderID:       entry.TraderID,
+			Seats:          1,
+			Reference:      fmt.Sprintf("WL-%d-%d", entry.ID, appointment.ID),
+			Status:         holdHeld,
+			ExpiresAt:      expiresAt,
+		}
+		if err := tx.Create(&hold).Error; err != nil {
+			return nil, err
+		}
+
+		entry.Status = WaitlistOffered
+		entry.OfferedAvailabilityID = &slot.ID
+		entry.OfferAppointmentID = &appointment.ID
+		entry.OfferedAt = &now
+		entry.OfferExpiresAt = &expiresAt
+		if err := tx.Save(&entry).Error; err != nil {
+			return nil, err
+		}
+
+		entry.OfferedAvailability = &slot
+		offered = append(offered, entry)
+	}
+	return offered, nil
+}
+
+// ExpireWaitlistOffers marks offers that ran out unclaimed as missed. Their
+// seats are freed by the appointment package's hold sweeper, which then
+// offers them to the next trader in line.
+func ExpireWaitlistOffers(tx *gorm.DB, now time.Time) (int64, error) {
+	result := tx.Model(&models.WaitlistEntry{}).
+		Where("status = ? AND offer_expires_at <= ?", WaitlistOffered, now).
+		Update("status", WaitlistMissed)
+	return result.RowsAffected, result.Error
+}
+
+// ClaimWaitlistOffer gives up the seat held for the trader's offer on the
+// slot, if any, so the trader can book it through the usual checkout within
+// the same tx. Call it before the seats are reserved. The entry is marked
+// claimed, but goes back to the queue if the checkout is abandoned or
+// declined; see RestoreWaitlistClaim.
+func ClaimWaitlistOffer(tx *gorm.DB, traderID, availabilityID uint) error {
+	var entry models.WaitlistEntry
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("trader_id = ? AND offered_availability_id = ? AND status = ?", traderID, availabilityID, WaitlistOffered).
+		First(&entry).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return releaseOffer(tx, &entry, WaitlistClaimed)
+}
+
+// RestoreWaitlistClaim puts the trader's entry claimed for the slot back in
+// the queue, in the place it had, once the checkout that claimed it is
+// released unpaid. Entries of traders still booked into the slot are left
+// claimed. The trader isn't offered the same slot again.
+func RestoreWaitlistClaim(tx *gorm.DB, traderID, availabilityID uint) error {
+	return tx.Model(&models.WaitlistEntry{}).
+		Where("trader_id = ? AND offered_availability_id = ? AND status = ?", traderID, availabilityID, WaitlistClaimed).
+		Where("trader_id NOT IN (?)", seatsQuery(tx).Select("trader_id").Where("availability_id = ?", availabilityID)).
+		Updates(map[string]interface{}{
+			"status":               WaitlistWaiting,
+			"offer_appointment_id": nil,
+			"offered_at":           nil,
+			"offer_expires_at":     nil,
+		}).Error
+}
+
+// releaseOffer frees the seat held for entry's offer and moves the entry to status
+func releaseOffer(tx *gorm.DB, entry *models.WaitlistEntry, status string) error {
+	if entry.OfferAppointmentID != nil {
+		if err := tx.Model(&models.Appointment{}).
+			Where("id = ? AND payment_status = ?", *entry.OfferAppointmentID, "pending").
+			Updates(map[string]interface{}{"status": "Expired", "payment_status": "expired"}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.SlotHold{}).
+			Where("appointment_id = ? AND status = ?", *entry.OfferAppointmentID, holdHeld).
+			Update("status", holdExpired).Error; err != nil {
+			return err
+		}
+	}
+	entry.Status = status
+	return tx.Model(entry).Update("status", status).Error
+}
+
+// OfferWaitlist offers the slot's free seats to the waitlist in its own
+// transaction and notifies the traders who were offered one. Errors are
+// logged, as the change that freed the seats has already been made.
+func OfferWaitlist(db *gorm.DB, notifier signals.NotificationSender, availabilityID uint) {
+	var offered []models.WaitlistEntry
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		offered, err = OfferSeats(tx, availabilityID, time.Now())
+		return err
+	})
+	if err != nil {
+		log.Printf("Error offering slot %d to the waitlist: %v", availabilityID, err)
+		return
+	}
+
+	for i := range offered {
+		notifyWaitlistOffer(db, notifier, &offered[i])
+	}
+}
+
+// notifyWaitlistOffer tells the trader by push and email that a seat is held
+// for them, with times in their own zone
+func notifyWaitlistOffer(db *gorm.DB, notifier signals.NotificationSender, entry *models.WaitlistEntry) {
+	var trader models.User
+	if err := db.First(&trader, entry.TraderID).Error; err != nil {
+		log.Printf("Error loading trader %d for waitlist offer: %v", entry.TraderID, err)
+		return
+	}
+	var expert models.Expert
+	if err := db.Preload("User").First(&expert, entry.ExpertID).Error; err != nil {
+		log.Printf("Error loading expert %d for waitlist offer: %v", entry.ExpertID, err)
+		return
+	}
+
+	slot := entry.OfferedAvailability
+	loc := utils.LoadZone(trader.TimeZone)
+	expertName := "your expert"
+	if expert.User != nil {
+		expertName = expert.User.FullName
+	}
+	title := fmt.Sprintf("A seat opened up with %s", expertName)
+	body := fmt.Sprintf("\"%s\" on %s is held for you until %s. Book it before then to keep it.",
+		slot.EventName,
+		slot.StartTime.In(loc).Format("Mon 2 Jan 2006, 15:04 MST"),
+		entry.OfferExpiresAt.In(loc).Format("15:04 MST"))
+
+	data := map[string]interface{}{
+		"type":              "waitlist_offer",
+		"waitlist_entry_id": entry.ID,
+		"availability_id":   slot.ID,
+		"expert_id":         entry.ExpertID,
+	}
+	if _, err := notifier.SendUserNotification(strconv.FormatUint(uint64(trader.ID), 10), title, body, data); err != nil {
+		log.Printf("Error pushing waitlist offer %d to user %d: %v", entry.ID, trader.ID, err)
+	}
+	if trader.Email != "" {
+		if err := utils.SendEmail(trader.Email, title, body, ""); err != nil {
+			log.Printf("Error emailing waitlist offer %d to user %d: %v", entry.ID, trader.ID, err)
+		}
+	}
+}
+
+// waitlistPosition is the entry's 1-based place among the expert's waiting entries
+func waitlistPosition(db *gorm.DB, entry *models.WaitlistEntry) (int, error) {
+	var ahead int64
+	err := db.Model(&models.WaitlistEntry{}).
+		Where("expert_id = ? AND status = ?", entry.ExpertID, WaitlistWaiting).
+		Where("created_at < ? OR (created_at = ? AND id < ?)", entry.CreatedAt, entry.CreatedAt, entry.ID).
+		Count(&ahead).Error
+	return int(ahead) + 1, err
+}
+
+// newWaitlistResponse adds the entry's position when it is waiting
+func newWaitlistResponse(db *gorm.DB, entry models.WaitlistEntry) (WaitlistEntryResponse, error) {
+	response := WaitlistEntryResponse{WaitlistEntry: entry}
+	if entry.Status == WaitlistWaiting {
+		position, err := waitlistPosition(db, &entry)
+		if err != nil {
+			return response, err
+		}
+		response.Position = position
+	}
+	return response, nil
+}
+
+// JoinWaitlist puts the signed-in trader on the expert's waitlist. The
+// optional from and to (RFC 3339 or YYYY-MM-DD in the trader's zone) and
+// category limit which freed seats they are offered.
+func (h *AvailabilityHandler) JoinWaitlist(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	expertID, err := strconv.ParseUint(mux.Vars(r)["expertId"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid expert ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		From     string `json:"from"`
+		To       string `json:"to"`
+		Category string `json:"category"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var expert models.Expert
+	if err := h.db.First(&expert, expertID).Error; err != nil {
+		http.Error(w, "Expert not found", http.StatusNotFound)
+		return
+	}
+	if expert.UserID == userID {
+		http.Error(w, "You can't join your own waitlist", http.StatusBadRequest)
+		return
+	}
+
+	entry := models.WaitlistEntry{
+		ExpertID: expert.ID,
+		TraderID: userID,
+		Category: strings.TrimSpace(req.Category),
+		Status:   WaitlistWaiting,
+	}
+	loc := utils.RequestZone(h.db, r)
+	if req.From != "" {
+		from, ok := parseSearchTime(req.From, loc, false)
+		if !ok {
+			http.Error(w, "Invalid from; use RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		entry.From = &from
+	}
+	if req.To != "" {
+		to, ok := parseSearchTime(req.To, loc, true)
+		if !ok {
+			http.Error(w, "Invalid to; use RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		if !to.After(time.Now()) || (entry.From != nil && !to.After(*entry.From)) {
+			http.Error(w, "to must be in the future and after from", http.StatusBadRequest)
+			return
+		}
+		entry.To = &to
+	}
+
+	var active int64
+	if err := h.db.Model(&models.WaitlistEntry{}).
+		Where("expert_id = ? AND trader_id = ? AND status IN ?", expert.ID, userID, []string{WaitlistWaiting, WaitlistOffered}).
+		Count(&active).Error; err != nil {
+		http.Error(w, "Error joining waitlist", http.StatusInternalServerError)
+		return
+	}
+	if active > 0 {
+		http.Error(w, "You are already on this expert's waitlist", http.StatusConflict)
+		return
+	}
+
+	if err := h.db.Create(&entry).Error; err != nil {
+		http.Error(w, "Error joining waitlist", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := newWaitlistResponse(h.db, entry)
+	if err != nil {
+		http.Error(w, "Error loading waitlist position", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// GetMyWaitlist lists the signed-in trader's waiting and offered entries
+func (h *AvailabilityHandler) GetMyWaitlist(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var entries []models.WaitlistEntry
+	if err := h.db.Preload("OfferedAvailability").
+		Where("trader_id = ? AND status IN ?", userID, []string{WaitlistWaiting, WaitlistOffered}).
+		Order("created_at").
+		Find(&entries).Error; err != nil {
+		http.Error(w, "Error fetching waitlist", http.StatusInternalServerError)
+		return
+	}
+
+	loc := utils.RequestZone(h.db, r)
+	responses := make([]WaitlistEntryResponse, 0, len(entries))
+	for _, entry := range entries {
+		if entry.OfferedAvailability != nil {
+			renderSlot(entry.OfferedAvailability, loc)
+		}
+		response, err := newWaitlistResponse(h.db, entry)
+		if err != nil {
+			http.Error(w, "Error loading waitlist position", http.StatusInternalServerError)
+			return
+		}
+		responses = append(responses, response)
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+// LeaveWaitlist takes the trader off a waitlist. A seat held for them is
+// offered to the next trader in line.
+func (h *AvailabilityHandler) LeaveWaitlist(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	entryID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid waitlist entry ID", http.StatusBadRequest)
+		return
+	}
+
+	var entry models.WaitlistEntry
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND trader_id = ? AND status IN ?", entryID, userID, []string{WaitlistWaiting, WaitlistOffered}).
+			First(&entry).Error; err != nil {
+			return err
+		}
+		return releaseOffer(tx, &entry, WaitlistLeft)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Waitlist entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error leaving waitlist", http.StatusInternalServerError)
+		return
+	}
+
+	if entry.OfferedAvailabilityID != nil {
+		go OfferWaitlist(h.db, h.notifier, *entry.OfferedAvailabilityID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetExpertWaitlist lists the traders waiting for the expert, in order. Only
+// the expert and admins can see it.
+func (h *AvailabilityHandler) GetExpertWaitlist(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	var entries []models.WaitlistEntry
+	if err := h.db.Preload("OfferedAvailability").
+		Where("expert_id = ? AND status IN ?", expert.ID, []string{WaitlistWaiting, WaitlistOffered}).
+		Order("created_at, id").
+		Find(&entries).Error; err != nil {
+		http.Error(w, "Error fetching waitlist", http.StatusInternalServerError)
+		return
+	}
+
+	loc := utils.RequestZone(h.db, r)
+	responses := make([]WaitlistEntryResponse, len(entries))
+	position := 0
+	for i, entry := range entries {
+		if entry.OfferedAvailability != nil {
+			renderSlot(entry.OfferedAvailability, loc)
+		}
+		responses[i] = WaitlistEntryResponse{WaitlistEntry: entry}
+		if entry.Status == WaitlistWaiting {
+			position++
+			responses[i].Position = position
+		}
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
@@ -0,0 +1,263 @@
+package availability
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/signals/signalstest"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// join puts the trader on the expert's waitlist, limited as entry is
+func join(t *testing.T, db *gorm.DB, expertID, traderID uint, entry models.WaitlistEntry) *models.WaitlistEntry {
+	t.Helper()
+
+	entry.ExpertID, entry.TraderID, entry.Status = expertID, traderID, WaitlistWaiting
+	if err := db.Create(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &entry
+}
+
+// offer runs OfferSeats for the slot in a transaction and returns the IDs of
+// the entries offered a seat
+func offer(t *testing.T, db *gorm.DB, slotID uint, now time.Time) []uint {
+	t.Helper()
+
+	var offered []models.WaitlistEntry
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		offered, err = OfferSeats(tx, slotID, now)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("offering slot %d: %v", slotID, err)
+	}
+	ids := make([]uint, len(offered))
+	for i, entry := range offered {
+		ids[i] = entry.ID
+	}
+	return ids
+}
+
+// entryStatus reloads the entry's status
+func entryStatus(db *gorm.DB, entry *models.WaitlistEntry) string {
+	var got models.WaitlistEntry
+	db.First(&got, entry.ID)
+	return got.Status
+}
+
+func TestOfferSeats(t *testing.T) {
+	db := testdb.Open(t, "availability")
+	now := time.Now().Truncate(time.Microsecond) // As Postgres stores it
+	expert := testdb.Expert(t, db, "Waitlisted Expert")
+	slot := testdb.Slot(t, db, expert, now.Add(48*time.Hour).Truncate(time.Hour), 2, 5000)
+	ids := traders(t, db, 5)
+	if err := book(db, slot.ID, ids[0], 1); err != nil {
+		t.Fatal(err)
+	}
+
+	past := slot.StartTime.Add(-time.Hour)
+	join(t, db, expert.ID, ids[0], models.WaitlistEntry{})                   // Already booked into the slot
+	join(t, db, expert.ID, ids[1], models.WaitlistEntry{Category: "crypto"}) // Another category
+	join(t, db, expert.ID, ids[2], models.WaitlistEntry{To: &past})          // Only before the slot
+	first := join(t, db, expert.ID, ids[3], models.WaitlistEntry{})
+	second := join(t, db, expert.ID, ids[4], models.WaitlistEntry{})
+
+	if offered := offer(t, db, slot.ID, now); len(offered) != 1 || offered[0] != first.ID {
+		t.Fatalf("offered %v, want entry %d", offered, first.ID)
+	}
+	var entry models.WaitlistEntry
+	db.First(&entry, first.ID)
+	if entry.Status != WaitlistOffered || entry.OfferExpiresAt == nil || !entry.OfferExpiresAt.Equal(now.Add(waitlistOfferTTL)) {
+		t.Errorf("entry = %s until %v", entry.Status, entry.OfferExpiresAt)
+	}
+
+	// The seat is held, so there is nothing more to offer
+	if taken, _ := SeatsTaken(db, slot.ID); taken != 2 {
+		t.Errorf("%d seats taken, want 2", taken)
+	}
+	if offered := offer(t, db, slot.ID, now); len(offered) != 0 {
+		t.Errorf("offered %v from a full slot", offered)
+	}
+
+	// The offer runs out and its seat goes to the next in line
+	later := now.Add(waitlistOfferTTL)
+	if missed, err := ExpireWaitlistOffers(db, later); err != nil || missed != 1 {
+		t.Fatalf("expired %d offers, error %v", missed, err)
+	}
+	db.Model(&models.Appointment{}).Where("id = ?", *entry.OfferAppointmentID).Update("status", "Expired")
+	if offered := offer(t, db, slot.ID, later); len(offered) != 1 || offered[0] != second.ID {
+		t.Errorf("offered %v, want entry %d", offered, second.ID)
+	}
+	if got := entryStatus(db, first); got != WaitlistMissed {
+		t.Errorf("first entry is %s, want %s", got, WaitlistMissed)
+	}
+}
+
+func TestOfferSeatsBeforeBookingsClose(t *testing.T) {
+	db := testdb.Open(t, "availability")
+	now := time.Now().Truncate(time.Microsecond)
+	expert := testdb.Expert(t, db, "Notice Expert")
+	db.Model(expert).Update("min_notice_minutes", 60)
+	trader := testdb.User(t, db, "Late Trader")
+	join(t, db, expert.ID, trader.ID, models.WaitlistEntry{})
+
+	// Bookings close in 15 minutes, before the offer would run out
+	soon := testdb.Slot(t, db, expert, now.Add(75*time.Minute), 1, 5000)
+	offer(t, db, soon.ID, now)
+	var entry models.WaitlistEntry
+	db.Where("trader_id = ?", trader.ID).First(&entry)
+	if entry.OfferExpiresAt == nil || !entry.OfferExpiresAt.Equal(soon.StartTime.Add(-time.Hour)) {
+		t.Errorf("offer expires at %v, want %v", entry.OfferExpiresAt, soon.StartTime.Add(-time.Hour))
+	}
+
+	// Bookings have closed, so the seat isn't offered
+	closed := testdb.Slot(t, db, expert, now.Add(30*time.Minute), 1, 5000)
+	other := testdb.User(t, db, "Another Trader")
+	join(t, db, expert.ID, other.ID, models.WaitlistEntry{})
+	if offered := offer(t, db, closed.ID, now); len(offered) != 0 {
+		t.Errorf("offered %v after bookings closed", offered)
+	}
+}
+
+func TestClaimWaitlistOffer(t *testing.T) {
+	db := testdb.Open(t, "availability")
+	now := time.Now()
+	expert := testdb.Expert(t, db, "Claimed Expert")
+	slot := testdb.Slot(t, db, expert, now.Add(48*time.Hour).Truncate(time.Hour), 1, 5000)
+	trader := testdb.User(t, db, "Claiming Trader")
+	entry := join(t, db, expert.ID, trader.ID, models.WaitlistEntry{})
+	offer(t, db, slot.ID, now)
+
+	// Claiming gives up the held seat so the checkout can take it
+	claim := func(tx *gorm.DB) error { return ClaimWaitlistOffer(tx, trader.ID, slot.ID) }
+	if err := db.Transaction(claim); err != nil {
+		t.Fatal(err)
+	}
+	if got := entryStatus(db, entry); got != WaitlistClaimed {
+		t.Errorf("entry is %s, want %s", got, WaitlistClaimed)
+	}
+	if taken, _ := SeatsTaken(db, slot.ID); taken != 0 {
+		t.Errorf("%d seats still held", taken)
+	}
+
+	// The checkout was abandoned, so the trader goes back to the queue
+	restore := func(tx *gorm.DB) error { return RestoreWaitlistClaim(tx, trader.ID, slot.ID) }
+	if err := db.Transaction(restore); err != nil {
+		t.Fatal(err)
+	}
+	if got := entryStatus(db, entry); got != WaitlistWaiting {
+		t.Errorf("entry is %s after restoring, want %s", got, WaitlistWaiting)
+	}
+	// ...but isn't offered the same slot again
+	if offered := offer(t, db, slot.ID, now); len(offered) != 0 {
+		t.Errorf("offered %v the same slot again", offered)
+	}
+
+	// A trader who did book keeps their claim
+	db.Model(entry).Update("status", WaitlistClaimed)
+	if err := book(db, slot.ID, trader.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Transaction(restore); err != nil {
+		t.Fatal(err)
+	}
+	if got := entryStatus(db, entry); got != WaitlistClaimed {
+		t.Errorf("booked trader's entry is %s, want %s", got, WaitlistClaimed)
+	}
+}
+
+func TestOfferWaitlist(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	db := testdb.Open(t, "availability")
+	expert := testdb.Expert(t, db, "Notifying Expert")
+	slot := testdb.Slot(t, db, expert, time.Now().Add(48*time.Hour).Truncate(time.Hour), 1, 5000)
+	trader := testdb.User(t, db, "Notified Trader")
+	entry := join(t, db, expert.ID, trader.ID, models.WaitlistEntry{})
+
+	notifier := &signalstest.Notifier{}
+	OfferWaitlist(db, notifier, slot.ID)
+
+	sent := notifier.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d notifications, want 1", len(sent))
+	}
+	if sent[0].UserID != fmt.Sprint(trader.ID) || sent[0].Title != "A seat opened up with Notifying Expert" {
+		t.Errorf("notification = %+v", sent[0])
+	}
+	if sent[0].Data["type"] != "waitlist_offer" || sent[0].Data["waitlist_entry_id"] != entry.ID {
+		t.Errorf("data = %v", sent[0].Data)
+	}
+}
+
+func TestJoinWaitlist(t *testing.T) {
+	db := testdb.Open(t, "availability")
+	h := &AvailabilityHandler{db: db}
+	expert := testdb.Expert(t, db, "Queue Expert")
+	ids := traders(t, db, 2)
+
+	call := func(handler http.HandlerFunc, userID uint, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(body)
+		r := testdb.AsUser(httptest.NewRequest(http.MethodPost, "/", &buf), userID)
+		w := httptest.NewRecorder()
+		handler(w, mux.SetURLVars(r, vars))
+		return w
+	}
+	expertVars := map[string]string{"expertId": fmt.Sprint(expert.ID)}
+
+	var entries []WaitlistEntryResponse
+	for _, id := range ids {
+		w := call(h.JoinWaitlist, id, expertVars, map[string]string{"category": " forex "})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		var entry WaitlistEntryResponse
+		json.NewDecoder(w.Body).Decode(&entry)
+		entries = append(entries, entry)
+	}
+	if entries[0].Position != 1 || entries[1].Position != 2 || entries[0].Category != "forex" {
+		t.Errorf("entries = %+v", entries)
+	}
+
+	tests := []struct {
+		name   string
+		userID uint
+		body   map[string]string
+		want   int
+	}{
+		{name: "already waiting", userID: ids[0], want: http.StatusConflict},
+		{name: "own waitlist", userID: expert.UserID, want: http.StatusBadRequest},
+		{name: "bad from", userID: ids[0], body: map[string]string{"from": "next week"}, want: http.StatusBadRequest},
+		{name: "to in the past", userID: ids[0], body: map[string]string{"to": "2020-01-01"}, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := call(h.JoinWaitlist, tt.userID, expertVars, tt.body); w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	// Leaving moves the next trader up
+	leaveVars := map[string]string{"id": fmt.Sprint(entries[0].ID)}
+	if w := call(h.LeaveWaitlist, ids[1], leaveVars, nil); w.Code != http.StatusNotFound {
+		t.Errorf("leaving another trader's entry: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := call(h.LeaveWaitlist, ids[0], leaveVars, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("leaving: status = %d", w.Code)
+	}
+	w := call(h.GetMyWaitlist, ids[1], nil, nil)
+	var mine []WaitlistEntryResponse
+	json.NewDecoder(w.Body).Decode(&mine)
+	if len(mine) != 1 || mine[0].Position != 1 {
+		t.Errorf("waitlist = %+v, want first in line", mine)
+	}
+}
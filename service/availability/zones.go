@@ -0,0 +1,59 @@
+package availability
+
+import (
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"gorm.io/gorm"
+)
+
+// localDate returns the calendar date of t in loc, as a UTC midnight
+func localDate(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// dateOf returns the UTC midnight starting t's day
+func dateOf(t time.Time) time.Time {
+	return localDate(t, time.UTC)
+}
+
+// dayBounds returns the instants a calendar date starts and ends at in loc.
+// Days are 23 or 25 hours long when daylight saving changes.
+func dayBounds(date time.Time, loc *time.Location) (time.Time, time.Time) {
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, loc)
+	return start.UTC(), end.UTC()
+}
+
+// expertZone returns the time zone of the expert
+func expertZone(db *gorm.DB, expertID uint) *time.Location {
+	var expert models.Expert
+	if err := db.Select("id", "time_zone").First(&expert, expertID).Error; err != nil {
+		return time.UTC
+	}
+	return utils.LoadZone(expert.TimeZone)
+}
+
+// normalizeSlot stores the slot's times as UTC instants and sets Date to
+// the calendar date the slot starts on in the expert's zone
+func normalizeSlot(slot *models.Availability, expertLoc *time.Location) {
+	slot.StartTime = slot.StartTime.UTC()
+	slot.EndTime = slot.EndTime.UTC()
+	slot.Date = localDate(slot.StartTime, expertLoc)
+}
+
+// renderSlots shows each slot's times in loc
+func renderSlots(slots []models.Availability, loc *time.Location) {
+	for i := range slots {
+		renderSlot(&slots[i], loc)
+	}
+}
+
+// renderSlot shows the slot's times in loc
+func renderSlot(slot *models.Availability, loc *time.Location) {
+	slot.StartTime = slot.StartTime.In(loc)
+	slot.EndTime = slot.EndTime.In(loc)
+	slot.TimeZone = loc.String()
+}
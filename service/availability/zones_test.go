@@ -0,0 +1,71 @@
+package availability
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+)
+
+func TestLocalDate(t *testing.T) {
+	instant := time.Date(2026, 3, 2, 23, 30, 0, 0, time.UTC)
+	tests := []struct{ zone, want string }{
+		{"UTC", "2026-03-02"},
+		{"Africa/Accra", "2026-03-02"},
+		{"Africa/Lagos", "2026-03-03"}, // Already past midnight
+		{"America/New_York", "2026-03-02"},
+	}
+	for _, tt := range tests {
+		date := localDate(instant, utils.LoadZone(tt.zone))
+		if date.Format("2006-01-02") != tt.want || date.Location() != time.UTC || date.Hour() != 0 {
+			t.Errorf("localDate in %s = %v, want %s at UTC midnight", tt.zone, date, tt.want)
+		}
+	}
+}
+
+func TestDayBounds(t *testing.T) {
+	london := utils.LoadZone("Europe/London")
+	tests := []struct {
+		date       time.Time
+		start, end string
+		hours      float64
+	}{
+		{time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), "2026-03-02T00:00:00Z", "2026-03-03T00:00:00Z", 24},
+		{time.Date(2026, 3, 29, 0, 0, 0, 0, time.UTC), "2026-03-29T00:00:00Z", "2026-03-29T23:00:00Z", 23},  // Clocks go forward
+		{time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC), "2026-10-24T23:00:00Z", "2026-10-26T00:00:00Z", 25}, // and back
+	}
+	for _, tt := range tests {
+		start, end := dayBounds(tt.date, london)
+		if start.Format(time.RFC3339) != tt.start || end.Format(time.RFC3339) != tt.end || end.Sub(start).Hours() != tt.hours {
+			t.Errorf("dayBounds(%s) = %s to %s, want %s to %s", tt.date.Format("2006-01-02"), start.Format(time.RFC3339), end.Format(time.RFC3339), tt.start, tt.end)
+		}
+	}
+}
+
+func TestNormalizeAndRenderSlot(t *testing.T) {
+	lagos := utils.LoadZone("Africa/Lagos")
+	newYork := utils.LoadZone("America/New_York")
+
+	// An expert in Lagos offering 00:30 local time, which is still the day before in UTC
+	slot := models.Availability{
+		StartTime: time.Date(2026, 3, 3, 0, 30, 0, 0, lagos),
+		EndTime:   time.Date(2026, 3, 3, 1, 30, 0, 0, lagos),
+	}
+	normalizeSlot(&slot, lagos)
+	if slot.StartTime.Location() != time.UTC || slot.StartTime.Format(time.RFC3339) != "2026-03-02T23:30:00Z" {
+		t.Errorf("stored start = %s, want 2026-03-02T23:30:00Z", slot.StartTime.Format(time.RFC3339))
+	}
+	if slot.Date.Format("2006-01-02") != "2026-03-03" {
+		t.Errorf("date = %s, want the expert's 2026-03-03", slot.Date.Format("2006-01-02"))
+	}
+
+	slots := []models.Availability{slot}
+	renderSlots(slots, newYork)
+	if got := slots[0].StartTime.Format(time.RFC3339); got != "2026-03-02T18:30:00-05:00" || slots[0].TimeZone != "America/New_York" {
+		t.Errorf("rendered start = %s in %s", got, slots[0].TimeZone)
+	}
+	if !slots[0].StartTime.Equal(slot.StartTime) {
+		t.Error("rendering moved the slot")
+	}
+}
@@ -0,0 +1,177 @@
+package calendar
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+)
+
+// iCalendar methods; feeds publish, invites request or cancel
+const (
+	MethodPublish = "PUBLISH"
+	MethodRequest = "REQUEST"
+	MethodCancel  = "CANCEL"
+)
+
+const prodID = "-//KodeFX//Appointments//EN"
+
+// Event is a VEVENT in an iCalendar document
+type Event struct {
+	UID         string
+	Sequence    int
+	Summary     string
+	Description string
+	Start       time.Time
+	End         time.Time
+	Status      string // CONFIRMED, TENTATIVE, CANCELLED
+	Transparent bool   // Shown as free time, e.g. open slots
+	Organizer   *Person
+	Attendees   []Person
+	Updated     time.Time
+}
+
+// Person is an organizer or attendee of an event
+type Person struct {
+	Name  string
+	Email string
+}
+
+// Render builds an iCalendar document holding events
+func Render(name, method string, events []Event, now time.Time) []byte {
+	var buf bytes.Buffer
+	write := func(line string) {
+		buf.WriteString(fold(line))
+		buf.WriteString("\r\n")
+	}
+
+	write("BEGIN:VCALENDAR")
+	write("VERSION:2.0")
+	write("PRODID:" + prodID)
+	write("CALSCALE:GREGORIAN")
+	write("METHOD:" + method)
+	if name != "" {
+		write("X-WR-CALNAME:" + escape(name))
+	}
+
+	for _, event := range events {
+		write("BEGIN:VEVENT")
+		write("UID:" + event.UID)
+		write(fmt.Sprintf("SEQUENCE:%d", event.Sequence))
+		write("DTSTAMP:" + formatTime(now))
+		if !event.Updated.IsZero() {
+			write("LAST-MODIFIED:" + formatTime(event.Updated))
+		}
+		write("DTSTART:" + formatTime(event.Start))
+		write("DTEND:" + formatTime(event.End))
+		write("SUMMARY:" + escape(event.Summary))
+		if event.Description != "" {
+			write("DESCRIPTION:" + escape(event.Description))
+		}
+		if event.Status != "" {
+			write("STATUS:" + event.Status)
+		}
+		if event.Transparent {
+			write("TRANSP:TRANSPARENT")
+		} else {
+			write("TRANSP:OPAQUE")
+		}
+		if event.Organizer != nil && event.Organizer.Email != "" {
+			write(fmt.Sprintf("ORGANIZER;CN=%s:mailto:%s", paramValue(event.Organizer.Name), event.Organizer.Email))
+		}
+		for _, attendee := range event.Attendees {
+			if attendee.Email == "" {
+				continue
+			}
+			write(fmt.Sprintf("ATTENDEE;CN=%s;ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED:mailto:%s", paramValue(attendee.Name), attendee.Email))
+		}
+		write("END:VEVENT")
+	}
+
+	write("END:VCALENDAR")
+	return buf.Bytes()
+}
+
+// AppointmentEvent describes appointment as an event. The trader and the
+// expert's user are included when loaded.
+func AppointmentEvent(appointment *models.Appointment) Event {
+	event := Event{
+		UID:         fmt.Sprintf("appointment-%d@kodefx", appointment.ID),
+		Sequence:    appointment.CalendarSequence,
+		Summary:     appointment.EventName,
+		Description: "KodeFX session. Join the meeting from the app shortly before it starts.",
+		Start:       appointment.StartTime,
+		End:         appointment.EndTime,
+		Status:      "CONFIRMED",
+		Updated:     appointment.UpdatedAt,
+	}
+	if appointment.Status == "Cancelled" {
+		event.Status = "CANCELLED"
+	}
+	if appointment.Seats > 1 {
+		event.Description = fmt.Sprintf("KodeFX group session, %d seats. Join the meeting from the app shortly before it starts.", appointment.Seats)
+	}
+
+	if appointment.Expert != nil && appointment.Expert.User != nil {
+		event.Organizer = &Person{Name: appointment.Expert.User.FullName, Email: appointment.Expert.User.Email}
+	}
+	if appointment.Trader != nil {
+		event.Attendees = append(event.Attendees, Person{Name: appointment.Trader.FullName, Email: appointment.Trader.Email})
+	}
+	return event
+}
+
+// AvailabilityEvent describes an open slot as free time in the expert's calendar
+func AvailabilityEvent(slot *models.Availability) Event {
+	description := "Open for booking"
+	if slot.Capacity > 1 {
+		description = fmt.Sprintf("%d of %d seats booked", slot.SeatsTaken, slot.Capacity)
+	}
+	return Event{
+		UID:         fmt.Sprintf("availability-%d@kodefx", slot.ID),
+		Summary:     "Available: " + slot.EventName,
+		Description: description,
+		Start:       slot.StartTime,
+		End:         slot.EndTime,
+		Status:      "TENTATIVE",
+		Transparent: true,
+		Updated:     slot.UpdatedAt,
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// escape escapes a TEXT value
+func escape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// paramValue quotes a parameter value such as a name, which may not hold quotes
+func paramValue(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, "'") + `"`
+}
+
+// fold splits a content line into lines of at most 75 octets, continuing
+// each with a space, without breaking UTF-8 characters
+func fold(line string) string {
+	if len(line) <= 75 {
+		return line
+	}
+
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > 75 {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
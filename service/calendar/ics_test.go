@@ -0,0 +1,104 @@
+package calendar
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+)
+
+func TestRender(t *testing.T) {
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	lagos := time.FixedZone("WAT", 3600)
+	event := Event{
+		UID:         "appointment-7@kodefx",
+		Sequence:    2,
+		Summary:     "Scalping; entries, exits",
+		Description: "Line one\nLine two",
+		Start:       time.Date(2026, 3, 2, 19, 0, 0, 0, lagos),
+		End:         time.Date(2026, 3, 2, 20, 0, 0, 0, lagos),
+		Status:      "CONFIRMED",
+		Organizer:   &Person{Name: `Ama "The Analyst"`, Email: "ama@example.com"},
+		Attendees:   []Person{{Name: "Kofi", Email: "kofi@example.com"}, {Name: "No Email"}},
+	}
+
+	ics := string(Render("KodeFX", MethodRequest, []Event{event}, now))
+	if !strings.HasSuffix(ics, "END:VCALENDAR\r\n") || strings.Contains(strings.ReplaceAll(ics, "\r\n", ""), "\n") {
+		t.Fatal("lines must end in CRLF")
+	}
+	unfolded := strings.ReplaceAll(ics, "\r\n ", "")
+	for _, want := range []string{
+		"METHOD:REQUEST",
+		"X-WR-CALNAME:KodeFX",
+		"SEQUENCE:2",
+		"DTSTAMP:20260301T090000Z",
+		"DTSTART:20260302T180000Z", // In UTC
+		"DTEND:20260302T190000Z",
+		`SUMMARY:Scalping\; entries\, exits`,
+		`DESCRIPTION:Line one\nLine two`,
+		"TRANSP:OPAQUE",
+		`ORGANIZER;CN="Ama 'The Analyst'":mailto:ama@example.com`,
+		`ATTENDEE;CN="Kofi";ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED:mailto:kofi@example.com`,
+	} {
+		if !strings.Contains(unfolded, want+"\r\n") {
+			t.Errorf("no line %s in:\n%s", want, ics)
+		}
+	}
+	if strings.Contains(ics, "No Email") {
+		t.Error("attendee without an email listed")
+	}
+}
+
+func TestFold(t *testing.T) {
+	tests := []string{
+		"SUMMARY:short",
+		"DESCRIPTION:" + strings.Repeat("a", 200),
+		"SUMMARY:" + strings.Repeat("GH₵ ", 40), // Multi-byte characters must not be split
+	}
+	for _, line := range tests {
+		folded := fold(line)
+		parts := strings.Split(folded, "\r\n")
+		for i, part := range parts {
+			if len(part) > 75 || !utf8.ValidString(part) {
+				t.Errorf("part %d of %q is %d octets or not UTF-8", i, line[:20], len(part))
+			}
+			if i > 0 && !strings.HasPrefix(part, " ") {
+				t.Errorf("continuation %d does not start with a space", i)
+			}
+		}
+		if unfolded := strings.ReplaceAll(folded, "\r\n ", ""); unfolded != line {
+			t.Errorf("unfolding %q gives %q", line[:20], unfolded)
+		}
+	}
+}
+
+func TestAppointmentEvent(t *testing.T) {
+	appointment := &models.Appointment{
+		EventName:        "Group review",
+		Seats:            3,
+		Status:           "Cancelled",
+		CalendarSequence: 4,
+		Expert:           &models.Expert{User: &models.User{FullName: "Ama", Email: "ama@example.com"}},
+		Trader:           &models.User{FullName: "Kofi", Email: "kofi@example.com"},
+	}
+	appointment.ID = 9
+
+	event := AppointmentEvent(appointment)
+	if event.UID != "appointment-9@kodefx" || event.Sequence != 4 || event.Status != "CANCELLED" {
+		t.Errorf("event = %+v", event)
+	}
+	if !strings.Contains(event.Description, "3 seats") {
+		t.Errorf("description = %q", event.Description)
+	}
+	if event.Organizer == nil || event.Organizer.Email != "ama@example.com" || len(event.Attendees) != 1 {
+		t.Errorf("organizer %+v, attendees %+v", event.Organizer, event.Attendees)
+	}
+
+	slot := &models.Availability{EventName: "Open session", Capacity: 4, SeatsTaken: 1}
+	slot.ID = 3
+	if free := AvailabilityEvent(slot); free.UID != "availability-3@kodefx" || !free.Transparent || free.Description != "1 of 4 seats booked" {
+		t.Errorf("slot event = %+v", free)
+	}
+}
@@ -0,0 +1,147 @@
+package calendar
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Invite kinds
+const (
+	InviteConfirmed   = "confirmed"
+	InviteRescheduled = "rescheduled"
+	InviteCancelled   = "cancelled"
+)
+
+// QueueInvites queues an .ics invite for the appointment's trader and
+// expert within tx. They are emailed by the calendar mailer once tx commits.
+func QueueInvites(tx *gorm.DB, appointment *models.Appointment, kind string) error {
+	var users []models.User
+	if err := tx.Select("users.id", "users.email").
+		Where("users.id = ? OR users.id IN (?)", appointment.TraderID,
+			tx.Model(&models.Expert{}).Select("user_id").Where("id = ?", appointment.ExpertID)).
+		Find(&users).Error; err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if user.Email == "" {
+			continue
+		}
+		invite := models.CalendarInvite{
+			AppointmentID: appointment.ID,
+			UserID:        user.ID,
+			Email:         user.Email,
+			Kind:          kind,
+		}
+		if err := tx.Create(&invite).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendInvite emails invite with the appointment's current event attached
+func (h *CalendarHandler) sendInvite(invite *models.CalendarInvite) error {
+	var appointment models.Appointment
+	if err := h.db.Preload("Trader").Preload("Expert.User").First(&appointment, invite.AppointmentID).Error; err != nil {
+		return err
+	}
+
+	method := MethodRequest
+	subject := "Confirmed: "
+	if invite.Kind == InviteRescheduled {
+		subject = "Rescheduled: "
+	}
+	if invite.Kind == InviteCancelled || appointment.Status == "Cancelled" {
+		method = MethodCancel
+		subject = "Cancelled: "
+	}
+	subject += appointment.EventName
+
+	var user models.User
+	h.db.Select("id", "time_zone").First(&user, invite.UserID)
+	start := appointment.StartTime.In(utils.LoadZone(user.TimeZone))
+	body := fmt.Sprintf("%s\n\n%s, %s to %s\n\nThe attached invite adds the session to your calendar.",
+		subject, start.Format("Monday 2 January 2006"), start.Format("15:04"),
+		appointment.EndTime.In(start.Location()).Format("15:04 MST"))
+
+	event := AppointmentEvent(&appointment)
+	if method == MethodCancel {
+		event.Status = "CANCELLED"
+	}
+	ics := Render("", method, []Event{event}, time.Now())
+
+	return utils.SendEmail(invite.Email, subject, body, "", utils.Attachment{
+		Name:        "invite.ics",
+		Data:        ics,
+		ContentType: fmt.Sprintf("text/calendar; charset=utf-8; method=%s", method),
+	})
+}
+
+// runMailer periodically emails queued invites
+func (h *CalendarHandler) runMailer() {
+	ticker := time.NewTicker(mailInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.mailPendingInvites(); err != nil {
+			log.Printf("Error emailing calendar invites: %v", err)
+		}
+	}
+}
+
+// mailPendingInvites emails every invite without EmailedAt, giving up on an
+// invite after maxEmailAttempts failures. Each invite is tried at most once
+// per run.
+func (h *CalendarHandler) mailPendingInvites() error {
+	var lastID uint
+	for i := 0; i < mailBatchSize; i++ {
+		id, err := h.mailNextInvite(lastID)
+		if err != nil || id == 0 {
+			return err
+		}
+		lastID = id
+	}
+	return nil
+}
+
+// mailNextInvite emails the first unsent invite after afterID and returns its
+// ID, or zero when there is nothing left to send. The invite stays locked
+// until it is marked, so a mailer on another instance skips it instead of
+// sending it again.
+func (h *CalendarHandler) mailNextInvite(afterID uint) (uint, error) {
+	var sentID uint
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var invite models.CalendarInvite
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("id > ? AND emailed_at IS NULL AND email_attempts < ?", afterID, maxEmailAttempts).
+			Order("id ASC").
+			First(&invite).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = h.sendInvite(&invite)
+		if errors.Is(err, utils.ErrMailNotConfigured) {
+			// Nothing can be sent until SMTP is set up; keep the invites queued
+			return nil
+		}
+		sentID = invite.ID
+		if err != nil {
+			log.Printf("Error emailing calendar invite %d: %v", invite.ID, err)
+			return tx.Model(&invite).Update("email_attempts", invite.EmailAttempts+1).Error
+		}
+		return tx.Model(&invite).Update("emailed_at", time.Now()).Error
+	})
+	return sentID, err
+}
@@ -0,0 +1,249 @@
+package calendar
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/availability"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	// mailInterval is how often the mailer looks for invites to email
+	mailInterval = time.Minute
+	// maxEmailAttempts is how many times an invite email is tried before giving up
+	maxEmailAttempts = 5
+	// mailBatchSize is the most invites emailed in one run
+	mailBatchSize = 50
+	// feedHistory is how far back feeds list past appointments
+	feedHistory = 90 * 24 * time.Hour
+	// feedSlotsAhead is how far ahead feeds list an expert's open slots
+	feedSlotsAhead = 8 * 7 * 24 * time.Hour
+)
+
+// Response is a standardized API response structure
+type Response struct {
+	Data  interface{} `json:"data,omitempty"`
+	Meta  interface{} `json:"meta,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// CalendarHandler serves iCalendar feeds and invites and emails queued invites
+type CalendarHandler struct {
+	db *gorm.DB
+}
+
+// NewCalendarHandler creates a new calendar handler and starts the invite mailer
+func NewCalendarHandler(db *gorm.DB) *CalendarHandler {
+	h := &CalendarHandler{db: db}
+	go h.runMailer()
+
+	return h
+}
+
+// RegisterRoutes registers all calendar routes
+func (h *CalendarHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/calendar/feed", utils.AuthMiddleware(h.GetFeedURL)).Methods("GET")
+	router.HandleFunc("/calendar/feed/reset", utils.AuthMiddleware(h.ResetFeedURL)).Methods("POST")
+	router.HandleFunc("/calendar/feeds/{token:[0-9a-f]+}.ics", h.GetFeed).Methods("GET")
+	router.HandleFunc("/appointments/{id:[0-9]+}/invite.ics", utils.AuthMiddleware(h.GetInvite)).Methods("GET")
+}
+
+// newToken returns a random feed token
+func newToken() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// feedURL is the public URL of the feed for token, under the same API prefix
+// as r. PUBLIC_BASE_URL sets the host when the server sits behind a proxy.
+func feedURL(r *http.Request, token string) string {
+	prefix := r.URL.Path
+	if i := strings.Index(prefix, "/calendar/"); i >= 0 {
+		prefix = prefix[:i]
+	}
+
+	base := strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return fmt.Sprintf("%s%s/calendar/feeds/%s.ics", base, prefix, token)
+}
+
+// GetFeedURL returns the caller's secret feed URL, creating it on first use
+func (h *CalendarHandler) GetFeedURL(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var token models.CalendarToken
+	err = h.db.Where("user_id = ?", userID).First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		token.UserID = userID
+		if token.Token, err = newToken(); err == nil {
+			err = h.db.Create(&token).Error
+		}
+	}
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to create calendar feed")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: map[string]string{"url": feedURL(r, token.Token)}})
+}
+
+// ResetFeedURL replaces the caller's feed URL so the old one stops working
+func (h *CalendarHandler) ResetFeedURL(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	value, err := newToken()
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to reset calendar feed")
+		return
+	}
+
+	token := models.CalendarToken{UserID: userID}
+	if err := h.db.Where("user_id = ?", userID).
+		Assign(models.CalendarToken{Token: value}).
+		FirstOrCreate(&token).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to reset calendar feed")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: map[string]string{"url": feedURL(r, token.Token)}})
+}
+
+// GetFeed serves the feed for the token in the URL: the user's appointments
+// and, for experts, their open slots. Calendar apps fetch it without signing
+// in, so the token is the only credential.
+func (h *CalendarHandler) GetFeed(w http.ResponseWriter, r *http.Request) {
+	var token models.CalendarToken
+	if err := h.db.Where("token = ?", mux.Vars(r)["token"]).First(&token).Error; err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	now := time.Now()
+	var expert models.Expert
+	isExpert := h.db.Where("user_id = ?", token.UserID).First(&expert).Error == nil
+
+	query := h.db.Preload("Trader").Preload("Expert.User").
+		Where("status NOT IN ?", []string{"Pending", "Expired"}).
+		Where("end_time >= ?", now.Add(-feedHistory))
+	if isExpert {
+		query = query.Where("trader_id = ? OR expert_id = ?", token.UserID, expert.ID)
+	} else {
+		query = query.Where("trader_id = ?", token.UserID)
+	}
+
+	var appointments []models.Appointment
+	if err := query.Order("start_time").Find(&appointments).Error; err != nil {
+		http.Error(w, "Error building calendar", http.StatusInternalServerError)
+		return
+	}
+
+	events := make([]Event, 0, len(appointments))
+	for i := range appointments {
+		events = append(events, AppointmentEvent(&appointments[i]))
+	}
+
+	if isExpert {
+		var slots []models.Availability
+		if err := h.db.Where("expert_id = ? AND start_time > ? AND start_time <= ?", expert.ID, now, now.Add(feedSlotsAhead)).
+			Order("start_time").
+			Find(&slots).Error; err != nil {
+			http.Error(w, "Error building calendar", http.StatusInternalServerError)
+			return
+		}
+		if err := availability.FillSeatsTaken(h.db, slots); err != nil {
+			http.Error(w, "Error building calendar", http.StatusInternalServerError)
+			return
+		}
+		for i := range slots {
+			// Fully booked slots already show as appointments
+			if slots[i].SeatsTaken < slots[i].Capacity {
+				events = append(events, AvailabilityEvent(&slots[i]))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(Render("KodeFX", MethodPublish, events, now))
+}
+
+// GetInvite downloads an appointment as an .ics file for its trader or expert
+func (h *CalendarHandler) GetInvite(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid appointment ID")
+		return
+	}
+
+	var appointment models.Appointment
+	if err := h.db.Preload("Trader").Preload("Expert.User").First(&appointment, id).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Appointment not found")
+		return
+	}
+	if appointment.TraderID != userID && (appointment.Expert == nil || appointment.Expert.UserID != userID) {
+		h.respondWithError(w, http.StatusForbidden, "You are not part of this appointment")
+		return
+	}
+	if appointment.Status == "Pending" || appointment.Status == "Expired" {
+		h.respondWithError(w, http.StatusConflict, "The appointment has not been confirmed")
+		return
+	}
+
+	method := MethodRequest
+	if appointment.Status == "Cancelled" {
+		method = MethodCancel
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8; method="+method)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="appointment-%d.ics"`, appointment.ID))
+	w.WriteHeader(http.StatusOK)
+	w.Write(Render("", method, []Event{AppointmentEvent(&appointment)}, time.Now()))
+}
+
+// Helper function to respond with an error
+func (h *CalendarHandler) respondWithError(w http.ResponseWriter, code int, message string) {
+	h.respondWithJSON(w, code, Response{Error: message})
+}
+
+// Helper function to respond with JSON
+func (h *CalendarHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -0,0 +1,168 @@
+package calendar
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+func TestFeedURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		proto   string
+		wantURL string
+	}{
+		{name: "plain", wantURL: "http://api.example.com/api/v1/calendar/feeds/abc.ics"},
+		{name: "behind TLS proxy", proto: "https", wantURL: "https://api.example.com/api/v1/calendar/feeds/abc.ics"},
+		{name: "public base URL", base: "https://kodefx.example/", wantURL: "https://kodefx.example/api/v1/calendar/feeds/abc.ics"},
+	}
+	for _, tt := range tests {
+		t.Setenv("PUBLIC_BASE_URL", tt.base)
+		r := httptest.NewRequest(http.MethodGet, "http://api.example.com/api/v1/calendar/feed", nil)
+		r.Header.Set("X-Forwarded-Proto", tt.proto)
+		if got := feedURL(r, "abc"); got != tt.wantURL {
+			t.Errorf("%s: feedURL = %s, want %s", tt.name, got, tt.wantURL)
+		}
+	}
+}
+
+// feedToken asks for the user's feed URL, or a new one when reset is set,
+// and returns its token
+func feedToken(t *testing.T, h *CalendarHandler, userID uint, reset bool) string {
+	t.Helper()
+
+	handler := h.GetFeedURL
+	if reset {
+		handler = h.ResetFeedURL
+	}
+	w := httptest.NewRecorder()
+	handler(w, testdb.AsUser(httptest.NewRequest(http.MethodGet, "/calendar/feed", nil), userID))
+	var response struct {
+		Data struct{ URL string }
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("feed URL: status %d, %v", w.Code, err)
+	}
+	return strings.TrimSuffix(path.Base(response.Data.URL), ".ics")
+}
+
+// feed fetches the feed for token
+func feed(h *CalendarHandler, token string) *httptest.ResponseRecorder {
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/calendar/feeds/"+token+".ics", nil), map[string]string{"token": token})
+	w := httptest.NewRecorder()
+	h.GetFeed(w, r)
+	return w
+}
+
+func TestGetFeed(t *testing.T) {
+	db := testdb.Open(t, "calendar")
+	h := &CalendarHandler{db: db}
+	now := time.Now()
+	expert := testdb.Expert(t, db, "Feed Expert")
+	trader := testdb.User(t, db, "Feed Trader")
+	start := now.Add(48 * time.Hour).Truncate(time.Hour)
+
+	booked := testdb.Slot(t, db, expert, start, 1, 5000)
+	open := testdb.Slot(t, db, expert, start.Add(24*time.Hour), 2, 5000)
+	book := func(slot *models.Availability, reference, status string) *models.Appointment {
+		appointment := testdb.Appointment(slot, trader.ID, 1, reference)
+		appointment.Status = status
+		db.Create(appointment)
+		return appointment
+	}
+	confirmed := book(booked, "APT-1", "Confirmed")
+	pending := book(open, "APT-2", "Pending")
+
+	token := feedToken(t, h, trader.ID, false)
+	if again := feedToken(t, h, trader.ID, false); again != token {
+		t.Errorf("feed URL changed from %s to %s without a reset", token, again)
+	}
+
+	w := feed(h, token)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("trader feed: status %d, %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	ics := w.Body.String()
+	if !strings.Contains(ics, "UID:appointment-"+fmt.Sprint(confirmed.ID)+"@kodefx") || strings.Contains(ics, "appointment-"+fmt.Sprint(pending.ID)+"@") {
+		t.Errorf("trader feed should list only the confirmed appointment:\n%s", ics)
+	}
+	if strings.Contains(ics, "availability-") {
+		t.Error("trader feed lists open slots")
+	}
+
+	// The expert sees the booking and the slot still open, but not the full one
+	ics = feed(h, feedToken(t, h, expert.UserID, false)).Body.String()
+	if !strings.Contains(ics, "UID:appointment-"+fmt.Sprint(confirmed.ID)+"@kodefx") ||
+		!strings.Contains(ics, "UID:availability-"+fmt.Sprint(open.ID)+"@kodefx") ||
+		strings.Contains(ics, "availability-"+fmt.Sprint(booked.ID)+"@") {
+		t.Errorf("expert feed:\n%s", ics)
+	}
+
+	// Resetting stops the old URL working
+	if reset := feedToken(t, h, trader.ID, true); reset == token {
+		t.Error("reset kept the same token")
+	}
+	if w := feed(h, token); w.Code != http.StatusNotFound {
+		t.Errorf("old token: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestMailPendingInvites(t *testing.T) {
+	tests := []struct {
+		name         string
+		smtpHost     string
+		wantAttempts int
+	}{
+		{name: "mail not configured", wantAttempts: 0},
+		{name: "server unreachable", smtpHost: "127.0.0.1", wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "calendar")
+			t.Setenv("SMTP_HOST", tt.smtpHost)
+			t.Setenv("SMTP_PORT", "1")
+			expert := testdb.Expert(t, db, "Invited Expert")
+			slot := testdb.Slot(t, db, expert, time.Now().Add(48*time.Hour).Truncate(time.Hour), 1, 5000)
+			appointment := testdb.Appointment(slot, testdb.User(t, db, "Invited Trader").ID, 1, "APT-1")
+			appointment.Status = "Confirmed"
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Create(appointment).Error; err != nil {
+					return err
+				}
+				return QueueInvites(tx, appointment, InviteConfirmed)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := &CalendarHandler{db: db}
+			if err := h.mailPendingInvites(); err != nil {
+				t.Fatalf("mailPendingInvites: %v", err)
+			}
+
+			var invites []models.CalendarInvite
+			db.Order("id").Find(&invites)
+			if len(invites) != 2 {
+				t.Fatalf("%d invites queued, want one each for the trader and the expert", len(invites))
+			}
+			for _, invite := range invites {
+				if invite.EmailedAt != nil || invite.EmailAttempts != tt.wantAttempts {
+					t.Errorf("invite to %s emailed at %v after %d attempts, want unsent after %d", invite.Email, invite.EmailedAt, invite.EmailAttempts, tt.wantAttempts)
+				}
+			}
+		})
+	}
+}
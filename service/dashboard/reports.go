@@ -0,0 +1,331 @@
+package dashboard
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
+)
+
+// paidSubscriptionStatuses are the statuses of subscriptions that were paid
+// for, whether or not they are still running
+var paidSubscriptionStatuses = []string{"active", "past_due", "expired", "switched"}
+
+// revenueGroupings maps each supported group_by value to the SQL that keys a
+// report row and the label shown with it
+var revenueGroupings = map[string]struct{ key, label string }{
+	"day":     {"to_char(date_trunc('day', t.created_at), 'YYYY-MM-DD')", "''"},
+	"week":    {"to_char(date_trunc('week', t.created_at), 'YYYY-MM-DD')", "''"},
+	"month":   {"to_char(date_trunc('month', t.created_at), 'YYYY-MM')", "''"},
+	"product": {productSQL, "''"},
+	"expert":  {"CAST(j.expert_id AS TEXT)", "MAX(eu.full_name)"},
+	"plan":    {"s.plan", "MAX(p.name)"},
+}
+
+// productSQL classifies a transaction by the payment reference prefix
+const productSQL = "CASE WHEN t.reference LIKE 'APT-%' THEN 'appointment' WHEN t.reference LIKE 'SIG-%' THEN 'signal_subscription' WHEN t.reference LIKE 'PKG-%' THEN 'session_package' ELSE 'other' END"
+
+// reversedPaymentSQL recovers the payment reference from a payment reversal
+// journal, posted as <reference>-REV or <reference>-REF<n>
+const reversedPaymentSQL = "regexp_replace(j.reference, '-(REV|REF[0-9]+)$', '')"
+
+// RevenueRow is one line of a revenue report. Amounts are in minor units of Currency.
+type RevenueRow struct {
+	Key         string `json:"key"`
+	Label       string `json:"label,omitempty"`
+	Currency    string `json:"currency"`
+	Payments    int64  `json:"payments"`
+	Gross       int64  `json:"gross_minor"`        // What customers paid, including wallet credit
+	Wallet      int64  `json:"wallet_minor"`       // Part of Gross paid from wallets
+	Refunds     int64  `json:"refunds_minor"`      // Refunded against these payments
+	Net         int64  `json:"net_minor"`          // Gross less refunds
+	Commission  int64  `json:"commission_minor"`   // Platform share per the ledger, after reversals and refunds
+	ExpertShare int64  `json:"expert_share_minor"` // Owed to experts per the ledger, after reversals
+}
+
+// reportRange reads start_date and end_date (YYYY-MM-DD), defaulting to a
+// window that suits the grouping
+func reportRange(r *http.Request, groupBy string) (time.Time, time.Time, error) {
+	layout := "2006-01-02"
+	now := time.Now()
+	end := now
+
+	var start time.Time
+	switch groupBy {
+	case "day":
+		start = now.AddDate(0, 0, -30)
+	case "week":
+		start = now.AddDate(0, 0, -7*12)
+	default:
+		start = now.AddDate(-1, 0, 0)
+	}
+
+	if value := r.URL.Query().Get("start_date"); value != "" {
+		parsed, err := time.Parse(layout, value)
+		if err != nil {
+			return start, end, fmt.Errorf("Invalid start_date format. Use YYYY-MM-DD")
+		}
+		start = parsed
+	}
+	if value := r.URL.Query().Get("end_date"); value != "" {
+		parsed, err := time.Parse(layout, value)
+		if err != nil {
+			return start, end, fmt.Errorf("Invalid end_date format. Use YYYY-MM-DD")
+		}
+		end = parsed.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	return start, end, nil
+}
+
+// GetRevenueReport reports payments between start_date and end_date grouped
+// by day, week, month, product, expert or plan (?group_by=), with refunds
+// netted out. ?format=csv returns the report as a CSV download.
+func (h *DashboardHandler) GetRevenueReport(w http.ResponseWriter, r *http.Request) {
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy == "" {
+		groupBy = "month"
+	}
+	grouping, ok := revenueGroupings[groupBy]
+	if !ok {
+		h.respondWithError(w, http.StatusBadRequest, "group_by must be day, week, month, product, expert or plan")
+		return
+	}
+
+	start, end, err := reportRange(r, groupBy)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Refunds are credited to wallets under the reference of the payment they reverse
+	refunds := h.db.Table("wallet_entries").
+		Select("reference, SUM(amount_minor) AS refunded").
+		Where("source = ? AND direction = ? AND deleted_at IS NULL", wallet.SourceRefund, "credit").
+		Group("reference")
+
+	// Taking back an expert's share, earned or still deferred, returns it to
+	// the platform, which pays the refund out of it
+	reversals := h.db.Table("ledger_journals j").
+		Joins("JOIN ledger_entries e ON e.journal_id = j.id AND e.account IN ? AND e.deleted_at IS NULL",
+			[]string{models.AccountExpertPayable, models.AccountExpertDeferred}).
+		Select(reversedPaymentSQL+" AS reference, SUM(e.debit_minor) AS reversed").
+		Where("j.kind = ? AND j.deleted_at IS NULL", "payment_reversal").
+		Group(reversedPaymentSQL)
+
+	query := h.db.Table("transactions t").
+		Joins("LEFT JOIN (?) r ON r.reference = t.reference", refunds).
+		Joins("LEFT JOIN (?) rv ON rv.reference = t.reference", reversals).
+		Joins("LEFT JOIN ledger_journals j ON j.reference = t.reference AND j.kind = 'payment' AND j.deleted_at IS NULL").
+		Where("t.deleted_at IS NULL AND t.created_at BETWEEN ? AND ?", start, end)
+
+	switch groupBy {
+	case "expert":
+		query = query.
+			Joins("JOIN experts e ON e.id = j.expert_id").
+			Joins("JOIN users eu ON eu.id = e.user_id")
+	case "plan":
+		query = query.
+			Joins("JOIN signal_subscriptions s ON s.payment_id = t.reference").
+			Joins("LEFT JOIN subscription_plans p ON p.code = s.plan")
+	}
+
+	if currency := utils.NormalizeCurrency(r.URL.Query().Get("currency")); currency != "" {
+		query = query.Where("t.currency = ?", currency)
+	}
+	if product := r.URL.Query().Get("product"); product != "" {
+		query = query.Where(productSQL+" = ?", product)
+	}
+
+	rows := []RevenueRow{}
+	if err := query.
+		Select(fmt.Sprintf(`%s AS key, %s AS label, t.currency AS currency,
+			COUNT(*) AS payments,
+			COALESCE(SUM(t.amount_minor), 0) AS gross,
+			COALESCE(SUM(t.wallet_minor), 0) AS wallet,
+			COALESCE(SUM(r.refunded), 0) AS refunds,
+			COALESCE(SUM(j.commission_minor), 0) + COALESCE(SUM(rv.reversed), 0) - COALESCE(SUM(r.refunded), 0) AS commission,
+			COALESCE(SUM(j.gross_minor - j.commission_minor), 0) - COALESCE(SUM(rv.reversed), 0) AS expert_share`, grouping.key, grouping.label)).
+		Group(grouping.key + ", t.currency").
+		Order("key ASC, currency ASC").
+		Scan(&rows).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to build revenue report")
+		return
+	}
+
+	totals := map[string]*RevenueRow{}
+	for i := range rows {
+		rows[i].Net = rows[i].Gross - rows[i].Refunds
+
+		total, ok := totals[rows[i].Currency]
+		if !ok {
+			total = &RevenueRow{Key: "total", Currency: rows[i].Currency}
+			totals[rows[i].Currency] = total
+		}
+		total.Payments += rows[i].Payments
+		total.Gross += rows[i].Gross
+		total.Wallet += rows[i].Wallet
+		total.Refunds += rows[i].Refunds
+		total.Net += rows[i].Net
+		total.Commission += rows[i].Commission
+		total.ExpertShare += rows[i].ExpertShare
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		writeRevenueCSV(w, fmt.Sprintf("revenue-by-%s-%s-%s.csv", groupBy, start.Format("20060102"), end.Format("20060102")), groupBy, rows)
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{
+		Data:   rows,
+		Totals: totals,
+		Meta: map[string]interface{}{
+			"group_by":   groupBy,
+			"start_date": start,
+			"end_date":   end,
+		},
+	})
+}
+
+// writeRevenueCSV writes rows as a CSV download. Amounts are in major units
+// so the file opens cleanly in a spreadsheet.
+func writeRevenueCSV(w http.ResponseWriter, filename, groupBy string, rows []RevenueRow) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(http.StatusOK)
+
+	major := func(amount int64, currency string) string {
+		return strconv.FormatFloat(utils.FromMinor(amount, currency), 'f', utils.LookupCurrency(currency).Exponent, 64)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{groupBy, "label", "currency", "payments", "gross", "wallet", "refunds", "net", "commission", "expert_share"})
+	for _, row := range rows {
+		writer.Write([]string{
+			row.Key,
+			row.Label,
+			row.Currency,
+			strconv.FormatInt(row.Payments, 10),
+			major(row.Gross, row.Currency),
+			major(row.Wallet, row.Currency),
+			major(row.Refunds, row.Currency),
+			major(row.Net, row.Currency),
+			major(row.Commission, row.Currency),
+			major(row.ExpertShare, row.Currency),
+		})
+	}
+	writer.Flush()
+}
+
+// SubscriptionMetrics summarises recurring subscription revenue in one currency
+type SubscriptionMetrics struct {
+	Currency    string `json:"currency"`
+	MRR         int64  `json:"mrr_minor"` // Monthly recurring revenue at end_date
+	Subscribers int64  `json:"subscribers"`
+}
+
+// coveredUsers returns the users with a paid subscription running at t
+func (h *DashboardHandler) coveredUsers(t time.Time) (map[uint]bool, error) {
+	var ids []uint
+	if err := h.db.Table("signal_subscriptions").
+		Where("deleted_at IS NULL AND status IN ? AND start_date <= ? AND end_date > ?", paidSubscriptionStatuses, t, t).
+		Distinct().
+		Pluck("user_id", &ids).Error; err != nil {
+		return nil, err
+	}
+
+	users := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		users[id] = true
+	}
+	return users, nil
+}
+
+// GetSubscriptionReport returns MRR at end_date and subscriber churn between
+// start_date and end_date (YYYY-MM-DD, defaulting to the last 30 days)
+func (h *DashboardHandler) GetSubscriptionReport(w http.ResponseWriter, r *http.Request) {
+	start, end, err := reportRange(r, "day")
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if end.After(time.Now()) {
+		end = time.Now()
+	}
+
+	// Each subscription contributes its plan's price spread over the months it
+	// covers, so coupons and plan change proration don't skew it. Legacy plans
+	// have no price and fall back to what was paid.
+	var mrrRows []struct {
+		Currency    string
+		MRR         float64
+		Subscribers int64
+	}
+	if err := h.db.Table("signal_subscriptions s").
+		Joins("JOIN subscription_plans p ON p.code = s.plan").
+		Where("s.deleted_at IS NULL AND s.status IN ? AND s.start_date <= ? AND s.end_date > ?", paidSubscriptionStatuses, end, end).
+		Select(`s.currency AS currency,
+			SUM(CAST(CASE WHEN p.price_minor > 0 AND p.currency = s.currency THEN p.price_minor ELSE s.amount_minor END AS FLOAT) / GREATEST(p.duration_months, 1)) AS mrr,
+			COUNT(DISTINCT s.user_id) AS subscribers`).
+		Group("s.currency").
+		Scan(&mrrRows).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to calculate MRR")
+		return
+	}
+
+	metrics := make([]SubscriptionMetrics, 0, len(mrrRows))
+	for _, row := range mrrRows {
+		metrics = append(metrics, SubscriptionMetrics{
+			Currency:    row.Currency,
+			MRR:         int64(math.Round(row.MRR)),
+			Subscribers: row.Subscribers,
+		})
+	}
+
+	atStart, err := h.coveredUsers(start)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to calculate churn")
+		return
+	}
+	atEnd, err := h.coveredUsers(end)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to calculate churn")
+		return
+	}
+
+	var churned, retained int64
+	for id := range atStart {
+		if atEnd[id] {
+			retained++
+		} else {
+			churned++
+		}
+	}
+	newSubscribers := int64(len(atEnd)) - retained
+
+	churnRate := 0.0
+	if len(atStart) > 0 {
+		churnRate = math.Round(float64(churned)/float64(len(atStart))*10000) / 100
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{
+		Data: map[string]interface{}{
+			"mrr":                metrics,
+			"subscribers_start":  len(atStart),
+			"subscribers_end":    len(atEnd),
+			"new_subscribers":    newSubscribers,
+			"churned":            churned,
+			"churn_rate_percent": churnRate,
+		},
+		Meta: map[string]interface{}{
+			"start_date": start,
+			"end_date":   end,
+		},
+	})
+}
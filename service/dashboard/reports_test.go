@@ -0,0 +1,219 @@
+package dashboard
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/earnings"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
+	"gorm.io/gorm"
+)
+
+// revenueFixture records, at 20% commission:
+//   - APT-1, a GHS 100.00 session with the expert
+//   - APT-2, a GHS 50.00 session with the expert, refunded to the wallet
+//   - a GHS 120.00 quarterly subscription
+//   - APT-3, an NGN 200.00 session with the expert
+func revenueFixture(t *testing.T, db *gorm.DB) *models.Expert {
+	t.Helper()
+	t.Setenv("PLATFORM_COMMISSION_RATE", "0.2")
+
+	expert := testdb.Expert(t, db, "Ama Expert")
+	trader := testdb.User(t, db, "Trader")
+	quarterly := testdb.Plan(t, db, "quarterly", 3, 12000)
+	sub := testdb.Subscription(t, db, trader.ID, quarterly, time.Now(), time.Now().AddDate(0, 3, 0))
+
+	payments := []struct {
+		reference string
+		amount    int64
+		currency  string
+		expertID  *uint
+	}{
+		{"APT-1", 10000, "GHS", &expert.ID},
+		{"APT-2", 5000, "GHS", &expert.ID},
+		{sub.PaymentID, 12000, "GHS", nil},
+		{"APT-3", 20000, "NGN", &expert.ID},
+	}
+	for _, p := range payments {
+		if err := db.Create(&models.Transaction{UserID: trader.ID, Amount: p.amount, Currency: p.currency, Method: "card", Purpose: "payment", Reference: p.reference}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := earnings.RecordPayment(db, p.reference, p.amount, p.currency, p.expertID, "Payment"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// APT-2 is refunded: the expert's share is taken back and the whole
+	// payment credited to the trader's wallet
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := earnings.ReversePayment(tx, "APT-2", "Expert missed the session"); err != nil {
+			return err
+		}
+		_, err := wallet.Credit(tx, trader.ID, 5000, "GHS", wallet.SourceRefund, "APT-2", "Refund", nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expert
+}
+
+// revenueReport runs the revenue report with query
+func revenueReport(t *testing.T, db *gorm.DB, query string) (*httptest.ResponseRecorder, []RevenueRow) {
+	t.Helper()
+
+	h := &DashboardHandler{db: db}
+	w := httptest.NewRecorder()
+	h.GetRevenueReport(w, httptest.NewRequest(http.MethodGet, "/dashboard/revenue?"+query, nil))
+
+	var response struct {
+		Data []RevenueRow `json:"data"`
+	}
+	if w.Code == http.StatusOK && w.Header().Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, response.Data
+}
+
+func TestGetRevenueReport(t *testing.T) {
+	db := testdb.Open(t, "dashboard")
+	expert := revenueFixture(t, db)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []RevenueRow
+	}{
+		{name: "by product", query: "group_by=product", want: []RevenueRow{
+			{Key: "appointment", Currency: "GHS", Payments: 2, Gross: 15000, Refunds: 5000, Net: 10000, Commission: 2000, ExpertShare: 8000},
+			{Key: "appointment", Currency: "NGN", Payments: 1, Gross: 20000, Net: 20000, Commission: 4000, ExpertShare: 16000},
+			{Key: "signal_subscription", Currency: "GHS", Payments: 1, Gross: 12000, Net: 12000, Commission: 12000},
+		}},
+		{name: "one currency", query: "group_by=product&currency=ngn", want: []RevenueRow{
+			{Key: "appointment", Currency: "NGN", Payments: 1, Gross: 20000, Net: 20000, Commission: 4000, ExpertShare: 16000},
+		}},
+		{name: "one product", query: "group_by=product&product=signal_subscription", want: []RevenueRow{
+			{Key: "signal_subscription", Currency: "GHS", Payments: 1, Gross: 12000, Net: 12000, Commission: 12000},
+		}},
+		{name: "by expert", query: "group_by=expert&currency=GHS", want: []RevenueRow{
+			{Key: fmt.Sprint(expert.ID), Label: expert.User.FullName, Currency: "GHS", Payments: 2, Gross: 15000, Refunds: 5000, Net: 10000, Commission: 2000, ExpertShare: 8000},
+		}},
+		{name: "by plan", query: "group_by=plan", want: []RevenueRow{
+			{Key: "quarterly", Label: "quarterly", Currency: "GHS", Payments: 1, Gross: 12000, Net: 12000, Commission: 12000},
+		}},
+		{name: "before any payments", query: "group_by=month&start_date=2020-01-01&end_date=2020-12-31", want: []RevenueRow{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, rows := revenueReport(t, db, tt.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if len(rows) != len(tt.want) {
+				t.Fatalf("rows = %+v, want %+v", rows, tt.want)
+			}
+			for i := range rows {
+				if rows[i] != tt.want[i] {
+					t.Errorf("row %d = %+v, want %+v", i, rows[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("by month", func(t *testing.T) {
+		_, rows := revenueReport(t, db, "currency=GHS")
+		if len(rows) != 1 || rows[0].Key != time.Now().Format("2006-01") || rows[0].Gross != 27000 || rows[0].Net != 22000 {
+			t.Errorf("rows = %+v, want this month's GHS 270.00 gross, 220.00 net", rows)
+		}
+	})
+
+	t.Run("bad parameters", func(t *testing.T) {
+		for _, query := range []string{"group_by=year", "start_date=01-01-2026", "end_date=tomorrow"} {
+			if w, _ := revenueReport(t, db, query); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: status = %d, want %d", query, w.Code, http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		w, _ := revenueReport(t, db, "group_by=product&currency=GHS&format=csv")
+		if w.Header().Get("Content-Type") != "text/csv" {
+			t.Fatalf("content type = %s", w.Header().Get("Content-Type"))
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 || records[0][0] != "product" {
+			t.Fatalf("records = %v", records)
+		}
+		// Amounts are in major units
+		if got := records[1]; got[0] != "appointment" || got[4] != "150.00" || got[6] != "50.00" || got[7] != "100.00" {
+			t.Errorf("appointment line = %v", got)
+		}
+	})
+}
+
+func TestGetSubscriptionReport(t *testing.T) {
+	db := testdb.Open(t, "dashboard")
+	now := time.Now()
+	quarterly := testdb.Plan(t, db, "quarterly", 3, 30000)
+	monthly := testdb.Plan(t, db, "monthly", 1, 10000)
+	legacy := models.SubscriptionPlan{Code: "legacy", Name: "Legacy", DurationMonths: 1, Currency: "GHS"}
+	if err := db.Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribed throughout the window
+	testdb.Subscription(t, db, testdb.User(t, db, "Retained").ID, quarterly, now.AddDate(0, 0, -40), now.AddDate(0, 0, 50))
+	// New, bought with a coupon: MRR counts the plan price, not what was paid
+	discounted := testdb.Subscription(t, db, testdb.User(t, db, "New").ID, monthly, now.AddDate(0, 0, -5), now.AddDate(0, 0, 25))
+	db.Model(discounted).Update("amount_minor", 5000)
+	// New on a plan from before prices were set, so what was paid counts
+	old := testdb.Subscription(t, db, testdb.User(t, db, "Legacy").ID, &legacy, now.AddDate(0, 0, -3), now.AddDate(0, 0, 27))
+	db.Model(old).Update("amount_minor", 6000)
+	// Lapsed during the window
+	lapsed := testdb.Subscription(t, db, testdb.User(t, db, "Churned").ID, monthly, now.AddDate(0, 0, -60), now.AddDate(0, 0, -10))
+	db.Model(lapsed).Update("status", "expired")
+	// Never paid
+	pending := testdb.Subscription(t, db, testdb.User(t, db, "Pending").ID, monthly, now.AddDate(0, 0, -40), now.AddDate(0, 0, 20))
+	db.Model(pending).Update("status", "pending")
+
+	h := &DashboardHandler{db: db}
+	w := httptest.NewRecorder()
+	h.GetSubscriptionReport(w, httptest.NewRequest(http.MethodGet, "/dashboard/subscriptions", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var response struct {
+		Data struct {
+			MRR              []SubscriptionMetrics `json:"mrr"`
+			SubscribersStart int                   `json:"subscribers_start"`
+			SubscribersEnd   int                   `json:"subscribers_end"`
+			New              int64                 `json:"new_subscribers"`
+			Churned          int64                 `json:"churned"`
+			ChurnRate        float64               `json:"churn_rate_percent"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	data := response.Data
+
+	if len(data.MRR) != 1 || data.MRR[0] != (SubscriptionMetrics{Currency: "GHS", MRR: 26000, Subscribers: 3}) {
+		t.Errorf("MRR = %+v, want GHS 260.00 from 3 subscribers", data.MRR)
+	}
+	if data.SubscribersStart != 2 || data.SubscribersEnd != 3 || data.New != 2 || data.Churned != 1 || data.ChurnRate != 50 {
+		t.Errorf("churn = %+v", data)
+	}
+}
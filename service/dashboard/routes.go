@@ -2,12 +2,11 @@ package dashboard
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
-	"os"
 
 	"github.com/KAsare1/Kodefx-server/cmd/models"
 	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 )
@@ -20,16 +19,28 @@ func NewDashboardHandler(db *gorm.DB) *DashboardHandler {
 	return &DashboardHandler{db: db}
 }
 
+// Response is the standard response format for report endpoints
+type Response struct {
+	Data   interface{} `json:"data,omitempty"`
+	Totals interface{} `json:"totals,omitempty"`
+	Meta   interface{} `json:"meta,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
 type DashboardStats struct {
-	TotalTraders int64   `json:"total_traders"`
-	TotalExperts int64   `json:"total_experts"`
-	TotalIncome  float64 `json:"total_income"`
+	TotalTraders    int64  `json:"total_traders"`
+	TotalExperts    int64  `json:"total_experts"`
+	TotalIncome     int64  `json:"total_income_minor"` // Payments less refunds, in Currency
+	Currency        string `json:"currency"`
+	IncomeFormatted string `json:"total_income_formatted"`
 }
 
 // RegisterRoutes registers dashboard-related routes with Gorilla Mux
 func (h *DashboardHandler) RegisterRoutes(router *mux.Router) {
 	dashboardRouter := router.PathPrefix("/dashboard").Subrouter()
 	dashboardRouter.HandleFunc("/stats", utils.AuthMiddleware(h.GetDashboardStats)).Methods("GET")
+	dashboardRouter.HandleFunc("/revenue", utils.AdminMiddleware(h.db, h.GetRevenueReport)).Methods("GET")
+	dashboardRouter.HandleFunc("/subscriptions", utils.AdminMiddleware(h.db, h.GetSubscriptionReport)).Methods("GET")
 }
 
 func (h *DashboardHandler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
@@ -44,50 +55,52 @@ func (h *DashboardHandler) GetDashboardStats(w http.ResponseWriter, r *http.Requ
 	h.db.Model(&models.User{}).Where("role = ?", "expert").Count(&expertsCount)
 	stats.TotalExperts = expertsCount
 
-	// Fetch Total Income from Paystack
-	income, err := h.FetchTotalIncome()
+	// Total income from our own payment records, in the requested currency
+	stats.Currency = utils.NormalizeCurrency(r.URL.Query().Get("currency"))
+	if stats.Currency == "" {
+		stats.Currency = utils.DefaultCurrency()
+	}
+	income, err := h.totalIncome(stats.Currency)
 	if err != nil {
 		http.Error(w, "Failed to fetch total income", http.StatusInternalServerError)
 		return
 	}
 	stats.TotalIncome = income
+	stats.IncomeFormatted = utils.FormatMoney(income, stats.Currency)
 
 	// Return JSON Response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
 }
 
-func (h *DashboardHandler) FetchTotalIncome() (float64, error) {
-	paystackURL := "https://api.paystack.co/transaction/totals"
-	apiKey := os.Getenv("PAYSTACK_SECRET_KEY") // Use environment variable
-
-	req, err := http.NewRequest("GET", paystackURL, nil)
-	if err != nil {
-		return 0, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
+// totalIncome sums every payment in currency, less what was refunded to wallets
+func (h *DashboardHandler) totalIncome(currency string) (int64, error) {
+	var paid, refunded int64
+	if err := h.db.Model(&models.Transaction{}).
+		Where("currency = ?", currency).
+		Select("COALESCE(SUM(amount_minor), 0)").
+		Scan(&paid).Error; err != nil {
 		return 0, err
 	}
-	defer resp.Body.Close()
-
-	var response struct {
-		Status bool `json:"status"`
-		Data   struct {
-			TotalVolume float64 `json:"total_volume"`
-		} `json:"data"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+	if err := h.db.Model(&models.WalletEntry{}).
+		Where("currency = ? AND source = ? AND direction = ?", currency, wallet.SourceRefund, "credit").
+		Where("reference IN (?)", h.db.Model(&models.Transaction{}).Select("reference")).
+		Select("COALESCE(SUM(amount_minor), 0)").
+		Scan(&refunded).Error; err != nil {
 		return 0, err
 	}
+	return paid - refunded, nil
+}
 
-	if !response.Status {
-		return 0, fmt.Errorf("failed to fetch income from Paystack")
-	}
+// Helper function to respond with an error
+func (h *DashboardHandler) respondWithError(w http.ResponseWriter, code int, message string) {
+	h.respondWithJSON(w, code, Response{Error: message})
+}
 
-	return response.Data.TotalVolume, nil
+// Helper function to respond with JSON
+func (h *DashboardHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
 }
@@ -0,0 +1,384 @@
+package earnings
+
+import (
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultCommissionRate is the platform's share when PLATFORM_COMMISSION_RATE is unset
+const defaultCommissionRate = 0.2
+
+// ErrUnbalancedJournal is returned when a journal's debits and credits differ
+var ErrUnbalancedJournal = errors.New("ledger journal does not balance")
+
+// CommissionRate returns the fraction of each expert payment kept by the platform
+func CommissionRate() float64 {
+	if value, err := strconv.ParseFloat(os.Getenv("PLATFORM_COMMISSION_RATE"), 64); err == nil && value >= 0 && value <= 1 {
+		return value
+	}
+	return defaultCommissionRate
+}
+
+// postJournal writes journal and its entries after checking that they balance.
+// Entries take the journal's currency. A journal whose reference was already
+// posted is skipped, so callers can safely retry.
+func postJournal(tx *gorm.DB, journal *models.LedgerJournal) error {
+	var debits, credits int64
+	for i := range journal.Entries {
+		journal.Entries[i].Currency = journal.Currency
+		debits += journal.Entries[i].Debit
+		credits += journal.Entries[i].Credit
+	}
+	if debits != credits {
+		return ErrUnbalancedJournal
+	}
+
+	var existing int64
+	if err := tx.Model(&models.LedgerJournal{}).Where("reference = ?", journal.Reference).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	return tx.Create(journal).Error
+}
+
+// lockExpert locks the expert's row for the rest of tx. Everything that
+// takes from an expert's balance holds it while reading the balance, so
+// concurrent payouts and reversals cannot together take more than is there.
+func lockExpert(tx *gorm.DB, expertID uint) (*models.Expert, error) {
+	var expert models.Expert
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&expert, expertID).Error; err != nil {
+		return nil, err
+	}
+	return &expert, nil
+}
+
+// RecordPayment posts a successful payment to the ledger. When the payment is
+// for an expert's service, the platform keeps CommissionRate of the gross and
+// the rest is owed to the expert; otherwise the platform keeps it all.
+func RecordPayment(tx *gorm.DB, reference string, gross int64, currency string, expertID *uint, description string) error {
+	_, err := recordPayment(tx, reference, gross, currency, expertID, models.AccountExpertPayable, description)
+	return err
+}
+
+// RecordPrepayment posts a payment for sessions the expert gives later, such
+// as a session package. It is split like RecordPayment, but the expert's
+// share is held in AccountExpertDeferred until EarnDeferred moves it to their
+// balance. It returns the share deferred.
+func RecordPrepayment(tx *gorm.DB, reference string, gross int64, currency string, expertID uint, description string) (int64, error) {
+	return recordPayment(tx, reference, gross, currency, &expertID, models.AccountExpertDeferred, description)
+}
+
+// recordPayment posts a payment, crediting the expert's share to shareAccount
+// and returning it
+func recordPayment(tx *gorm.DB, reference string, gross int64, currency string, expertID *uint, shareAccount, description string) (int64, error) {
+	if gross <= 0 {
+		return 0, nil
+	}
+
+	commission := gross
+	if expertID != nil {
+		commission = utils.ScaleMinor(gross, CommissionRate())
+	}
+	share := gross - commission
+
+	journal := models.LedgerJournal{
+		Reference:   reference,
+		Kind:        "payment",
+		ExpertID:    expertID,
+		Description: description,
+		Currency:    currency,
+		Gross:       gross,
+		Commission:  commission,
+		Entries: []models.LedgerEntry{
+			{Account: models.AccountCash, Debit: gross},
+			{Account: models.AccountPlatformRevenue, Credit: commission},
+		},
+	}
+	if share > 0 {
+		journal.Entries = append(journal.Entries, models.LedgerEntry{
+			Account:  shareAccount,
+			ExpertID: expertID,
+			Credit:   share,
+		})
+	}
+
+	return share, postJournal(tx, &journal)
+}
+
+// EarnDeferred moves amount of the expert's deferred share to their balance,
+// e.g. as a package credit is redeemed. Like RecordPayment it is skipped if
+// reference was already posted.
+func EarnDeferred(tx *gorm.DB, reference string, amount int64, currency string, expertID uint, description string) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	return postJournal(tx, &models.LedgerJournal{
+		Reference:   reference,
+		Kind:        "deferred_earning",
+		ExpertID:    &expertID,
+		Description: description,
+		Currency:    currency,
+		Entries: []models.LedgerEntry{
+			{Account: models.AccountExpertDeferred, ExpertID: &expertID, Debit: amount},
+			{Account: models.AccountExpertPayable, ExpertID: &expertID, Credit: amount},
+		},
+	})
+}
+
+// UnearnDeferred moves amount earned through EarnDeferred back to the
+// expert's deferred share, e.g. when a credit is given back after the expert
+// missed the session. As with ReversePaymentPart, only what the expert can
+// still request is taken from their balance; the platform covers the rest.
+func UnearnDeferred(tx *gorm.DB, reference string, amount int64, currency string, expertID uint, description string) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	if _, err := lockExpert(tx, expertID); err != nil {
+		return err
+	}
+	balance, err := ExpertBalance(tx, expertID, currency)
+	if err != nil {
+		return err
+	}
+	taken := amount
+	if taken > balance.Available {
+		taken = balance.Available
+	}
+	if taken < 0 {
+		taken = 0
+	}
+
+	journal := models.LedgerJournal{
+		Reference:   reference,
+		Kind:        "deferred_return",
+		ExpertID:    &expertID,
+		Description: description,
+		Currency:    currency,
+		Entries: []models.LedgerEntry{
+			{Account: models.AccountExpertDeferred, ExpertID: &expertID, Credit: amount},
+		},
+	}
+	if taken > 0 {
+		journal.Entries = append(journal.Entries, models.LedgerEntry{
+			Account: models.AccountExpertPayable, ExpertID: &expertID, Debit: taken,
+		})
+	}
+	if taken < amount {
+		journal.Entries = append(journal.Entries, models.LedgerEntry{
+			Account: models.AccountPlatformRevenue, Debit: amount - taken,
+		})
+	}
+	return postJournal(tx, &journal)
+}
+
+// ForfeitDeferred returns amount of the expert's deferred share to the
+// platform, e.g. for package credits that were refunded. It is posted as a
+// payment reversal under reversalReference, which must be the payment's
+// reference with a -REF<n> suffix so reports can match it to the payment.
+func ForfeitDeferred(tx *gorm.DB, reversalReference string, amount int64, currency string, expertID uint, description string) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	return postJournal(tx, &models.LedgerJournal{
+		Reference:   reversalReference,
+		Kind:        "payment_reversal",
+		ExpertID:    &expertID,
+		Description: description,
+		Currency:    currency,
+		Entries: []models.LedgerEntry{
+			{Account: models.AccountExpertDeferred, ExpertID: &expertID, Debit: amount},
+			{Account: models.AccountPlatformRevenue, Credit: amount},
+		},
+	})
+}
+
+// ReversePayment takes back the expert's share of the payment posted under
+// reference, e.g. when the expert missed the session it paid for. The share
+// returns to platform revenue, from where the customer can be refunded. It is
+// skipped if the payment had no expert share or was already reversed.
+func ReversePayment(tx *gorm.DB, reference, description string) error {
+	return ReversePaymentPart(tx, reference, reference+"-REV", 1, 1, description)
+}
+
+// ReversePaymentPart takes back parts/whole of the expert's share of the
+// payment posted under reference, e.g. for the unused credits of a session
+// package, posting it under reversalReference. Like ReversePayment it is
+// skipped if there is no share or reversalReference was already posted.
+// Only what the expert can still request is taken back: a share that was
+// already paid out, or is waiting to be, stays with the expert and the
+// platform covers the refund.
+func ReversePaymentPart(tx *gorm.DB, reference, reversalReference string, parts, whole int64, description string) error {
+	var journal models.LedgerJournal
+	if err := tx.Preload("Entries").Where("reference = ? AND kind = ?", reference, "payment").First(&journal).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	var share int64
+	for _, entry := range journal.Entries {
+		if entry.Account == models.AccountExpertPayable {
+			share += entry.Credit
+		}
+	}
+	if whole <= 0 {
+		return nil
+	}
+	share = share * parts / whole
+	if share <= 0 || journal.ExpertID == nil {
+		return nil
+	}
+
+	if _, err := lockExpert(tx, *journal.ExpertID); err != nil {
+		return err
+	}
+	balance, err := ExpertBalance(tx, *journal.ExpertID, journal.Currency)
+	if err != nil {
+		return err
+	}
+	if share > balance.Available {
+		share = balance.Available
+	}
+	if share <= 0 {
+		return nil
+	}
+
+	return postJournal(tx, &models.LedgerJournal{
+		Reference:   reversalReference,
+		Kind:        "payment_reversal",
+		ExpertID:    journal.ExpertID,
+		Description: description,
+		Currency:    journal.Currency,
+		Entries: []models.LedgerEntry{
+			{Account: models.AccountExpertPayable, ExpertID: journal.ExpertID, Debit: share},
+			{Account: models.AccountPlatformRevenue, Credit: share},
+		},
+	})
+}
+
+// RecordTransfer posts amount from the credit account to the debit account,
+// for movements that involve no expert such as wallet credit being granted or
+// spent. Like RecordPayment it is skipped if reference was already posted.
+func RecordTransfer(tx *gorm.DB, reference, kind string, amount int64, currency, debitAccount, creditAccount, description string) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	return postJournal(tx, &models.LedgerJournal{
+		Reference:   reference,
+		Kind:        kind,
+		Description: description,
+		Currency:    currency,
+		Entries: []models.LedgerEntry{
+			{Account: debitAccount, Debit: amount},
+			{Account: creditAccount, Credit: amount},
+		},
+	})
+}
+
+// recordPayout moves a payout from the expert's balance out of the platform's cash
+func recordPayout(tx *gorm.DB, payout *models.Payout) error {
+	return postJournal(tx, &models.LedgerJournal{
+		Reference:   payout.Reference,
+		Kind:        "payout",
+		ExpertID:    &payout.ExpertID,
+		Description: "Payout to expert",
+		Currency:    payout.Currency,
+		Entries: []models.LedgerEntry{
+			{Account: models.AccountExpertPayable, ExpertID: &payout.ExpertID, Debit: payout.Amount},
+			{Account: models.AccountCash, Credit: payout.Amount},
+		},
+	})
+}
+
+// reversePayout returns a failed or reversed payout to the expert's balance
+func reversePayout(tx *gorm.DB, payout *models.Payout) error {
+	var posted int64
+	if err := tx.Model(&models.LedgerJournal{}).Where("reference = ?", payout.Reference).Count(&posted).Error; err != nil {
+		return err
+	}
+	if posted == 0 {
+		return nil
+	}
+
+	return postJournal(tx, &models.LedgerJournal{
+		Reference:   payout.Reference + "-REV",
+		Kind:        "payout_reversal",
+		ExpertID:    &payout.ExpertID,
+		Description: "Payout returned to balance",
+		Currency:    payout.Currency,
+		Entries: []models.LedgerEntry{
+			{Account: models.AccountCash, Debit: payout.Amount},
+			{Account: models.AccountExpertPayable, ExpertID: &payout.ExpertID, Credit: payout.Amount},
+		},
+	})
+}
+
+// Balance summarises what the platform owes an expert in one currency. All
+// amounts are in minor units.
+type Balance struct {
+	ExpertID       uint   `json:"expert_id"`
+	Currency       string `json:"currency"`
+	TotalEarned    int64  `json:"total_earned_minor"`    // Expert share of all payments, and of prepaid sessions as they are earned
+	TotalPaidOut   int64  `json:"total_paid_out_minor"`  // Payouts sent, net of reversals
+	Balance        int64  `json:"balance_minor"`         // Ledger balance owed to the expert
+	PendingPayouts int64  `json:"pending_payouts_minor"` // Requested or approved payouts not yet sent
+	Available      int64  `json:"available_minor"`       // What can still be requested
+	Formatted      string `json:"available_formatted"`
+}
+
+// ExpertBalance computes the expert's current balance in currency from the ledger
+func ExpertBalance(db *gorm.DB, expertID uint, currency string) (*Balance, error) {
+	var totals struct {
+		Earned  int64
+		PaidOut int64
+		Balance int64
+	}
+	err := db.Table("ledger_entries").
+		Joins("JOIN ledger_journals ON ledger_journals.id = ledger_entries.journal_id").
+		Where("ledger_entries.account = ? AND ledger_entries.expert_id = ? AND ledger_entries.currency = ? AND ledger_entries.deleted_at IS NULL",
+			models.AccountExpertPayable, expertID, currency).
+		Select(`COALESCE(SUM(CASE WHEN ledger_journals.kind IN ('payment', 'deferred_earning') THEN ledger_entries.credit_minor ELSE 0 END), 0) AS earned,
+			COALESCE(SUM(CASE WHEN ledger_journals.kind = 'payout' THEN ledger_entries.debit_minor
+				WHEN ledger_journals.kind = 'payout_reversal' THEN -ledger_entries.credit_minor ELSE 0 END), 0) AS paid_out,
+			COALESCE(SUM(ledger_entries.credit_minor - ledger_entries.debit_minor), 0) AS balance`).
+		Scan(&totals).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var pending int64
+	if err := db.Model(&models.Payout{}).
+		Where("expert_id = ? AND currency = ? AND status IN ?", expertID, currency, []string{"requested", "approved"}).
+		Select("COALESCE(SUM(amount_minor), 0)").
+		Scan(&pending).Error; err != nil {
+		return nil, err
+	}
+
+	// Reversed payments and returned deferred earnings lower the balance
+	// without being paid out
+	balance := totals.Balance
+	return &Balance{
+		ExpertID:       expertID,
+		Currency:       currency,
+		TotalEarned:    totals.Earned,
+		TotalPaidOut:   totals.PaidOut,
+		Balance:        balance,
+		PendingPayouts: pending,
+		Available:      balance - pending,
+		Formatted:      utils.FormatMoney(balance-pending, currency),
+	}, nil
+}
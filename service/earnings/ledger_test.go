@@ -0,0 +1,309 @@
+package earnings
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"gorm.io/gorm"
+)
+
+func TestCommissionRate(t *testing.T) {
+	tests := []struct {
+		env  string
+		want float64
+	}{
+		{env: "", want: defaultCommissionRate},
+		{env: "0.15", want: 0.15},
+		{env: "0", want: 0},
+		{env: "1", want: 1},
+		{env: "1.5", want: defaultCommissionRate},
+		{env: "-0.1", want: defaultCommissionRate},
+		{env: "lots", want: defaultCommissionRate},
+	}
+	for _, tt := range tests {
+		t.Setenv("PLATFORM_COMMISSION_RATE", tt.env)
+		if got := CommissionRate(); got != tt.want {
+			t.Errorf("CommissionRate with %q = %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestPostJournalUnbalanced(t *testing.T) {
+	// Checked before anything is written, so no database is needed
+	err := postJournal(nil, &models.LedgerJournal{Reference: "BAD", Currency: "GHS", Entries: []models.LedgerEntry{
+		{Account: models.AccountCash, Debit: 1000},
+		{Account: models.AccountPlatformRevenue, Credit: 999},
+	}})
+	if !errors.Is(err, ErrUnbalancedJournal) {
+		t.Errorf("postJournal = %v, want %v", err, ErrUnbalancedJournal)
+	}
+}
+
+// earner creates an expert with a payout account and earnings of share, from
+// a GHS payment of share at no commission
+func earner(t *testing.T, db *gorm.DB, share int64) *models.Expert {
+	t.Helper()
+	t.Setenv("PLATFORM_COMMISSION_RATE", "0")
+
+	expert := testdb.Expert(t, db, "Paid Expert")
+	if err := db.Model(expert).Update("transfer_recipient_code", "RCP_test").Error; err != nil {
+		t.Fatal(err)
+	}
+	if share > 0 {
+		if err := RecordPayment(db, "APT-earned", share, "GHS", &expert.ID, "Session"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return expert
+}
+
+// balance returns the expert's GHS balance, failing t on error
+func balance(t *testing.T, db *gorm.DB, expertID uint) *Balance {
+	t.Helper()
+
+	b, err := ExpertBalance(db, expertID, "GHS")
+	if err != nil {
+		t.Fatalf("ExpertBalance: %v", err)
+	}
+	return b
+}
+
+// checkLedgerBalances fails t if the ledger's debits and credits differ
+func checkLedgerBalances(t *testing.T, db *gorm.DB) {
+	t.Helper()
+
+	var totals struct{ Debits, Credits int64 }
+	db.Model(&models.LedgerEntry{}).Select("COALESCE(SUM(debit_minor), 0) AS debits, COALESCE(SUM(credit_minor), 0) AS credits").Scan(&totals)
+	if totals.Debits != totals.Credits {
+		t.Errorf("ledger debits %d, credits %d", totals.Debits, totals.Credits)
+	}
+}
+
+func TestRecordPayment(t *testing.T) {
+	db := testdb.Open(t, "earnings")
+	t.Setenv("PLATFORM_COMMISSION_RATE", "0.2")
+	expert := testdb.Expert(t, db, "Expert")
+
+	if err := RecordPayment(db, "APT-1", 10000, "GHS", &expert.ID, "Session"); err != nil {
+		t.Fatal(err)
+	}
+	// Retried, e.g. by a second webhook delivery
+	if err := RecordPayment(db, "APT-1", 10000, "GHS", &expert.ID, "Session"); err != nil {
+		t.Fatal(err)
+	}
+	// Signal subscriptions have no expert, so the platform keeps it all
+	if err := RecordPayment(db, "SIG-1", 5000, "GHS", nil, "Subscription"); err != nil {
+		t.Fatal(err)
+	}
+
+	var journal models.LedgerJournal
+	db.Preload("Entries").Where("reference = ?", "APT-1").First(&journal)
+	if journal.Gross != 10000 || journal.Commission != 2000 || len(journal.Entries) != 3 {
+		t.Errorf("journal = gross %d, commission %d, %d entries", journal.Gross, journal.Commission, len(journal.Entries))
+	}
+	var journals int64
+	db.Model(&models.LedgerJournal{}).Count(&journals)
+	if journals != 2 {
+		t.Errorf("%d journals, want the retry skipped", journals)
+	}
+
+	if b := balance(t, db, expert.ID); b.TotalEarned != 8000 || b.Balance != 8000 || b.Available != 8000 {
+		t.Errorf("balance = %+v, want 8000 earned and available", b)
+	}
+	checkLedgerBalances(t, db)
+}
+
+func TestExpertBalance(t *testing.T) {
+	db := testdb.Open(t, "earnings")
+	expert := earner(t, db, 10000)
+
+	steps := []struct {
+		name        string
+		post        func() error
+		wantBalance int64
+		wantPaidOut int64
+		wantEarned  int64
+	}{
+		{name: "paid out", post: func() error {
+			return recordPayout(db, &models.Payout{ExpertID: expert.ID, Amount: 3000, Currency: "GHS", Reference: "PO-1"})
+		}, wantBalance: 7000, wantPaidOut: 3000, wantEarned: 10000},
+		{name: "payout reversed", post: func() error {
+			return reversePayout(db, &models.Payout{ExpertID: expert.ID, Amount: 3000, Currency: "GHS", Reference: "PO-1"})
+		}, wantBalance: 10000, wantEarned: 10000},
+		{name: "payment reversed is not a payout", post: func() error {
+			return ReversePayment(db, "APT-earned", "Missed session")
+		}, wantEarned: 10000},
+		{name: "prepayment held back", post: func() error {
+			_, err := RecordPrepayment(db, "PKG-1", 6000, "GHS", expert.ID, "Package")
+			return err
+		}, wantEarned: 10000},
+		{name: "prepayment earned", post: func() error {
+			return EarnDeferred(db, "PKG-1-C1", 2000, "GHS", expert.ID, "Credit redeemed")
+		}, wantBalance: 2000, wantEarned: 12000},
+		{name: "earning returned is not a payout", post: func() error {
+			return UnearnDeferred(db, "PKG-1-C1-BACK", 2000, "GHS", expert.ID, "Credit given back")
+		}, wantEarned: 12000},
+	}
+	for _, step := range steps {
+		if err := step.post(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		b := balance(t, db, expert.ID)
+		if b.Balance != step.wantBalance || b.TotalPaidOut != step.wantPaidOut || b.TotalEarned != step.wantEarned {
+			t.Errorf("%s: balance %d, paid out %d, earned %d; want %d, %d, %d",
+				step.name, b.Balance, b.TotalPaidOut, b.TotalEarned, step.wantBalance, step.wantPaidOut, step.wantEarned)
+		}
+	}
+	checkLedgerBalances(t, db)
+
+	// Payouts waiting to be sent are not available to request
+	if err := db.Create(&models.Payout{ExpertID: expert.ID, Amount: 500, Currency: "GHS", Status: "requested", Reference: "PO-2"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := EarnDeferred(db, "PKG-1-C2", 2000, "GHS", expert.ID, "Credit redeemed"); err != nil {
+		t.Fatal(err)
+	}
+	if b := balance(t, db, expert.ID); b.PendingPayouts != 500 || b.Available != 1500 {
+		t.Errorf("pending %d, available %d; want 500 and 1500", b.PendingPayouts, b.Available)
+	}
+}
+
+func TestReversePaymentPart(t *testing.T) {
+	tests := []struct {
+		name        string
+		parts       int64
+		whole       int64
+		paidOut     int64 // Paid out of the expert's 10000 balance before the reversal
+		wantBalance int64 // Left after the reversal
+	}{
+		{name: "whole share", parts: 1, whole: 1, wantBalance: 0},
+		{name: "unused part", parts: 2, whole: 5, wantBalance: 6000},
+		{name: "capped at what is left", parts: 1, whole: 1, paidOut: 7000, wantBalance: 0},
+		{name: "nothing left", parts: 1, whole: 1, paidOut: 10000, wantBalance: 0},
+		{name: "no parts", parts: 0, whole: 5, wantBalance: 10000},
+		{name: "no whole", parts: 1, whole: 0, wantBalance: 10000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "earnings")
+			expert := earner(t, db, 10000)
+			if tt.paidOut > 0 {
+				if err := recordPayout(db, &models.Payout{ExpertID: expert.ID, Amount: tt.paidOut, Currency: "GHS", Reference: "PO-1"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := 0; i < 2; i++ { // The second time is a retry and changes nothing
+				err := db.Transaction(func(tx *gorm.DB) error {
+					return ReversePaymentPart(tx, "APT-earned", "APT-earned-REF1", tt.parts, tt.whole, "Refund")
+				})
+				if err != nil {
+					t.Fatalf("ReversePaymentPart: %v", err)
+				}
+			}
+
+			b := balance(t, db, expert.ID)
+			if b.Balance != tt.wantBalance {
+				t.Errorf("balance = %d, want %d", b.Balance, tt.wantBalance)
+			}
+			if b.TotalPaidOut != tt.paidOut {
+				t.Errorf("paid out = %d, want %d", b.TotalPaidOut, tt.paidOut)
+			}
+			checkLedgerBalances(t, db)
+		})
+	}
+
+	t.Run("unknown payment", func(t *testing.T) {
+		db := testdb.Open(t, "earnings")
+		if err := ReversePaymentPart(db, "APT-missing", "APT-missing-REV", 1, 1, "Refund"); err != nil {
+			t.Errorf("ReversePaymentPart = %v, want nothing to do", err)
+		}
+	})
+}
+
+func TestUnearnDeferred(t *testing.T) {
+	tests := []struct {
+		name        string
+		paidOut     int64
+		wantBalance int64
+		wantCovered int64 // Taken from platform revenue instead of the expert
+	}{
+		{name: "taken from the balance", wantBalance: 0},
+		{name: "balance already paid out", paidOut: 3000, wantBalance: 0, wantCovered: 2000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "earnings")
+			expert := earner(t, db, 0)
+			if _, err := RecordPrepayment(db, "PKG-1", 10000, "GHS", expert.ID, "Package"); err != nil {
+				t.Fatal(err)
+			}
+			if err := EarnDeferred(db, "PKG-1-C1", 3000, "GHS", expert.ID, "Credit redeemed"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.paidOut > 0 {
+				if err := recordPayout(db, &models.Payout{ExpertID: expert.ID, Amount: tt.paidOut, Currency: "GHS", Reference: "PO-1"}); err != nil {
+					t.Fatal(err)
+				}
+				// Earned again since, so only 1000 remains on the balance
+				if err := EarnDeferred(db, "PKG-1-C2", 1000, "GHS", expert.ID, "Credit redeemed"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				return UnearnDeferred(tx, "PKG-1-C1-BACK", 3000, "GHS", expert.ID, "Credit given back")
+			})
+			if err != nil {
+				t.Fatalf("UnearnDeferred: %v", err)
+			}
+
+			if b := balance(t, db, expert.ID); b.Balance != tt.wantBalance {
+				t.Errorf("balance = %d, want %d", b.Balance, tt.wantBalance)
+			}
+			var covered int64
+			db.Model(&models.LedgerEntry{}).Where("account = ?", models.AccountPlatformRevenue).Select("COALESCE(SUM(debit_minor), 0)").Scan(&covered)
+			if covered != tt.wantCovered {
+				t.Errorf("platform covered %d, want %d", covered, tt.wantCovered)
+			}
+			checkLedgerBalances(t, db)
+		})
+	}
+}
+
+func TestReversalsAndPayoutRace(t *testing.T) {
+	db := testdb.Open(t, "earnings")
+	expert := earner(t, db, 0)
+	for i := 1; i <= 4; i++ {
+		if err := RecordPayment(db, fmt.Sprintf("APT-%d", i), 2500, "GHS", &expert.ID, "Session"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two payouts of the whole balance race reversals of two payments; with
+	// the expert locked, each sees what the others took
+	errs := testdb.Race(4, func(i int) error {
+		if i < 2 {
+			_, err := requestPayout(db, expert.ID, 10000, "GHS", fmt.Sprintf("PO-%d", i))
+			return err
+		}
+		return db.Transaction(func(tx *gorm.DB) error {
+			return ReversePayment(tx, fmt.Sprintf("APT-%d", i), "Missed session")
+		})
+	})
+	for i, err := range errs {
+		if err != nil && !errors.Is(err, ErrInsufficientBalance) {
+			t.Errorf("call %d: %v", i, err)
+		}
+	}
+
+	if b := balance(t, db, expert.ID); b.Available < 0 {
+		t.Errorf("available = %d after the race; payouts and reversals took more than the balance", b.Available)
+	}
+	checkLedgerBalances(t, db)
+}
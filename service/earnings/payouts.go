@@ -0,0 +1,252 @@
+package earnings
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrInsufficientBalance is returned when a payout exceeds the available balance
+	ErrInsufficientBalance = errors.New("payout exceeds available balance")
+	// ErrNoPayoutAccount is returned when an expert has not set up a payout account
+	ErrNoPayoutAccount = errors.New("expert has no payout account")
+	// ErrPayoutNotPending is returned when a payout has already been reviewed
+	ErrPayoutNotPending = errors.New("payout has already been reviewed")
+)
+
+const (
+	// payoutSettleWait is how long a payout with no transfer outcome is left
+	// for the webhook before it is verified with the provider
+	payoutSettleWait = time.Hour
+	// payoutReconcileInterval is how often unsettled payouts are checked
+	payoutReconcileInterval = 15 * time.Minute
+)
+
+// requestPayout creates a payout request for amount. The expert row is locked
+// so concurrent requests cannot together exceed the balance.
+func requestPayout(db *gorm.DB, expertID uint, amount int64, currency string, reference string) (*models.Payout, error) {
+	var payout models.Payout
+	err := db.Transaction(func(tx *gorm.DB) error {
+		expert, err := lockExpert(tx, expertID)
+		if err != nil {
+			return err
+		}
+		if expert.TransferRecipientCode == "" {
+			return ErrNoPayoutAccount
+		}
+
+		balance, err := ExpertBalance(tx, expertID, currency)
+		if err != nil {
+			return err
+		}
+		if amount > balance.Available {
+			return ErrInsufficientBalance
+		}
+
+		payout = models.Payout{
+			ExpertID:  expertID,
+			Amount:    amount,
+			Currency:  currency,
+			Status:    "requested",
+			Reference: reference,
+		}
+		return tx.Create(&payout).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// approvePayout sends a requested payout through the provider. The payout is
+// marked approved before the transfer so it cannot be sent twice. Only a
+// transfer the provider rejected fails the payout. When the transfer call
+// gives no answer the payout stays approved, still counted against the
+// balance, for reconcilePayouts to look up; otherwise it is posted to the
+// ledger as processing until the transfer webhook settles it.
+func (h *EarningsHandler) approvePayout(payoutID uint, reviewerID uint, now time.Time) (*models.Payout, error) {
+	var payout models.Payout
+	var expert models.Expert
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payout, payoutID).Error; err != nil {
+			return err
+		}
+		if payout.Status != "requested" {
+			return ErrPayoutNotPending
+		}
+		if err := tx.First(&expert, payout.ExpertID).Error; err != nil {
+			return err
+		}
+		if expert.TransferRecipientCode == "" {
+			return ErrNoPayoutAccount
+		}
+
+		payout.Status = "approved"
+		payout.ReviewedByID = &reviewerID
+		payout.ReviewedAt = &now
+		return tx.Save(&payout).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, transferErr := h.provider.Transfer(payment.TransferRequest{
+		Amount:        payout.Amount,
+		Currency:      payout.Currency,
+		RecipientCode: expert.TransferRecipientCode,
+		Reference:     payout.Reference,
+		Reason:        "KodeFx earnings payout",
+	})
+	if transferErr != nil && !errors.Is(transferErr, payment.ErrTransferFailed) {
+		log.Printf("Transfer for payout %s has no outcome yet: %v", payout.Reference, transferErr)
+		return &payout, nil
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if transferErr != nil {
+			payout.Status = "failed"
+			payout.FailureReason = transferErr.Error()
+			return tx.Save(&payout).Error
+		}
+		return settlePayout(tx, &payout, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// settlePayout applies the provider's transfer result to an approved or
+// processing payout: failed and reversed transfers return the amount to the
+// expert's balance, anything else posts the payout to the ledger, marking it
+// paid once the transfer has succeeded.
+func settlePayout(tx *gorm.DB, payout *models.Payout, result *payment.TransferResult) error {
+	switch result.Status {
+	case "failed", "reversed":
+		if err := reversePayout(tx, payout); err != nil {
+			return err
+		}
+		payout.Status = "failed"
+		payout.FailureReason = "Transfer was " + result.Status
+		return tx.Save(payout).Error
+	}
+
+	if result.TransferCode != "" {
+		payout.TransferCode = result.TransferCode
+	}
+	payout.Status = "processing"
+	if result.Status == "success" {
+		payout.Status = "paid"
+	}
+	if err := recordPayout(tx, payout); err != nil {
+		return err
+	}
+	return tx.Save(payout).Error
+}
+
+// reconcilePayouts verifies payouts that have waited longer than
+// payoutSettleWait without a transfer outcome, including approved ones whose
+// transfer result was never recorded. Only an approved payout whose transfer
+// the provider has no record of was never sent and fails. A processing
+// payout's transfer was accepted, so it is left for the transfer webhook or
+// a later round, as is any payout the provider could not be asked about.
+func (h *EarningsHandler) reconcilePayouts(now time.Time) error {
+	var unsettled []models.Payout
+	if err := h.db.Where("status IN ? AND updated_at <= ?", []string{"approved", "processing"}, now.Add(-payoutSettleWait)).
+		Find(&unsettled).Error; err != nil {
+		return err
+	}
+
+	for i := range unsettled {
+		reference := unsettled[i].Reference
+		result, err := h.provider.VerifyTransfer(reference)
+		neverSent := errors.Is(err, payment.ErrTransferFailed)
+		if neverSent {
+			if unsettled[i].Status != "approved" {
+				log.Printf("Transfer for processing payout %s not found; waiting for the webhook", reference)
+				continue
+			}
+			result, err = &payment.TransferResult{Reference: reference, Status: "failed"}, nil
+		}
+		if err != nil {
+			log.Printf("Error verifying transfer for payout %s: %v", reference, err)
+			continue
+		}
+
+		err = h.db.Transaction(func(tx *gorm.DB) error {
+			var payout models.Payout
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payout, unsettled[i].ID).Error; err != nil {
+				return err
+			}
+			if payout.Status != "approved" && payout.Status != "processing" {
+				return nil
+			}
+			if neverSent && payout.Status != "approved" {
+				return nil
+			}
+			if payout.Status == "processing" && result.Status != "success" && result.Status != "failed" && result.Status != "reversed" {
+				// Still in flight; touch the row so it waits another round
+				return tx.Model(&payout).Update("updated_at", now).Error
+			}
+			return settlePayout(tx, &payout, result)
+		})
+		if err != nil {
+			log.Printf("Error settling payout %s: %v", reference, err)
+		}
+	}
+	return nil
+}
+
+// runPayoutReconciler periodically settles payouts left without a transfer outcome
+func (h *EarningsHandler) runPayoutReconciler() {
+	ticker := time.NewTicker(payoutReconcileInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.reconcilePayouts(time.Now()); err != nil {
+			log.Printf("Error reconciling payouts: %v", err)
+		}
+	}
+}
+
+// HandleTransferEvent settles a payout from a provider transfer webhook event
+// (transfer.success, transfer.failed or transfer.reversed)
+func HandleTransferEvent(tx *gorm.DB, event string, reference string, reason string) error {
+	var payout models.Payout
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("reference = ?", reference).
+		First(&payout).Error; err != nil {
+		return err
+	}
+
+	switch event {
+	case "transfer.success":
+		switch payout.Status {
+		case "processing":
+			return tx.Model(&payout).Update("status", "paid").Error
+		case "approved":
+			// The transfer result was never recorded, so post it now
+			return settlePayout(tx, &payout, &payment.TransferResult{Reference: reference, Status: "success"})
+		}
+		return nil
+	case "transfer.failed", "transfer.reversed":
+		if payout.Status == "failed" {
+			return nil
+		}
+		if err := reversePayout(tx, &payout); err != nil {
+			return err
+		}
+		return tx.Model(&payout).Updates(map[string]interface{}{
+			"status":         "failed",
+			"failure_reason": reason,
+		}).Error
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package earnings
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+)
+
+func TestRequestPayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		account bool // The expert has set up a payout account
+		amount  int64
+		wantErr error
+	}{
+		{name: "within the balance", account: true, amount: 8000},
+		{name: "whole balance", account: true, amount: 10000},
+		{name: "over the balance", account: true, amount: 10001, wantErr: ErrInsufficientBalance},
+		{name: "no payout account", amount: 100, wantErr: ErrNoPayoutAccount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "earnings")
+			expert := earner(t, db, 10000)
+			if !tt.account {
+				db.Model(expert).Update("transfer_recipient_code", "")
+			}
+
+			payout, err := requestPayout(db, expert.ID, tt.amount, "GHS", "PO-1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("requestPayout error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if payout.Status != "requested" {
+				t.Errorf("payout is %s, want requested", payout.Status)
+			}
+			if b := balance(t, db, expert.ID); b.Balance != 10000 || b.Available != 10000-tt.amount {
+				t.Errorf("balance %d, available %d after requesting %d", b.Balance, b.Available, tt.amount)
+			}
+		})
+	}
+}
+
+func TestRequestPayoutRace(t *testing.T) {
+	db := testdb.Open(t, "earnings")
+	expert := earner(t, db, 10000)
+
+	errs := testdb.Race(5, func(i int) error {
+		_, err := requestPayout(db, expert.ID, 3000, "GHS", fmt.Sprintf("PO-%d", i))
+		return err
+	})
+
+	var ok int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case !errors.Is(err, ErrInsufficientBalance):
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if ok != 3 {
+		t.Errorf("%d payouts requested, want 3", ok)
+	}
+	if b := balance(t, db, expert.ID); b.Available != 1000 {
+		t.Errorf("available = %d, want 1000", b.Available)
+	}
+}
+
+func TestApprovePayout(t *testing.T) {
+	tests := []struct {
+		name           string
+		transferStatus string
+		transferErr    error
+		wantStatus     string
+		wantPaidOut    int64
+		wantAvailable  int64
+	}{
+		{name: "sent", transferStatus: "success", wantStatus: "paid", wantPaidOut: 4000, wantAvailable: 6000},
+		{name: "queued", transferStatus: "pending", wantStatus: "processing", wantPaidOut: 4000, wantAvailable: 6000},
+		{name: "failed", transferStatus: "failed", wantStatus: "failed", wantAvailable: 10000},
+		{name: "rejected", transferErr: fmt.Errorf("%w: insufficient balance", payment.ErrTransferFailed), wantStatus: "failed", wantAvailable: 10000},
+		{name: "no answer", transferErr: &payment.APIError{StatusCode: 502}, wantStatus: "approved", wantAvailable: 6000},
+		{name: "timed out", transferErr: errors.New("context deadline exceeded"), wantStatus: "approved", wantAvailable: 6000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "earnings")
+			expert := earner(t, db, 10000)
+			admin := testdb.User(t, db, "Admin")
+			requested, err := requestPayout(db, expert.ID, 4000, "GHS", "PO-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			provider := payment.NewFakeProvider()
+			provider.TransferStatus = tt.transferStatus
+			provider.TransferErr = tt.transferErr
+			h := &EarningsHandler{db: db, provider: provider}
+
+			payout, err := h.approvePayout(requested.ID, admin.ID, time.Now())
+			if err != nil {
+				t.Fatalf("approvePayout: %v", err)
+			}
+			if payout.Status != tt.wantStatus {
+				t.Errorf("payout is %s, want %s", payout.Status, tt.wantStatus)
+			}
+			if b := balance(t, db, expert.ID); b.TotalPaidOut != tt.wantPaidOut || b.Available != tt.wantAvailable {
+				t.Errorf("paid out %d, available %d; want %d, %d", b.TotalPaidOut, b.Available, tt.wantPaidOut, tt.wantAvailable)
+			}
+
+			// It can't be sent a second time
+			if _, err := h.approvePayout(requested.ID, admin.ID, time.Now()); !errors.Is(err, ErrPayoutNotPending) {
+				t.Errorf("second approval error = %v, want %v", err, ErrPayoutNotPending)
+			}
+			if len(provider.Transfers) != 1 {
+				t.Errorf("%d transfers sent, want 1", len(provider.Transfers))
+			}
+		})
+	}
+}
+
+func TestReconcilePayouts(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        string // Of the payout before reconciling
+		verified      string // Transfer status the provider reports, if it knows the transfer
+		verifyErr     error
+		wantStatus    string
+		wantAvailable int64
+	}{
+		{name: "approved, sent", status: "approved", verified: "success", wantStatus: "paid", wantAvailable: 6000},
+		{name: "approved, queued", status: "approved", verified: "pending", wantStatus: "processing", wantAvailable: 6000},
+		{name: "approved, failed", status: "approved", verified: "failed", wantStatus: "failed", wantAvailable: 10000},
+		{name: "approved, never sent", status: "approved", wantStatus: "failed", wantAvailable: 10000},
+		{name: "approved, provider down", status: "approved", verifyErr: &payment.APIError{StatusCode: 503}, wantStatus: "approved", wantAvailable: 6000},
+		{name: "approved, bad credentials", status: "approved", verifyErr: &payment.APIError{StatusCode: 401}, wantStatus: "approved", wantAvailable: 6000},
+		{name: "approved, rate limited", status: "approved", verifyErr: &payment.APIError{StatusCode: 429}, wantStatus: "approved", wantAvailable: 6000},
+		{name: "processing, sent", status: "processing", verified: "success", wantStatus: "paid", wantAvailable: 6000},
+		{name: "processing, reversed", status: "processing", verified: "reversed", wantStatus: "failed", wantAvailable: 10000},
+		{name: "processing, still queued", status: "processing", verified: "pending", wantStatus: "processing", wantAvailable: 6000},
+		{name: "processing, not found", status: "processing", wantStatus: "processing", wantAvailable: 6000},
+		{name: "processing, provider down", status: "processing", verifyErr: &payment.APIError{StatusCode: 500}, wantStatus: "processing", wantAvailable: 6000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "earnings")
+			now := time.Now()
+			expert := earner(t, db, 10000)
+			payout := models.Payout{ExpertID: expert.ID, Amount: 4000, Currency: "GHS", Status: tt.status, Reference: "PO-1"}
+			if err := db.Create(&payout).Error; err != nil {
+				t.Fatal(err)
+			}
+			if tt.status == "processing" {
+				if err := recordPayout(db, &payout); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.Model(&payout).UpdateColumn("updated_at", now.Add(-2*payoutSettleWait))
+
+			provider := payment.NewFakeProvider()
+			provider.VerifyTransferErr = tt.verifyErr
+			if tt.verified != "" {
+				provider.VerifiedTransfers["PO-1"] = payment.TransferResult{Reference: "PO-1", TransferCode: "TRF_1", Status: tt.verified}
+			}
+			h := &EarningsHandler{db: db, provider: provider}
+
+			// A second round must not post anything twice
+			for i := 0; i < 2; i++ {
+				if err := h.reconcilePayouts(now.Add(time.Duration(i) * 2 * payoutSettleWait)); err != nil {
+					t.Fatalf("reconcilePayouts: %v", err)
+				}
+			}
+
+			db.First(&payout, payout.ID)
+			if payout.Status != tt.wantStatus {
+				t.Errorf("payout is %s, want %s", payout.Status, tt.wantStatus)
+			}
+			if b := balance(t, db, expert.ID); b.Available != tt.wantAvailable {
+				t.Errorf("available = %d, want %d", b.Available, tt.wantAvailable)
+			}
+			checkLedgerBalances(t, db)
+		})
+	}
+
+	t.Run("recent payouts wait for the webhook", func(t *testing.T) {
+		db := testdb.Open(t, "earnings")
+		expert := earner(t, db, 10000)
+		payout := models.Payout{ExpertID: expert.ID, Amount: 4000, Currency: "GHS", Status: "approved", Reference: "PO-1"}
+		if err := db.Create(&payout).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		h := &EarningsHandler{db: db, provider: payment.NewFakeProvider()}
+		if err := h.reconcilePayouts(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		db.First(&payout, payout.ID)
+		if payout.Status != "approved" {
+			t.Errorf("payout is %s, want it left approved", payout.Status)
+		}
+	})
+}
+
+func TestHandleTransferEvent(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        string
+		event         string
+		wantStatus    string
+		wantAvailable int64
+	}{
+		{name: "processing sent", status: "processing", event: "transfer.success", wantStatus: "paid", wantAvailable: 6000},
+		{name: "approved sent", status: "approved", event: "transfer.success", wantStatus: "paid", wantAvailable: 6000},
+		{name: "processing failed", status: "processing", event: "transfer.failed", wantStatus: "failed", wantAvailable: 10000},
+		{name: "approved reversed", status: "approved", event: "transfer.reversed", wantStatus: "failed", wantAvailable: 10000},
+		{name: "already failed", status: "failed", event: "transfer.failed", wantStatus: "failed", wantAvailable: 10000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "earnings")
+			expert := earner(t, db, 10000)
+			payout := models.Payout{ExpertID: expert.ID, Amount: 4000, Currency: "GHS", Status: tt.status, Reference: "PO-1"}
+			if err := db.Create(&payout).Error; err != nil {
+				t.Fatal(err)
+			}
+			if tt.status == "processing" {
+				if err := recordPayout(db, &payout); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Webhooks may be delivered more than once
+			for i := 0; i < 2; i++ {
+				if err := HandleTransferEvent(db, tt.event, "PO-1", "Bank rejected"); err != nil {
+					t.Fatalf("HandleTransferEvent: %v", err)
+				}
+			}
+
+			db.First(&payout, payout.ID)
+			if payout.Status != tt.wantStatus {
+				t.Errorf("payout is %s, want %s", payout.Status, tt.wantStatus)
+			}
+			if b := balance(t, db, expert.ID); b.Available != tt.wantAvailable {
+				t.Errorf("available = %d, want %d", b.Available, tt.wantAvailable)
+			}
+			checkLedgerBalances(t, db)
+		})
+	}
+}
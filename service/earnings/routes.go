@@ -0,0 +1,456 @@
+package earnings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Response is a standardized API response structure
+type Response struct {
+	Data  interface{} `json:"data,omitempty"`
+	Meta  interface{} `json:"meta,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// StatementLine is one movement on an expert's balance. Amounts are in minor units.
+type StatementLine struct {
+	Date        time.Time `json:"date"`
+	Reference   string    `json:"reference"`
+	Kind        string    `json:"kind"`
+	Description string    `json:"description"`
+	Gross       int64     `json:"gross_minor,omitempty"`      // Amount the customer paid
+	Commission  int64     `json:"commission_minor,omitempty"` // Platform share of Gross
+	Amount      int64     `json:"amount_minor"`               // Change to the expert's balance
+	Balance     int64     `json:"balance_minor"`              // Balance after this line
+}
+
+// requestCurrency returns the ?currency= query parameter or the default currency
+func requestCurrency(r *http.Request) string {
+	if currency := utils.NormalizeCurrency(r.URL.Query().Get("currency")); currency != "" {
+		return currency
+	}
+	return utils.DefaultCurrency()
+}
+
+// EarningsHandler handles expert earnings and payout HTTP requests
+type EarningsHandler struct {
+	db       *gorm.DB
+	provider payment.Provider
+}
+
+// NewEarningsHandler creates a new earnings handler and starts reconciling
+// unsettled payouts
+func NewEarningsHandler(db *gorm.DB) *EarningsHandler {
+	h := &EarningsHandler{
+		db:       db,
+		provider: payment.NewProvider(),
+	}
+	go h.runPayoutReconciler()
+
+	return h
+}
+
+// RegisterRoutes registers all earnings and payout routes
+func (h *EarningsHandler) RegisterRoutes(router *mux.Router) {
+	// Expert earnings
+	router.HandleFunc("/experts/{id:[0-9]+}/earnings", utils.AuthMiddleware(h.GetBalance)).Methods("GET")
+	router.HandleFunc("/experts/{id:[0-9]+}/earnings/statement", utils.AuthMiddleware(h.GetStatement)).Methods("GET")
+
+	// Payout account and requests
+	router.HandleFunc("/experts/{id:[0-9]+}/payout-account", utils.AuthMiddleware(h.SetPayoutAccount)).Methods("PUT")
+	router.HandleFunc("/experts/{id:[0-9]+}/payouts", utils.AuthMiddleware(h.GetExpertPayouts)).Methods("GET")
+	router.HandleFunc("/experts/{id:[0-9]+}/payouts", utils.AuthMiddleware(h.RequestPayout)).Methods("POST")
+
+	// Payout review
+	router.HandleFunc("/payouts", utils.AdminMiddleware(h.db, h.GetPayouts)).Methods("GET")
+	router.HandleFunc("/payouts/{id:[0-9]+}/approve", utils.AdminMiddleware(h.db, h.ApprovePayout)).Methods("PATCH")
+	router.HandleFunc("/payouts/{id:[0-9]+}/reject", utils.AdminMiddleware(h.db, h.RejectPayout)).Methods("PATCH")
+}
+
+// authorizeExpert loads the expert in the path and checks that the caller is
+// that expert or an admin
+func (h *EarningsHandler) authorizeExpert(w http.ResponseWriter, r *http.Request) (*models.Expert, bool) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	expertID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid expert ID")
+		return nil, false
+	}
+
+	var expert models.Expert
+	if err := h.db.First(&expert, expertID).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Expert not found")
+		return nil, false
+	}
+
+	if expert.UserID != userID && !utils.IsAdmin(h.db, userID) {
+		h.respondWithError(w, http.StatusForbidden, "You don't have permission to view these earnings")
+		return nil, false
+	}
+
+	return &expert, true
+}
+
+// GetBalance returns the expert's earnings, payouts and available balance
+func (h *EarningsHandler) GetBalance(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	balance, err := ExpertBalance(h.db, expert.ID, requestCurrency(r))
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to calculate balance")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{
+		Data: balance,
+		Meta: map[string]interface{}{
+			"commission_rate":        CommissionRate(),
+			"payout_account_present": expert.TransferRecipientCode != "",
+		},
+	})
+}
+
+// GetStatement lists every movement on the expert's balance in ?currency=
+// between start_date and end_date (YYYY-MM-DD, defaulting to the current month)
+func (h *EarningsHandler) GetStatement(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	layout := "2006-01-02"
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	to := now
+
+	if value := r.URL.Query().Get("start_date"); value != "" {
+		parsed, err := time.Parse(layout, value)
+		if err != nil {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid start_date format. Use YYYY-MM-DD")
+			return
+		}
+		from = parsed
+	}
+	if value := r.URL.Query().Get("end_date"); value != "" {
+		parsed, err := time.Parse(layout, value)
+		if err != nil {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid end_date format. Use YYYY-MM-DD")
+			return
+		}
+		to = parsed.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	currency := requestCurrency(r)
+
+	// Balance carried into the period
+	var opening int64
+	if err := h.db.Model(&models.LedgerEntry{}).
+		Where("account = ? AND expert_id = ? AND currency = ? AND created_at < ?", models.AccountExpertPayable, expert.ID, currency, from).
+		Select("COALESCE(SUM(credit_minor - debit_minor), 0)").
+		Scan(&opening).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve statement")
+		return
+	}
+
+	var journals []models.LedgerJournal
+	if err := h.db.Preload("Entries").
+		Where("expert_id = ? AND currency = ? AND created_at BETWEEN ? AND ?", expert.ID, currency, from, to).
+		Order("created_at ASC").
+		Find(&journals).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve statement")
+		return
+	}
+
+	running := opening
+	lines := make([]StatementLine, 0, len(journals))
+	for _, journal := range journals {
+		var amount int64
+		for _, entry := range journal.Entries {
+			if entry.Account == models.AccountExpertPayable {
+				amount += entry.Credit - entry.Debit
+			}
+		}
+		running += amount
+
+		lines = append(lines, StatementLine{
+			Date:        journal.CreatedAt,
+			Reference:   journal.Reference,
+			Kind:        journal.Kind,
+			Description: journal.Description,
+			Gross:       journal.Gross,
+			Commission:  journal.Commission,
+			Amount:      amount,
+			Balance:     running,
+		})
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{
+		Data: lines,
+		Meta: map[string]interface{}{
+			"expert_id":                 expert.ID,
+			"currency":                  currency,
+			"start_date":                from,
+			"end_date":                  to,
+			"opening_balance_minor":     opening,
+			"closing_balance_minor":     running,
+			"closing_balance_formatted": utils.FormatMoney(running, currency),
+		},
+	})
+}
+
+// SetPayoutAccount registers the bank or mobile money account an expert is paid into
+func (h *EarningsHandler) SetPayoutAccount(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Type          string `json:"type"`
+		AccountName   string `json:"account_name"`
+		AccountNumber string `json:"account_number"`
+		BankCode      string `json:"bank_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if request.AccountName == "" || request.AccountNumber == "" || request.BankCode == "" {
+		h.respondWithError(w, http.StatusBadRequest, "Account name, account number and bank code are required")
+		return
+	}
+	if request.Type == "" {
+		request.Type = "ghipss"
+	}
+	if request.Type != "ghipss" && request.Type != "mobile_money" {
+		h.respondWithError(w, http.StatusBadRequest, "Type must be ghipss or mobile_money")
+		return
+	}
+
+	recipient, err := h.provider.CreateTransferRecipient(payment.TransferRecipientRequest{
+		Type:          request.Type,
+		Name:          request.AccountName,
+		AccountNumber: request.AccountNumber,
+		BankCode:      request.BankCode,
+		Currency:      utils.DefaultCurrency(),
+	})
+	if err != nil {
+		log.Printf("Error creating transfer recipient for expert %d: %v", expert.ID, err)
+		h.respondWithError(w, http.StatusBadGateway, "Could not verify payout account")
+		return
+	}
+
+	if err := h.db.Model(expert).Updates(map[string]interface{}{
+		"transfer_recipient_code": recipient.RecipientCode,
+		"payout_account_name":     request.AccountName,
+		"payout_account_number":   request.AccountNumber,
+		"payout_bank_code":        request.BankCode,
+	}).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to save payout account")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: map[string]interface{}{
+		"account_name":   request.AccountName,
+		"account_number": maskAccountNumber(request.AccountNumber),
+		"bank_code":      request.BankCode,
+	}})
+}
+
+// maskAccountNumber hides all but the last four digits of an account number
+func maskAccountNumber(number string) string {
+	if len(number) <= 4 {
+		return number
+	}
+	masked := make([]byte, len(number))
+	for i := range masked {
+		if i < len(number)-4 {
+			masked[i] = '*'
+		} else {
+			masked[i] = number[i]
+		}
+	}
+	return string(masked)
+}
+
+// RequestPayout asks for part or all of the available balance to be paid out
+func (h *EarningsHandler) RequestPayout(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Amount   int64  `json:"amount_minor"`
+		Currency string `json:"currency"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if request.Amount <= 0 {
+		h.respondWithError(w, http.StatusBadRequest, "Amount must be positive")
+		return
+	}
+	currency := utils.NormalizeCurrency(request.Currency)
+	if currency == "" {
+		currency = utils.DefaultCurrency()
+	}
+	if !utils.IsSupportedCurrency(currency) {
+		h.respondWithError(w, http.StatusBadRequest, "Unsupported currency")
+		return
+	}
+
+	reference := fmt.Sprintf("PAY-%d-%d", expert.ID, time.Now().UnixNano())
+	payout, err := requestPayout(h.db, expert.ID, request.Amount, currency, reference)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNoPayoutAccount):
+			h.respondWithError(w, http.StatusConflict, "Set up a payout account first")
+		case errors.Is(err, ErrInsufficientBalance):
+			h.respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			h.respondWithError(w, http.StatusInternalServerError, "Failed to request payout")
+		}
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusCreated, Response{Data: payout})
+}
+
+// GetExpertPayouts lists an expert's payouts, newest first
+func (h *EarningsHandler) GetExpertPayouts(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	var payouts []models.Payout
+	if err := h.db.Where("expert_id = ?", expert.ID).Order("created_at DESC").Find(&payouts).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve payouts")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: payouts})
+}
+
+// GetPayouts lists payouts across all experts, optionally filtered by ?status=
+func (h *EarningsHandler) GetPayouts(w http.ResponseWriter, r *http.Request) {
+	query := h.db.Preload("Expert")
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var payouts []models.Payout
+	if err := query.Order("created_at ASC").Find(&payouts).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve payouts")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: payouts})
+}
+
+// ApprovePayout approves a requested payout and sends the transfer
+func (h *EarningsHandler) ApprovePayout(w http.ResponseWriter, r *http.Request) {
+	reviewerID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	payoutID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid payout ID")
+		return
+	}
+
+	payout, err := h.approvePayout(uint(payoutID), reviewerID, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			h.respondWithError(w, http.StatusNotFound, "Payout not found")
+		case errors.Is(err, ErrPayoutNotPending), errors.Is(err, ErrNoPayoutAccount):
+			h.respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			h.respondWithError(w, http.StatusInternalServerError, "Failed to approve payout")
+		}
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: payout})
+}
+
+// RejectPayout declines a requested payout, releasing the amount back to the
+// expert's available balance
+func (h *EarningsHandler) RejectPayout(w http.ResponseWriter, r *http.Request) {
+	reviewerID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	payoutID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid payout ID")
+		return
+	}
+
+	var request struct {
+		Note string `json:"note"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+
+	now := time.Now()
+	result := h.db.Model(&models.Payout{}).
+		Where("id = ? AND status = ?", payoutID, "requested").
+		Updates(map[string]interface{}{
+			"status":         "rejected",
+			"note":           request.Note,
+			"reviewed_by_id": reviewerID,
+			"reviewed_at":    now,
+		})
+	if result.Error != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to reject payout")
+		return
+	}
+	if result.RowsAffected == 0 {
+		h.respondWithError(w, http.StatusConflict, "Payout not found or already reviewed")
+		return
+	}
+
+	var payout models.Payout
+	h.db.First(&payout, payoutID)
+	h.respondWithJSON(w, http.StatusOK, Response{Data: payout})
+}
+
+// Helper function to respond with an error
+func (h *EarningsHandler) respondWithError(w http.ResponseWriter, code int, message string) {
+	h.respondWithJSON(w, code, Response{Error: message})
+}
+
+// Helper function to respond with JSON
+func (h *EarningsHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -0,0 +1,90 @@
+package invoices
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"gorm.io/gorm"
+)
+
+// Invoice kinds
+const (
+	KindAppointment        = "appointment"
+	KindSignalSubscription = "signal_subscription"
+	KindSessionPackage     = "session_package"
+)
+
+// numberPrefix returns the prefix of invoice numbers, from INVOICE_PREFIX
+func numberPrefix() string {
+	if prefix := os.Getenv("INVOICE_PREFIX"); prefix != "" {
+		return prefix
+	}
+	return "KFX"
+}
+
+// nextNumber takes the next invoice number for year. The sequence row stays
+// locked until tx commits, so concurrent payments are numbered one after the
+// other and a rolled back payment does not use up a number.
+func nextNumber(tx *gorm.DB, year int) (string, error) {
+	var last int64
+	err := tx.Raw(`INSERT INTO invoice_sequences (year, last_number) VALUES (?, 1)
+		ON CONFLICT (year) DO UPDATE SET last_number = invoice_sequences.last_number + 1
+		RETURNING last_number`, year).Scan(&last).Error
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%06d", numberPrefix(), year, last), nil
+}
+
+// IssueInvoice creates the receipt for a recorded payment transaction. It is
+// idempotent: a transaction that already has an invoice gets that invoice back.
+// The invoice is emailed to the customer by the invoice mailer once tx commits.
+func IssueInvoice(tx *gorm.DB, transaction *models.Transaction, kind, description string) (*models.Invoice, error) {
+	var existing models.Invoice
+	err := tx.Where("transaction_id = ?", transaction.ID).First(&existing).Error
+	if err == nil {
+		return &existing, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var user models.User
+	if err := tx.Select("id", "full_name", "email").First(&user, transaction.UserID).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	number, err := nextNumber(tx, now.Year())
+	if err != nil {
+		return nil, err
+	}
+
+	invoice := models.Invoice{
+		Number:        number,
+		UserID:        transaction.UserID,
+		TransactionID: transaction.ID,
+		Reference:     transaction.Reference,
+		Kind:          kind,
+		Description:   description,
+		CustomerName:  user.FullName,
+		CustomerEmail: user.Email,
+		Currency:      transaction.Currency,
+		Subtotal:      transaction.Amount + transaction.DiscountAmount,
+		Discount:      transaction.DiscountAmount,
+		Total:         transaction.Amount,
+		WalletAmount:  transaction.WalletAmount,
+		CouponCode:    transaction.CouponCode,
+		PaymentMethod: payment.MethodLabel(transaction.Method),
+		IssuedAt:      now,
+	}
+	if err := tx.Create(&invoice).Error; err != nil {
+		return nil, err
+	}
+
+	return &invoice, nil
+}
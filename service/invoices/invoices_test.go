@@ -0,0 +1,180 @@
+package invoices
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"gorm.io/gorm"
+)
+
+// paid records a card payment of amount by userID
+func paid(t *testing.T, db *gorm.DB, userID uint, amount int64, reference string) *models.Transaction {
+	t.Helper()
+
+	transaction := models.Transaction{UserID: userID, Amount: amount, Currency: "GHS", Method: "card", Purpose: "appointment", Reference: reference}
+	if err := db.Create(&transaction).Error; err != nil {
+		t.Fatalf("creating transaction %s: %v", reference, err)
+	}
+	return &transaction
+}
+
+func TestIssueInvoice(t *testing.T) {
+	db := testdb.Open(t, "invoices")
+	t.Setenv("INVOICE_PREFIX", "")
+	user := testdb.User(t, db, "Paying Trader")
+	year := time.Now().Year()
+
+	first := paid(t, db, user.ID, 10000, "APT-1")
+	discounted := paid(t, db, user.ID, 8000, "APT-2")
+	db.Model(discounted).Updates(map[string]interface{}{"discount_minor": 2000, "coupon_code": "SAVE20", "wallet_minor": 3000})
+
+	issue := func(transaction *models.Transaction) *models.Invoice {
+		var invoice *models.Invoice
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			invoice, err = IssueInvoice(tx, transaction, KindAppointment, "Session with an expert")
+			return err
+		})
+		if err != nil {
+			t.Fatalf("IssueInvoice(%s): %v", transaction.Reference, err)
+		}
+		return invoice
+	}
+
+	invoice := issue(first)
+	if want := fmt.Sprintf("KFX-%d-000001", year); invoice.Number != want {
+		t.Errorf("first number = %s, want %s", invoice.Number, want)
+	}
+	if invoice.CustomerEmail != user.Email || invoice.Total != 10000 || invoice.Subtotal != 10000 || invoice.PaymentMethod == "" {
+		t.Errorf("invoice = %+v", invoice)
+	}
+
+	// A payment confirmed twice keeps its invoice and number
+	if again := issue(first); again.ID != invoice.ID || again.Number != invoice.Number {
+		t.Errorf("second issue = %s, want %s again", again.Number, invoice.Number)
+	}
+
+	db.First(discounted, discounted.ID)
+	second := issue(discounted)
+	if want := fmt.Sprintf("KFX-%d-000002", year); second.Number != want {
+		t.Errorf("second number = %s, want %s", second.Number, want)
+	}
+	if second.Subtotal != 10000 || second.Discount != 2000 || second.Total != 8000 || second.WalletAmount != 3000 || second.CouponCode != "SAVE20" {
+		t.Errorf("discounted invoice = subtotal %d, discount %d, total %d, wallet %d, coupon %q",
+			second.Subtotal, second.Discount, second.Total, second.WalletAmount, second.CouponCode)
+	}
+}
+
+func TestNextNumber(t *testing.T) {
+	db := testdb.Open(t, "invoices")
+
+	take := func(year int) (string, error) {
+		var number string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			number, err = nextNumber(tx, year)
+			return err
+		})
+		return number, err
+	}
+
+	t.Setenv("INVOICE_PREFIX", "INV")
+	if number, _ := take(2026); number != "INV-2026-000001" {
+		t.Errorf("first 2026 number = %s", number)
+	}
+
+	// A payment that rolls back gives its number back
+	rollback := errors.New("payment failed")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if _, err := nextNumber(tx, 2026); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatal(err)
+	}
+	if number, _ := take(2026); number != "INV-2026-000002" {
+		t.Errorf("number after a rollback = %s, want INV-2026-000002", number)
+	}
+
+	// Each year starts again from one
+	if number, _ := take(2027); number != "INV-2027-000001" {
+		t.Errorf("first 2027 number = %s", number)
+	}
+}
+
+func TestNextNumberRace(t *testing.T) {
+	db := testdb.Open(t, "invoices")
+	t.Setenv("INVOICE_PREFIX", "")
+
+	numbers := make([]string, 20)
+	errs := testdb.Race(len(numbers), func(i int) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			numbers[i], err = nextNumber(tx, 2026)
+			return err
+		})
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No gaps and no duplicates
+	sort.Strings(numbers)
+	for i, number := range numbers {
+		if want := fmt.Sprintf("KFX-2026-%06d", i+1); number != want {
+			t.Fatalf("numbers = %v, want KFX-2026-000001 to -000020", numbers)
+		}
+	}
+}
+
+func TestMailPendingInvoices(t *testing.T) {
+	tests := []struct {
+		name         string
+		smtpHost     string
+		attempts     int // Failed before this run
+		wantAttempts int
+	}{
+		{name: "mail not configured", wantAttempts: 0},
+		{name: "server unreachable", smtpHost: "127.0.0.1", wantAttempts: 1},
+		{name: "given up", smtpHost: "127.0.0.1", attempts: maxEmailAttempts, wantAttempts: maxEmailAttempts},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "invoices")
+			t.Setenv("SMTP_HOST", tt.smtpHost)
+			t.Setenv("SMTP_PORT", "1")
+			user := testdb.User(t, db, "Paying Trader")
+
+			var invoice *models.Invoice
+			err := db.Transaction(func(tx *gorm.DB) error {
+				var err error
+				invoice, err = IssueInvoice(tx, paid(t, db, user.ID, 10000, "APT-1"), KindAppointment, "Session")
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Model(invoice).Update("email_attempts", tt.attempts)
+
+			h := &InvoiceHandler{db: db}
+			if err := h.mailPendingInvoices(); err != nil {
+				t.Fatalf("mailPendingInvoices: %v", err)
+			}
+
+			db.First(invoice, invoice.ID)
+			if invoice.EmailedAt != nil || invoice.EmailAttempts != tt.wantAttempts {
+				t.Errorf("invoice emailed at %v after %d attempts, want unsent after %d", invoice.EmailedAt, invoice.EmailAttempts, tt.wantAttempts)
+			}
+		})
+	}
+}
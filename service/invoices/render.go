@@ -0,0 +1,194 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+)
+
+// companyName returns the issuer shown on invoices, from COMPANY_NAME
+func companyName() string {
+	if name := os.Getenv("COMPANY_NAME"); name != "" {
+		return name
+	}
+	return "KodeFX"
+}
+
+var htmlTemplate = template.Must(template.New("invoice").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Receipt {{.Invoice.Number}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; color: #222; max-width: 640px; margin: 40px auto; }
+h1 { font-size: 24px; margin-bottom: 4px; }
+table { width: 100%; border-collapse: collapse; margin-top: 24px; }
+th, td { text-align: left; padding: 8px 0; border-bottom: 1px solid #ddd; }
+td.amount, th.amount { text-align: right; }
+.total td { font-weight: bold; border-bottom: none; }
+.muted { color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Company}}</h1>
+<p class="muted">Receipt {{.Invoice.Number}} &middot; Issued {{.Issued}}</p>
+<p><strong>Billed to</strong><br>{{.Invoice.CustomerName}}<br>{{.Invoice.CustomerEmail}}</p>
+<p><strong>Payment reference</strong><br>{{.Invoice.Reference}}<br>Paid by {{.Invoice.PaymentMethod}}</p>
+<table>
+<tr><th>Description</th><th class="amount">Amount</th></tr>
+<tr><td>{{.Invoice.Description}}</td><td class="amount">{{.Subtotal}}</td></tr>
+{{if .Invoice.Discount}}<tr><td>Discount{{if .Invoice.CouponCode}} ({{.Invoice.CouponCode}}){{end}}</td><td class="amount">-{{.Discount}}</td></tr>{{end}}
+<tr class="total"><td>Total paid</td><td class="amount">{{.Total}}</td></tr>
+{{if .Invoice.WalletAmount}}<tr><td class="muted">of which from wallet</td><td class="amount muted">{{.Wallet}}</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+// RenderHTML renders invoice as a standalone HTML document
+func RenderHTML(invoice *models.Invoice) ([]byte, error) {
+	var buf bytes.Buffer
+	err := htmlTemplate.Execute(&buf, map[string]interface{}{
+		"Company":  companyName(),
+		"Invoice":  invoice,
+		"Issued":   invoice.IssuedAt.Format("2 January 2006"),
+		"Subtotal": utils.FormatMoney(invoice.Subtotal, invoice.Currency),
+		"Discount": utils.FormatMoney(invoice.Discount, invoice.Currency),
+		"Total":    utils.FormatMoney(invoice.Total, invoice.Currency),
+		"Wallet":   utils.FormatMoney(invoice.WalletAmount, invoice.Currency),
+	})
+	return buf.Bytes(), err
+}
+
+// RenderText renders invoice as a plain text summary for email bodies
+func RenderText(invoice *models.Invoice) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Thank you for your payment to %s.\n\n", companyName())
+	fmt.Fprintf(&b, "Receipt: %s\nIssued: %s\nReference: %s\n\n", invoice.Number, invoice.IssuedAt.Format("2 January 2006"), invoice.Reference)
+	fmt.Fprintf(&b, "%s: %s\n", invoice.Description, utils.FormatMoney(invoice.Subtotal, invoice.Currency))
+	if invoice.Discount > 0 {
+		fmt.Fprintf(&b, "Discount: -%s\n", utils.FormatMoney(invoice.Discount, invoice.Currency))
+	}
+	fmt.Fprintf(&b, "Total paid: %s\n", utils.FormatMoney(invoice.Total, invoice.Currency))
+	if invoice.WalletAmount > 0 {
+		fmt.Fprintf(&b, "Paid from wallet: %s\n", utils.FormatMoney(invoice.WalletAmount, invoice.Currency))
+	}
+	b.WriteString("\nThe receipt is attached as a PDF.\n")
+	return b.String()
+}
+
+// pdfText is one line of text placed on the PDF page
+type pdfText struct {
+	bold bool
+	size int
+	x, y int
+	text string
+}
+
+// RenderPDF renders invoice as a single-page A4 PDF using the standard
+// Helvetica fonts, so no font files need to be embedded
+func RenderPDF(invoice *models.Invoice) []byte {
+	money := func(amount int64) string {
+		return utils.FormatMoneyCode(amount, invoice.Currency)
+	}
+
+	lines := []pdfText{
+		{true, 22, 50, 780, companyName()},
+		{false, 11, 50, 758, "Receipt " + invoice.Number},
+		{false, 11, 50, 742, "Issued " + invoice.IssuedAt.Format("2 January 2006")},
+		{true, 11, 50, 700, "Billed to"},
+		{false, 11, 50, 684, invoice.CustomerName},
+		{false, 11, 50, 668, invoice.CustomerEmail},
+		{true, 11, 320, 700, "Payment reference"},
+		{false, 11, 320, 684, invoice.Reference},
+		{false, 11, 320, 668, "Paid by " + invoice.PaymentMethod},
+		{true, 11, 50, 620, "Description"},
+		{true, 11, 430, 620, "Amount"},
+		{false, 11, 50, 598, invoice.Description},
+		{false, 11, 430, 598, money(invoice.Subtotal)},
+	}
+
+	y := 576
+	if invoice.Discount > 0 {
+		label := "Discount"
+		if invoice.CouponCode != "" {
+			label += " (" + invoice.CouponCode + ")"
+		}
+		lines = append(lines,
+			pdfText{false, 11, 50, y, label},
+			pdfText{false, 11, 430, y, "-" + money(invoice.Discount)},
+		)
+		y -= 22
+	}
+	lines = append(lines,
+		pdfText{true, 12, 50, y, "Total paid"},
+		pdfText{true, 12, 430, y, money(invoice.Total)},
+	)
+	if invoice.WalletAmount > 0 {
+		y -= 18
+		lines = append(lines,
+			pdfText{false, 10, 50, y, "of which from wallet"},
+			pdfText{false, 10, 430, y, money(invoice.WalletAmount)},
+		)
+	}
+
+	var content bytes.Buffer
+	for _, line := range lines {
+		font := "F1"
+		if line.bold {
+			font = "F2"
+		}
+		fmt.Fprintf(&content, "BT /%s %d Tf %d %d Td (%s) Tj ET\n", font, line.size, line.x, line.y, pdfEscape(line.text))
+	}
+	// Rule under the table header
+	content.WriteString("0.8 G 50 612 m 545 612 l S\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents 6 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return out.Bytes()
+}
+
+// pdfEscape escapes text for a PDF string literal. Characters outside
+// printable ASCII are replaced because the standard fonts cannot show them.
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,106 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+)
+
+func testInvoice() *models.Invoice {
+	return &models.Invoice{
+		Number:        "KFX-2026-000042",
+		Reference:     "APT-42",
+		Description:   "Session with Ama (Forex basics)",
+		CustomerName:  "Kofi Mensah",
+		CustomerEmail: "kofi@example.com",
+		Currency:      "GHS",
+		Subtotal:      10000,
+		Discount:      2000,
+		Total:         8000,
+		WalletAmount:  3000,
+		CouponCode:    "SAVE20",
+		PaymentMethod: "MTN Mobile Money",
+		IssuedAt:      time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestRenderText(t *testing.T) {
+	t.Setenv("COMPANY_NAME", "")
+
+	text := RenderText(testInvoice())
+	for _, want := range []string{"KFX-2026-000042", "5 March 2026", "APT-42", "GH₵100.00", "Discount: -GH₵20.00", "Total paid: GH₵80.00", "Paid from wallet: GH₵30.00"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text has no %q:\n%s", want, text)
+		}
+	}
+
+	plain := testInvoice()
+	plain.Discount, plain.WalletAmount = 0, 0
+	if text := RenderText(plain); strings.Contains(text, "Discount") || strings.Contains(text, "wallet") {
+		t.Errorf("text without a discount or wallet mentions them:\n%s", text)
+	}
+}
+
+func TestRenderHTML(t *testing.T) {
+	invoice := testInvoice()
+	invoice.CustomerName = `<script>alert("x")</script>`
+
+	body, err := RenderHTML(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(body, []byte("<script>")) {
+		t.Error("customer name not escaped")
+	}
+	if !bytes.Contains(body, []byte("KFX-2026-000042")) {
+		t.Error("invoice number missing")
+	}
+}
+
+func TestRenderPDF(t *testing.T) {
+	pdf := RenderPDF(testInvoice())
+
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("not a complete PDF")
+	}
+	// Amounts use the ASCII currency code, which the standard fonts can show
+	for _, want := range []string{"(GHS 100.00)", "(-GHS 20.00)", "(GHS 80.00)", "(Discount \\(SAVE20\\))", "(Session with Ama \\(Forex basics\\))"} {
+		if !bytes.Contains(pdf, []byte(want)) {
+			t.Errorf("PDF has no %s", want)
+		}
+	}
+
+	// Every object must start at the offset the cross-reference table gives
+	start := bytes.LastIndex(pdf, []byte("startxref\n"))
+	var xref int
+	fmt.Sscanf(string(pdf[start+len("startxref\n"):]), "%d", &xref)
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+	lines := strings.Split(string(pdf[xref:]), "\n")
+	for i := 1; i <= 6; i++ {
+		var offset int
+		fmt.Sscanf(lines[2+i], "%d", &offset)
+		if want := fmt.Sprintf("%d 0 obj", i); !bytes.HasPrefix(pdf[offset:], []byte(want)) {
+			t.Errorf("object %d not at offset %d", i, offset)
+		}
+	}
+}
+
+func TestPDFEscape(t *testing.T) {
+	tests := []struct{ text, want string }{
+		{"Plain text", "Plain text"},
+		{`a (b) \c`, `a \(b\) \\c`},
+		{"GH₵ Kwame", "GH? Kwame"},
+		{"line\nbreak", "line?break"},
+	}
+	for _, tt := range tests {
+		if got := pdfEscape(tt.text); got != tt.want {
+			t.Errorf("pdfEscape(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package invoices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// mailInterval is how often the mailer looks for invoices to email
+	mailInterval = time.Minute
+	// maxEmailAttempts is how many times an invoice email is tried before giving up
+	maxEmailAttempts = 5
+	// mailBatchSize is the most invoices emailed in one run
+	mailBatchSize = 50
+)
+
+// Response is a standardized API response structure
+type Response struct {
+	Data  interface{} `json:"data,omitempty"`
+	Meta  interface{} `json:"meta,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// InvoiceHandler handles invoice HTTP requests and emails new invoices
+type InvoiceHandler struct {
+	db *gorm.DB
+}
+
+// NewInvoiceHandler creates a new invoice handler and starts the invoice mailer
+func NewInvoiceHandler(db *gorm.DB) *InvoiceHandler {
+	h := &InvoiceHandler{db: db}
+	go h.runMailer()
+
+	return h
+}
+
+// RegisterRoutes registers all invoice routes
+func (h *InvoiceHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/invoices", utils.AuthMiddleware(h.GetInvoices)).Methods("GET")
+	router.HandleFunc("/invoices/{id:[0-9]+}", utils.AuthMiddleware(h.GetInvoice)).Methods("GET")
+	router.HandleFunc("/invoices/{id:[0-9]+}/html", utils.AuthMiddleware(h.DownloadHTML)).Methods("GET")
+	router.HandleFunc("/invoices/{id:[0-9]+}/pdf", utils.AuthMiddleware(h.DownloadPDF)).Methods("GET")
+	router.HandleFunc("/invoices/{id:[0-9]+}/email", utils.AuthMiddleware(h.ResendInvoice)).Methods("POST")
+}
+
+// GetInvoices lists the caller's invoices, newest first. Admins see everyone's
+// and may filter by ?user_id=.
+func (h *InvoiceHandler) GetInvoices(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	query := h.db.Model(&models.Invoice{})
+	if utils.IsAdmin(h.db, userID) {
+		if value := r.URL.Query().Get("user_id"); value != "" {
+			filterID, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				h.respondWithError(w, http.StatusBadRequest, "Invalid user_id parameter")
+				return
+			}
+			query = query.Where("user_id = ?", filterID)
+		}
+	} else {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve invoices")
+		return
+	}
+
+	var invoices []models.Invoice
+	if err := query.Order("issued_at DESC, id DESC").
+		Limit(perPage).Offset((page - 1) * perPage).
+		Find(&invoices).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve invoices")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{
+		Data: invoices,
+		Meta: map[string]interface{}{
+			"page":     page,
+			"per_page": perPage,
+			"total":    total,
+		},
+	})
+}
+
+// loadInvoice loads the invoice in the path and checks that the caller owns it
+// or is an admin
+func (h *InvoiceHandler) loadInvoice(w http.ResponseWriter, r *http.Request) (*models.Invoice, bool) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid invoice ID")
+		return nil, false
+	}
+
+	var invoice models.Invoice
+	if err := h.db.First(&invoice, id).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Invoice not found")
+		return nil, false
+	}
+
+	if invoice.UserID != userID && !utils.IsAdmin(h.db, userID) {
+		h.respondWithError(w, http.StatusForbidden, "You don't have permission to view this invoice")
+		return nil, false
+	}
+
+	return &invoice, true
+}
+
+// GetInvoice returns an invoice as JSON
+func (h *InvoiceHandler) GetInvoice(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := h.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: invoice})
+}
+
+// DownloadHTML returns an invoice as an HTML document
+func (h *InvoiceHandler) DownloadHTML(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := h.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := RenderHTML(invoice)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to render invoice")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// DownloadPDF returns an invoice as a PDF attachment
+func (h *InvoiceHandler) DownloadPDF(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := h.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, invoice.Number))
+	w.WriteHeader(http.StatusOK)
+	w.Write(RenderPDF(invoice))
+}
+
+// ResendInvoice emails an invoice to its customer again
+func (h *InvoiceHandler) ResendInvoice(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := h.loadInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	if err := sendInvoice(invoice); err != nil {
+		log.Printf("Error emailing invoice %s: %v", invoice.Number, err)
+		if errors.Is(err, utils.ErrMailNotConfigured) {
+			h.respondWithError(w, http.StatusServiceUnavailable, "Email is not available")
+			return
+		}
+		h.respondWithError(w, http.StatusBadGateway, "Failed to send invoice email")
+		return
+	}
+
+	now := time.Now()
+	h.db.Model(invoice).Update("emailed_at", now)
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: map[string]string{
+		"message": "Invoice sent to " + invoice.CustomerEmail,
+	}})
+}
+
+// sendInvoice emails invoice to its customer with the PDF attached
+func sendInvoice(invoice *models.Invoice) error {
+	html, err := RenderHTML(invoice)
+	if err != nil {
+		return err
+	}
+
+	return utils.SendEmail(invoice.CustomerEmail, "Your receipt "+invoice.Number, RenderText(invoice), string(html),
+		utils.Attachment{Name: invoice.Number + ".pdf", Data: RenderPDF(invoice)})
+}
+
+// runMailer periodically emails invoices that have not been sent yet
+func (h *InvoiceHandler) runMailer() {
+	ticker := time.NewTicker(mailInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.mailPendingInvoices(); err != nil {
+			log.Printf("Error emailing invoices: %v", err)
+		}
+	}
+}
+
+// mailPendingInvoices emails every invoice without EmailedAt, giving up on an
+// invoice after maxEmailAttempts failures. Each invoice is tried at most once
+// per run.
+func (h *InvoiceHandler) mailPendingInvoices() error {
+	var lastID uint
+	for i := 0; i < mailBatchSize; i++ {
+		id, err := h.mailNextInvoice(lastID)
+		if err != nil || id == 0 {
+			return err
+		}
+		lastID = id
+	}
+	return nil
+}
+
+// mailNextInvoice emails the first unsent invoice after afterID and returns
+// its ID, or zero when there is nothing left to send. The invoice stays
+// locked until it is marked, so a mailer on another instance skips it
+// instead of sending it again.
+func (h *InvoiceHandler) mailNextInvoice(afterID uint) (uint, error) {
+	var sentID uint
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var invoice models.Invoice
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("id > ? AND emailed_at IS NULL AND email_attempts < ? AND customer_email != ''", afterID, maxEmailAttempts).
+			Order("id ASC").
+			First(&invoice).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = sendInvoice(&invoice)
+		if errors.Is(err, utils.ErrMailNotConfigured) {
+			// Nothing can be sent until SMTP is set up; keep the invoices queued
+			return nil
+		}
+		sentID = invoice.ID
+		if err != nil {
+			log.Printf("Error emailing invoice %s: %v", invoice.Number, err)
+			return tx.Model(&invoice).Update("email_attempts", invoice.EmailAttempts+1).Error
+		}
+		return tx.Model(&invoice).Update("emailed_at", time.Now()).Error
+	})
+	return sentID, err
+}
+
+// Helper function to respond with an error
+func (h *InvoiceHandler) respondWithError(w http.ResponseWriter, code int, message string) {
+	h.respondWithJSON(w, code, Response{Error: message})
+}
+
+// Helper function to respond with JSON
+func (h *InvoiceHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -0,0 +1,85 @@
+package meetings
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Provider creates the video rooms appointments are held in. Jitsi is the
+// default; other services plug in by implementing Provider and being
+// returned from NewProvider.
+type Provider interface {
+	Name() string
+	CreateRoom(req RoomRequest) (*Room, error)
+	// JoinURL is the link a participant opens to enter the room
+	JoinURL(room Room, displayName string) string
+}
+
+// RoomRequest describes the session a room is created for. Every
+// appointment in a slot shares its room.
+type RoomRequest struct {
+	AvailabilityID uint
+	Title          string
+	StartTime      time.Time
+	EndTime        time.Time
+}
+
+// Room is a created meeting room
+type Room struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// NewProvider returns the provider configured through MEETING_PROVIDER,
+// defaulting to Jitsi at JITSI_BASE_URL or the public meet.jit.si server.
+func NewProvider() Provider {
+	switch name := os.Getenv("MEETING_PROVIDER"); name {
+	case "", "jitsi":
+	default:
+		log.Printf("Unknown meeting provider %q, using Jitsi", name)
+	}
+	return NewJitsiProvider(os.Getenv("JITSI_BASE_URL"))
+}
+
+// JitsiProvider builds Jitsi Meet links. Jitsi creates a room the first time
+// someone opens its URL, so rooms only need a name nobody can guess.
+type JitsiProvider struct {
+	baseURL string
+}
+
+// NewJitsiProvider returns a provider for the Jitsi server at baseURL
+func NewJitsiProvider(baseURL string) *JitsiProvider {
+	if baseURL == "" {
+		baseURL = "https://meet.jit.si"
+	}
+	return &JitsiProvider{baseURL: strings.TrimRight(baseURL, "/")}
+}
+
+func (p *JitsiProvider) Name() string {
+	return "jitsi"
+}
+
+func (p *JitsiProvider) CreateRoom(req RoomRequest) (*Room, error) {
+	secret := make([]byte, 12)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("error generating room name: %w", err)
+	}
+
+	name := fmt.Sprintf("kodefx-%d-%s", req.AvailabilityID, hex.EncodeToString(secret))
+	return &Room{Name: name, URL: p.baseURL + "/" + name}, nil
+}
+
+func (p *JitsiProvider) JoinURL(room Room, displayName string) string {
+	if displayName == "" {
+		return room.URL
+	}
+	// Jitsi reads config from the fragment as URL encoded JSON values
+	return room.URL + "#userInfo.displayName=" + url.PathEscape(strconv.Quote(displayName))
+}
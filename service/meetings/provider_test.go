@@ -0,0 +1,60 @@
+package meetings
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewProvider(t *testing.T) {
+	for _, name := range []string{"", "jitsi", "zoom"} {
+		t.Setenv("MEETING_PROVIDER", name)
+		t.Setenv("JITSI_BASE_URL", "https://meet.example.com/")
+		provider := NewProvider()
+		if provider.Name() != "jitsi" {
+			t.Errorf("MEETING_PROVIDER=%q gives %s, want jitsi", name, provider.Name())
+		}
+		room, _ := provider.CreateRoom(RoomRequest{AvailabilityID: 1})
+		if !strings.HasPrefix(room.URL, "https://meet.example.com/kodefx-1-") {
+			t.Errorf("room URL = %s, want one on JITSI_BASE_URL", room.URL)
+		}
+	}
+}
+
+func TestJitsiCreateRoom(t *testing.T) {
+	provider := NewJitsiProvider("")
+	req := RoomRequest{AvailabilityID: 42, Title: "Group session", StartTime: time.Now(), EndTime: time.Now().Add(time.Hour)}
+
+	first, err := provider.CreateRoom(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := provider.CreateRoom(req)
+
+	if !strings.HasPrefix(first.Name, "kodefx-42-") || len(first.Name) != len("kodefx-42-")+24 {
+		t.Errorf("room name = %s, want kodefx-42- and 24 hex digits", first.Name)
+	}
+	if first.URL != "https://meet.jit.si/"+first.Name {
+		t.Errorf("room URL = %s", first.URL)
+	}
+	// Names must not be guessable, even for the same slot
+	if first.Name == second.Name {
+		t.Error("two rooms got the same name")
+	}
+}
+
+func TestJitsiJoinURL(t *testing.T) {
+	provider := NewJitsiProvider("https://meet.example.com")
+	room := Room{Name: "kodefx-1-abc", URL: "https://meet.example.com/kodefx-1-abc"}
+
+	tests := []struct{ name, want string }{
+		{"", "https://meet.example.com/kodefx-1-abc"},
+		{"Kofi Mensah", "https://meet.example.com/kodefx-1-abc#userInfo.displayName=%22Kofi%20Mensah%22"},
+		{`Ama "FX" #1`, "https://meet.example.com/kodefx-1-abc#userInfo.displayName=%22Ama%20%5C%22FX%5C%22%20%231%22"},
+	}
+	for _, tt := range tests {
+		if got := provider.JoinURL(room, tt.name); got != tt.want {
+			t.Errorf("JoinURL(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
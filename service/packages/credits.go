@@ -0,0 +1,405 @@
+package packages
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/service/earnings"
+	"github.com/KAsare1/Kodefx-server/service/invoices"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// defaultRefundDays is how long after purchase traders can refund unused
+	// credits when PACKAGE_REFUND_DAYS is unset
+	defaultRefundDays = 14
+	// expiryInterval is how often lapsed packages are expired
+	expiryInterval = time.Hour
+)
+
+// Purchase statuses
+const (
+	PurchasePending  = "pending"
+	PurchaseActive   = "active"
+	PurchaseExpired  = "expired"
+	PurchaseRefunded = "refunded"
+	PurchaseFailed   = "failed"
+)
+
+var (
+	// ErrNoCredits is returned when redeeming a package with no credits left
+	ErrNoCredits = errors.New("this package has no credits left")
+	// ErrPackageInactive is returned when redeeming a package that is unpaid, expired or refunded
+	ErrPackageInactive = errors.New("this package is not active")
+	// ErrPackageNotApplicable is returned when the slot is not covered by the package
+	ErrPackageNotApplicable = errors.New("this package can't be used for this session")
+	// ErrRefundWindowClosed is returned when a trader asks for a refund too late
+	ErrRefundWindowClosed = errors.New("the refund period for this package has ended")
+	// ErrNothingToRefund is returned when a package has no unused credits to refund
+	ErrNothingToRefund = errors.New("this package has no unused credits to refund")
+	// ErrAmountMismatch is returned when a payment does not cover the package price
+	ErrAmountMismatch = errors.New("payment amount does not match package amount")
+	// ErrCurrencyMismatch is returned when a payment is in a different currency from the package
+	ErrCurrencyMismatch = errors.New("payment currency does not match package currency")
+)
+
+// IsCreditError reports whether err is a redemption or refund failure that
+// should be shown to the trader rather than treated as a server error
+func IsCreditError(err error) bool {
+	for _, target := range []error{ErrNoCredits, ErrPackageInactive, ErrPackageNotApplicable,
+		ErrRefundWindowClosed, ErrNothingToRefund} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RefundWindow is how long after purchase a trader can refund unused credits
+func RefundWindow() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("PACKAGE_REFUND_DAYS"))
+	if err != nil || days < 0 {
+		days = defaultRefundDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// CompletePackagePayment activates the pending purchase paid for by
+// reference, starting its validity period, and records the transaction.
+// amount is what was collected by card, in minor units of currency; any
+// wallet part is captured here, and if it was released and spent meanwhile
+// the card payment is refunded to the wallet. It is idempotent: a purchase
+// that is no longer pending is returned with activated set to false.
+func CompletePackagePayment(tx *gorm.DB, reference string, amount int64, currency, method string, now time.Time) (*models.PackagePurchase, bool, error) {
+	var purchase models.PackagePurchase
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("payment_id = ?", reference).
+		First(&purchase).Error; err != nil {
+		return nil, false, err
+	}
+
+	if purchase.Status != PurchasePending {
+		return &purchase, false, nil
+	}
+
+	if amount > 0 && currency != purchase.Currency {
+		return nil, false, ErrCurrencyMismatch
+	}
+	if amount+purchase.WalletAmount < purchase.Amount {
+		return nil, false, ErrAmountMismatch
+	}
+
+	purpose := fmt.Sprintf("Session Package - %s (%d sessions)", purchase.Name, purchase.Sessions)
+
+	// A payment that arrives after the wallet part was released and spent
+	// can't complete the purchase, so the card payment is refunded instead
+	err := wallet.CaptureHold(tx, purchase.TraderID, purchase.WalletAmount, purchase.Currency, reference)
+	if errors.Is(err, wallet.ErrInsufficientFunds) {
+		log.Printf("Refunding package payment %s: %v", reference, err)
+		return &purchase, false, refundUnusablePayment(tx, &purchase, amount, method, purpose)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	total := amount + purchase.WalletAmount
+
+	expiresAt := now.AddDate(0, 0, purchase.ValidityDays)
+	purchase.Status = PurchaseActive
+	purchase.CreditsRemaining = purchase.Sessions
+	purchase.PaidAt = &now
+	purchase.ExpiresAt = &expiresAt
+	if err := tx.Save(&purchase).Error; err != nil {
+		return nil, false, err
+	}
+
+	transaction := models.Transaction{
+		UserID:       purchase.TraderID,
+		Amount:       total,
+		WalletAmount: purchase.WalletAmount,
+		Currency:     purchase.Currency,
+		Method:       method,
+		Purpose:      purpose,
+		Reference:    reference,
+	}
+	if err := tx.Create(&transaction).Error; err != nil {
+		return nil, false, err
+	}
+
+	if _, err := invoices.IssueInvoice(tx, &transaction, invoices.KindSessionPackage, purpose); err != nil {
+		return nil, false, err
+	}
+
+	// The expert's share is held back and earned credit by credit as they are
+	// redeemed; refunded credits give their part back to the platform
+	share, err := earnings.RecordPrepayment(tx, reference, total, purchase.Currency, purchase.ExpertID, purpose)
+	if err != nil {
+		return nil, false, err
+	}
+	purchase.ExpertShare = share
+	if err := tx.Model(&purchase).Update("expert_share_minor", share).Error; err != nil {
+		return nil, false, err
+	}
+
+	return &purchase, true, nil
+}
+
+// refundUnusablePayment marks the purchase refunded and credits the card
+// payment for it to the trader's wallet
+func refundUnusablePayment(tx *gorm.DB, purchase *models.PackagePurchase, amount int64, method, purpose string) error {
+	purchase.Status = PurchaseRefunded
+	purchase.WalletAmount = 0
+	if err := tx.Save(purchase).Error; err != nil {
+		return err
+	}
+
+	transaction := models.Transaction{
+		UserID:    purchase.TraderID,
+		Amount:    amount,
+		Currency:  purchase.Currency,
+		Method:    method,
+		Purpose:   purpose,
+		Reference: purchase.PaymentID,
+	}
+	if err := tx.Create(&transaction).Error; err != nil {
+		return err
+	}
+
+	return wallet.RefundPayment(tx, purchase.TraderID, amount, purchase.Currency, purchase.PaymentID,
+		"Refund for "+purpose)
+}
+
+// releaseDeclinedPurchase marks the pending purchase paid for by reference
+// failed after its payment was declined and returns its wallet hold
+func releaseDeclinedPurchase(db *gorm.DB, reference string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PackagePurchase{}).
+			Where("payment_id = ? AND status = ?", reference, PurchasePending).
+			Update("status", PurchaseFailed).Error; err != nil {
+			return err
+		}
+		return wallet.ReleaseHold(tx, reference)
+	})
+}
+
+// RedeemCredit takes one credit from the trader's purchase to book slot. The
+// purchase must be active and unexpired, with the slot's expert, currency and,
+// if the package has one, category. The caller books the slot in the same tx
+// and then calls EarnCredit.
+func RedeemCredit(tx *gorm.DB, purchaseID, traderID uint, slot *models.Availability, now time.Time) (*models.PackagePurchase, error) {
+	var purchase models.PackagePurchase
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND trader_id = ?", purchaseID, traderID).
+		First(&purchase).Error; err != nil {
+		return nil, err
+	}
+
+	if purchase.Status != PurchaseActive || purchase.ExpiresAt == nil || !purchase.ExpiresAt.After(now) {
+		return nil, ErrPackageInactive
+	}
+	// Credits must still be valid when the session starts
+	if !purchase.ExpiresAt.After(slot.StartTime) || slot.ExpertID != purchase.ExpertID || slot.Currency != purchase.Currency {
+		return nil, ErrPackageNotApplicable
+	}
+	if purchase.Category != "" && !strings.EqualFold(purchase.Category, slot.Category) {
+		return nil, ErrPackageNotApplicable
+	}
+	if purchase.CreditsRemaining < 1 {
+		return nil, ErrNoCredits
+	}
+
+	purchase.CreditsRemaining--
+	if err := tx.Model(&purchase).Update("credits_remaining", purchase.CreditsRemaining).Error; err != nil {
+		return nil, err
+	}
+	return &purchase, nil
+}
+
+// EarnCredit pays the expert their share of the credit redeemed for
+// appointment, moving it out of the purchase's deferred share
+func EarnCredit(tx *gorm.DB, purchase *models.PackagePurchase, appointment *models.Appointment) error {
+	if purchase.ExpertShare == 0 {
+		// Paid before shares were deferred, so the expert was paid up front
+		return nil
+	}
+
+	amount := creditShare(purchase, purchase.SettledCredits, purchase.SettledCredits+1)
+	purchase.SettledCredits++
+	if err := tx.Model(purchase).Update("settled_credits", purchase.SettledCredits).Error; err != nil {
+		return err
+	}
+	return earnings.EarnDeferred(tx, fmt.Sprintf("%s-APT%d", purchase.PaymentID, appointment.ID), amount,
+		purchase.Currency, purchase.ExpertID, fmt.Sprintf("Appointment %d: %s", appointment.ID, appointment.EventName))
+}
+
+// creditShare is the expert's share of the purchase's credits from to to,
+// counted over all its sessions so the parts always add up to the whole share
+func creditShare(purchase *models.PackagePurchase, from, to int) int64 {
+	sessions := int64(purchase.Sessions)
+	return purchase.ExpertShare*int64(to)/sessions - purchase.ExpertShare*int64(from)/sessions
+}
+
+// ReturnCredit gives back the credit used for appointment, e.g. when the
+// expert missed the session, and takes back what the expert earned for it.
+// If the package has since expired or been refunded, the credit's value is
+// refunded to the trader's wallet instead.
+func ReturnCredit(tx *gorm.DB, appointment *models.Appointment, createdByID *uint, now time.Time) error {
+	if appointment.PackagePurchaseID == nil {
+		return nil
+	}
+
+	var purchase models.PackagePurchase
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&purchase, *appointment.PackagePurchaseID).Error; err != nil {
+		return err
+	}
+
+	description := fmt.Sprintf("Refund for missed appointment %d: %s", appointment.ID, appointment.EventName)
+	if purchase.ExpertShare > 0 && purchase.SettledCredits > 0 {
+		amount := creditShare(&purchase, purchase.SettledCredits-1, purchase.SettledCredits)
+		if err := earnings.UnearnDeferred(tx, fmt.Sprintf("%s-APT%d-RET", purchase.PaymentID, appointment.ID), amount,
+			purchase.Currency, purchase.ExpertID, description); err != nil {
+			return err
+		}
+		purchase.SettledCredits--
+		if err := tx.Model(&purchase).Update("settled_credits", purchase.SettledCredits).Error; err != nil {
+			return err
+		}
+	}
+
+	if purchase.Status == PurchaseActive && purchase.ExpiresAt != nil && purchase.ExpiresAt.After(now) {
+		return tx.Model(&purchase).Update("credits_remaining", gorm.Expr("credits_remaining + 1")).Error
+	}
+	return refundCredits(tx, &purchase, 1, description, createdByID)
+}
+
+// RefundUnusedCredits refunds the purchase's remaining credits to the
+// trader's wallet, pro rata to what was paid for the package, and closes it.
+// Traders may do so until the refund window after purchase ends; admins
+// (byAdmin) at any time before the package expires.
+func RefundUnusedCredits(tx *gorm.DB, purchaseID uint, createdByID *uint, byAdmin bool, now time.Time) (*models.PackagePurchase, error) {
+	var purchase models.PackagePurchase
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&purchase, purchaseID).Error; err != nil {
+		return nil, err
+	}
+
+	if purchase.Status != PurchaseActive || purchase.ExpiresAt == nil || !purchase.ExpiresAt.After(now) {
+		return nil, ErrPackageInactive
+	}
+	if !byAdmin && purchase.PaidAt != nil && now.After(purchase.PaidAt.Add(RefundWindow())) {
+		return nil, ErrRefundWindowClosed
+	}
+	if purchase.CreditsRemaining < 1 {
+		return nil, ErrNothingToRefund
+	}
+
+	credits := purchase.CreditsRemaining
+	description := fmt.Sprintf("Refund for %d unused credits of %s", credits, purchase.Name)
+	if err := refundCredits(tx, &purchase, credits, description, createdByID); err != nil {
+		return nil, err
+	}
+
+	purchase.CreditsRemaining = 0
+	purchase.Status = PurchaseRefunded
+	if err := tx.Model(&purchase).Updates(map[string]interface{}{
+		"credits_remaining": 0,
+		"status":            PurchaseRefunded,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return &purchase, nil
+}
+
+// refundCredits credits the value of credits of the purchase to the trader's
+// wallet and gives the expert's share of them back to the platform
+func refundCredits(tx *gorm.DB, purchase *models.PackagePurchase, credits int, description string, createdByID *uint) error {
+	refundedCredits := purchase.RefundedCredits + credits
+
+	// Work out the refund from the running total so rounding never refunds more than was paid
+	amount := purchase.Amount*int64(refundedCredits)/int64(purchase.Sessions) - purchase.RefundedAmount
+	if amount <= 0 {
+		return nil
+	}
+
+	reversal := fmt.Sprintf("%s-REF%d", purchase.PaymentID, refundedCredits)
+	if purchase.ExpertShare > 0 {
+		share := creditShare(purchase, purchase.SettledCredits, purchase.SettledCredits+credits)
+		if err := earnings.ForfeitDeferred(tx, reversal, share, purchase.Currency, purchase.ExpertID, description); err != nil {
+			return err
+		}
+		purchase.SettledCredits += credits
+	} else if err := earnings.ReversePaymentPart(tx, purchase.PaymentID, reversal, int64(credits), int64(purchase.Sessions), description); err != nil {
+		return err
+	}
+	if _, err := wallet.Credit(tx, purchase.TraderID, amount, purchase.Currency, wallet.SourceRefund,
+		purchase.PaymentID, description, createdByID); err != nil {
+		return err
+	}
+
+	purchase.RefundedCredits = refundedCredits
+	purchase.RefundedAmount += amount
+	return tx.Model(purchase).Updates(map[string]interface{}{
+		"refunded_credits": purchase.RefundedCredits,
+		"refunded_minor":   purchase.RefundedAmount,
+		"settled_credits":  purchase.SettledCredits,
+	}).Error
+}
+
+// expirePurchases closes active purchases past their expiry. Unused credits
+// lapse and the expert earns their share of them; sessions already booked
+// with them still go ahead.
+func expirePurchases(db *gorm.DB, now time.Time) (int64, error) {
+	var expired int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var purchases []models.PackagePurchase
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND expires_at <= ?", PurchaseActive, now).
+			Find(&purchases).Error; err != nil {
+			return err
+		}
+
+		for i := range purchases {
+			purchase := &purchases[i]
+			if purchase.ExpertShare > 0 && purchase.SettledCredits < purchase.Sessions {
+				share := creditShare(purchase, purchase.SettledCredits, purchase.Sessions)
+				if err := earnings.EarnDeferred(tx, purchase.PaymentID+"-EXP", share, purchase.Currency, purchase.ExpertID,
+					fmt.Sprintf("Lapsed credits of %s", purchase.Name)); err != nil {
+					return err
+				}
+				purchase.SettledCredits = purchase.Sessions
+			}
+			if err := tx.Model(purchase).Updates(map[string]interface{}{
+				"status":          PurchaseExpired,
+				"settled_credits": purchase.SettledCredits,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		expired = int64(len(purchases))
+		return nil
+	})
+	return expired, err
+}
+
+// runExpirer periodically expires lapsed package purchases
+func (h *PackageHandler) runExpirer() {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := expirePurchases(h.db, time.Now())
+		if err != nil {
+			log.Printf("Error expiring session packages: %v", err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("Expired %d session packages", expired)
+		}
+	}
+}
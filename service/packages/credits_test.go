@@ -0,0 +1,258 @@
+package packages
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/earnings"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/KAsare1/Kodefx-server/service/wallet/wallettest"
+	"gorm.io/gorm"
+)
+
+func TestCreditShare(t *testing.T) {
+	tests := []struct {
+		share    int64
+		sessions int
+		parts    []int64 // Share of each credit in turn
+	}{
+		{share: 8000, sessions: 4, parts: []int64{2000, 2000, 2000, 2000}},
+		{share: 8000, sessions: 3, parts: []int64{2666, 2667, 2667}},
+		{share: 1, sessions: 3, parts: []int64{0, 0, 1}},
+		{share: 7999, sessions: 1, parts: []int64{7999}},
+	}
+	for _, tt := range tests {
+		purchase := &models.PackagePurchase{ExpertShare: tt.share, Sessions: tt.sessions}
+		var sum int64
+		for i, want := range tt.parts {
+			if got := creditShare(purchase, i, i+1); got != want {
+				t.Errorf("creditShare(%d of %d, credit %d) = %d, want %d", tt.share, tt.sessions, i+1, got, want)
+			}
+			sum += creditShare(purchase, i, i+1)
+		}
+		if sum != tt.share {
+			t.Errorf("credits of %d over %d sessions add up to %d", tt.share, tt.sessions, sum)
+		}
+		if got := creditShare(purchase, 0, tt.sessions); got != tt.share {
+			t.Errorf("creditShare(%d of %d, all credits) = %d", tt.share, tt.sessions, got)
+		}
+	}
+}
+
+// purchaseFixture creates a pending purchase of a package of sessions priced
+// amount, walletAmount of which is held from the trader's wallet
+func purchaseFixture(t *testing.T, db *gorm.DB, sessions int, amount, walletAmount int64) (*models.PackagePurchase, *models.Expert) {
+	t.Helper()
+
+	expert := testdb.Expert(t, db, "Package Expert")
+	trader := testdb.User(t, db, "Package Trader")
+	pkg := testdb.Package(t, db, expert, sessions, amount)
+	if walletAmount > 0 {
+		wallettest.Hold(t, db, trader.ID, walletAmount, "PKG-test")
+	}
+	return testdb.Purchase(t, db, pkg, trader.ID, "PKG-test", walletAmount), expert
+}
+
+// pay completes the purchase's payment as its webhook does
+func pay(t *testing.T, db *gorm.DB, purchase *models.PackagePurchase, now time.Time) (*models.PackagePurchase, bool) {
+	t.Helper()
+
+	var completed *models.PackagePurchase
+	var activated bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		completed, activated, err = CompletePackagePayment(tx, purchase.PaymentID, purchase.Amount-purchase.WalletAmount, "GHS", payment.ChannelCard, now)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("CompletePackagePayment: %v", err)
+	}
+	return completed, activated
+}
+
+func TestCompletePackagePaymentLate(t *testing.T) {
+	tests := []struct {
+		name        string
+		releaseHold bool // The wallet hold was released before the payment arrived
+		spendHold   bool // and the money spent
+		activated   bool
+		wantStatus  string
+		wantWallet  int64
+	}{
+		{name: "wallet hold still held", activated: true, wantStatus: PurchaseActive},
+		{name: "wallet hold released but balance left", releaseHold: true, activated: true, wantStatus: PurchaseActive},
+		{name: "wallet hold released and spent", releaseHold: true, spendHold: true, wantStatus: PurchaseRefunded, wantWallet: 6000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "packages")
+			purchase, _ := purchaseFixture(t, db, 3, 10000, 4000)
+
+			if tt.releaseHold {
+				wallettest.Release(t, db, purchase.PaymentID)
+			}
+			if tt.spendHold {
+				wallettest.Spend(t, db, purchase.TraderID, 4000)
+			}
+
+			_, activated := pay(t, db, purchase, time.Now())
+			if activated != tt.activated {
+				t.Errorf("activated = %v, want %v", activated, tt.activated)
+			}
+
+			// A repeated webhook changes nothing
+			if _, again := pay(t, db, purchase, time.Now()); again {
+				t.Error("repeated webhook activated the purchase again")
+			}
+
+			db.First(purchase, purchase.ID)
+			if purchase.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", purchase.Status, tt.wantStatus)
+			}
+			if balance := wallettest.Balance(t, db, purchase.TraderID); balance != tt.wantWallet {
+				t.Errorf("wallet balance = %d, want %d", balance, tt.wantWallet)
+			}
+		})
+	}
+}
+
+func TestRedeemCreditRace(t *testing.T) {
+	tests := []struct {
+		name    string
+		credits int
+		traders int
+	}{
+		{name: "last credit", credits: 1, traders: 5},
+		{name: "two credits", credits: 2, traders: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "packages")
+			now := time.Now()
+			purchase, expert := purchaseFixture(t, db, tt.credits, 10000, 0)
+			pay(t, db, purchase, now)
+			slot := testdb.Slot(t, db, expert, now.Add(48*time.Hour).Truncate(time.Hour), tt.traders, 5000)
+
+			redeem := func(int) error {
+				return db.Transaction(func(tx *gorm.DB) error {
+					_, err := RedeemCredit(tx, purchase.ID, purchase.TraderID, slot, now)
+					return err
+				})
+			}
+
+			ok := 0
+			for _, err := range testdb.Race(tt.traders, redeem) {
+				switch {
+				case err == nil:
+					ok++
+				case !errors.Is(err, ErrNoCredits):
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+			if ok != tt.credits {
+				t.Errorf("%d credits redeemed, want %d", ok, tt.credits)
+			}
+
+			db.First(purchase, purchase.ID)
+			if purchase.CreditsRemaining != 0 {
+				t.Errorf("%d credits left, want 0", purchase.CreditsRemaining)
+			}
+		})
+	}
+}
+
+func TestExpertPackageShare(t *testing.T) {
+	tests := []struct {
+		name       string
+		returned   bool // The redeemed credit is returned, e.g. the expert missed it
+		end        string
+		wantCredit int    // Credits of the expert's share they end up earning
+		wantWallet int64  // Refunded to the trader
+		wantStatus string // Of the purchase
+	}{
+		{name: "unused credits lapse", end: "expire", wantCredit: 3, wantStatus: PurchaseExpired},
+		{name: "unused credits refunded", end: "refund", wantCredit: 1, wantWallet: 6666, wantStatus: PurchaseRefunded},
+		{name: "returned credit then refunded", returned: true, end: "refund", wantCredit: 0, wantWallet: 10000, wantStatus: PurchaseRefunded},
+		{name: "returned credit then lapses", returned: true, end: "expire", wantCredit: 3, wantStatus: PurchaseExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "packages")
+			now := time.Now()
+			purchase, expert := purchaseFixture(t, db, 3, 10000, 0)
+			purchase, _ = pay(t, db, purchase, now)
+			share := purchase.ExpertShare
+			slot := testdb.Slot(t, db, expert, now.Add(48*time.Hour).Truncate(time.Hour), 1, 5000)
+
+			earned := func() int64 {
+				t.Helper()
+				balance, err := earnings.ExpertBalance(db, expert.ID, "GHS")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return balance.Balance
+			}
+			if got := earned(); got != 0 {
+				t.Fatalf("expert earned %d before any credit was used", got)
+			}
+
+			// Redeeming a credit earns the expert their share of it
+			appointment := &models.Appointment{Model: gorm.Model{ID: 1}, EventName: "Test session", PackagePurchaseID: &purchase.ID}
+			if err := db.Transaction(func(tx *gorm.DB) error {
+				redeemed, err := RedeemCredit(tx, purchase.ID, purchase.TraderID, slot, now)
+				if err != nil {
+					return err
+				}
+				return EarnCredit(tx, redeemed, appointment)
+			}); err != nil {
+				t.Fatalf("redeeming credit: %v", err)
+			}
+			if got, want := earned(), creditShare(purchase, 0, 1); got != want {
+				t.Errorf("expert earned %d after one credit, want %d", got, want)
+			}
+
+			if tt.returned {
+				if err := db.Transaction(func(tx *gorm.DB) error { return ReturnCredit(tx, appointment, nil, now) }); err != nil {
+					t.Fatalf("ReturnCredit: %v", err)
+				}
+				if got := earned(); got != 0 {
+					t.Errorf("expert kept %d of a returned credit", got)
+				}
+			}
+
+			switch tt.end {
+			case "expire":
+				if _, err := expirePurchases(db, now.AddDate(0, 0, 31)); err != nil {
+					t.Fatalf("expirePurchases: %v", err)
+				}
+			case "refund":
+				if err := db.Transaction(func(tx *gorm.DB) error {
+					_, err := RefundUnusedCredits(tx, purchase.ID, nil, true, now)
+					return err
+				}); err != nil {
+					t.Fatalf("RefundUnusedCredits: %v", err)
+				}
+			}
+
+			db.First(purchase, purchase.ID)
+			if purchase.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", purchase.Status, tt.wantStatus)
+			}
+			if purchase.SettledCredits != purchase.Sessions {
+				t.Errorf("%d of %d credits settled", purchase.SettledCredits, purchase.Sessions)
+			}
+			if got, want := earned(), creditShare(purchase, 0, tt.wantCredit); got != want {
+				t.Errorf("expert earned %d, want %d (%d of share %d)", got, want, tt.wantCredit, share)
+			}
+			if balance := wallettest.Balance(t, db, purchase.TraderID); balance != tt.wantWallet {
+				t.Errorf("wallet balance = %d, want %d", balance, tt.wantWallet)
+			}
+		})
+	}
+}
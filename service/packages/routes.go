@@ -0,0 +1,516 @@
+package packages
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Limits on the packages an expert can offer
+const (
+	maxSessions     = 100
+	maxValidityDays = 730
+)
+
+// Response is a standardized API response structure
+type Response struct {
+	Data  interface{} `json:"data,omitempty"`
+	Meta  interface{} `json:"meta,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// PackageHandler handles session packages: experts set them up, traders buy
+// them and refund unused credits. Credits are redeemed through the
+// appointment routes.
+type PackageHandler struct {
+	db       *gorm.DB
+	provider payment.Provider
+}
+
+// NewPackageHandler creates a new package handler and starts expiring lapsed packages
+func NewPackageHandler(db *gorm.DB) *PackageHandler {
+	h := &PackageHandler{db: db, provider: payment.NewProvider()}
+	go h.runExpirer()
+
+	return h
+}
+
+// RegisterRoutes registers all session package routes
+func (h *PackageHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/experts/{expertId:[0-9]+}/packages", h.GetExpertPackages).Methods("GET")
+	router.HandleFunc("/experts/{expertId:[0-9]+}/packages", utils.AuthMiddleware(h.CreatePackage)).Methods("POST")
+	router.HandleFunc("/experts/{expertId:[0-9]+}/packages/{id:[0-9]+}", utils.AuthMiddleware(h.UpdatePackage)).Methods("PUT")
+	router.HandleFunc("/experts/{expertId:[0-9]+}/packages/{id:[0-9]+}", utils.AuthMiddleware(h.DeactivatePackage)).Methods("DELETE")
+
+	router.HandleFunc("/packages/{id:[0-9]+}/purchase", utils.AuthMiddleware(h.PurchasePackage)).Methods("POST")
+	router.HandleFunc("/packages/purchases", utils.AuthMiddleware(h.GetPurchases)).Methods("GET")
+	router.HandleFunc("/packages/purchases/{id:[0-9]+}", utils.AuthMiddleware(h.GetPurchase)).Methods("GET")
+	router.HandleFunc("/packages/purchases/{id:[0-9]+}/refund", utils.AuthMiddleware(h.RefundPurchase)).Methods("POST")
+}
+
+// authorizeExpert loads the expert in the path and checks that the caller is
+// that expert or an admin
+func (h *PackageHandler) authorizeExpert(w http.ResponseWriter, r *http.Request) (*models.Expert, bool) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	expertID, err := strconv.ParseUint(mux.Vars(r)["expertId"], 10, 32)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid expert ID")
+		return nil, false
+	}
+
+	var expert models.Expert
+	if err := h.db.First(&expert, expertID).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Expert not found")
+		return nil, false
+	}
+
+	if expert.UserID != userID && !utils.IsAdmin(h.db, userID) {
+		h.respondWithError(w, http.StatusForbidden, "You don't have permission to manage this expert's packages")
+		return nil, false
+	}
+	return &expert, true
+}
+
+// findPackage loads the package in the path, which must belong to expert
+func (h *PackageHandler) findPackage(w http.ResponseWriter, r *http.Request, expert *models.Expert) (*models.SessionPackage, bool) {
+	var pkg models.SessionPackage
+	if err := h.db.Where("id = ? AND expert_id = ?", mux.Vars(r)["id"], expert.ID).First(&pkg).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Package not found")
+		return nil, false
+	}
+	return &pkg, true
+}
+
+// validatePackage checks a package's terms, normalizing its currency
+func validatePackage(pkg *models.SessionPackage) error {
+	pkg.Name = strings.TrimSpace(pkg.Name)
+	pkg.Category = strings.TrimSpace(pkg.Category)
+	if pkg.Name == "" {
+		return errors.New("Name is required")
+	}
+	if pkg.Sessions < 1 || pkg.Sessions > maxSessions {
+		return fmt.Errorf("Sessions must be between 1 and %d", maxSessions)
+	}
+	if pkg.Price <= 0 {
+		return errors.New("Price must be greater than zero")
+	}
+	pkg.Currency = utils.NormalizeCurrency(pkg.Currency)
+	if pkg.Currency == "" {
+		pkg.Currency = utils.DefaultCurrency()
+	}
+	if !utils.IsSupportedCurrency(pkg.Currency) {
+		return errors.New("Unsupported currency")
+	}
+	if pkg.ValidityDays == 0 {
+		pkg.ValidityDays = 90
+	}
+	if pkg.ValidityDays < 1 || pkg.ValidityDays > maxValidityDays {
+		return fmt.Errorf("Validity must be between 1 and %d days", maxValidityDays)
+	}
+	return nil
+}
+
+// GetExpertPackages lists the expert's packages on sale, cheapest per session first
+func (h *PackageHandler) GetExpertPackages(w http.ResponseWriter, r *http.Request) {
+	var packages []models.SessionPackage
+	if err := h.db.Where("expert_id = ? AND active = ?", mux.Vars(r)["expertId"], true).
+		Order("price_minor / sessions, id").
+		Find(&packages).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to fetch packages")
+		return
+	}
+	h.respondWithJSON(w, http.StatusOK, Response{Data: packages})
+}
+
+// CreatePackage puts a new session package on sale for the expert
+func (h *PackageHandler) CreatePackage(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name         string `json:"name"`
+		Description  string `json:"description"`
+		Category     string `json:"category"`
+		Sessions     int    `json:"sessions"`
+		Price        int64  `json:"price_minor"`
+		Currency     string `json:"currency"`
+		ValidityDays int    `json:"validity_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	pkg := models.SessionPackage{
+		ExpertID:     expert.ID,
+		Name:         request.Name,
+		Description:  request.Description,
+		Category:     request.Category,
+		Sessions:     request.Sessions,
+		Price:        request.Price,
+		Currency:     request.Currency,
+		ValidityDays: request.ValidityDays,
+		Active:       true,
+	}
+	if err := validatePackage(&pkg); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.db.Create(&pkg).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to create package")
+		return
+	}
+	h.respondWithJSON(w, http.StatusCreated, Response{Data: pkg})
+}
+
+// UpdatePackage changes a package's terms. Fields left out are unchanged.
+// Packages already bought keep the terms they were bought on.
+func (h *PackageHandler) UpdatePackage(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+	pkg, ok := h.findPackage(w, r, expert)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name         *string `json:"name"`
+		Description  *string `json:"description"`
+		Category     *string `json:"category"`
+		Sessions     *int    `json:"sessions"`
+		Price        *int64  `json:"price_minor"`
+		Currency     *string `json:"currency"`
+		ValidityDays *int    `json:"validity_days"`
+		Active       *bool   `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if request.Name != nil {
+		pkg.Name = *request.Name
+	}
+	if request.Description != nil {
+		pkg.Description = *request.Description
+	}
+	if request.Category != nil {
+		pkg.Category = *request.Category
+	}
+	if request.Sessions != nil {
+		pkg.Sessions = *request.Sessions
+	}
+	if request.Price != nil {
+		pkg.Price = *request.Price
+	}
+	if request.Currency != nil {
+		pkg.Currency = *request.Currency
+	}
+	if request.ValidityDays != nil {
+		pkg.ValidityDays = *request.ValidityDays
+	}
+	if request.Active != nil {
+		pkg.Active = *request.Active
+	}
+	if err := validatePackage(pkg); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.db.Save(pkg).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to update package")
+		return
+	}
+	h.respondWithJSON(w, http.StatusOK, Response{Data: pkg})
+}
+
+// DeactivatePackage takes a package off sale. Packages already bought can
+// still be used.
+func (h *PackageHandler) DeactivatePackage(w http.ResponseWriter, r *http.Request) {
+	expert, ok := h.authorizeExpert(w, r)
+	if !ok {
+		return
+	}
+	pkg, ok := h.findPackage(w, r, expert)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Model(pkg).Update("active", false).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to deactivate package")
+		return
+	}
+	h.respondWithJSON(w, http.StatusOK, Response{Data: pkg})
+}
+
+// PurchasePackage starts the checkout for a package. Credits are added once
+// the payment is confirmed.
+func (h *PackageHandler) PurchasePackage(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request struct {
+		UseWallet bool `json:"use_wallet"`
+		payment.ChannelRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	var pkg models.SessionPackage
+	if err := h.db.Where("id = ? AND active = ?", mux.Vars(r)["id"], true).First(&pkg).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Package not found")
+		return
+	}
+
+	if err := request.ChannelRequest.Validate(pkg.Currency); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx := h.db.Begin()
+
+	var user models.User
+	if err := tx.First(&user, userID).Error; err != nil {
+		tx.Rollback()
+		h.respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	now := time.Now()
+	purchase := models.PackagePurchase{
+		PackageID:    pkg.ID,
+		TraderID:     userID,
+		ExpertID:     pkg.ExpertID,
+		Name:         pkg.Name,
+		Category:     pkg.Category,
+		Sessions:     pkg.Sessions,
+		Amount:       pkg.Price,
+		Currency:     pkg.Currency,
+		ValidityDays: pkg.ValidityDays,
+		PaymentID:    fmt.Sprintf("PKG-%d-%d", userID, now.UnixNano()),
+		Status:       PurchasePending,
+	}
+	reference := purchase.PaymentID
+
+	// Cover what the wallet can; the rest is charged to the trader's card
+	if request.UseWallet {
+		purchase.WalletAmount, err = wallet.Hold(tx, userID, purchase.Amount, purchase.Currency, reference,
+			"Session Package - "+pkg.Name)
+		if err != nil {
+			tx.Rollback()
+			h.respondWithError(w, http.StatusInternalServerError, "Error applying wallet balance")
+			return
+		}
+	}
+	amountDue := purchase.Amount - purchase.WalletAmount
+
+	if err := tx.Create(&purchase).Error; err != nil {
+		tx.Rollback()
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to create purchase")
+		return
+	}
+
+	response := map[string]interface{}{
+		"reference":        reference,
+		"purchase_id":      purchase.ID,
+		"amount_minor":     purchase.Amount,
+		"wallet_minor":     purchase.WalletAmount,
+		"amount_due_minor": amountDue,
+		"currency":         purchase.Currency,
+	}
+
+	if amountDue == 0 {
+		// Fully covered by the wallet, so add the credits straight away
+		if _, _, err := CompletePackagePayment(tx, reference, 0, purchase.Currency, "Wallet", now); err != nil {
+			tx.Rollback()
+			h.respondWithError(w, http.StatusInternalServerError, "Error activating package")
+			return
+		}
+		response["status"] = PurchaseActive
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Error completing initialization")
+		return
+	}
+
+	if amountDue > 0 {
+		// Start a card checkout or charge the trader's mobile money wallet. The
+		// purchase is saved first so a charge that goes through always finds it.
+		collection, err := payment.Collect(h.provider, request.ChannelRequest, payment.InitializeRequest{
+			Email:     user.Email,
+			Amount:    amountDue,
+			Currency:  purchase.Currency,
+			Reference: reference,
+			Metadata: map[string]interface{}{
+				"payment_type": "session_package",
+				"user_id":      userID,
+				"package_id":   pkg.ID,
+			},
+		})
+		if err != nil {
+			if errors.Is(err, payment.ErrChargeFailed) {
+				if err := releaseDeclinedPurchase(h.db, reference); err != nil {
+					log.Printf("Error releasing declined purchase %s: %v", reference, err)
+				}
+				h.respondWithError(w, http.StatusPaymentRequired, err.Error())
+				return
+			}
+			// The charge may still go through, so the purchase is left pending
+			// and its wallet hold runs out if it never does
+			log.Printf("Error initializing package payment: %v", err)
+			h.respondWithError(w, http.StatusInternalServerError, "Error initializing payment")
+			return
+		}
+		for key, value := range collection {
+			response[key] = value
+		}
+	}
+
+	h.respondWithJSON(w, http.StatusCreated, Response{Data: response})
+}
+
+// GetPurchases lists the caller's paid packages, newest first. Admins may
+// list another trader's with ?trader_id=.
+func (h *PackageHandler) GetPurchases(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	traderID := uint64(userID)
+	if value := r.URL.Query().Get("trader_id"); value != "" && utils.IsAdmin(h.db, userID) {
+		if traderID, err = strconv.ParseUint(value, 10, 32); err != nil {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid trader ID")
+			return
+		}
+	}
+
+	query := h.db.Where("trader_id = ? AND status <> ?", traderID, PurchasePending)
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var purchases []models.PackagePurchase
+	if err := query.Order("created_at DESC").Find(&purchases).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to fetch packages")
+		return
+	}
+	h.respondWithJSON(w, http.StatusOK, Response{Data: purchases})
+}
+
+// loadPurchase loads the purchase in the path, which the caller must have
+// bought, be the expert of or be an admin
+func (h *PackageHandler) loadPurchase(w http.ResponseWriter, r *http.Request) (*models.PackagePurchase, uint, bool) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return nil, 0, false
+	}
+
+	var purchase models.PackagePurchase
+	if err := h.db.First(&purchase, mux.Vars(r)["id"]).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Purchase not found")
+		return nil, 0, false
+	}
+
+	if purchase.TraderID != userID && !utils.IsAdmin(h.db, userID) {
+		var expert models.Expert
+		if err := h.db.Select("id", "user_id").First(&expert, purchase.ExpertID).Error; err != nil || expert.UserID != userID {
+			h.respondWithError(w, http.StatusNotFound, "Purchase not found")
+			return nil, 0, false
+		}
+	}
+	return &purchase, userID, true
+}
+
+// GetPurchase returns a package purchase and the appointments booked with it
+func (h *PackageHandler) GetPurchase(w http.ResponseWriter, r *http.Request) {
+	purchase, _, ok := h.loadPurchase(w, r)
+	if !ok {
+		return
+	}
+
+	var appointments []models.Appointment
+	if err := h.db.Where("package_purchase_id = ?", purchase.ID).Order("start_time").Find(&appointments).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to fetch appointments")
+		return
+	}
+	h.respondWithJSON(w, http.StatusOK, Response{
+		Data: purchase,
+		Meta: map[string]interface{}{"appointments": appointments},
+	})
+}
+
+// RefundPurchase refunds a package's unused credits to the trader's wallet.
+// Traders can do so within the refund window; admins at any time before the
+// package expires.
+func (h *PackageHandler) RefundPurchase(w http.ResponseWriter, r *http.Request) {
+	purchase, userID, ok := h.loadPurchase(w, r)
+	if !ok {
+		return
+	}
+
+	isAdmin := utils.IsAdmin(h.db, userID)
+	if purchase.TraderID != userID && !isAdmin {
+		h.respondWithError(w, http.StatusForbidden, "Only the trader or an admin can refund this package")
+		return
+	}
+
+	var refunded *models.PackagePurchase
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		refunded, err = RefundUnusedCredits(tx, purchase.ID, &userID, isAdmin, time.Now())
+		return err
+	})
+	if err != nil {
+		if IsCreditError(err) {
+			h.respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to refund package")
+		return
+	}
+	h.respondWithJSON(w, http.StatusOK, Response{Data: refunded})
+}
+
+// Helper function to respond with an error
+func (h *PackageHandler) respondWithError(w http.ResponseWriter, code int, message string) {
+	h.respondWithJSON(w, code, Response{Error: message})
+}
+
+// Helper function to respond with JSON
+func (h *PackageHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
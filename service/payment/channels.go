@@ -0,0 +1,203 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Payment channels a customer can choose at checkout
+const (
+	ChannelCard        = "card"         // Hosted checkout, card or any channel Paystack offers
+	ChannelMobileMoney = "mobile_money" // Direct charge to a mobile money wallet
+)
+
+// Mobile money networks, using Paystack's provider codes
+const (
+	NetworkMTN        = "mtn"
+	NetworkVodafone   = "vod"
+	NetworkAirtelTigo = "atl"
+)
+
+// Charge statuses returned for direct charges
+const (
+	ChargeSuccess    = "success"
+	ChargeFailed     = "failed"
+	ChargePending    = "pending"
+	ChargeSendOTP    = "send_otp"    // The customer must submit the OTP sent to their phone
+	ChargePayOffline = "pay_offline" // The customer must approve the prompt on their phone
+)
+
+// ErrChargeFailed is returned when the provider declines a direct charge outright
+var ErrChargeFailed = errors.New("payment was declined")
+
+// networkAliases maps the names customers and Paystack use for each network
+var networkAliases = map[string]string{
+	"mtn":        NetworkMTN,
+	"vod":        NetworkVodafone,
+	"vodafone":   NetworkVodafone,
+	"telecel":    NetworkVodafone,
+	"atl":        NetworkAirtelTigo,
+	"tgo":        NetworkAirtelTigo,
+	"airteltigo": NetworkAirtelTigo,
+	"airtel":     NetworkAirtelTigo,
+	"tigo":       NetworkAirtelTigo,
+}
+
+// networkNames are the display names of each network
+var networkNames = map[string]string{
+	NetworkMTN:        "MTN",
+	NetworkVodafone:   "Vodafone",
+	NetworkAirtelTigo: "AirtelTigo",
+}
+
+// NormalizeNetwork returns the provider code for a network name, reporting
+// whether it is a supported network
+func NormalizeNetwork(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.NewReplacer(" ", "", "-", "", "_", "").Replace(name)
+	code, ok := networkAliases[name]
+	return code, ok
+}
+
+// MobileMoneyDetails identifies the wallet to charge
+type MobileMoneyDetails struct {
+	Phone    string `json:"phone"`
+	Provider string `json:"provider"` // mtn, vodafone or airteltigo
+}
+
+// ChannelRequest is the part of a payment initialization request that picks
+// how the customer pays. It defaults to card.
+type ChannelRequest struct {
+	Channel     string              `json:"channel"`
+	MobileMoney *MobileMoneyDetails `json:"mobile_money,omitempty"`
+}
+
+// Validate checks the channel details for a payment in currency and
+// normalizes the channel, network and phone number
+func (c *ChannelRequest) Validate(currency string) error {
+	c.Channel = strings.ToLower(strings.TrimSpace(c.Channel))
+	switch c.Channel {
+	case "":
+		c.Channel = ChannelCard
+		return nil
+	case ChannelCard:
+		return nil
+	case ChannelMobileMoney:
+	default:
+		return fmt.Errorf("channel must be %s or %s", ChannelCard, ChannelMobileMoney)
+	}
+
+	if currency != "GHS" {
+		return fmt.Errorf("mobile money is only available for GHS payments")
+	}
+	if c.MobileMoney == nil {
+		return fmt.Errorf("mobile_money phone and provider are required")
+	}
+
+	network, ok := NormalizeNetwork(c.MobileMoney.Provider)
+	if !ok {
+		return fmt.Errorf("mobile money provider must be MTN, Vodafone or AirtelTigo")
+	}
+	c.MobileMoney.Provider = network
+
+	phone, ok := normalizePhone(c.MobileMoney.Phone)
+	if !ok {
+		return fmt.Errorf("enter a valid Ghanaian mobile money number")
+	}
+	c.MobileMoney.Phone = phone
+	return nil
+}
+
+// normalizePhone converts a Ghanaian number to the local 0XXXXXXXXX form
+func normalizePhone(phone string) (string, bool) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+
+	if strings.HasPrefix(digits, "233") && len(digits) == 12 {
+		digits = "0" + digits[3:]
+	}
+	if len(digits) != 10 || digits[0] != '0' {
+		return "", false
+	}
+	return digits, true
+}
+
+// Collect starts collecting req.Amount over the chosen channel: a hosted
+// checkout for card, or a direct charge to the customer's wallet for mobile
+// money. The returned fields are added to the initialization response; the
+// payment itself is confirmed by the charge.success webhook either way.
+func Collect(p Provider, channel ChannelRequest, req InitializeRequest) (map[string]interface{}, error) {
+	if channel.Channel != ChannelMobileMoney {
+		checkout, err := p.InitializeTransaction(req)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"channel":           ChannelCard,
+			"authorization_url": checkout.AuthorizationURL,
+		}, nil
+	}
+
+	result, err := p.ChargeMobileMoney(MobileMoneyChargeRequest{
+		Email:     req.Email,
+		Amount:    req.Amount,
+		Currency:  req.Currency,
+		Reference: req.Reference,
+		Phone:     channel.MobileMoney.Phone,
+		Network:   channel.MobileMoney.Provider,
+		Metadata:  req.Metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Status == ChargeFailed {
+		return nil, fmt.Errorf("%w: %s", ErrChargeFailed, result.GatewayResponse)
+	}
+
+	return map[string]interface{}{
+		"channel":        ChannelMobileMoney,
+		"payment_status": result.Status,
+		"display_text":   result.DisplayText,
+	}, nil
+}
+
+// MethodFor returns the Transaction.Method recorded for a payment made over
+// channel. Mobile money payments include the network, e.g. "mobile_money_mtn".
+func MethodFor(channel, network string) string {
+	channel = strings.ToLower(strings.TrimSpace(channel))
+	if channel == "" {
+		return ChannelCard
+	}
+	if channel == ChannelMobileMoney {
+		if code, ok := NormalizeNetwork(network); ok {
+			return ChannelMobileMoney + "_" + code
+		}
+	}
+	return channel
+}
+
+// MethodLabel describes a Transaction.Method for receipts and history,
+// e.g. "MTN Mobile Money"
+func MethodLabel(method string) string {
+	switch {
+	case method == ChannelCard:
+		return "Card"
+	case method == ChannelMobileMoney:
+		return "Mobile Money"
+	case strings.HasPrefix(method, ChannelMobileMoney+"_"):
+		if name, ok := networkNames[strings.TrimPrefix(method, ChannelMobileMoney+"_")]; ok {
+			return name + " Mobile Money"
+		}
+		return "Mobile Money"
+	case method == "bank" || method == "bank_transfer":
+		return "Bank Transfer"
+	case method == "ussd":
+		return "USSD"
+	}
+	return method
+}
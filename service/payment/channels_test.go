@@ -0,0 +1,131 @@
+package payment
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChannelRequestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		channel   ChannelRequest
+		currency  string
+		wantErr   bool
+		wantPhone string
+		wantNet   string
+	}{
+		{name: "defaults to card", channel: ChannelRequest{}, currency: "USD"},
+		{name: "mobile money", channel: ChannelRequest{Channel: "Mobile_Money", MobileMoney: &MobileMoneyDetails{Phone: "+233 24 123 4567", Provider: "MTN"}}, currency: "GHS", wantPhone: "0241234567", wantNet: NetworkMTN},
+		{name: "telecel is vodafone", channel: ChannelRequest{Channel: ChannelMobileMoney, MobileMoney: &MobileMoneyDetails{Phone: "0201234567", Provider: "Telecel"}}, currency: "GHS", wantPhone: "0201234567", wantNet: NetworkVodafone},
+		{name: "mobile money outside GHS", channel: ChannelRequest{Channel: ChannelMobileMoney, MobileMoney: &MobileMoneyDetails{Phone: "0241234567", Provider: "mtn"}}, currency: "USD", wantErr: true},
+		{name: "missing wallet", channel: ChannelRequest{Channel: ChannelMobileMoney}, currency: "GHS", wantErr: true},
+		{name: "unknown network", channel: ChannelRequest{Channel: ChannelMobileMoney, MobileMoney: &MobileMoneyDetails{Phone: "0241234567", Provider: "glo"}}, currency: "GHS", wantErr: true},
+		{name: "short number", channel: ChannelRequest{Channel: ChannelMobileMoney, MobileMoney: &MobileMoneyDetails{Phone: "024123", Provider: "mtn"}}, currency: "GHS", wantErr: true},
+		{name: "unknown channel", channel: ChannelRequest{Channel: "bank"}, currency: "GHS", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.channel.Validate(tt.currency)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil || tt.channel.MobileMoney == nil {
+				return
+			}
+			if tt.channel.MobileMoney.Phone != tt.wantPhone || tt.channel.MobileMoney.Provider != tt.wantNet {
+				t.Errorf("wallet = %s on %s, want %s on %s", tt.channel.MobileMoney.Phone, tt.channel.MobileMoney.Provider, tt.wantPhone, tt.wantNet)
+			}
+		})
+	}
+}
+
+func TestCollect(t *testing.T) {
+	mobileMoney := ChannelRequest{Channel: ChannelMobileMoney, MobileMoney: &MobileMoneyDetails{Phone: "0241234567", Provider: NetworkMTN}}
+
+	tests := []struct {
+		name       string
+		channel    ChannelRequest
+		status     string // Mobile money charge status
+		wantErr    error
+		wantFields map[string]interface{}
+	}{
+		{name: "card checkout", channel: ChannelRequest{Channel: ChannelCard}, wantFields: map[string]interface{}{"channel": ChannelCard, "authorization_url": "https://checkout.fake/REF-1"}},
+		{name: "approve on phone", channel: mobileMoney, status: ChargePayOffline, wantFields: map[string]interface{}{"channel": ChannelMobileMoney, "payment_status": ChargePayOffline}},
+		{name: "otp needed", channel: mobileMoney, status: ChargeSendOTP, wantFields: map[string]interface{}{"channel": ChannelMobileMoney, "payment_status": ChargeSendOTP}},
+		{name: "declined outright", channel: mobileMoney, status: ChargeFailed, wantErr: ErrChargeFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := NewFakeProvider()
+			if tt.status != "" {
+				provider.MobileMoneyStatus = tt.status
+			}
+
+			fields, err := Collect(provider, tt.channel, InitializeRequest{Email: "trader@example.com", Amount: 5000, Currency: "GHS", Reference: "REF-1"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Collect() error = %v, want %v", err, tt.wantErr)
+			}
+			for key, want := range tt.wantFields {
+				if fields[key] != want {
+					t.Errorf("%s = %v, want %v", key, fields[key], want)
+				}
+			}
+
+			if tt.channel.Channel == ChannelMobileMoney {
+				if len(provider.MobileMoney) != 1 || provider.MobileMoney[0].Phone != "0241234567" || provider.MobileMoney[0].Amount != 5000 {
+					t.Errorf("mobile money charges = %+v", provider.MobileMoney)
+				}
+			} else if len(provider.Initialized) != 1 {
+				t.Errorf("%d checkouts started, want 1", len(provider.Initialized))
+			}
+		})
+	}
+}
+
+func TestChargeResultOutcome(t *testing.T) {
+	tests := []struct {
+		result    *ChargeResult
+		succeeded bool
+		declined  bool
+	}{
+		{&ChargeResult{Status: ChargeSuccess}, true, false},
+		{&ChargeResult{Status: ChargeFailed}, false, true},
+		{&ChargeResult{Status: "abandoned"}, false, true},
+		{&ChargeResult{Status: "reversed"}, false, true},
+		{&ChargeResult{Status: ChargePending}, false, false},
+		{&ChargeResult{Status: ChargeSendOTP}, false, false},
+		{nil, false, false},
+	}
+	for _, tt := range tests {
+		if got := tt.result.Succeeded(); got != tt.succeeded {
+			t.Errorf("%+v Succeeded() = %v, want %v", tt.result, got, tt.succeeded)
+		}
+		if got := tt.result.Declined(); got != tt.declined {
+			t.Errorf("%+v Declined() = %v, want %v", tt.result, got, tt.declined)
+		}
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	tests := []struct {
+		channel, network string
+		method, label    string
+	}{
+		{"", "", ChannelCard, "Card"},
+		{ChannelCard, "", ChannelCard, "Card"},
+		{ChannelMobileMoney, "MTN", "mobile_money_mtn", "MTN Mobile Money"},
+		{ChannelMobileMoney, "airtel tigo", "mobile_money_atl", "AirtelTigo Mobile Money"},
+		{ChannelMobileMoney, "", ChannelMobileMoney, "Mobile Money"},
+	}
+	for _, tt := range tests {
+		method := MethodFor(tt.channel, tt.network)
+		if method != tt.method {
+			t.Errorf("MethodFor(%q, %q) = %q, want %q", tt.channel, tt.network, method, tt.method)
+		}
+		if label := MethodLabel(method); label != tt.label {
+			t.Errorf("MethodLabel(%q) = %q, want %q", method, label, tt.label)
+		}
+	}
+}
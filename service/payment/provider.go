@@ -0,0 +1,613 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider abstracts the payment gateway so handlers and background workers
+// can run against Paystack in production and a fake in tests.
+type Provider interface {
+	InitializeTransaction(req InitializeRequest) (*InitializeResult, error)
+	ChargeAuthorization(req ChargeAuthorizationRequest) (*ChargeResult, error)
+	VerifyTransaction(reference string) (*ChargeResult, error)
+	ChargeMobileMoney(req MobileMoneyChargeRequest) (*ChargeResult, error)
+	SubmitOTP(reference, otp string) (*ChargeResult, error)
+	CreateTransferRecipient(req TransferRecipientRequest) (*TransferRecipient, error)
+	Transfer(req TransferRequest) (*TransferResult, error)
+	VerifyTransfer(reference string) (*TransferResult, error)
+}
+
+// ErrTransferFailed is returned when the provider rejects a transfer outright,
+// so no money was sent. Other transfer errors leave the outcome unknown.
+var ErrTransferFailed = errors.New("transfer was rejected")
+
+// APIError is returned when Paystack answers with a non-2xx status, e.g. for
+// bad credentials, rate limiting or an outage. Unless the reference looked up
+// was not found, the outcome of the request is unknown.
+type APIError struct {
+	StatusCode int
+	Code       string // Paystack's error code, when given
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("paystack returned %d: %s", e.StatusCode, e.Message)
+}
+
+// notFound reports whether err is Paystack saying it has no record of the
+// reference looked up. Paystack answers unknown references with a 404, or a
+// 400 naming the missing transaction or transfer.
+func notFound(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch {
+	case apiErr.StatusCode == http.StatusNotFound:
+		return true
+	case apiErr.StatusCode != http.StatusBadRequest:
+		return false
+	case apiErr.Code != "":
+		return strings.HasSuffix(apiErr.Code, "_not_found")
+	}
+	return strings.Contains(strings.ToLower(apiErr.Message), "not found")
+}
+
+// InitializeRequest describes a hosted checkout to be started for a customer
+type InitializeRequest struct {
+	Email     string
+	Amount    int64 // Minor units
+	Currency  string
+	Reference string
+	Metadata  map[string]interface{}
+}
+
+// InitializeResult holds the checkout details returned by the provider
+type InitializeResult struct {
+	AuthorizationURL string `json:"authorization_url"`
+	AccessCode       string `json:"access_code"`
+	Reference        string `json:"reference"`
+}
+
+// ChargeAuthorizationRequest charges a previously saved card authorization
+type ChargeAuthorizationRequest struct {
+	Email             string
+	Amount            int64 // Minor units
+	Currency          string
+	Reference         string
+	AuthorizationCode string
+	Metadata          map[string]interface{}
+}
+
+// MobileMoneyChargeRequest charges a customer's mobile money wallet directly.
+// The customer approves the charge on their phone, sometimes after an OTP.
+type MobileMoneyChargeRequest struct {
+	Email     string
+	Amount    int64 // Minor units
+	Currency  string
+	Reference string
+	Phone     string
+	Network   string // mtn, vod or atl
+	Metadata  map[string]interface{}
+}
+
+// ChargeResult is the outcome of a direct charge
+type ChargeResult struct {
+	Reference       string `json:"reference"`
+	Status          string `json:"status"`           // success, failed, pending, send_otp, pay_offline
+	Amount          int64  `json:"amount,omitempty"` // Minor units
+	Currency        string `json:"currency,omitempty"`
+	GatewayResponse string `json:"gateway_response"`
+	DisplayText     string `json:"display_text,omitempty"` // Instructions to show the customer
+}
+
+// Succeeded reports whether the charge completed successfully
+func (c *ChargeResult) Succeeded() bool {
+	return c != nil && c.Status == "success"
+}
+
+// Declined reports whether the charge definitely did not go through. Any
+// other unsuccessful status may still complete later.
+func (c *ChargeResult) Declined() bool {
+	if c == nil {
+		return false
+	}
+	switch c.Status {
+	case ChargeFailed, "abandoned", "reversed":
+		return true
+	}
+	return false
+}
+
+// TransferRecipientRequest registers a bank or mobile money account to pay out to
+type TransferRecipientRequest struct {
+	Type          string // ghipss for bank accounts, mobile_money for wallets
+	Name          string
+	AccountNumber string
+	BankCode      string
+	Currency      string
+}
+
+// TransferRecipient is a registered payout destination
+type TransferRecipient struct {
+	RecipientCode string `json:"recipient_code"`
+}
+
+// TransferRequest sends money from the platform balance to a recipient
+type TransferRequest struct {
+	Amount        int64 // Minor units
+	Currency      string
+	RecipientCode string
+	Reference     string
+	Reason        string
+}
+
+// TransferResult is the outcome of a transfer. Pending transfers are settled
+// later through the transfer webhook events.
+type TransferResult struct {
+	Reference    string `json:"reference"`
+	TransferCode string `json:"transfer_code"`
+	Status       string `json:"status"` // success, pending, otp, failed, reversed
+}
+
+// NewProvider returns the provider configured through PAYMENT_PROVIDER,
+// defaulting to Paystack.
+func NewProvider() Provider {
+	if os.Getenv("PAYMENT_PROVIDER") == "fake" {
+		return NewFakeProvider()
+	}
+	return NewPaystackProvider(os.Getenv("PAYSTACK_SECRET_KEY"))
+}
+
+// PaystackProvider talks to the Paystack REST API
+type PaystackProvider struct {
+	secretKey string
+	baseURL   string
+	client    *http.Client
+}
+
+// NewPaystackProvider creates a Paystack provider using the given secret key
+func NewPaystackProvider(secretKey string) *PaystackProvider {
+	return &PaystackProvider{
+		secretKey: secretKey,
+		baseURL:   "https://api.paystack.co",
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// InitializeTransaction starts a hosted checkout
+func (p *PaystackProvider) InitializeTransaction(req InitializeRequest) (*InitializeResult, error) {
+	payload := map[string]interface{}{
+		"email":     req.Email,
+		"amount":    req.Amount,
+		"currency":  req.Currency,
+		"reference": req.Reference,
+		"metadata":  req.Metadata,
+	}
+	log.Printf("Payload to Paystack: %+v\n", payload)
+
+	var resp struct {
+		Status  bool             `json:"status"`
+		Message string           `json:"message"`
+		Data    InitializeResult `json:"data"`
+	}
+	if err := p.post("/transaction/initialize", payload, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Status {
+		return nil, fmt.Errorf("paystack initialize failed: %s", resp.Message)
+	}
+	return &resp.Data, nil
+}
+
+// ChargeAuthorization charges a saved authorization without customer interaction
+func (p *PaystackProvider) ChargeAuthorization(req ChargeAuthorizationRequest) (*ChargeResult, error) {
+	payload := map[string]interface{}{
+		"email":              req.Email,
+		"amount":             req.Amount,
+		"currency":           req.Currency,
+		"reference":          req.Reference,
+		"authorization_code": req.AuthorizationCode,
+		"metadata":           req.Metadata,
+	}
+
+	var resp struct {
+		Status  bool         `json:"status"`
+		Message string       `json:"message"`
+		Data    ChargeResult `json:"data"`
+	}
+	err := p.post("/transaction/charge_authorization", payload, &resp)
+	switch {
+	case resp.Data.Status != "":
+		// The charge was attempted; declines carry their status, sometimes
+		// alongside an error reply
+		return &resp.Data, nil
+	case err != nil:
+		return nil, err
+	}
+	// Without a charge status the outcome is unknown, so it isn't a decline
+	return nil, fmt.Errorf("paystack charge returned no status: %s", resp.Message)
+}
+
+// VerifyTransaction looks up the current outcome of a charge. A reference
+// Paystack doesn't know was never charged and is reported as ErrChargeFailed;
+// any other error leaves the outcome unknown.
+func (p *PaystackProvider) VerifyTransaction(reference string) (*ChargeResult, error) {
+	var resp struct {
+		Status  bool         `json:"status"`
+		Message string       `json:"message"`
+		Data    ChargeResult `json:"data"`
+	}
+	err := p.get("/transaction/verify/"+url.PathEscape(reference), &resp)
+	switch {
+	case notFound(err):
+		return nil, fmt.Errorf("%w: %v", ErrChargeFailed, err)
+	case err != nil:
+		return nil, err
+	case !resp.Status || resp.Data.Status == "":
+		return nil, fmt.Errorf("paystack verification returned no status: %s", resp.Message)
+	}
+	return &resp.Data, nil
+}
+
+// ChargeMobileMoney starts a direct mobile money charge
+func (p *PaystackProvider) ChargeMobileMoney(req MobileMoneyChargeRequest) (*ChargeResult, error) {
+	payload := map[string]interface{}{
+		"email":     req.Email,
+		"amount":    req.Amount,
+		"currency":  req.Currency,
+		"reference": req.Reference,
+		"mobile_money": map[string]string{
+			"phone":    req.Phone,
+			"provider": req.Network,
+		},
+		"metadata": req.Metadata,
+	}
+
+	return p.charge("/charge", payload)
+}
+
+// SubmitOTP completes a mobile money charge that is waiting for the OTP sent
+// to the customer's phone
+func (p *PaystackProvider) SubmitOTP(reference, otp string) (*ChargeResult, error) {
+	return p.charge("/charge/submit_otp", map[string]interface{}{
+		"reference": reference,
+		"otp":       otp,
+	})
+}
+
+// charge posts to one of the Charge API endpoints. Declined charges come back
+// with status false, sometimes with an error reply, but still carry a result,
+// so they are not treated as errors.
+func (p *PaystackProvider) charge(path string, payload interface{}) (*ChargeResult, error) {
+	var resp struct {
+		Status  bool         `json:"status"`
+		Message string       `json:"message"`
+		Data    ChargeResult `json:"data"`
+	}
+	err := p.post(path, payload, &resp)
+	if resp.Data.Status == "" {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("paystack charge failed: %s", resp.Message)
+	}
+	if resp.Data.GatewayResponse == "" {
+		resp.Data.GatewayResponse = resp.Message
+	}
+	return &resp.Data, nil
+}
+
+// CreateTransferRecipient registers a payout destination
+func (p *PaystackProvider) CreateTransferRecipient(req TransferRecipientRequest) (*TransferRecipient, error) {
+	payload := map[string]interface{}{
+		"type":           req.Type,
+		"name":           req.Name,
+		"account_number": req.AccountNumber,
+		"bank_code":      req.BankCode,
+		"currency":       req.Currency,
+	}
+
+	var resp struct {
+		Status  bool              `json:"status"`
+		Message string            `json:"message"`
+		Data    TransferRecipient `json:"data"`
+	}
+	if err := p.post("/transferrecipient", payload, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Status {
+		return nil, fmt.Errorf("paystack recipient creation failed: %s", resp.Message)
+	}
+	return &resp.Data, nil
+}
+
+// Transfer pays out from the Paystack balance to a recipient
+func (p *PaystackProvider) Transfer(req TransferRequest) (*TransferResult, error) {
+	payload := map[string]interface{}{
+		"source":    "balance",
+		"amount":    req.Amount,
+		"currency":  req.Currency,
+		"recipient": req.RecipientCode,
+		"reference": req.Reference,
+		"reason":    req.Reason,
+	}
+
+	var resp struct {
+		Status  bool           `json:"status"`
+		Message string         `json:"message"`
+		Data    TransferResult `json:"data"`
+	}
+	err := p.post("/transfer", payload, &resp)
+	var apiErr *APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest:
+		// Paystack refused the request, e.g. for an invalid recipient or a
+		// short balance, so nothing was sent
+		return nil, fmt.Errorf("%w: %v", ErrTransferFailed, err)
+	case err != nil:
+		return nil, err
+	case !resp.Status || resp.Data.Status == "":
+		return nil, fmt.Errorf("paystack transfer returned no status: %s", resp.Message)
+	}
+	return &resp.Data, nil
+}
+
+// VerifyTransfer looks up the current outcome of a transfer. A reference
+// Paystack doesn't know was never sent and is reported as ErrTransferFailed;
+// any other error leaves the outcome unknown.
+func (p *PaystackProvider) VerifyTransfer(reference string) (*TransferResult, error) {
+	var resp struct {
+		Status  bool           `json:"status"`
+		Message string         `json:"message"`
+		Data    TransferResult `json:"data"`
+	}
+	err := p.get("/transfer/verify/"+url.PathEscape(reference), &resp)
+	switch {
+	case notFound(err):
+		return nil, fmt.Errorf("%w: %v", ErrTransferFailed, err)
+	case err != nil:
+		return nil, err
+	case !resp.Status || resp.Data.Status == "":
+		return nil, fmt.Errorf("paystack transfer verification returned no status: %s", resp.Message)
+	}
+	return &resp.Data, nil
+}
+
+func (p *PaystackProvider) post(path string, payload interface{}, out interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", p.baseURL+path, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return p.do(req, out)
+}
+
+func (p *PaystackProvider) get(path string, out interface{}) error {
+	req, err := http.NewRequest("GET", p.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	return p.do(req, out)
+}
+
+func (p *PaystackProvider) do(req *http.Request, out interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+p.secretKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling paystack: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading paystack response: %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Error replies may still carry a result, e.g. a declined charge
+		json.Unmarshal(body, out)
+		var reply struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &reply)
+		return &APIError{StatusCode: resp.StatusCode, Code: reply.Code, Message: reply.Message}
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("error reading paystack response: %v", err)
+	}
+	return nil
+}
+
+// FakeProvider is an in-memory provider for tests and local development.
+// Every call is recorded and charges succeed unless ChargeStatus is changed.
+// ChargeErr, when set, is returned by ChargeAuthorization instead, e.g. to
+// simulate a timeout. Verified holds the outcome VerifyTransaction reports
+// per reference; unknown references were never charged. VerifyErr, when set,
+// is returned by VerifyTransaction instead, e.g. to simulate an outage.
+// TransferErr, VerifyTransferErr and VerifiedTransfers do the same for
+// transfers.
+// Mobile money charges wait for approval on the phone unless
+// MobileMoneyStatus is changed, and OTPs are answered with OTPStatus.
+type FakeProvider struct {
+	mu                sync.Mutex
+	ChargeStatus      string
+	ChargeErr         error
+	VerifyErr         error
+	MobileMoneyStatus string
+	OTPStatus         string
+	TransferStatus    string
+	TransferErr       error
+	VerifyTransferErr error
+	Initialized       []InitializeRequest
+	Charged           []ChargeAuthorizationRequest
+	MobileMoney       []MobileMoneyChargeRequest
+	OTPs              map[string]string // OTP submitted per reference
+	Verified          map[string]ChargeResult
+	Recipients        []TransferRecipientRequest
+	Transfers         []TransferRequest
+	VerifiedTransfers map[string]TransferResult
+}
+
+// NewFakeProvider creates a fake provider whose charges and transfers succeed
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		ChargeStatus:      ChargeSuccess,
+		MobileMoneyStatus: ChargePayOffline,
+		OTPStatus:         ChargePayOffline,
+		TransferStatus:    "success",
+		OTPs:              map[string]string{},
+		Verified:          map[string]ChargeResult{},
+		VerifiedTransfers: map[string]TransferResult{},
+	}
+}
+
+// InitializeTransaction records the request and returns a dummy checkout URL
+func (f *FakeProvider) InitializeTransaction(req InitializeRequest) (*InitializeResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Initialized = append(f.Initialized, req)
+	return &InitializeResult{
+		AuthorizationURL: "https://checkout.fake/" + req.Reference,
+		AccessCode:       "fake-" + req.Reference,
+		Reference:        req.Reference,
+	}, nil
+}
+
+// ChargeAuthorization records the request and returns ChargeStatus
+func (f *FakeProvider) ChargeAuthorization(req ChargeAuthorizationRequest) (*ChargeResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Charged = append(f.Charged, req)
+	if f.ChargeErr != nil {
+		return nil, f.ChargeErr
+	}
+	result := ChargeResult{
+		Reference:       req.Reference,
+		Status:          f.ChargeStatus,
+		Amount:          req.Amount,
+		Currency:        req.Currency,
+		GatewayResponse: "fake " + f.ChargeStatus,
+	}
+	f.Verified[req.Reference] = result
+	return &result, nil
+}
+
+// VerifyTransaction returns the outcome recorded in Verified for reference
+func (f *FakeProvider) VerifyTransaction(reference string) (*ChargeResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.VerifyErr != nil {
+		return nil, f.VerifyErr
+	}
+	result, ok := f.Verified[reference]
+	if !ok {
+		return nil, fmt.Errorf("%w: transaction reference not found", ErrChargeFailed)
+	}
+	return &result, nil
+}
+
+// ChargeMobileMoney records the request and returns MobileMoneyStatus
+func (f *FakeProvider) ChargeMobileMoney(req MobileMoneyChargeRequest) (*ChargeResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.MobileMoney = append(f.MobileMoney, req)
+	return &ChargeResult{
+		Reference:       req.Reference,
+		Status:          f.MobileMoneyStatus,
+		GatewayResponse: "fake " + f.MobileMoneyStatus,
+		DisplayText:     fakeDisplayText(f.MobileMoneyStatus),
+	}, nil
+}
+
+// SubmitOTP records the OTP and returns OTPStatus
+func (f *FakeProvider) SubmitOTP(reference, otp string) (*ChargeResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.OTPs[reference] = otp
+	return &ChargeResult{
+		Reference:       reference,
+		Status:          f.OTPStatus,
+		GatewayResponse: "fake " + f.OTPStatus,
+		DisplayText:     fakeDisplayText(f.OTPStatus),
+	}, nil
+}
+
+// fakeDisplayText mirrors the instructions Paystack returns for each status
+func fakeDisplayText(status string) string {
+	switch status {
+	case ChargeSendOTP:
+		return "Please enter the OTP sent to your phone"
+	case ChargePayOffline:
+		return "Please complete authorization process on your mobile phone"
+	}
+	return ""
+}
+
+// CreateTransferRecipient records the request and returns a dummy recipient code
+func (f *FakeProvider) CreateTransferRecipient(req TransferRecipientRequest) (*TransferRecipient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Recipients = append(f.Recipients, req)
+	return &TransferRecipient{
+		RecipientCode: fmt.Sprintf("RCP_fake_%d", len(f.Recipients)),
+	}, nil
+}
+
+// Transfer records the request and returns TransferStatus
+func (f *FakeProvider) Transfer(req TransferRequest) (*TransferResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Transfers = append(f.Transfers, req)
+	if f.TransferErr != nil {
+		return nil, f.TransferErr
+	}
+	result := TransferResult{
+		Reference:    req.Reference,
+		TransferCode: "TRF_fake_" + req.Reference,
+		Status:       f.TransferStatus,
+	}
+	f.VerifiedTransfers[req.Reference] = result
+	return &result, nil
+}
+
+// VerifyTransfer returns the outcome recorded in VerifiedTransfers for reference
+func (f *FakeProvider) VerifyTransfer(reference string) (*TransferResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.VerifyTransferErr != nil {
+		return nil, f.VerifyTransferErr
+	}
+	result, ok := f.VerifiedTransfers[reference]
+	if !ok {
+		return nil, fmt.Errorf("%w: transfer not found", ErrTransferFailed)
+	}
+	return &result, nil
+}
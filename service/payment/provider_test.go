@@ -0,0 +1,205 @@
+package payment
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// paystackReplying returns a Paystack provider whose requests are all
+// answered with code and body
+func paystackReplying(t *testing.T, code int, body string) *PaystackProvider {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk_test" {
+			t.Errorf("request sent without the secret key")
+		}
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	p := NewPaystackProvider("sk_test")
+	p.baseURL = server.URL
+	return p
+}
+
+func TestPaystackChargeAuthorization(t *testing.T) {
+	tests := []struct {
+		name         string
+		code         int
+		body         string
+		wantStatus   string // Charge status returned, if any
+		wantDeclined bool
+		wantAPIError int // Status of the APIError returned, if any
+	}{
+		{name: "charged", code: 200, body: `{"status":true,"data":{"status":"success","amount":10000}}`, wantStatus: ChargeSuccess},
+		{name: "declined", code: 200, body: `{"status":true,"data":{"status":"failed","gateway_response":"Insufficient Funds"}}`, wantStatus: ChargeFailed, wantDeclined: true},
+		{name: "declined with an error reply", code: 400, body: `{"status":false,"message":"Declined","data":{"status":"failed"}}`, wantStatus: ChargeFailed, wantDeclined: true},
+		{name: "abandoned", code: 200, body: `{"status":true,"data":{"status":"abandoned"}}`, wantStatus: "abandoned", wantDeclined: true},
+		{name: "still processing", code: 200, body: `{"status":true,"data":{"status":"pending"}}`, wantStatus: ChargePending},
+		{name: "request rejected", code: 400, body: `{"status":false,"message":"Invalid authorization code"}`, wantAPIError: 400},
+		{name: "bad credentials", code: 401, body: `{"status":false,"message":"Invalid key"}`, wantAPIError: 401},
+		{name: "rate limited", code: 429, body: `{"status":false,"message":"Too many requests"}`, wantAPIError: 429},
+		{name: "outage", code: 502, body: `<html>Bad gateway</html>`, wantAPIError: 502},
+		{name: "no charge status", code: 200, body: `{"status":false,"message":"Something went wrong"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := paystackReplying(t, tt.code, tt.body)
+			result, err := p.ChargeAuthorization(ChargeAuthorizationRequest{Email: "trader@example.com", Amount: 10000, Currency: "GHS", Reference: "SIG-1", AuthorizationCode: "AUTH_1"})
+
+			// Nothing but an explicit charge status may be taken as a decline
+			if errors.Is(err, ErrChargeFailed) {
+				t.Fatalf("error reported as a decline: %v", err)
+			}
+			if tt.wantStatus == "" {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", result)
+				}
+				var apiErr *APIError
+				if got := errors.As(err, &apiErr); got != (tt.wantAPIError != 0) || got && apiErr.StatusCode != tt.wantAPIError {
+					t.Errorf("error = %v, want an APIError with status %d", err, tt.wantAPIError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ChargeAuthorization: %v", err)
+			}
+			if result.Status != tt.wantStatus || result.Declined() != tt.wantDeclined {
+				t.Errorf("charge is %s (declined %v), want %s (declined %v)", result.Status, result.Declined(), tt.wantStatus, tt.wantDeclined)
+			}
+		})
+	}
+}
+
+func TestPaystackVerifyTransaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		code         int
+		body         string
+		wantStatus   string // Charge status returned, if any
+		wantNotFound bool   // Reported as ErrChargeFailed: never charged
+	}{
+		{name: "charged", code: 200, body: `{"status":true,"data":{"status":"success","amount":10000,"currency":"GHS"}}`, wantStatus: ChargeSuccess},
+		{name: "declined", code: 200, body: `{"status":true,"data":{"status":"failed"}}`, wantStatus: ChargeFailed},
+		{name: "unknown reference", code: 400, body: `{"status":false,"message":"Transaction reference not found"}`, wantNotFound: true},
+		{name: "unknown reference by code", code: 400, body: `{"status":false,"message":"No record","code":"transaction_not_found"}`, wantNotFound: true},
+		{name: "not found", code: 404, body: `{"status":false,"message":"Not found"}`, wantNotFound: true},
+		{name: "other validation error", code: 400, body: `{"status":false,"message":"Merchant not found","code":"invalid_params"}`},
+		{name: "bad credentials", code: 401, body: `{"status":false,"message":"Invalid key"}`},
+		{name: "rate limited", code: 429, body: `{"status":false,"message":"Too many requests"}`},
+		{name: "server error", code: 500, body: `{"status":false,"message":"Server error"}`},
+		{name: "no charge status", code: 200, body: `{"status":true,"data":{}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := paystackReplying(t, tt.code, tt.body)
+			result, err := p.VerifyTransaction("SIG-1")
+
+			if got := errors.Is(err, ErrChargeFailed); got != tt.wantNotFound {
+				t.Fatalf("VerifyTransaction error = %v, want never charged %v", err, tt.wantNotFound)
+			}
+			if tt.wantStatus == "" {
+				if err == nil {
+					t.Errorf("got %+v, want an error", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyTransaction: %v", err)
+			}
+			if result.Status != tt.wantStatus {
+				t.Errorf("charge is %s, want %s", result.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPaystackTransfer(t *testing.T) {
+	tests := []struct {
+		name         string
+		code         int
+		body         string
+		wantStatus   string // Transfer status returned, if any
+		wantRejected bool   // Reported as ErrTransferFailed: nothing was sent
+	}{
+		{name: "sent", code: 200, body: `{"status":true,"data":{"reference":"PO-1","transfer_code":"TRF_1","status":"success"}}`, wantStatus: "success"},
+		{name: "queued", code: 200, body: `{"status":true,"data":{"reference":"PO-1","transfer_code":"TRF_1","status":"pending"}}`, wantStatus: "pending"},
+		{name: "short balance", code: 400, body: `{"status":false,"message":"Your balance is not enough to fulfil this request"}`, wantRejected: true},
+		{name: "bad credentials", code: 401, body: `{"status":false,"message":"Invalid key"}`},
+		{name: "rate limited", code: 429, body: `{"status":false,"message":"Too many requests"}`},
+		{name: "outage", code: 503, body: `<html>Service unavailable</html>`},
+		{name: "no transfer status", code: 200, body: `{"status":true,"data":{}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := paystackReplying(t, tt.code, tt.body)
+			result, err := p.Transfer(TransferRequest{Amount: 4000, Currency: "GHS", RecipientCode: "RCP_1", Reference: "PO-1"})
+
+			if got := errors.Is(err, ErrTransferFailed); got != tt.wantRejected {
+				t.Fatalf("Transfer error = %v, want rejected %v", err, tt.wantRejected)
+			}
+			if tt.wantStatus == "" {
+				if err == nil {
+					t.Errorf("got %+v, want an error", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Transfer: %v", err)
+			}
+			if result.Status != tt.wantStatus || result.TransferCode != "TRF_1" {
+				t.Errorf("transfer = %+v, want %s", result, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPaystackVerifyTransfer(t *testing.T) {
+	tests := []struct {
+		name         string
+		code         int
+		body         string
+		wantStatus   string // Transfer status returned, if any
+		wantNotFound bool   // Reported as ErrTransferFailed: never sent
+	}{
+		{name: "sent", code: 200, body: `{"status":true,"data":{"reference":"PO-1","status":"success"}}`, wantStatus: "success"},
+		{name: "reversed", code: 200, body: `{"status":true,"data":{"reference":"PO-1","status":"reversed"}}`, wantStatus: "reversed"},
+		{name: "unknown reference", code: 400, body: `{"status":false,"message":"Transfer not found"}`, wantNotFound: true},
+		{name: "unknown reference by code", code: 400, body: `{"status":false,"message":"No record","code":"transfer_not_found"}`, wantNotFound: true},
+		{name: "not found", code: 404, body: `{"status":false,"message":"Not found"}`, wantNotFound: true},
+		{name: "bad credentials", code: 401, body: `{"status":false,"message":"Invalid key"}`},
+		{name: "rate limited", code: 429, body: `{"status":false,"message":"Too many requests"}`},
+		{name: "server error", code: 500, body: `{"status":false,"message":"Server error"}`},
+		{name: "error in a success reply", code: 200, body: `{"status":false,"message":"Something went wrong"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := paystackReplying(t, tt.code, tt.body)
+			result, err := p.VerifyTransfer("PO-1")
+
+			if got := errors.Is(err, ErrTransferFailed); got != tt.wantNotFound {
+				t.Fatalf("VerifyTransfer error = %v, want never sent %v", err, tt.wantNotFound)
+			}
+			if tt.wantStatus == "" {
+				if err == nil {
+					t.Errorf("got %+v, want an error", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyTransfer: %v", err)
+			}
+			if result.Status != tt.wantStatus {
+				t.Errorf("transfer is %s, want %s", result.Status, tt.wantStatus)
+			}
+		})
+	}
+}
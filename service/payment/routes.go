@@ -0,0 +1,122 @@
+package payment
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Response is a standardized API response structure
+type Response struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// PaymentHandler handles the customer steps of direct charges that happen
+// after initialization, such as submitting a mobile money OTP
+type PaymentHandler struct {
+	db       *gorm.DB
+	provider Provider
+}
+
+// NewPaymentHandler creates a new payment handler
+func NewPaymentHandler(db *gorm.DB) *PaymentHandler {
+	return &PaymentHandler{db: db, provider: NewProvider()}
+}
+
+// RegisterRoutes registers all payment routes
+func (h *PaymentHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/payments/{reference}/otp", utils.AuthMiddleware(h.SubmitOTP)).Methods("POST")
+}
+
+// SubmitOTP passes the OTP the customer received to the provider for a
+// mobile money charge still awaiting payment. Only the customer who started
+// the payment may submit its OTP.
+func (h *PaymentHandler) SubmitOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	reference := mux.Vars(r)["reference"]
+
+	var request struct {
+		OTP string `json:"otp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	request.OTP = strings.TrimSpace(request.OTP)
+	if request.OTP == "" {
+		h.respondWithError(w, http.StatusBadRequest, "OTP is required")
+		return
+	}
+
+	pending, err := h.isAwaitingPayment(userID, reference)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to look up payment")
+		return
+	}
+	if !pending {
+		h.respondWithError(w, http.StatusNotFound, "No payment awaiting an OTP for this reference")
+		return
+	}
+
+	result, err := h.provider.SubmitOTP(reference, request.OTP)
+	if err != nil {
+		log.Printf("Error submitting OTP for %s: %v", reference, err)
+		h.respondWithError(w, http.StatusBadGateway, "Failed to submit OTP")
+		return
+	}
+	if result.Status == ChargeFailed {
+		h.respondWithError(w, http.StatusPaymentRequired, "Payment was declined: "+result.GatewayResponse)
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: result})
+}
+
+// isAwaitingPayment reports whether reference belongs to one of the user's
+// appointments, subscriptions or package purchases whose payment has not yet
+// been confirmed
+func (h *PaymentHandler) isAwaitingPayment(userID uint, reference string) (bool, error) {
+	var count int64
+	switch {
+	case strings.HasPrefix(reference, "APT-"):
+		err := h.db.Model(&models.Appointment{}).
+			Where("payment_id = ? AND trader_id = ? AND payment_status = ?", reference, userID, "pending").
+			Count(&count).Error
+		return count > 0, err
+	case strings.HasPrefix(reference, "SIG-"):
+		err := h.db.Model(&models.SignalSubscription{}).
+			Where("payment_id = ? AND user_id = ? AND status = ?", reference, userID, "pending").
+			Count(&count).Error
+		return count > 0, err
+	case strings.HasPrefix(reference, "PKG-"):
+		err := h.db.Model(&models.PackagePurchase{}).
+			Where("payment_id = ? AND trader_id = ? AND status = ?", reference, userID, "pending").
+			Count(&count).Error
+		return count > 0, err
+	}
+	return false, nil
+}
+
+// Helper function to respond with an error
+func (h *PaymentHandler) respondWithError(w http.ResponseWriter, code int, message string) {
+	h.respondWithJSON(w, code, Response{Error: message})
+}
+
+// Helper function to respond with JSON
+func (h *PaymentHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
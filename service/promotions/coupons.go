@@ -0,0 +1,312 @@
+package promotions
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// couponReservationTTL is how long an unpaid checkout holds a coupon use
+const couponReservationTTL = time.Hour
+
+const (
+	// ProductAppointment identifies appointment payments
+	ProductAppointment = "appointment"
+	// ProductSignalSubscription identifies signal subscription payments
+	ProductSignalSubscription = "signal_subscription"
+)
+
+var (
+	ErrCouponNotFound      = errors.New("coupon not found")
+	ErrCouponInactive      = errors.New("coupon is not active")
+	ErrCouponExpired       = errors.New("coupon has expired")
+	ErrCouponExhausted     = errors.New("coupon usage limit reached")
+	ErrCouponUserLimit     = errors.New("coupon already used the maximum number of times")
+	ErrCouponNotApplicable = errors.New("coupon does not apply to this purchase")
+	ErrCouponMinAmount     = errors.New("order amount is below the coupon minimum")
+)
+
+// IsCouponError reports whether err is a coupon validation failure that
+// should be shown to the user rather than treated as a server error
+func IsCouponError(err error) bool {
+	for _, target := range []error{ErrCouponNotFound, ErrCouponInactive, ErrCouponExpired,
+		ErrCouponExhausted, ErrCouponUserLimit, ErrCouponNotApplicable, ErrCouponMinAmount} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Purchase describes what a coupon is being applied to
+type Purchase struct {
+	UserID   uint
+	Product  string // ProductAppointment or ProductSignalSubscription
+	PlanCode string // Subscription plan, for signal subscriptions
+	ExpertID uint   // Expert being booked, for appointments
+	Amount   int64  // Minor units
+	Currency string
+}
+
+// Discount is the result of applying a coupon to a purchase
+type Discount struct {
+	CouponID       uint   `json:"coupon_id"`
+	Code           string `json:"code"`
+	Currency       string `json:"currency"`
+	OriginalAmount int64  `json:"original_amount_minor"`
+	DiscountAmount int64  `json:"discount_amount_minor"`
+	FinalAmount    int64  `json:"final_amount_minor"`
+}
+
+// NormalizeCode canonicalises a coupon code as entered by a user
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// PreviewCoupon checks a coupon against a purchase without reserving it
+func PreviewCoupon(db *gorm.DB, code string, purchase Purchase, now time.Time) (*Discount, error) {
+	var coupon models.Coupon
+	if err := db.Where("code = ?", NormalizeCode(code)).First(&coupon).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCouponNotFound
+		}
+		return nil, err
+	}
+
+	if err := validateCoupon(db, &coupon, purchase, now); err != nil {
+		return nil, err
+	}
+	return applyCoupon(&coupon, purchase), nil
+}
+
+// ReserveCoupon validates a coupon and reserves one use of it for reference.
+// The coupon row is locked so concurrent checkouts cannot exceed its limits.
+func ReserveCoupon(tx *gorm.DB, code string, purchase Purchase, reference string, now time.Time) (*Discount, error) {
+	var coupon models.Coupon
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("code = ?", NormalizeCode(code)).
+		First(&coupon).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCouponNotFound
+		}
+		return nil, err
+	}
+
+	if err := validateCoupon(tx, &coupon, purchase, now); err != nil {
+		return nil, err
+	}
+
+	discount := applyCoupon(&coupon, purchase)
+	redemption := models.CouponRedemption{
+		CouponID:       coupon.ID,
+		UserID:         purchase.UserID,
+		Reference:      reference,
+		OriginalAmount: discount.OriginalAmount,
+		DiscountAmount: discount.DiscountAmount,
+		Currency:       discount.Currency,
+		Status:         "pending",
+	}
+	if err := tx.Create(&redemption).Error; err != nil {
+		return nil, err
+	}
+
+	return discount, nil
+}
+
+// ReleaseReservation frees the coupon use reserved for reference when its
+// payment was declined, so it no longer counts against the coupon's limits
+func ReleaseReservation(tx *gorm.DB, reference string) error {
+	return tx.Model(&models.CouponRedemption{}).
+		Where("reference = ? AND status = ?", reference, "pending").
+		Update("status", "released").Error
+}
+
+// SettlePayment finalises the promotions attached to a successful payment of
+// paid, in minor units: the coupon reserved for reference is marked redeemed
+// and, on a referred user's first paid purchase, their referrer is rewarded.
+// It returns the redemption, or nil when no coupon was used.
+//
+// A reservation that ran out before the payment arrived no longer holds a
+// use, so the coupon's limits are checked again. The discount was already
+// given at checkout and stays on the redemption, but a use beyond the limits
+// is marked over_limit instead of redeemed and doesn't count as one.
+func SettlePayment(tx *gorm.DB, userID uint, reference string, paid int64, now time.Time) (*models.CouponRedemption, error) {
+	var redemption *models.CouponRedemption
+
+	var found models.CouponRedemption
+	err := tx.Preload("Coupon").Where("reference = ?", reference).First(&found).Error
+	if err == nil {
+		if found.Status == "pending" {
+			status := "redeemed"
+			if !found.CreatedAt.After(now.Add(-couponReservationTTL)) {
+				within, err := withinLimits(tx, &found, now)
+				if err != nil {
+					return nil, err
+				}
+				if !within {
+					status = "over_limit"
+				}
+			}
+			if err := tx.Model(&found).Update("status", status).Error; err != nil {
+				return nil, err
+			}
+		}
+		redemption = &found
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	// Free purchases don't earn the referrer anything
+	if paid > 0 {
+		if err := grantReferralReward(tx, userID, reference); err != nil {
+			return nil, err
+		}
+	}
+
+	return redemption, nil
+}
+
+// withinLimits reports whether redeeming the expired reservation redemption
+// keeps its coupon within its usage limits. The coupon row is locked so
+// concurrent checkouts see the result.
+func withinLimits(tx *gorm.DB, redemption *models.CouponRedemption, now time.Time) (bool, error) {
+	var coupon models.Coupon
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&coupon, redemption.CouponID).Error; err != nil {
+		return false, err
+	}
+
+	if coupon.MaxUses > 0 {
+		uses, err := countUses(tx, now, "coupon_id = ? AND id <> ?", coupon.ID, redemption.ID)
+		if err != nil {
+			return false, err
+		}
+		if uses >= int64(coupon.MaxUses) {
+			return false, nil
+		}
+	}
+
+	if coupon.PerUserLimit > 0 {
+		uses, err := countUses(tx, now, "coupon_id = ? AND user_id = ? AND id <> ?", coupon.ID, redemption.UserID, redemption.ID)
+		if err != nil {
+			return false, err
+		}
+		if uses >= int64(coupon.PerUserLimit) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// validateCoupon checks every restriction on coupon for purchase
+func validateCoupon(db *gorm.DB, coupon *models.Coupon, purchase Purchase, now time.Time) error {
+	if !coupon.Active {
+		return ErrCouponInactive
+	}
+	if coupon.ExpiresAt != nil && now.After(*coupon.ExpiresAt) {
+		return ErrCouponExpired
+	}
+	if coupon.OwnerID != nil && *coupon.OwnerID != purchase.UserID {
+		return ErrCouponNotApplicable
+	}
+	if !appliesToProduct(coupon, purchase) || !appliesToExpert(coupon, purchase) {
+		return ErrCouponNotApplicable
+	}
+	// Amounts on the coupon are only meaningful in its own currency
+	if coupon.Currency != "" && coupon.Currency != purchase.Currency {
+		return ErrCouponNotApplicable
+	}
+	if purchase.Amount < coupon.MinAmount {
+		return ErrCouponMinAmount
+	}
+
+	if coupon.MaxUses > 0 {
+		uses, err := countUses(db, now, "coupon_id = ?", coupon.ID)
+		if err != nil {
+			return err
+		}
+		if uses >= int64(coupon.MaxUses) {
+			return ErrCouponExhausted
+		}
+	}
+
+	if coupon.PerUserLimit > 0 {
+		uses, err := countUses(db, now, "coupon_id = ? AND user_id = ?", coupon.ID, purchase.UserID)
+		if err != nil {
+			return err
+		}
+		if uses >= int64(coupon.PerUserLimit) {
+			return ErrCouponUserLimit
+		}
+	}
+
+	return nil
+}
+
+// countUses counts redeemed uses plus reservations from checkouts still in progress
+func countUses(db *gorm.DB, now time.Time, query string, args ...interface{}) (int64, error) {
+	var count int64
+	err := db.Model(&models.CouponRedemption{}).
+		Where(query, args...).
+		Where("status = ? OR (status = ? AND created_at > ?)", "redeemed", "pending", now.Add(-couponReservationTTL)).
+		Count(&count).Error
+	return count, err
+}
+
+func appliesToProduct(coupon *models.Coupon, purchase Purchase) bool {
+	if len(coupon.Products) == 0 {
+		return true
+	}
+	for _, product := range coupon.Products {
+		if product == purchase.Product || (purchase.PlanCode != "" && product == purchase.PlanCode) {
+			return true
+		}
+	}
+	return false
+}
+
+func appliesToExpert(coupon *models.Coupon, purchase Purchase) bool {
+	if len(coupon.ExpertIDs) == 0 {
+		return true
+	}
+	if purchase.Product != ProductAppointment {
+		return false
+	}
+	for _, expertID := range coupon.ExpertIDs {
+		if uint(expertID) == purchase.ExpertID {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCoupon computes the discount coupon gives on the purchase. The discount
+// never exceeds the amount itself.
+func applyCoupon(coupon *models.Coupon, purchase Purchase) *Discount {
+	var off int64
+	switch coupon.DiscountType {
+	case "percentage":
+		off = utils.ScaleMinor(purchase.Amount, coupon.Value/100)
+		if coupon.MaxDiscount > 0 && off > coupon.MaxDiscount {
+			off = coupon.MaxDiscount
+		}
+	case "fixed":
+		off = coupon.AmountOff
+	}
+
+	if off > purchase.Amount {
+		off = purchase.Amount
+	}
+	return &Discount{
+		CouponID:       coupon.ID,
+		Code:           coupon.Code,
+		Currency:       purchase.Currency,
+		OriginalAmount: purchase.Amount,
+		DiscountAmount: off,
+		FinalAmount:    purchase.Amount - off,
+	}
+}
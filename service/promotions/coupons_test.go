@@ -0,0 +1,389 @@
+package promotions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/wallet/wallettest"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+func TestNormalizeCode(t *testing.T) {
+	tests := []struct{ code, want string }{
+		{"SAVE10", "SAVE10"},
+		{" save10 ", "SAVE10"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeCode(tt.code); got != tt.want {
+			t.Errorf("NormalizeCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestIsCouponError(t *testing.T) {
+	if !IsCouponError(fmt.Errorf("checkout: %w", ErrCouponExhausted)) {
+		t.Error("wrapped coupon error not recognised")
+	}
+	if IsCouponError(errors.New("connection refused")) || IsCouponError(nil) {
+		t.Error("other errors reported as coupon errors")
+	}
+}
+
+func TestApplyCoupon(t *testing.T) {
+	tests := []struct {
+		name   string
+		coupon models.Coupon
+		amount int64
+		want   int64 // Discount
+	}{
+		{name: "percentage", coupon: models.Coupon{DiscountType: "percentage", Value: 10}, amount: 10000, want: 1000},
+		{name: "percentage rounds to the minor unit", coupon: models.Coupon{DiscountType: "percentage", Value: 15}, amount: 3333, want: 500},
+		{name: "percentage capped", coupon: models.Coupon{DiscountType: "percentage", Value: 50, MaxDiscount: 2000}, amount: 10000, want: 2000},
+		{name: "percentage under the cap", coupon: models.Coupon{DiscountType: "percentage", Value: 10, MaxDiscount: 2000}, amount: 10000, want: 1000},
+		{name: "fixed", coupon: models.Coupon{DiscountType: "fixed", AmountOff: 1500}, amount: 10000, want: 1500},
+		{name: "fixed above the amount", coupon: models.Coupon{DiscountType: "fixed", AmountOff: 15000}, amount: 10000, want: 10000},
+		{name: "hundred percent", coupon: models.Coupon{DiscountType: "percentage", Value: 100}, amount: 10000, want: 10000},
+		{name: "unknown type", coupon: models.Coupon{DiscountType: "bogus", Value: 10}, amount: 10000, want: 0},
+	}
+	for _, tt := range tests {
+		discount := applyCoupon(&tt.coupon, Purchase{Amount: tt.amount, Currency: "GHS"})
+		if discount.DiscountAmount != tt.want || discount.FinalAmount != tt.amount-tt.want || discount.OriginalAmount != tt.amount {
+			t.Errorf("%s: discount %d, final %d; want %d off %d", tt.name, discount.DiscountAmount, discount.FinalAmount, tt.want, tt.amount)
+		}
+	}
+}
+
+func TestValidateCoupon(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	owner := uint(7)
+	booking := Purchase{UserID: 1, Product: ProductAppointment, ExpertID: 3, Amount: 10000, Currency: "GHS"}
+	signals := Purchase{UserID: 1, Product: ProductSignalSubscription, PlanCode: "quarterly", Amount: 25000, Currency: "GHS"}
+
+	// No usage limits are set, so the database is never consulted
+	tests := []struct {
+		name     string
+		coupon   models.Coupon
+		purchase Purchase
+		wantErr  error
+	}{
+		{name: "valid", coupon: models.Coupon{Active: true}, purchase: booking},
+		{name: "inactive", coupon: models.Coupon{}, purchase: booking, wantErr: ErrCouponInactive},
+		{name: "expired", coupon: models.Coupon{Active: true, ExpiresAt: &past}, purchase: booking, wantErr: ErrCouponExpired},
+		{name: "not yet expired", coupon: models.Coupon{Active: true, ExpiresAt: &future}, purchase: booking},
+		{name: "owned by someone else", coupon: models.Coupon{Active: true, OwnerID: &owner}, purchase: booking, wantErr: ErrCouponNotApplicable},
+		{name: "other product", coupon: models.Coupon{Active: true, Products: pq.StringArray{ProductSignalSubscription}}, purchase: booking, wantErr: ErrCouponNotApplicable},
+		{name: "plan code", coupon: models.Coupon{Active: true, Products: pq.StringArray{"quarterly"}}, purchase: signals},
+		{name: "other plan code", coupon: models.Coupon{Active: true, Products: pq.StringArray{"annual"}}, purchase: signals, wantErr: ErrCouponNotApplicable},
+		{name: "expert", coupon: models.Coupon{Active: true, ExpertIDs: pq.Int64Array{2, 3}}, purchase: booking},
+		{name: "other expert", coupon: models.Coupon{Active: true, ExpertIDs: pq.Int64Array{2}}, purchase: booking, wantErr: ErrCouponNotApplicable},
+		{name: "expert coupon on signals", coupon: models.Coupon{Active: true, ExpertIDs: pq.Int64Array{3}}, purchase: signals, wantErr: ErrCouponNotApplicable},
+		{name: "other currency", coupon: models.Coupon{Active: true, Currency: "NGN"}, purchase: booking, wantErr: ErrCouponNotApplicable},
+		{name: "below the minimum", coupon: models.Coupon{Active: true, MinAmount: 20000}, purchase: booking, wantErr: ErrCouponMinAmount},
+		{name: "at the minimum", coupon: models.Coupon{Active: true, MinAmount: 10000}, purchase: booking},
+	}
+	for _, tt := range tests {
+		if err := validateCoupon(nil, &tt.coupon, tt.purchase, now); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: validateCoupon = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// coupon creates an active 10% coupon with the given code and usage limits
+func coupon(t *testing.T, db *gorm.DB, code string, maxUses, perUser int) *models.Coupon {
+	t.Helper()
+
+	c := models.Coupon{Code: code, DiscountType: "percentage", Value: 10, MaxUses: maxUses, PerUserLimit: perUser, Active: true}
+	if err := db.Create(&c).Error; err != nil {
+		t.Fatalf("creating coupon %s: %v", code, err)
+	}
+	return &c
+}
+
+// reserve reserves code for userID's appointment payment reference
+func reserve(db *gorm.DB, code string, userID uint, reference string, now time.Time) (*Discount, error) {
+	var discount *Discount
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		discount, err = ReserveCoupon(tx, code, Purchase{UserID: userID, Product: ProductAppointment, Amount: 10000, Currency: "GHS"}, reference, now)
+		return err
+	})
+	return discount, err
+}
+
+func TestReserveCoupon(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		maxUses  int
+		perUser  int
+		earlier  string        // Status of an earlier redemption, if any
+		age      time.Duration // of the earlier redemption
+		sameUser bool          // The earlier redemption was by the same user
+		code     string
+		wantErr  error
+	}{
+		{name: "unused", maxUses: 1, code: "SAVE10"},
+		{name: "code in another case", maxUses: 1, code: " save10 "},
+		{name: "unknown code", code: "NOPE", wantErr: ErrCouponNotFound},
+		{name: "redeemed up to the limit", maxUses: 1, earlier: "redeemed", code: "SAVE10", wantErr: ErrCouponExhausted},
+		{name: "reserved by a checkout in progress", maxUses: 1, earlier: "pending", code: "SAVE10", wantErr: ErrCouponExhausted},
+		{name: "reservation ran out", maxUses: 1, earlier: "pending", age: 2 * couponReservationTTL, code: "SAVE10"},
+		{name: "reservation released", maxUses: 1, earlier: "released", code: "SAVE10"},
+		{name: "over the limit does not count", maxUses: 1, earlier: "over_limit", code: "SAVE10"},
+		{name: "per user limit", perUser: 1, earlier: "redeemed", sameUser: true, code: "SAVE10", wantErr: ErrCouponUserLimit},
+		{name: "per user limit, other user", perUser: 1, earlier: "redeemed", code: "SAVE10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "promotions")
+			c := coupon(t, db, "SAVE10", tt.maxUses, tt.perUser)
+			user := testdb.User(t, db, "Coupon User")
+			if tt.earlier != "" {
+				earlierUser := user.ID
+				if !tt.sameUser {
+					earlierUser = testdb.User(t, db, "Earlier User").ID
+				}
+				if err := db.Create(&models.CouponRedemption{CouponID: c.ID, UserID: earlierUser, Reference: "APT-earlier",
+					Status: tt.earlier, Model: gorm.Model{CreatedAt: now.Add(-tt.age)}}).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			discount, err := reserve(db, tt.code, user.ID, "APT-1", now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReserveCoupon error = %v, want %v", err, tt.wantErr)
+			}
+
+			var reserved int64
+			db.Model(&models.CouponRedemption{}).Where("reference = ? AND status = ?", "APT-1", "pending").Count(&reserved)
+			if tt.wantErr != nil {
+				if reserved != 0 {
+					t.Error("rejected coupon was reserved")
+				}
+				return
+			}
+			if reserved != 1 || discount.DiscountAmount != 1000 || discount.FinalAmount != 9000 {
+				t.Errorf("reserved %d, discount %+v", reserved, discount)
+			}
+		})
+	}
+}
+
+func TestReserveCouponRace(t *testing.T) {
+	db := testdb.Open(t, "promotions")
+	coupon(t, db, "LIMITED", 3, 0)
+	now := time.Now()
+
+	traders := make([]uint, 8)
+	for i := range traders {
+		traders[i] = testdb.User(t, db, fmt.Sprintf("Trader %d", i)).ID
+	}
+	errs := testdb.Race(len(traders), func(i int) error {
+		_, err := reserve(db, "LIMITED", traders[i], fmt.Sprintf("APT-%d", i), now)
+		return err
+	})
+
+	var ok int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case !errors.Is(err, ErrCouponExhausted):
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if ok != 3 {
+		t.Errorf("%d checkouts reserved the coupon, want 3", ok)
+	}
+}
+
+func TestReleaseReservation(t *testing.T) {
+	db := testdb.Open(t, "promotions")
+	coupon(t, db, "ONCE", 1, 0)
+	now := time.Now()
+	first := testdb.User(t, db, "Declined Trader")
+	second := testdb.User(t, db, "Next Trader")
+
+	if _, err := reserve(db, "ONCE", first.ID, "APT-1", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserve(db, "ONCE", second.ID, "APT-2", now); !errors.Is(err, ErrCouponExhausted) {
+		t.Fatalf("second reservation error = %v, want %v", err, ErrCouponExhausted)
+	}
+
+	// The first payment is declined, freeing the use
+	if err := ReleaseReservation(db, "APT-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserve(db, "ONCE", second.ID, "APT-2", now); err != nil {
+		t.Errorf("reservation after release: %v", err)
+	}
+
+	// Releasing again does not touch a redemption that was settled
+	db.Model(&models.CouponRedemption{}).Where("reference = ?", "APT-2").Update("status", "redeemed")
+	if err := ReleaseReservation(db, "APT-2"); err != nil {
+		t.Fatal(err)
+	}
+	var settled models.CouponRedemption
+	db.Where("reference = ?", "APT-2").First(&settled)
+	if settled.Status != "redeemed" {
+		t.Errorf("settled redemption is %s after release", settled.Status)
+	}
+}
+
+func TestSettlePayment(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		reserved   bool          // A coupon was reserved for the payment
+		age        time.Duration // of the reservation
+		usedUp     bool          // Others redeemed the coupon once the reservation ran out
+		wantStatus string
+	}{
+		{name: "reservation held", reserved: true, wantStatus: "redeemed"},
+		{name: "reservation ran out, uses left", reserved: true, age: 2 * couponReservationTTL, wantStatus: "redeemed"},
+		{name: "reservation ran out, used up", reserved: true, age: 2 * couponReservationTTL, usedUp: true, wantStatus: "over_limit"},
+		{name: "no coupon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "promotions")
+			c := coupon(t, db, "ONCE", 1, 0)
+			user := testdb.User(t, db, "Paying Trader")
+			if tt.reserved {
+				if err := db.Create(&models.CouponRedemption{CouponID: c.ID, UserID: user.ID, Reference: "APT-1", DiscountAmount: 1000,
+					Status: "pending", Model: gorm.Model{CreatedAt: now.Add(-tt.age)}}).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.usedUp {
+				other := testdb.User(t, db, "Other Trader")
+				if _, err := reserve(db, "ONCE", other.ID, "APT-2", now); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var redemption *models.CouponRedemption
+			err := db.Transaction(func(tx *gorm.DB) error {
+				var err error
+				redemption, err = SettlePayment(tx, user.ID, "APT-1", 9000, now)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("SettlePayment: %v", err)
+			}
+
+			if tt.wantStatus == "" {
+				if redemption != nil {
+					t.Errorf("redemption = %+v, want none", redemption)
+				}
+				return
+			}
+			var stored models.CouponRedemption
+			db.Where("reference = ?", "APT-1").First(&stored)
+			if redemption == nil || stored.Status != tt.wantStatus || stored.DiscountAmount != 1000 {
+				t.Errorf("redemption is %s with %d off, want %s with the discount kept", stored.Status, stored.DiscountAmount, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestGenerateCode(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		code, err := GenerateCode(8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != 8 {
+			t.Fatalf("code %q is not 8 characters", code)
+		}
+		for _, r := range code {
+			if !strings.ContainsRune(codeAlphabet, r) {
+				t.Fatalf("code %q uses %q, outside the alphabet", code, r)
+			}
+		}
+		seen[code] = true
+	}
+	if len(seen) < 45 {
+		t.Errorf("only %d distinct codes in 50", len(seen))
+	}
+}
+
+func TestReferralCodeFor(t *testing.T) {
+	db := testdb.Open(t, "promotions")
+	user := testdb.User(t, db, "Referrer")
+
+	code, err := ReferralCodeFor(db, user.ID)
+	if err != nil || len(code) != 8 {
+		t.Fatalf("ReferralCodeFor = %q, %v", code, err)
+	}
+	again, err := ReferralCodeFor(db, user.ID)
+	if err != nil || again != code {
+		t.Errorf("second call = %q, %v; want %q kept", again, err, code)
+	}
+}
+
+func TestReferralReward(t *testing.T) {
+	t.Setenv("REFERRAL_REWARD_AMOUNT", "")
+	t.Setenv("DEFAULT_CURRENCY", "")
+
+	tests := []struct {
+		name        string
+		selfRefer   bool
+		notReferred bool
+		payments    []int64 // Paid, in order
+		wantReward  int64
+	}{
+		{name: "first paid purchase", payments: []int64{9000}, wantReward: 2000},
+		{name: "rewarded once", payments: []int64{9000, 5000}, wantReward: 2000},
+		{name: "free purchase earns nothing", payments: []int64{0}},
+		{name: "free then paid", payments: []int64{0, 9000}, wantReward: 2000},
+		{name: "referred themselves", selfRefer: true, payments: []int64{9000}},
+		{name: "not referred", notReferred: true, payments: []int64{9000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "promotions")
+			referrer := testdb.User(t, db, "Referrer")
+			referee := testdb.User(t, db, "Referee")
+			switch {
+			case tt.selfRefer:
+				db.Model(referee).Update("referred_by_id", referee.ID)
+			case !tt.notReferred:
+				db.Model(referee).Update("referred_by_id", referrer.ID)
+			}
+
+			for i, paid := range tt.payments {
+				err := db.Transaction(func(tx *gorm.DB) error {
+					_, err := SettlePayment(tx, referee.ID, fmt.Sprintf("APT-%d", i), paid, time.Now())
+					return err
+				})
+				if err != nil {
+					t.Fatalf("SettlePayment: %v", err)
+				}
+			}
+
+			if got := wallettest.Balance(t, db, referrer.ID); got != tt.wantReward {
+				t.Errorf("referrer wallet = %d, want %d", got, tt.wantReward)
+			}
+			if got := wallettest.Balance(t, db, referee.ID); got != 0 {
+				t.Errorf("referee wallet = %d, want nothing", got)
+			}
+		})
+	}
+}
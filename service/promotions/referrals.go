@@ -0,0 +1,122 @@
+package promotions
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultReferralReward is the credit, in major units, granted when
+// REFERRAL_REWARD_AMOUNT is unset
+const defaultReferralReward = 20.0
+
+// codeAlphabet leaves out characters that are easily confused when typed
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// referralRewardAmount returns the credit a referrer earns per referred
+// purchase, in minor units of the default currency
+func referralRewardAmount(currency string) int64 {
+	if value, err := strconv.ParseFloat(os.Getenv("REFERRAL_REWARD_AMOUNT"), 64); err == nil && value > 0 {
+		return utils.ToMinor(value, currency)
+	}
+	return utils.ToMinor(defaultReferralReward, currency)
+}
+
+// GenerateCode returns a random code of length n
+func GenerateCode(n int) (string, error) {
+	code := make([]byte, n)
+	for i := range code {
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = codeAlphabet[index.Int64()]
+	}
+	return string(code), nil
+}
+
+// ReferralCodeFor returns the user's referral code, creating one on first use
+func ReferralCodeFor(db *gorm.DB, userID uint) (string, error) {
+	var user models.User
+	if err := db.Select("id", "referral_code").First(&user, userID).Error; err != nil {
+		return "", err
+	}
+	if user.ReferralCode != nil {
+		return *user.ReferralCode, nil
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := GenerateCode(8)
+		if err != nil {
+			return "", err
+		}
+
+		var taken int64
+		if err := db.Model(&models.User{}).Where("referral_code = ?", code).Count(&taken).Error; err != nil {
+			return "", err
+		}
+		if taken > 0 {
+			continue
+		}
+
+		// Only set the code if another request has not done so in the meantime
+		result := db.Model(&models.User{}).
+			Where("id = ? AND referral_code IS NULL", userID).
+			Update("referral_code", code)
+		if result.Error != nil {
+			return "", result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ReferralCodeFor(db, userID)
+		}
+		return code, nil
+	}
+
+	return "", errors.New("could not generate a unique referral code")
+}
+
+// grantReferralReward credits the referrer of userID the first time userID
+// pays for something. The credit goes to the referrer's wallet.
+func grantReferralReward(tx *gorm.DB, userID uint, reference string) error {
+	var referee models.User
+	if err := tx.Select("id", "referred_by_id").First(&referee, userID).Error; err != nil {
+		return err
+	}
+	if referee.ReferredByID == nil || *referee.ReferredByID == userID {
+		return nil
+	}
+
+	currency := utils.DefaultCurrency()
+	reward := models.ReferralReward{
+		ReferrerID: *referee.ReferredByID,
+		RefereeID:  userID,
+		Reference:  reference,
+		Amount:     referralRewardAmount(currency),
+		Currency:   currency,
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&reward)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Already rewarded for an earlier purchase
+		return nil
+	}
+
+	entry, err := wallet.Credit(tx, reward.ReferrerID, reward.Amount, reward.Currency, wallet.SourceReferral,
+		fmt.Sprintf("REF-%d", userID), fmt.Sprintf("Referral credit for inviting user %d", userID), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&reward).Update("wallet_entry_id", entry.ID).Error
+}
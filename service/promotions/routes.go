@@ -0,0 +1,362 @@
+package promotions
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// Response is a standardized API response structure
+type Response struct {
+	Data  interface{} `json:"data,omitempty"`
+	Meta  interface{} `json:"meta,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// CouponRequest is the body accepted when creating or updating a coupon
+type CouponRequest struct {
+	Code         string     `json:"code"`
+	Description  string     `json:"description"`
+	DiscountType string     `json:"discount_type"`
+	Value        float64    `json:"value"`              // Percent off
+	AmountOff    *int64     `json:"amount_off_minor"`   // Minor units off
+	MaxDiscount  *int64     `json:"max_discount_minor"` // Minor units
+	MinAmount    *int64     `json:"min_amount_minor"`   // Minor units
+	Currency     string     `json:"currency"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxUses      *int       `json:"max_uses"`
+	PerUserLimit *int       `json:"per_user_limit"`
+	Products     []string   `json:"products"`
+	ExpertIDs    []int64    `json:"expert_ids"`
+	Active       *bool      `json:"active"`
+}
+
+// PromotionHandler handles coupon and referral HTTP requests
+type PromotionHandler struct {
+	db *gorm.DB
+}
+
+// NewPromotionHandler creates a new promotion handler
+func NewPromotionHandler(db *gorm.DB) *PromotionHandler {
+	return &PromotionHandler{db: db}
+}
+
+// RegisterRoutes registers all coupon and referral routes
+func (h *PromotionHandler) RegisterRoutes(router *mux.Router) {
+	// Coupon administration
+	router.HandleFunc("/coupons", utils.AdminMiddleware(h.db, h.GetCoupons)).Methods("GET")
+	router.HandleFunc("/coupons", utils.AdminMiddleware(h.db, h.CreateCoupon)).Methods("POST")
+	router.HandleFunc("/coupons/{code}", utils.AdminMiddleware(h.db, h.UpdateCoupon)).Methods("PUT")
+	router.HandleFunc("/coupons/{code}", utils.AdminMiddleware(h.db, h.DeactivateCoupon)).Methods("DELETE")
+
+	// Checking a code before paying
+	router.HandleFunc("/coupons/validate", utils.AuthMiddleware(h.ValidateCoupon)).Methods("POST")
+
+	// Referrals
+	router.HandleFunc("/referrals", utils.AuthMiddleware(h.GetReferrals)).Methods("GET")
+}
+
+// GetCoupons lists all coupons, newest first
+func (h *PromotionHandler) GetCoupons(w http.ResponseWriter, r *http.Request) {
+	query := h.db.Model(&models.Coupon{})
+	if r.URL.Query().Get("active") == "true" {
+		query = query.Where("active = ?", true)
+	}
+
+	var coupons []models.Coupon
+	if err := query.Order("created_at DESC").Find(&coupons).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve coupons")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: coupons})
+}
+
+// CreateCoupon adds a coupon
+func (h *PromotionHandler) CreateCoupon(w http.ResponseWriter, r *http.Request) {
+	var request CouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	request.Code = NormalizeCode(request.Code)
+	if request.Code == "" {
+		h.respondWithError(w, http.StatusBadRequest, "Code is required")
+		return
+	}
+
+	coupon := models.Coupon{
+		Code:   request.Code,
+		Active: true,
+	}
+	if message := applyCouponRequest(&coupon, &request); message != "" {
+		h.respondWithError(w, http.StatusBadRequest, message)
+		return
+	}
+
+	var existing int64
+	h.db.Model(&models.Coupon{}).Where("code = ?", coupon.Code).Count(&existing)
+	if existing > 0 {
+		h.respondWithError(w, http.StatusConflict, "A coupon with this code already exists")
+		return
+	}
+
+	if err := h.db.Create(&coupon).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to create coupon")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusCreated, Response{Data: coupon})
+}
+
+// UpdateCoupon changes a coupon's terms. Redemptions already made are unaffected.
+func (h *PromotionHandler) UpdateCoupon(w http.ResponseWriter, r *http.Request) {
+	var request CouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	var coupon models.Coupon
+	if err := h.db.Where("code = ?", NormalizeCode(mux.Vars(r)["code"])).First(&coupon).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+
+	if message := applyCouponRequest(&coupon, &request); message != "" {
+		h.respondWithError(w, http.StatusBadRequest, message)
+		return
+	}
+
+	if err := h.db.Save(&coupon).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to update coupon")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: coupon})
+}
+
+// DeactivateCoupon stops a coupon from being used. Coupons are kept so past
+// transactions still refer to them.
+func (h *PromotionHandler) DeactivateCoupon(w http.ResponseWriter, r *http.Request) {
+	result := h.db.Model(&models.Coupon{}).
+		Where("code = ?", NormalizeCode(mux.Vars(r)["code"])).
+		Update("active", false)
+	if result.Error != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to deactivate coupon")
+		return
+	}
+	if result.RowsAffected == 0 {
+		h.respondWithError(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: map[string]string{
+		"message": "Coupon deactivated successfully",
+	}})
+}
+
+// applyCouponRequest copies the fields set in request onto coupon and returns
+// a validation message, or an empty string when the result is valid
+func applyCouponRequest(coupon *models.Coupon, request *CouponRequest) string {
+	if request.Description != "" {
+		coupon.Description = request.Description
+	}
+	if request.DiscountType != "" {
+		coupon.DiscountType = strings.ToLower(request.DiscountType)
+	}
+	if request.Value != 0 {
+		coupon.Value = request.Value
+	}
+	if request.AmountOff != nil {
+		coupon.AmountOff = *request.AmountOff
+	}
+	if request.Currency != "" {
+		coupon.Currency = utils.NormalizeCurrency(request.Currency)
+	}
+	if request.MaxDiscount != nil {
+		coupon.MaxDiscount = *request.MaxDiscount
+	}
+	if request.MinAmount != nil {
+		coupon.MinAmount = *request.MinAmount
+	}
+	if request.ExpiresAt != nil {
+		coupon.ExpiresAt = request.ExpiresAt
+	}
+	if request.MaxUses != nil {
+		coupon.MaxUses = *request.MaxUses
+	}
+	if request.PerUserLimit != nil {
+		coupon.PerUserLimit = *request.PerUserLimit
+	}
+	if request.Products != nil {
+		coupon.Products = pq.StringArray(request.Products)
+	}
+	if request.ExpertIDs != nil {
+		coupon.ExpertIDs = pq.Int64Array(request.ExpertIDs)
+	}
+	if request.Active != nil {
+		coupon.Active = *request.Active
+	}
+
+	switch coupon.DiscountType {
+	case "percentage":
+		if coupon.Value <= 0 || coupon.Value > 100 {
+			return "Percentage discounts must be between 0 and 100"
+		}
+	case "fixed":
+		if coupon.AmountOff <= 0 {
+			return "Fixed discounts must be positive"
+		}
+		if coupon.Currency == "" {
+			coupon.Currency = utils.DefaultCurrency()
+		}
+	default:
+		return "Discount type must be percentage or fixed"
+	}
+	if coupon.Currency != "" && !utils.IsSupportedCurrency(coupon.Currency) {
+		return "Unsupported currency"
+	}
+	if coupon.MaxDiscount < 0 || coupon.MinAmount < 0 || coupon.MaxUses < 0 || coupon.PerUserLimit < 0 {
+		return "Limits cannot be negative"
+	}
+
+	return ""
+}
+
+// ValidateCoupon previews the discount a code gives on a purchase. The price
+// is always looked up on the server from the plan or availability slot.
+func (h *PromotionHandler) ValidateCoupon(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request struct {
+		Code           string `json:"code"`
+		Product        string `json:"product"`
+		SignalPlan     string `json:"signal_plan"`
+		AvailabilityID uint   `json:"availability_id"`
+		Seats          int    `json:"seats"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	purchase := Purchase{UserID: userID, Product: request.Product}
+	switch request.Product {
+	case ProductAppointment:
+		var availability models.Availability
+		if err := h.db.First(&availability, request.AvailabilityID).Error; err != nil {
+			h.respondWithError(w, http.StatusNotFound, "Time slot not found")
+			return
+		}
+		if request.Seats < 1 {
+			request.Seats = 1
+		}
+		purchase.ExpertID = availability.ExpertID
+		purchase.Amount = availability.Price * int64(request.Seats)
+		purchase.Currency = availability.Currency
+	case ProductSignalSubscription:
+		var plan models.SubscriptionPlan
+		if err := h.db.Where("code = ? AND active = ?", strings.ToLower(strings.TrimSpace(request.SignalPlan)), true).First(&plan).Error; err != nil {
+			h.respondWithError(w, http.StatusBadRequest, "Unknown subscription plan")
+			return
+		}
+		purchase.PlanCode = plan.Code
+		purchase.Amount = plan.Price
+		purchase.Currency = plan.Currency
+	default:
+		h.respondWithError(w, http.StatusBadRequest, "Product must be appointment or signal_subscription")
+		return
+	}
+
+	discount, err := PreviewCoupon(h.db, request.Code, purchase, time.Now())
+	if err != nil {
+		if IsCouponError(err) {
+			h.respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to validate coupon")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: discount})
+}
+
+// GetReferrals returns the caller's referral code together with the users
+// they referred and the credit earned so far
+func (h *PromotionHandler) GetReferrals(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	code, err := ReferralCodeFor(h.db, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			h.respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve referral code")
+		return
+	}
+
+	var referred int64
+	if err := h.db.Model(&models.User{}).Where("referred_by_id = ?", userID).Count(&referred).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve referrals")
+		return
+	}
+
+	var rewards []models.ReferralReward
+	if err := h.db.Preload("Coupon").
+		Where("referrer_id = ?", userID).
+		Order("created_at DESC").
+		Find(&rewards).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve referral rewards")
+		return
+	}
+
+	// Rewards are totalled per currency, in minor units
+	earned := map[string]int64{}
+	for _, reward := range rewards {
+		earned[reward.Currency] += reward.Amount
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{
+		Data: map[string]interface{}{
+			"referral_code": code,
+			"rewards":       rewards,
+		},
+		Meta: map[string]interface{}{
+			"referred_users": referred,
+			"rewarded_users": len(rewards),
+			"total_earned":   earned,
+		},
+	})
+}
+
+// Helper function to respond with an error
+func (h *PromotionHandler) respondWithError(w http.ResponseWriter, code int, message string) {
+	h.respondWithJSON(w, code, Response{Error: message})
+}
+
+// Helper function to respond with JSON
+func (h *PromotionHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
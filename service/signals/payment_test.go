@@ -0,0 +1,72 @@
+package signals
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+)
+
+func TestInitializeSignalPayment(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantCode   int
+		wantAmount int64 // Charged, from the catalog
+	}{
+		{name: "catalog price", body: `{"signal_plan":"monthly"}`, wantCode: http.StatusOK, wantAmount: 10000},
+		{name: "client amount ignored", body: `{"signal_plan":"Monthly","amount":1,"amount_minor":1}`, wantCode: http.StatusOK, wantAmount: 10000},
+		{name: "unknown plan", body: `{"signal_plan":"lifetime","amount":1}`, wantCode: http.StatusBadRequest},
+		{name: "retired plan", body: `{"signal_plan":"weekly"}`, wantCode: http.StatusBadRequest},
+		{name: "no plan", body: `{}`, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "signals")
+			testdb.Plan(t, db, "monthly", 1, 10000)
+			retired := testdb.Plan(t, db, "weekly", 1, 3000)
+			db.Model(retired).Update("active", false)
+			user := testdb.User(t, db, "Signal Buyer")
+
+			provider := payment.NewFakeProvider()
+			h := &SignalHandler{db: db, provider: provider}
+
+			r := testdb.AsUser(httptest.NewRequest(http.MethodPost, "/signals/payment/initialize", strings.NewReader(tt.body)), user.ID)
+			w := httptest.NewRecorder()
+			h.InitializeSignalPayment(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+
+			var subscriptions []models.SignalSubscription
+			db.Find(&subscriptions)
+			if tt.wantCode != http.StatusOK {
+				if len(subscriptions) != 0 || len(provider.Initialized) != 0 {
+					t.Errorf("rejected payment left %d subscriptions and %d checkouts", len(subscriptions), len(provider.Initialized))
+				}
+				return
+			}
+
+			if len(provider.Initialized) != 1 || provider.Initialized[0].Amount != tt.wantAmount {
+				t.Fatalf("checkouts = %+v, want one for %d", provider.Initialized, tt.wantAmount)
+			}
+			if len(subscriptions) != 1 || subscriptions[0].Plan != "monthly" || subscriptions[0].Amount != tt.wantAmount {
+				t.Errorf("subscriptions = %+v", subscriptions)
+			}
+
+			var response map[string]interface{}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response["amount_minor"] != float64(tt.wantAmount) || response["authorization_url"] == nil {
+				t.Errorf("response = %v", response)
+			}
+		})
+	}
+}
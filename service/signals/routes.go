@@ -1,18 +1,21 @@
 package signals
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
 	"github.com/KAsare1/Kodefx-server/cmd/models"
 	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/KAsare1/Kodefx-server/service/promotions"
+	"github.com/KAsare1/Kodefx-server/service/subscription"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
 	"github.com/gorilla/mux"
 	expo "github.com/oliveroneill/exponent-server-sdk-golang/sdk"
 	"gorm.io/gorm"
@@ -29,20 +32,28 @@ type DefaultNotificationSender struct {
 	expoClient *expo.PushClient
 }
 
+// NewNotificationSender returns a sender that pushes to the devices users
+// have registered and keeps their notification history
+func NewNotificationSender(db *gorm.DB) NotificationSender {
+	return &DefaultNotificationSender{
+		db:         db,
+		expoClient: expo.NewPushClient(nil),
+	}
+}
+
 // Add notificationSender field to SignalHandler
 type SignalHandler struct {
 	db                 *gorm.DB
 	notificationSender NotificationSender
+	provider           payment.Provider
 }
 
 // Update the NewSignalHandler function to initialize with NotificationSender
 func NewSignalHandler(db *gorm.DB) *SignalHandler {
 	return &SignalHandler{
 		db: db,
-		notificationSender: &DefaultNotificationSender{
-			db:         db,
-			expoClient: expo.NewPushClient(nil),
-		},
+		notificationSender: NewNotificationSender(db),
+		provider: payment.NewProvider(),
 	}
 }
 
@@ -327,7 +338,7 @@ func (h *SignalHandler) CreateSignal(w http.ResponseWriter, r *http.Request) {
 	// Get users with active signal subscriptions
 	var subscriberIDs []string
 	h.db.Model(&models.SignalSubscription{}).
-		Where("status = ? AND NOW() BETWEEN start_date AND end_date", "active").
+		Scopes(subscription.ActiveScope(time.Now())).
 		Pluck("user_id", &subscriberIDs)
 
 	// Convert userIDs from uint to string for the notification system
@@ -541,7 +552,7 @@ func (h *SignalHandler) UpdateSignal(w http.ResponseWriter, r *http.Request) {
 		// Get users with active signal subscriptions
 		var subscriberIDs []string
 		h.db.Model(&models.SignalSubscription{}).
-			Where("status = ? AND NOW() BETWEEN start_date AND end_date", "active").
+			Scopes(subscription.ActiveScope(time.Now())).
 			Pluck("user_id", &subscriberIDs)
 
 		// Convert userIDs from uint to string for the notification system
@@ -935,7 +946,7 @@ func (h *SignalHandler) CreateBatchSignals(w http.ResponseWriter, r *http.Reques
 	// Get users with active signal subscriptions
 	var subscriberIDs []string
 	h.db.Model(&models.SignalSubscription{}).
-		Where("status = ? AND NOW() BETWEEN start_date AND end_date", "active").
+		Scopes(subscription.ActiveScope(time.Now())).
 		Pluck("user_id", &subscriberIDs)
 
 	// Convert userIDs from uint to string for the notification system
@@ -1114,7 +1125,8 @@ func (h *SignalHandler) GetUserSignalStats(w http.ResponseWriter, r *http.Reques
 	json.NewEncoder(w).Encode(stats)
 }
 
-// InitializeSignalPayment initializes payment for signal subscriptions
+// InitializeSignalPayment initializes payment for signal subscriptions.
+// The amount is always taken from the plan catalog, never from the client.
 func (h *SignalHandler) InitializeSignalPayment(w http.ResponseWriter, r *http.Request) {
 	userID, err := utils.GetUserIDFromContext(r.Context())
 	if err != nil {
@@ -1123,8 +1135,11 @@ func (h *SignalHandler) InitializeSignalPayment(w http.ResponseWriter, r *http.R
 	}
 
 	var paymentRequest struct {
-		Amount     float64 `json:"amount"`
-		SignalPlan string  `json:"signal_plan"`
+		SignalPlan string `json:"signal_plan"`
+		AutoRenew  bool   `json:"auto_renew"`
+		CouponCode string `json:"coupon_code"`
+		UseWallet  bool   `json:"use_wallet"`
+		payment.ChannelRequest
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&paymentRequest); err != nil {
@@ -1132,6 +1147,21 @@ func (h *SignalHandler) InitializeSignalPayment(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	plan, err := subscription.LookupPlan(h.db, paymentRequest.SignalPlan)
+	if err != nil {
+		if errors.Is(err, subscription.ErrUnknownPlan) || errors.Is(err, subscription.ErrInactivePlan) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error retrieving plan", http.StatusInternalServerError)
+		return
+	}
+
+	if err := paymentRequest.ChannelRequest.Validate(plan.Currency); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Start transaction
 	tx := h.db.Begin()
 
@@ -1144,17 +1174,56 @@ func (h *SignalHandler) InitializeSignalPayment(w http.ResponseWriter, r *http.R
 	}
 
 	// Create a reference ID for this payment
-	reference := fmt.Sprintf("SIG-%d-%d", userID, time.Now().Unix())
+	now := time.Now()
+	reference := fmt.Sprintf("SIG-%d-%d", userID, now.Unix())
+
+	// Apply the coupon, if any
+	amount := plan.Price
+	var discount *promotions.Discount
+	if paymentRequest.CouponCode != "" {
+		discount, err = promotions.ReserveCoupon(tx, paymentRequest.CouponCode, promotions.Purchase{
+			UserID:   userID,
+			Product:  promotions.ProductSignalSubscription,
+			PlanCode: plan.Code,
+			Amount:   plan.Price,
+			Currency: plan.Currency,
+		}, reference, now)
+		if err != nil {
+			tx.Rollback()
+			if promotions.IsCouponError(err) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			http.Error(w, "Error applying coupon", http.StatusInternalServerError)
+			return
+		}
+		amount = discount.FinalAmount
+	}
+
+	// Cover what the wallet can; the rest is charged to the user's card
+	var walletAmount int64
+	if paymentRequest.UseWallet && amount > 0 {
+		walletAmount, err = wallet.Hold(tx, userID, amount, plan.Currency, reference, "Signal Subscription - "+plan.Code)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Error applying wallet balance", http.StatusInternalServerError)
+			return
+		}
+	}
+	amountDue := amount - walletAmount
 
 	// Create a pending signal subscription
 	signalSubscription := models.SignalSubscription{
-		UserID:    userID,
-		Plan:      paymentRequest.SignalPlan,
-		Amount:    paymentRequest.Amount,
-		Status:    "pending",
-		PaymentID: reference,
-		StartDate: time.Time{},
-		EndDate:   time.Time{},
+		UserID:       userID,
+		Plan:         plan.Code,
+		Amount:       amount,
+		Currency:     plan.Currency,
+		WalletAmount: walletAmount,
+		Status:       "pending",
+		PaymentID:    reference,
+		StartDate:    time.Time{},
+		EndDate:      time.Time{},
+		AutoRenew:    paymentRequest.AutoRenew,
 	}
 
 	if err := tx.Create(&signalSubscription).Error; err != nil {
@@ -1163,48 +1232,32 @@ func (h *SignalHandler) InitializeSignalPayment(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	// Initialize Paystack payment
-	paystackURL := "https://api.paystack.co/transaction/initialize"
-
-	paystackReq := map[string]interface{}{
-		"email":     user.Email,
-		"amount":    int64(paymentRequest.Amount * 100), // Convert to smallest unit
-		"reference": reference,
-		"metadata": map[string]interface{}{
-			"payment_type": "signal_subscription",
-			"user_id":      userID,
-			"signal_plan":  paymentRequest.SignalPlan,
-		},
+	response := map[string]interface{}{
+		"reference":       reference,
+		"subscription_id": signalSubscription.ID,
+		"amount_minor":     amount,
+		"amount":           utils.FromMinor(amount, plan.Currency), // Deprecated: use amount_minor
+		"wallet_minor":     walletAmount,
+		"amount_due_minor": amountDue,
+		"currency":         plan.Currency,
 	}
-	log.Printf("Payload to Paystack: %+v\n", paystackReq)
-
-	payloadBytes, _ := json.Marshal(paystackReq)
-	req, _ := http.NewRequest("POST", paystackURL, bytes.NewBuffer(payloadBytes))
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("PAYSTACK_SECRET_KEY"))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		tx.Rollback()
-		http.Error(w, "Error initializing payment", http.StatusInternalServerError)
-		return
+	if discount != nil {
+		response["discount"] = discount
 	}
-	defer resp.Body.Close()
 
-	var paystackResp struct {
-		Status bool `json:"status"`
-		Data   struct {
-			AuthorizationURL string `json:"authorization_url"`
-			AccessCode       string `json:"access_code"`
-			Reference        string `json:"reference"`
-		} `json:"data"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&paystackResp); err != nil {
-		tx.Rollback()
-		http.Error(w, "Error reading payment response", http.StatusInternalServerError)
-		return
+	if amountDue == 0 {
+		// Fully covered by the coupon and wallet, so activate straight away
+		method := "Coupon"
+		if walletAmount > 0 {
+			method = "Wallet"
+		}
+		if _, _, err := subscription.CompleteSubscriptionPayment(tx, reference, 0, plan.Currency, method,
+			subscription.Authorization{}, now); err != nil {
+			tx.Rollback()
+			http.Error(w, "Error activating subscription", http.StatusInternalServerError)
+			return
+		}
+		response["status"] = "active"
 	}
 
 	if err := tx.Commit().Error; err != nil {
@@ -1212,10 +1265,39 @@ func (h *SignalHandler) InitializeSignalPayment(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	if amountDue > 0 {
+		// Start a card checkout or charge the user's mobile money wallet. The
+		// subscription is saved first so a charge that goes through always finds it.
+		collection, err := payment.Collect(h.provider, paymentRequest.ChannelRequest, payment.InitializeRequest{
+			Email:     user.Email,
+			Amount:    amountDue,
+			Currency:  plan.Currency,
+			Reference: reference,
+			Metadata: map[string]interface{}{
+				"payment_type": "signal_subscription",
+				"user_id":      userID,
+				"signal_plan":  plan.Code,
+			},
+		})
+		if err != nil {
+			if errors.Is(err, payment.ErrChargeFailed) {
+				if err := subscription.ReleaseDeclinedPayment(h.db, reference); err != nil {
+					log.Printf("Error releasing declined subscription %s: %v", reference, err)
+				}
+				http.Error(w, err.Error(), http.StatusPaymentRequired)
+				return
+			}
+			// The charge may still go through, so the subscription is left
+			// pending and its wallet hold and coupon run out if it never does
+			log.Printf("Error initializing signal payment: %v", err)
+			http.Error(w, "Error initializing payment", http.StatusInternalServerError)
+			return
+		}
+		for key, value := range collection {
+			response[key] = value
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"authorization_url": paystackResp.Data.AuthorizationURL,
-		"reference":         reference,
-		"subscription_id":   signalSubscription.ID,
-	})
+	json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,47 @@
+// Package signalstest records push notifications for tests of the services
+// that send them.
+package signalstest
+
+import "sync"
+
+// Notification is a push notification sent to one user
+type Notification struct {
+	UserID      string
+	Title, Body string
+	Data        map[string]interface{}
+}
+
+// Notifier is a signals.NotificationSender that records what it is asked to
+// send instead of pushing it. Broadcasts are recorded once per user. Err,
+// when set, is returned for every send, e.g. to simulate a push outage.
+type Notifier struct {
+	Err error
+
+	mu   sync.Mutex
+	sent []Notification
+}
+
+// SendUserNotification records the notification for userID
+func (n *Notifier) SendUserNotification(userID string, title, body string, data map[string]interface{}) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.sent = append(n.sent, Notification{UserID: userID, Title: title, Body: body, Data: data})
+	return n.Err == nil, n.Err
+}
+
+// BroadcastNotification records the notification for each of userIDs
+func (n *Notifier) BroadcastNotification(title, body string, data map[string]interface{}, userIDs []string) (bool, error) {
+	for _, userID := range userIDs {
+		n.SendUserNotification(userID, title, body, data)
+	}
+	return n.Err == nil, n.Err
+}
+
+// Sent returns the notifications recorded so far, oldest first
+func (n *Notifier) Sent() []Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]Notification(nil), n.sent...)
+}
@@ -0,0 +1,371 @@
+package subscription
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PlanChangeQuote describes the cost of moving a subscription to another plan.
+// Amounts are in minor units of Currency.
+type PlanChangeQuote struct {
+	SubscriptionID  uint      `json:"subscription_id"`
+	CurrentPlan     string    `json:"current_plan"`
+	NewPlan         string    `json:"new_plan"`
+	NewPlanPrice    int64     `json:"new_plan_price_minor"`
+	Currency        string    `json:"currency"`
+	ProrationCredit int64     `json:"proration_credit_minor"` // Value of the unused part of the current subscription
+	AmountDue       int64     `json:"amount_due_minor"`       // What the user pays now; zero for most downgrades
+	EffectiveFrom   time.Time `json:"effective_from"`
+	NewEndDate      time.Time `json:"new_end_date"`
+}
+
+// prorationCredit values the unused remainder of sub at now, based on what
+// the subscription was actually worth: the amount paid plus any credit
+// carried into it from an earlier plan change
+func prorationCredit(sub *models.SignalSubscription, now time.Time) int64 {
+	total := sub.EndDate.Sub(sub.StartDate)
+	remaining := sub.EndDate.Sub(now)
+	if total <= 0 || remaining <= 0 {
+		return 0
+	}
+	return utils.ScaleMinor(sub.Amount+sub.ProrationCredit, float64(remaining)/float64(total))
+}
+
+// switchedEndDate returns when a switched subscription to plan ends. Credit
+// beyond the plan price is converted into extra time on the new plan.
+func switchedEndDate(plan *models.SubscriptionPlan, start time.Time, credit int64) time.Time {
+	end := planEndDate(plan, start)
+	if credit > plan.Price && plan.Price > 0 {
+		surplus := float64(credit-plan.Price) / float64(plan.Price)
+		end = end.Add(time.Duration(float64(end.Sub(start)) * surplus))
+	}
+	return end
+}
+
+// partialEndDate returns when a subscription to plan ends if only paid of the
+// plan price was paid for it, giving that share of the plan period
+func partialEndDate(plan *models.SubscriptionPlan, start time.Time, paid int64) time.Time {
+	end := planEndDate(plan, start)
+	if plan.Price <= 0 || paid >= plan.Price {
+		return end
+	}
+	if paid < 0 {
+		paid = 0
+	}
+	return start.Add(time.Duration(float64(end.Sub(start)) * float64(paid) / float64(plan.Price)))
+}
+
+// quotePlanChange prices moving sub to plan at now
+func quotePlanChange(sub *models.SignalSubscription, plan *models.SubscriptionPlan, now time.Time) PlanChangeQuote {
+	credit := prorationCredit(sub, now)
+	due := plan.Price - credit
+	if due < 0 {
+		due = 0
+	}
+
+	return PlanChangeQuote{
+		SubscriptionID:  sub.ID,
+		CurrentPlan:     sub.Plan,
+		NewPlan:         plan.Code,
+		NewPlanPrice:    plan.Price,
+		Currency:        plan.Currency,
+		ProrationCredit: credit,
+		AmountDue:       due,
+		EffectiveFrom:   now,
+		NewEndDate:      switchedEndDate(plan, now, credit),
+	}
+}
+
+// switchSubscription ends the subscription sub replaces at now and starts sub
+// in its place, moving any queued renewals so they follow on without a gap.
+func switchSubscription(tx *gorm.DB, sub *models.SignalSubscription, plan *models.SubscriptionPlan, now time.Time) error {
+	var previous models.SignalSubscription
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&previous, *sub.ReplacesID).Error; err != nil {
+		return err
+	}
+
+	sub.StartDate = now
+	sub.EndDate = switchedEndDate(plan, now, sub.ProrationCredit)
+
+	// The previous subscription lapsed before payment arrived, so there is
+	// nothing to switch from and its credit is gone. Only the part of the
+	// plan not covered by that credit was paid for.
+	if previous.Status != "active" || !previous.EndDate.After(now) {
+		sub.EndDate = partialEndDate(plan, now, plan.Price-sub.ProrationCredit)
+		sub.ProrationCredit = 0
+		return nil
+	}
+
+	sub.AutoRenew = sub.AutoRenew || previous.AutoRenew
+	if sub.AuthorizationCode == "" {
+		sub.AuthorizationCode = previous.AuthorizationCode
+	}
+
+	previousEnd := previous.EndDate
+	if err := tx.Model(&previous).Updates(map[string]interface{}{
+		"status":        "switched",
+		"end_date":      now,
+		"auto_renew":    false,
+		"renewed_by_id": sub.ID,
+	}).Error; err != nil {
+		return err
+	}
+
+	// Shift renewals that were queued behind the previous subscription
+	var queued []models.SignalSubscription
+	if err := tx.Where("user_id = ? AND id NOT IN ? AND status = ? AND start_date >= ?",
+		sub.UserID, []uint{sub.ID, previous.ID}, "active", previousEnd).
+		Order("start_date ASC").
+		Find(&queued).Error; err != nil {
+		return err
+	}
+
+	cursor := sub.EndDate
+	for _, next := range queued {
+		length := next.EndDate.Sub(next.StartDate)
+		if err := tx.Model(&next).Updates(map[string]interface{}{
+			"start_date": cursor,
+			"end_date":   cursor.Add(length),
+		}).Error; err != nil {
+			return err
+		}
+		cursor = cursor.Add(length)
+	}
+
+	// The queued renewal now continues the new subscription, so the worker must not renew it again
+	if len(queued) > 0 {
+		sub.RenewedByID = &queued[0].ID
+	}
+
+	return nil
+}
+
+// loadChangeableSubscription loads the caller's running subscription and target plan
+func (h *SubscriptionHandler) loadChangeableSubscription(w http.ResponseWriter, r *http.Request, planCode string, now time.Time) (*models.SignalSubscription, *models.SubscriptionPlan, bool) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return nil, nil, false
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid subscription ID")
+		return nil, nil, false
+	}
+
+	var sub models.SignalSubscription
+	if err := h.db.Preload("User").First(&sub, id).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Subscription not found")
+		return nil, nil, false
+	}
+
+	if sub.UserID != userID {
+		h.respondWithError(w, http.StatusForbidden, "You don't have permission to modify this subscription")
+		return nil, nil, false
+	}
+
+	if sub.Status != "active" || sub.StartDate.After(now) || !sub.EndDate.After(now) {
+		h.respondWithError(w, http.StatusConflict, "Only the currently running subscription can change plan")
+		return nil, nil, false
+	}
+
+	plan, err := LookupPlan(h.db, planCode)
+	if err != nil {
+		if errors.Is(err, ErrUnknownPlan) || errors.Is(err, ErrInactivePlan) {
+			h.respondWithError(w, http.StatusBadRequest, err.Error())
+			return nil, nil, false
+		}
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve plan")
+		return nil, nil, false
+	}
+
+	if plan.Code == sub.Plan {
+		h.respondWithError(w, http.StatusBadRequest, "Subscription is already on this plan")
+		return nil, nil, false
+	}
+
+	if plan.Currency != sub.Currency {
+		h.respondWithError(w, http.StatusBadRequest, "Plan is priced in a different currency from the current subscription")
+		return nil, nil, false
+	}
+
+	return &sub, plan, true
+}
+
+// QuotePlanChange previews the proration for moving a subscription to ?plan=
+func (h *SubscriptionHandler) QuotePlanChange(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	sub, plan, ok := h.loadChangeableSubscription(w, r, r.URL.Query().Get("plan"), now)
+	if !ok {
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: quotePlanChange(sub, plan, now)})
+}
+
+// ChangePlan moves a running subscription to another plan. Unused time on the
+// current plan is credited against the new one; any remainder is charged to the
+// saved card or through a new checkout, and the switch happens once it is paid.
+// A saved card charge that doesn't complete straight away is left to the
+// webhook; only a declined one falls back to checkout, under a new reference.
+func (h *SubscriptionHandler) ChangePlan(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Plan string `json:"plan"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	now := time.Now()
+	sub, plan, ok := h.loadChangeableSubscription(w, r, request.Plan, now)
+	if !ok {
+		return
+	}
+
+	quote := quotePlanChange(sub, plan, now)
+	change, err := h.createPlanChange(sub, plan, quote)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to create plan change")
+		return
+	}
+
+	// Nothing to pay: switch straight away
+	if quote.AmountDue == 0 {
+		h.completePlanChange(w, change.PaymentID, 0, quote)
+		return
+	}
+
+	metadata := map[string]interface{}{
+		"payment_type": "signal_subscription",
+		"user_id":      sub.UserID,
+		"signal_plan":  plan.Code,
+		"replaces_id":  sub.ID,
+	}
+
+	// Charge the saved card when there is one
+	if sub.AuthorizationCode != "" {
+		result, err := h.provider.ChargeAuthorization(payment.ChargeAuthorizationRequest{
+			Email:             sub.User.Email,
+			Amount:            quote.AmountDue,
+			Currency:          plan.Currency,
+			Reference:         change.PaymentID,
+			AuthorizationCode: sub.AuthorizationCode,
+			Metadata:          metadata,
+		})
+		switch {
+		case err == nil && result.Succeeded():
+			h.completePlanChange(w, change.PaymentID, quote.AmountDue, quote)
+			return
+		case err == nil && result.Declined():
+			log.Printf("Saved card declined for plan change %s, falling back to checkout: %s", change.PaymentID, result.GatewayResponse)
+			h.db.Model(change).Update("status", "failed")
+		default:
+			// The charge may still go through, even after an error reply, so
+			// it must not be retried under another reference; the webhook
+			// completes the change
+			if err != nil {
+				log.Printf("Saved card charge for plan change %s has no outcome yet: %v", change.PaymentID, err)
+			}
+			h.respondWithJSON(w, http.StatusAccepted, Response{Data: map[string]interface{}{
+				"reference":       change.PaymentID,
+				"subscription_id": change.ID,
+				"payment_status":  payment.ChargePending,
+				"quote":           quote,
+			}})
+			return
+		}
+
+		if change, err = h.createPlanChange(sub, plan, quote); err != nil {
+			h.respondWithError(w, http.StatusInternalServerError, "Failed to create plan change")
+			return
+		}
+	}
+
+	checkout, err := h.provider.InitializeTransaction(payment.InitializeRequest{
+		Email:     sub.User.Email,
+		Amount:    quote.AmountDue,
+		Currency:  plan.Currency,
+		Reference: change.PaymentID,
+		Metadata:  metadata,
+	})
+	if err != nil {
+		h.db.Model(change).Update("status", "failed")
+		h.respondWithError(w, http.StatusInternalServerError, "Error initializing payment")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusAccepted, Response{Data: map[string]interface{}{
+		"authorization_url": checkout.AuthorizationURL,
+		"reference":         change.PaymentID,
+		"subscription_id":   change.ID,
+		"quote":             quote,
+	}})
+}
+
+// createPlanChange records a pending change of sub to plan under a fresh
+// payment reference, cancelling any earlier change still awaiting payment
+func (h *SubscriptionHandler) createPlanChange(sub *models.SignalSubscription, plan *models.SubscriptionPlan, quote PlanChangeQuote) (*models.SignalSubscription, error) {
+	change := models.SignalSubscription{
+		UserID:          sub.UserID,
+		Plan:            plan.Code,
+		Amount:          quote.AmountDue,
+		Currency:        plan.Currency,
+		Status:          "pending",
+		PaymentID:       fmt.Sprintf("SIG-%d-%d", sub.UserID, time.Now().UnixNano()),
+		ReplacesID:      &sub.ID,
+		ProrationCredit: quote.ProrationCredit,
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		// Only the latest requested change for a subscription can go through
+		if err := tx.Model(&models.SignalSubscription{}).
+			Where("replaces_id = ? AND status = ?", sub.ID, "pending").
+			Update("status", "cancelled").Error; err != nil {
+			return err
+		}
+		return tx.Create(&change).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// completePlanChange activates a plan change that has been paid for
+func (h *SubscriptionHandler) completePlanChange(w http.ResponseWriter, reference string, amount int64, quote PlanChangeQuote) {
+	// Changes paid in full by the proration credit collect nothing from the card
+	method := payment.ChannelCard
+	if amount == 0 {
+		method = "Credit"
+	}
+
+	var switched *models.SignalSubscription
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		sub, _, err := CompleteSubscriptionPayment(tx, reference, amount, quote.Currency, method, Authorization{}, time.Now())
+		switched = sub
+		return err
+	})
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to change plan")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: map[string]interface{}{
+		"subscription": SubscriptionResponse{SignalSubscription: *switched},
+		"quote":        quote,
+	}})
+}
@@ -0,0 +1,193 @@
+package subscription
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/gorilla/mux"
+)
+
+func TestProrationCredit(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 30)
+
+	tests := []struct {
+		name   string
+		amount int64
+		carry  int64 // Credit carried in from an earlier plan change
+		now    time.Time
+		want   int64
+	}{
+		{name: "half used", amount: 10000, now: start.AddDate(0, 0, 15), want: 5000},
+		{name: "just started", amount: 10000, now: start, want: 10000},
+		{name: "ended", amount: 10000, now: end, want: 0},
+		{name: "long ended", amount: 10000, now: end.AddDate(0, 1, 0), want: 0},
+		{name: "carried credit counts", amount: 4000, carry: 6000, now: start.AddDate(0, 0, 15), want: 5000},
+	}
+	for _, tt := range tests {
+		sub := &models.SignalSubscription{Amount: tt.amount, ProrationCredit: tt.carry, StartDate: start, EndDate: end}
+		if got := prorationCredit(sub, tt.now); got != tt.want {
+			t.Errorf("%s: prorationCredit = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSwitchedEndDate(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	monthly := &models.SubscriptionPlan{DurationMonths: 1, Price: 10000}
+	month := start.AddDate(0, 1, 0).Sub(start)
+
+	tests := []struct {
+		name   string
+		credit int64
+		want   time.Time
+	}{
+		{name: "no credit", want: start.AddDate(0, 1, 0)},
+		{name: "credit below the price", credit: 4000, want: start.AddDate(0, 1, 0)},
+		{name: "credit equal to the price", credit: 10000, want: start.AddDate(0, 1, 0)},
+		{name: "surplus credit buys extra time", credit: 15000, want: start.AddDate(0, 1, 0).Add(month / 2)},
+	}
+	for _, tt := range tests {
+		if got := switchedEndDate(monthly, start, tt.credit); !got.Equal(tt.want) {
+			t.Errorf("%s: switchedEndDate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPartialEndDate(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	monthly := &models.SubscriptionPlan{DurationMonths: 1, Price: 10000}
+	month := start.AddDate(0, 1, 0).Sub(start)
+
+	tests := []struct {
+		paid int64
+		want time.Time
+	}{
+		{paid: 10000, want: start.AddDate(0, 1, 0)},
+		{paid: 12000, want: start.AddDate(0, 1, 0)},
+		{paid: 5000, want: start.Add(month / 2)},
+		{paid: 0, want: start},
+		{paid: -100, want: start},
+	}
+	for _, tt := range tests {
+		if got := partialEndDate(monthly, start, tt.paid); !got.Equal(tt.want) {
+			t.Errorf("partialEndDate(paid %d) = %v, want %v", tt.paid, got, tt.want)
+		}
+	}
+}
+
+func TestQuotePlanChange(t *testing.T) {
+	now := time.Date(2026, 3, 16, 0, 0, 0, 0, time.UTC)
+	sub := &models.SignalSubscription{Plan: "monthly", Amount: 10000, Currency: "GHS",
+		StartDate: now.AddDate(0, 0, -15), EndDate: now.AddDate(0, 0, 15)}
+
+	tests := []struct {
+		name    string
+		plan    models.SubscriptionPlan
+		wantDue int64
+		wantEnd time.Time
+	}{
+		{name: "upgrade pays the difference", plan: models.SubscriptionPlan{Code: "quarterly", DurationMonths: 3, Price: 25000}, wantDue: 20000, wantEnd: now.AddDate(0, 3, 0)},
+		{name: "downgrade costs nothing", plan: models.SubscriptionPlan{Code: "lite", DurationMonths: 1, Price: 5000}, wantDue: 0, wantEnd: now.AddDate(0, 1, 0)},
+		{name: "downgrade surplus extends the plan", plan: models.SubscriptionPlan{Code: "lite", DurationMonths: 1, Price: 2500}, wantDue: 0, wantEnd: now.AddDate(0, 1, 0).Add(now.AddDate(0, 1, 0).Sub(now))},
+	}
+	for _, tt := range tests {
+		quote := quotePlanChange(sub, &tt.plan, now)
+		if quote.ProrationCredit != 5000 || quote.AmountDue != tt.wantDue {
+			t.Errorf("%s: credit %d, due %d; want credit 5000, due %d", tt.name, quote.ProrationCredit, quote.AmountDue, tt.wantDue)
+		}
+		if !quote.NewEndDate.Equal(tt.wantEnd) {
+			t.Errorf("%s: new end %v, want %v", tt.name, quote.NewEndDate, tt.wantEnd)
+		}
+	}
+}
+
+func TestChangePlan(t *testing.T) {
+	tests := []struct {
+		name         string
+		plan         string
+		card         bool   // The subscription has a saved card
+		chargeStatus string // Of the saved card charge
+		chargeErr    error
+		wantCode     int
+		wantCheckout bool
+		wantSwitched bool
+	}{
+		{name: "upgrade charged to the saved card", plan: "quarterly", card: true, chargeStatus: payment.ChargeSuccess, wantCode: http.StatusOK, wantSwitched: true},
+		{name: "declined card falls back to checkout", plan: "quarterly", card: true, chargeStatus: payment.ChargeFailed, wantCode: http.StatusAccepted, wantCheckout: true},
+		{name: "charge still processing", plan: "quarterly", card: true, chargeStatus: payment.ChargePending, wantCode: http.StatusAccepted},
+		{name: "charge error is not a decline", plan: "quarterly", card: true, chargeErr: &payment.APIError{StatusCode: 503}, wantCode: http.StatusAccepted},
+		{name: "upgrade without a saved card", plan: "quarterly", wantCode: http.StatusAccepted, wantCheckout: true},
+		{name: "downgrade covered by the credit", plan: "lite", wantCode: http.StatusOK, wantSwitched: true},
+		{name: "same plan", plan: "monthly", wantCode: http.StatusBadRequest},
+		{name: "unknown plan", plan: "lifetime", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "subscription")
+			now := time.Now()
+			monthly := testdb.Plan(t, db, "monthly", 1, 10000)
+			testdb.Plan(t, db, "quarterly", 3, 25000)
+			testdb.Plan(t, db, "lite", 1, 2500)
+			user := testdb.User(t, db, "Plan Changer")
+			sub := testdb.Subscription(t, db, user.ID, monthly, now.AddDate(0, 0, -15), now.AddDate(0, 0, 15))
+			if tt.card {
+				db.Model(sub).Update("authorization_code", "AUTH_saved")
+			}
+			// A renewal already queued behind the current subscription
+			queued := testdb.Subscription(t, db, user.ID, monthly, sub.EndDate, sub.EndDate.AddDate(0, 1, 0))
+
+			provider := payment.NewFakeProvider()
+			if tt.chargeStatus != "" {
+				provider.ChargeStatus = tt.chargeStatus
+			}
+			provider.ChargeErr = tt.chargeErr
+			h := &SubscriptionHandler{db: db, provider: provider}
+
+			r := httptest.NewRequest(http.MethodPost, "/subscriptions/change", strings.NewReader(fmt.Sprintf(`{"plan":%q}`, tt.plan)))
+			r = testdb.AsUser(mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(sub.ID)}), user.ID)
+			w := httptest.NewRecorder()
+			h.ChangePlan(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+
+			if got := len(provider.Initialized) > 0; got != tt.wantCheckout {
+				t.Errorf("checkout started = %v, want %v", got, tt.wantCheckout)
+			}
+			if tt.wantCheckout && len(provider.Charged) > 0 && provider.Initialized[0].Reference == provider.Charged[0].Reference {
+				t.Error("checkout reused the reference of the declined card charge")
+			}
+
+			db.First(sub, sub.ID)
+			if got := sub.Status == "switched"; got != tt.wantSwitched {
+				t.Fatalf("previous subscription is %s, want switched %v", sub.Status, tt.wantSwitched)
+			}
+			if !tt.wantSwitched {
+				return
+			}
+
+			var change models.SignalSubscription
+			if err := db.Where("replaces_id = ? AND status = ?", sub.ID, "active").First(&change).Error; err != nil {
+				t.Fatalf("no active plan change: %v", err)
+			}
+			// No gap or overlap: the new plan starts where the old one now ends,
+			// and the queued renewal follows the new plan
+			if !change.StartDate.Equal(sub.EndDate) {
+				t.Errorf("new plan starts %v, previous ends %v", change.StartDate, sub.EndDate)
+			}
+			db.First(queued, queued.ID)
+			if !queued.StartDate.Equal(change.EndDate) {
+				t.Errorf("queued renewal starts %v, new plan ends %v", queued.StartDate, change.EndDate)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package subscription
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrUnknownPlan is returned when a plan code is not in the catalog
+	ErrUnknownPlan = errors.New("unknown subscription plan")
+	// ErrInactivePlan is returned when a plan exists but can no longer be bought
+	ErrInactivePlan = errors.New("subscription plan is not available")
+)
+
+// PlanRequest is the body accepted when creating or updating a plan
+type PlanRequest struct {
+	Code           string   `json:"code"`
+	Name           string   `json:"name"`
+	DurationMonths int      `json:"duration_months"`
+	Price          int64    `json:"price_minor"`
+	Currency       string   `json:"currency"`
+	Features       []string `json:"features"`
+	Active         *bool    `json:"active"`
+}
+
+// NormalizePlanCode puts a plan code in the form stored in the catalog
+func NormalizePlanCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+// LookupPlan returns the purchasable plan with the given code
+func LookupPlan(db *gorm.DB, code string) (*models.SubscriptionPlan, error) {
+	plan, err := findPlan(db, code)
+	if err != nil {
+		return nil, err
+	}
+	if !plan.Active {
+		return nil, ErrInactivePlan
+	}
+	return plan, nil
+}
+
+// findPlan returns the plan with the given code whether or not it is active,
+// so subscriptions bought before a plan was retired still resolve.
+func findPlan(db *gorm.DB, code string) (*models.SubscriptionPlan, error) {
+	var plan models.SubscriptionPlan
+	if err := db.Where("code = ?", NormalizePlanCode(code)).First(&plan).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUnknownPlan
+		}
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// GetPlans lists the plan catalog. Inactive plans are only included with ?all=true.
+func (h *SubscriptionHandler) GetPlans(w http.ResponseWriter, r *http.Request) {
+	query := h.db.Model(&models.SubscriptionPlan{})
+	if r.URL.Query().Get("all") != "true" {
+		query = query.Where("active = ?", true)
+	}
+
+	var plans []models.SubscriptionPlan
+	if err := query.Order("duration_months ASC").Find(&plans).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve plans")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: plans})
+}
+
+// CreatePlan adds a plan to the catalog
+func (h *SubscriptionHandler) CreatePlan(w http.ResponseWriter, r *http.Request) {
+	var request PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	request.Code = NormalizePlanCode(request.Code)
+	if request.Code == "" || request.Name == "" {
+		h.respondWithError(w, http.StatusBadRequest, "Code and name are required")
+		return
+	}
+	if request.DurationMonths < 1 || request.Price <= 0 {
+		h.respondWithError(w, http.StatusBadRequest, "Duration and price must be positive")
+		return
+	}
+
+	if request.Currency != "" && !utils.IsSupportedCurrency(request.Currency) {
+		h.respondWithError(w, http.StatusBadRequest, "Unsupported currency")
+		return
+	}
+
+	if _, err := findPlan(h.db, request.Code); err == nil {
+		h.respondWithError(w, http.StatusConflict, "A plan with this code already exists")
+		return
+	}
+
+	plan := models.SubscriptionPlan{
+		Code:           request.Code,
+		Name:           request.Name,
+		DurationMonths: request.DurationMonths,
+		Price:          request.Price,
+		Currency:       utils.NormalizeCurrency(request.Currency),
+		Features:       pq.StringArray(request.Features),
+		Active:         request.Active == nil || *request.Active,
+	}
+	if plan.Currency == "" {
+		plan.Currency = utils.DefaultCurrency()
+	}
+
+	if err := h.db.Create(&plan).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to create plan")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusCreated, Response{Data: plan})
+}
+
+// UpdatePlan changes a plan's details. The code itself cannot be changed
+// because existing subscriptions refer to it.
+func (h *SubscriptionHandler) UpdatePlan(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+
+	var request PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	plan, err := findPlan(h.db, code)
+	if err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Plan not found")
+		return
+	}
+
+	if request.Name != "" {
+		plan.Name = request.Name
+	}
+	if request.DurationMonths != 0 {
+		if request.DurationMonths < 1 {
+			h.respondWithError(w, http.StatusBadRequest, "Duration must be positive")
+			return
+		}
+		plan.DurationMonths = request.DurationMonths
+	}
+	if request.Price != 0 {
+		if request.Price < 0 {
+			h.respondWithError(w, http.StatusBadRequest, "Price must be positive")
+			return
+		}
+		plan.Price = request.Price
+	}
+	if request.Currency != "" {
+		if !utils.IsSupportedCurrency(request.Currency) {
+			h.respondWithError(w, http.StatusBadRequest, "Unsupported currency")
+			return
+		}
+		plan.Currency = utils.NormalizeCurrency(request.Currency)
+	}
+	if request.Features != nil {
+		plan.Features = pq.StringArray(request.Features)
+	}
+	if request.Active != nil {
+		plan.Active = *request.Active
+	}
+	// Seeded legacy plans have no price until one is set
+	if plan.Active && plan.Price <= 0 {
+		h.respondWithError(w, http.StatusBadRequest, "Set a price before activating the plan")
+		return
+	}
+
+	if err := h.db.Save(plan).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to update plan")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: plan})
+}
+
+// DeactivatePlan retires a plan so it can no longer be bought. Plans are never
+// deleted because existing subscriptions still refer to them.
+func (h *SubscriptionHandler) DeactivatePlan(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+
+	result := h.db.Model(&models.SubscriptionPlan{}).Where("code = ?", NormalizePlanCode(code)).Update("active", false)
+	if result.Error != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to deactivate plan")
+		return
+	}
+	if result.RowsAffected == 0 {
+		h.respondWithError(w, http.StatusNotFound, "Plan not found")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: map[string]string{
+		"message": "Plan deactivated successfully",
+	}})
+}
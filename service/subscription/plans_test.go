@@ -0,0 +1,199 @@
+package subscription
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+func TestNormalizePlanCode(t *testing.T) {
+	tests := []struct{ code, want string }{
+		{"monthly", "monthly"},
+		{" Monthly ", "monthly"},
+		{"ANNUAL", "annual"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizePlanCode(tt.code); got != tt.want {
+			t.Errorf("NormalizePlanCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestLookupPlan(t *testing.T) {
+	db := testdb.Open(t, "subscription")
+	testdb.Plan(t, db, "monthly", 1, 10000)
+	retired := testdb.Plan(t, db, "weekly", 1, 3000)
+	db.Model(retired).Update("active", false)
+
+	tests := []struct {
+		code    string
+		wantErr error
+	}{
+		{code: "monthly"},
+		{code: " MONTHLY "},
+		{code: "weekly", wantErr: ErrInactivePlan},
+		{code: "lifetime", wantErr: ErrUnknownPlan},
+		{code: "", wantErr: ErrUnknownPlan},
+	}
+	for _, tt := range tests {
+		plan, err := LookupPlan(db, tt.code)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("LookupPlan(%q) error = %v, want %v", tt.code, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (plan.Code != "monthly" || plan.Price != 10000) {
+			t.Errorf("LookupPlan(%q) = %s at %d", tt.code, plan.Code, plan.Price)
+		}
+	}
+
+	// Retired plans still resolve for the subscriptions that use them
+	if plan, err := findPlan(db, "weekly"); err != nil || plan.Active {
+		t.Errorf("findPlan(weekly) = %+v, %v", plan, err)
+	}
+}
+
+func TestCreatePlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{name: "new plan", body: `{"code":" Quarterly ","name":"Quarterly","duration_months":3,"price_minor":25000,"currency":"ghs"}`, wantCode: http.StatusCreated},
+		{name: "missing code", body: `{"name":"Quarterly","duration_months":3,"price_minor":25000}`, wantCode: http.StatusBadRequest},
+		{name: "no price", body: `{"code":"free","name":"Free","duration_months":1}`, wantCode: http.StatusBadRequest},
+		{name: "no duration", body: `{"code":"short","name":"Short","price_minor":100}`, wantCode: http.StatusBadRequest},
+		{name: "unsupported currency", body: `{"code":"euro","name":"Euro","duration_months":1,"price_minor":100,"currency":"XXX"}`, wantCode: http.StatusBadRequest},
+		{name: "existing code in another case", body: `{"code":"MONTHLY","name":"Monthly","duration_months":1,"price_minor":100}`, wantCode: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "subscription")
+			testdb.Plan(t, db, "monthly", 1, 10000)
+			h := &SubscriptionHandler{db: db}
+
+			w := httptest.NewRecorder()
+			h.CreatePlan(w, httptest.NewRequest(http.MethodPost, "/plans", strings.NewReader(tt.body)))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+
+			if tt.wantCode == http.StatusCreated {
+				plan, err := LookupPlan(db, "quarterly")
+				if err != nil {
+					t.Fatalf("created plan not found: %v", err)
+				}
+				if plan.Price != 25000 || plan.Currency != "GHS" || !plan.Active {
+					t.Errorf("created plan = %+v", plan)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdatePlan(t *testing.T) {
+	tests := []struct {
+		name       string
+		price      int64 // Of the plan before the update
+		body       string
+		wantCode   int
+		wantActive bool
+		wantPrice  int64
+	}{
+		{name: "activate a seeded plan without a price", body: `{"active":true}`, wantCode: http.StatusBadRequest},
+		{name: "price and activate a seeded plan", body: `{"active":true,"price_minor":9000}`, wantCode: http.StatusOK, wantActive: true, wantPrice: 9000},
+		{name: "negative price", price: 9000, body: `{"price_minor":-1}`, wantCode: http.StatusBadRequest, wantPrice: 9000},
+		{name: "retire", price: 9000, body: `{"active":false}`, wantCode: http.StatusOK, wantPrice: 9000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "subscription")
+			if err := db.Create(&models.SubscriptionPlan{Code: "annual", Name: "Annual", DurationMonths: 12, Price: tt.price, Currency: "GHS"}).Error; err != nil {
+				t.Fatal(err)
+			}
+			h := &SubscriptionHandler{db: db}
+
+			r := mux.SetURLVars(httptest.NewRequest(http.MethodPut, "/plans/ANNUAL", strings.NewReader(tt.body)), map[string]string{"code": "ANNUAL"})
+			w := httptest.NewRecorder()
+			h.UpdatePlan(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+
+			plan, err := findPlan(db, "annual")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plan.Active != tt.wantActive || plan.Price != tt.wantPrice {
+				t.Errorf("plan is active %v at %d, want active %v at %d", plan.Active, plan.Price, tt.wantActive, tt.wantPrice)
+			}
+		})
+	}
+}
+
+func TestCompleteSubscriptionPaymentPlan(t *testing.T) {
+	now := time.Date(2026, 1, 31, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		plan     string
+		paid     int64
+		existing bool // The user already has an active subscription
+		wantErr  error
+		wantEnd  time.Time
+	}{
+		{name: "quarterly plan", plan: "quarterly", paid: 25000, wantEnd: planEndDate(&models.SubscriptionPlan{DurationMonths: 3}, now)},
+		{name: "chained onto the active subscription", plan: "quarterly", paid: 25000, existing: true, wantEnd: planEndDate(&models.SubscriptionPlan{DurationMonths: 3}, now.AddDate(0, 0, 10))},
+		{name: "unknown plan is not treated as monthly", plan: "lifetime", paid: 25000, wantErr: ErrUnknownPlan},
+		{name: "underpaid", plan: "quarterly", paid: 100, wantErr: ErrAmountMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "subscription")
+			testdb.Plan(t, db, "quarterly", 3, 25000)
+			user := testdb.User(t, db, "Plan Buyer")
+
+			if tt.existing {
+				if err := db.Create(&models.SignalSubscription{UserID: user.ID, Plan: "quarterly", Amount: 25000, Currency: "GHS", Status: "active",
+					PaymentID: "SIG-earlier", StartDate: now.AddDate(0, -3, 0), EndDate: now.AddDate(0, 0, 10)}).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			sub := models.SignalSubscription{UserID: user.ID, Plan: tt.plan, Amount: 25000, Currency: "GHS", Status: "pending", PaymentID: "SIG-new"}
+			if err := db.Create(&sub).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				_, _, err := CompleteSubscriptionPayment(tx, sub.PaymentID, tt.paid, "GHS", payment.ChannelCard, Authorization{}, now)
+				return err
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CompleteSubscriptionPayment error = %v, want %v", err, tt.wantErr)
+			}
+
+			db.First(&sub, sub.ID)
+			if tt.wantErr != nil {
+				if sub.Status != "pending" {
+					t.Errorf("status = %q after a rejected payment", sub.Status)
+				}
+				return
+			}
+			if sub.Status != "active" || !sub.EndDate.Equal(tt.wantEnd) {
+				t.Errorf("subscription is %s until %v, want active until %v", sub.Status, sub.EndDate, tt.wantEnd)
+			}
+		})
+	}
+}
@@ -0,0 +1,482 @@
+package subscription
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/service/earnings"
+	"github.com/KAsare1/Kodefx-server/service/invoices"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/KAsare1/Kodefx-server/service/promotions"
+	"github.com/KAsare1/Kodefx-server/service/wallet"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// renewalLead is how long before EndDate the first renewal attempt is made
+	renewalLead = 24 * time.Hour
+	// gracePeriod keeps a past_due subscription usable while retries run
+	gracePeriod = 3 * 24 * time.Hour
+	// renewalInterval is how often the renewal worker wakes up
+	renewalInterval = 15 * time.Minute
+	// renewalClaim is how long an instance has a due subscription to itself
+	// while it charges it, so other instances don't charge it too
+	renewalClaim = time.Hour
+	// renewalSettleWait is how long a renewal charge with no definite outcome
+	// is left for the webhook before it is verified with the provider
+	renewalSettleWait = time.Hour
+)
+
+// retrySchedule is the wait after each failed renewal attempt. Once it is
+// exhausted auto-renew is switched off and the subscription lapses.
+var retrySchedule = []time.Duration{
+	12 * time.Hour,
+	24 * time.Hour,
+	48 * time.Hour,
+}
+
+// retryAfter returns how long to wait before the next renewal attempt once
+// attempts have failed, or false when the schedule is exhausted
+func retryAfter(attempts int) (time.Duration, bool) {
+	if attempts > len(retrySchedule) {
+		return 0, false
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	return retrySchedule[attempts-1], true
+}
+
+// Authorization is the reusable card authorization reported with a successful charge
+type Authorization struct {
+	AuthorizationCode string `json:"authorization_code"`
+	Reusable          bool   `json:"reusable"`
+	Channel           string `json:"channel"`
+	Bank              string `json:"bank"` // Issuing bank, or the network for mobile money
+}
+
+// ActiveScope restricts a subscription query to subscriptions that currently
+// grant access, including past_due ones still inside their grace period.
+func ActiveScope(now time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("((status = ? AND start_date <= ? AND end_date >= ?) OR (status = ? AND grace_until >= ?))",
+			"active", now, now, "past_due", now)
+	}
+}
+
+var (
+	// ErrAmountMismatch is returned when a payment does not cover the subscription price
+	ErrAmountMismatch = errors.New("payment amount does not match subscription amount")
+	// ErrCurrencyMismatch is returned when a payment is in a different currency from the subscription
+	ErrCurrencyMismatch = errors.New("payment currency does not match subscription currency")
+)
+
+// ReleaseDeclinedPayment marks the pending subscription paid for by reference
+// failed after its payment was declined, returning its wallet hold and
+// freeing its coupon
+func ReleaseDeclinedPayment(db *gorm.DB, reference string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.SignalSubscription{}).
+			Where("payment_id = ? AND status = ?", reference, "pending").
+			Update("status", "failed").Error; err != nil {
+			return err
+		}
+		if err := wallet.ReleaseHold(tx, reference); err != nil {
+			return err
+		}
+		return promotions.ReleaseReservation(tx, reference)
+	})
+}
+
+// planEndDate calculates when a subscription to plan started at start expires
+func planEndDate(plan *models.SubscriptionPlan, start time.Time) time.Time {
+	return start.AddDate(0, plan.DurationMonths, 0)
+}
+
+// CompleteSubscriptionPayment activates the pending subscription paid for by
+// reference and records the transaction. amount is what was collected by card,
+// in minor units of currency; any wallet part is captured here, and if it was
+// released and spent meanwhile the card payment is refunded to the wallet.
+// It is idempotent: a subscription that is no longer pending is returned with
+// activated set to false.
+func CompleteSubscriptionPayment(tx *gorm.DB, reference string, amount int64, currency string, method string, auth Authorization, now time.Time) (*models.SignalSubscription, bool, error) {
+	var subscription models.SignalSubscription
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("payment_id = ?", reference).
+		First(&subscription).Error; err != nil {
+		return nil, false, err
+	}
+
+	if subscription.Status != "pending" {
+		return &subscription, false, nil
+	}
+
+	plan, err := findPlan(tx, subscription.Plan)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if amount > 0 && currency != subscription.Currency {
+		return nil, false, ErrCurrencyMismatch
+	}
+	if amount+subscription.WalletAmount < subscription.Amount {
+		return nil, false, ErrAmountMismatch
+	}
+
+	// A payment that arrives after the wallet part was released and spent
+	// can't activate the subscription, so the card payment is refunded instead
+	err = wallet.CaptureHold(tx, subscription.UserID, subscription.WalletAmount, subscription.Currency, reference)
+	if errors.Is(err, wallet.ErrInsufficientFunds) {
+		log.Printf("Refunding subscription payment %s: %v", reference, err)
+		subscription.Status = "failed"
+		subscription.WalletAmount = 0
+		if err := tx.Save(&subscription).Error; err != nil {
+			return nil, false, err
+		}
+		return &subscription, false, wallet.RefundPayment(tx, subscription.UserID, amount, subscription.Currency,
+			reference, "Refund for Signal Subscription - "+subscription.Plan)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if subscription.ReplacesID != nil {
+		// Plan change: take over from the replaced subscription right now
+		if err := switchSubscription(tx, &subscription, plan, now); err != nil {
+			return nil, false, err
+		}
+	} else {
+		// Chain onto any subscription the user already has so paid periods never overlap
+		start := now
+		var latest models.SignalSubscription
+		err = tx.Where("user_id = ? AND id != ? AND status = ? AND end_date > ?",
+			subscription.UserID, subscription.ID, "active", now).
+			Order("end_date DESC").
+			First(&latest).Error
+		if err == nil {
+			start = latest.EndDate
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, err
+		}
+
+		subscription.StartDate = start
+		subscription.EndDate = planEndDate(plan, start)
+	}
+
+	// An automatic renewal continues the subscription it was charged for
+	if subscription.RenewalOfID != nil {
+		if err := tx.Model(&models.SignalSubscription{}).
+			Where("id = ?", *subscription.RenewalOfID).
+			Updates(map[string]interface{}{
+				"renewed_by_id":    subscription.ID,
+				"renewal_attempts": 0,
+			}).Error; err != nil {
+			return nil, false, err
+		}
+	}
+
+	subscription.Status = "active"
+	subscription.RenewalAttempts = 0
+	subscription.NextRenewalAt = time.Time{}
+	// Only cards can be charged again without the customer; mobile money
+	// payments need approval on the phone every time
+	if auth.Reusable && auth.AuthorizationCode != "" && (auth.Channel == "" || auth.Channel == payment.ChannelCard) {
+		subscription.AuthorizationCode = auth.AuthorizationCode
+	}
+
+	if err := tx.Save(&subscription).Error; err != nil {
+		return nil, false, err
+	}
+
+	// A successful payment settles any earlier subscription that was waiting on renewal
+	if err := tx.Model(&models.SignalSubscription{}).
+		Where("user_id = ? AND id != ? AND status = ?", subscription.UserID, subscription.ID, "past_due").
+		Updates(map[string]interface{}{
+			"status":        "expired",
+			"renewed_by_id": subscription.ID,
+		}).Error; err != nil {
+		return nil, false, err
+	}
+
+	// Plan changes fully covered by proration credit involve no payment
+	if amount == 0 && subscription.ReplacesID != nil {
+		return &subscription, true, nil
+	}
+
+	total := amount + subscription.WalletAmount
+	redemption, err := promotions.SettlePayment(tx, subscription.UserID, reference, total, now)
+	if err != nil {
+		return nil, false, err
+	}
+
+	purpose := "Signal Subscription - " + subscription.Plan
+	if subscription.ReplacesID != nil {
+		purpose += " (plan change)"
+	}
+
+	transaction := models.Transaction{
+		UserID:       subscription.UserID,
+		Amount:       total,
+		WalletAmount: subscription.WalletAmount,
+		Currency:     subscription.Currency,
+		Method:       method,
+		Purpose:      purpose,
+		Reference:    reference,
+	}
+	if redemption != nil {
+		transaction.CouponCode = redemption.Coupon.Code
+		transaction.DiscountAmount = redemption.DiscountAmount
+	}
+	if err := tx.Create(&transaction).Error; err != nil {
+		return nil, false, err
+	}
+
+	if _, err := invoices.IssueInvoice(tx, &transaction, invoices.KindSignalSubscription, purpose); err != nil {
+		return nil, false, err
+	}
+
+	// Subscription revenue is not tied to an expert, so the platform keeps all of it
+	if err := earnings.RecordPayment(tx, reference, total, subscription.Currency, nil, purpose); err != nil {
+		return nil, false, err
+	}
+
+	return &subscription, true, nil
+}
+
+// runRenewals periodically renews subscriptions that are about to expire and
+// moves lapsed ones through past_due and expired.
+func (h *SubscriptionHandler) runRenewals() {
+	ticker := time.NewTicker(renewalInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		if err := h.markLapsedSubscriptions(now); err != nil {
+			log.Printf("Error updating lapsed subscriptions: %v", err)
+		}
+		if err := h.renewDueSubscriptions(now); err != nil {
+			log.Printf("Error renewing subscriptions: %v", err)
+		}
+	}
+}
+
+// markLapsedSubscriptions puts auto-renewing subscriptions that passed their
+// EndDate into their grace period and expires those whose grace has run out.
+func (h *SubscriptionHandler) markLapsedSubscriptions(now time.Time) error {
+	var lapsed []models.SignalSubscription
+	if err := h.db.Where("status = ? AND end_date < ? AND auto_renew = ? AND renewed_by_id IS NULL", "active", now, true).
+		Find(&lapsed).Error; err != nil {
+		return err
+	}
+
+	for _, sub := range lapsed {
+		// A chained subscription may already cover the user
+		var successor int64
+		h.db.Model(&models.SignalSubscription{}).
+			Where("user_id = ? AND id != ? AND status = ? AND start_date >= ?", sub.UserID, sub.ID, "active", sub.StartDate).
+			Count(&successor)
+		if successor > 0 {
+			continue
+		}
+
+		if err := h.db.Model(&sub).Updates(map[string]interface{}{
+			"status":      "past_due",
+			"grace_until": sub.EndDate.Add(gracePeriod),
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	return h.db.Model(&models.SignalSubscription{}).
+		Where("status = ? AND grace_until < ?", "past_due", now).
+		Updates(map[string]interface{}{
+			"status":     "expired",
+			"auto_renew": false,
+		}).Error
+}
+
+// renewDueSubscriptions settles renewal charges left waiting on the provider
+// and charges the saved authorization of every auto-renewing subscription
+// that ends within renewalLead. Subscriptions with a renewal charge still
+// waiting are skipped so they are never charged twice.
+func (h *SubscriptionHandler) renewDueSubscriptions(now time.Time) error {
+	if err := h.settlePendingRenewals(now); err != nil {
+		log.Printf("Error settling pending renewals: %v", err)
+	}
+
+	var due []models.SignalSubscription
+	if err := h.db.Preload("User").
+		Where("status IN ? AND auto_renew = ? AND renewed_by_id IS NULL AND authorization_code != '' AND end_date <= ? AND next_renewal_at <= ?",
+			[]string{"active", "past_due"}, true, now.Add(renewalLead), now).
+		Where("NOT EXISTS (?)", h.db.Model(&models.SignalSubscription{}).
+			Select("1").
+			Where("renewal_of_id = signal_subscriptions.id AND status = ?", "pending")).
+		Find(&due).Error; err != nil {
+		return err
+	}
+
+	for i := range due {
+		// Claim the subscription so no other instance charges it at the same time
+		claim := h.db.Model(&models.SignalSubscription{}).
+			Where("id = ? AND next_renewal_at <= ?", due[i].ID, now).
+			Update("next_renewal_at", now.Add(renewalClaim))
+		if claim.Error != nil {
+			log.Printf("Error claiming subscription %d for renewal: %v", due[i].ID, claim.Error)
+			continue
+		}
+		if claim.RowsAffected == 0 {
+			continue
+		}
+
+		if err := h.renewSubscription(&due[i], now); err != nil {
+			log.Printf("Error renewing subscription %d: %v", due[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// renewSubscription attempts a single renewal charge for sub. Only a
+// definite decline counts as a failed attempt; a charge that is still
+// pending, or whose outcome is unknown, is left for the webhook or
+// settlePendingRenewals to complete.
+func (h *SubscriptionHandler) renewSubscription(sub *models.SignalSubscription, now time.Time) error {
+	// Renewals are charged at the current catalog price
+	plan, err := LookupPlan(h.db, sub.Plan)
+	if err != nil {
+		log.Printf("Disabling auto-renew for subscription %d: %v", sub.ID, err)
+		return h.db.Model(sub).Update("auto_renew", false).Error
+	}
+
+	reference := fmt.Sprintf("SIG-%d-%d", sub.UserID, now.UnixNano())
+
+	renewal := models.SignalSubscription{
+		UserID:            sub.UserID,
+		Plan:              plan.Code,
+		Amount:            plan.Price,
+		Currency:          plan.Currency,
+		Status:            "pending",
+		PaymentID:         reference,
+		AutoRenew:         true,
+		AuthorizationCode: sub.AuthorizationCode,
+		RenewalOfID:       &sub.ID,
+	}
+	if err := h.db.Create(&renewal).Error; err != nil {
+		return err
+	}
+
+	result, chargeErr := h.provider.ChargeAuthorization(payment.ChargeAuthorizationRequest{
+		Email:             sub.User.Email,
+		Amount:            renewal.Amount,
+		Currency:          renewal.Currency,
+		Reference:         reference,
+		AuthorizationCode: sub.AuthorizationCode,
+		Metadata: map[string]interface{}{
+			"payment_type": "signal_subscription",
+			"user_id":      sub.UserID,
+			"signal_plan":  sub.Plan,
+			"renewal_of":   sub.ID,
+		},
+	})
+
+	// Only a charge Paystack reports as declined has failed. Any error leaves
+	// the outcome unknown, so the renewal waits for the webhook or
+	// settlePendingRenewals rather than being charged again.
+	switch {
+	case chargeErr != nil:
+		log.Printf("Renewal charge %s for subscription %d has no outcome yet: %v", reference, sub.ID, chargeErr)
+		return nil
+	case result.Declined():
+		return h.recordFailedRenewal(sub, &renewal, now, fmt.Errorf("charge %s: %s", result.Status, result.GatewayResponse))
+	case !result.Succeeded():
+		log.Printf("Renewal charge %s for subscription %d is %s; waiting for the webhook", reference, sub.ID, result.Status)
+		return nil
+	}
+
+	return h.completeRenewal(&renewal, renewal.Amount, renewal.Currency, now)
+}
+
+// completeRenewal activates a renewal whose charge succeeded
+func (h *SubscriptionHandler) completeRenewal(renewal *models.SignalSubscription, amount int64, currency string, now time.Time) error {
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		_, _, err := CompleteSubscriptionPayment(tx, renewal.PaymentID, amount, currency, payment.ChannelCard,
+			Authorization{AuthorizationCode: renewal.AuthorizationCode, Reusable: true}, now)
+		return err
+	})
+}
+
+// settlePendingRenewals verifies renewal charges that have waited longer than
+// renewalSettleWait without a webhook. Successful ones are completed, and
+// declined ones and those Paystack has no record of are counted as failed
+// attempts. The rest, including any that can't be verified, keep waiting.
+func (h *SubscriptionHandler) settlePendingRenewals(now time.Time) error {
+	var pending []models.SignalSubscription
+	if err := h.db.Where("renewal_of_id IS NOT NULL AND status = ? AND created_at <= ?", "pending", now.Add(-renewalSettleWait)).
+		Find(&pending).Error; err != nil {
+		return err
+	}
+
+	for i := range pending {
+		renewal := &pending[i]
+		result, err := h.provider.VerifyTransaction(renewal.PaymentID)
+		if err != nil && !errors.Is(err, payment.ErrChargeFailed) {
+			log.Printf("Error verifying renewal charge %s: %v", renewal.PaymentID, err)
+			continue
+		}
+
+		if err == nil && result.Succeeded() {
+			if err := h.completeRenewal(renewal, result.Amount, result.Currency, now); err != nil {
+				log.Printf("Error completing renewal %s: %v", renewal.PaymentID, err)
+			}
+			continue
+		}
+		if err == nil && !result.Declined() {
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("charge %s: %s", result.Status, result.GatewayResponse)
+		}
+
+		var sub models.SignalSubscription
+		if err := h.db.First(&sub, *renewal.RenewalOfID).Error; err != nil {
+			log.Printf("Error loading subscription %d for renewal %s: %v", *renewal.RenewalOfID, renewal.PaymentID, err)
+			continue
+		}
+		if err := h.recordFailedRenewal(&sub, renewal, now, err); err != nil {
+			log.Printf("Error recording failed renewal %s: %v", renewal.PaymentID, err)
+		}
+	}
+	return nil
+}
+
+// recordFailedRenewal schedules the next dunning attempt or gives up on
+// auto-renew. The renewal is only marked failed if it is still pending, so
+// a renewal settled meanwhile by the webhook is left alone.
+func (h *SubscriptionHandler) recordFailedRenewal(sub *models.SignalSubscription, renewal *models.SignalSubscription, now time.Time, cause error) error {
+	log.Printf("Renewal of subscription %d failed: %v", sub.ID, cause)
+
+	result := h.db.Model(&models.SignalSubscription{}).
+		Where("id = ? AND status = ?", renewal.ID, "pending").
+		Update("status", "failed")
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	attempts := sub.RenewalAttempts + 1
+	updates := map[string]interface{}{
+		"renewal_attempts": attempts,
+	}
+	if wait, ok := retryAfter(attempts); ok {
+		updates["next_renewal_at"] = now.Add(wait)
+	} else {
+		updates["auto_renew"] = false
+	}
+
+	return h.db.Model(sub).Updates(updates).Error
+}
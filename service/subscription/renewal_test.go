@@ -0,0 +1,252 @@
+package subscription
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/KAsare1/Kodefx-server/service/payment"
+	"github.com/KAsare1/Kodefx-server/service/wallet/wallettest"
+	"gorm.io/gorm"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		attempts int
+		wait     time.Duration
+		ok       bool
+	}{
+		{1, 12 * time.Hour, true},
+		{2, 24 * time.Hour, true},
+		{3, 48 * time.Hour, true},
+		{4, 0, false},
+	}
+	for _, tt := range tests {
+		wait, ok := retryAfter(tt.attempts)
+		if wait != tt.wait || ok != tt.ok {
+			t.Errorf("retryAfter(%d) = %v, %v; want %v, %v", tt.attempts, wait, ok, tt.wait, tt.ok)
+		}
+	}
+}
+
+// renewalFixture creates a monthly plan and an auto-renewing subscription for
+// a new user that ends within renewalLead of now
+func renewalFixture(t *testing.T, db *gorm.DB, now time.Time, attempts int) *models.SignalSubscription {
+	t.Helper()
+
+	plan := testdb.Plan(t, db, "monthly", 1, 10000)
+	user := testdb.User(t, db, "Renewing Trader")
+	sub := testdb.Subscription(t, db, user.ID, plan, now.AddDate(0, -1, 0), now.Add(time.Hour))
+	if err := db.Model(sub).Updates(map[string]interface{}{
+		"auto_renew":         true,
+		"authorization_code": "AUTH_test",
+		"renewal_attempts":   attempts,
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	db.First(sub, sub.ID)
+	return sub
+}
+
+func TestRenewDueSubscriptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       string
+		chargeErr    error
+		attempts     int
+		renewal      string // Status of the renewal created
+		wantAttempts int
+		wantRenew    bool
+		wantNext     time.Duration // From now, when a retry is scheduled
+	}{
+		{name: "charge succeeds", status: payment.ChargeSuccess, renewal: "active", wantRenew: true},
+		{name: "first decline is retried", status: payment.ChargeFailed, renewal: "failed", wantAttempts: 1, wantRenew: true, wantNext: 12 * time.Hour},
+		{name: "last decline stops renewing", status: payment.ChargeFailed, attempts: 3, renewal: "failed", wantAttempts: 4},
+		{name: "abandoned charge is a decline", status: "abandoned", renewal: "failed", wantAttempts: 1, wantRenew: true, wantNext: 12 * time.Hour},
+		{name: "timeout waits for the webhook", chargeErr: errors.New("timeout"), renewal: "pending", wantRenew: true},
+		{name: "rate limit waits for verification", chargeErr: &payment.APIError{StatusCode: 429}, renewal: "pending", wantRenew: true},
+		{name: "rejected request waits for verification", chargeErr: &payment.APIError{StatusCode: 400, Message: "Invalid authorization"}, renewal: "pending", wantRenew: true},
+		{name: "pending charge waits for the webhook", status: payment.ChargePending, renewal: "pending", wantRenew: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "subscription")
+			now := time.Now().Truncate(time.Second)
+			sub := renewalFixture(t, db, now, tt.attempts)
+
+			provider := payment.NewFakeProvider()
+			provider.ChargeStatus = tt.status
+			provider.ChargeErr = tt.chargeErr
+			h := &SubscriptionHandler{db: db, provider: provider}
+
+			if err := h.renewDueSubscriptions(now); err != nil {
+				t.Fatalf("renewDueSubscriptions: %v", err)
+			}
+			if len(provider.Charged) != 1 {
+				t.Fatalf("charged %d times, want 1", len(provider.Charged))
+			}
+
+			var renewal models.SignalSubscription
+			if err := db.Where("renewal_of_id = ?", sub.ID).First(&renewal).Error; err != nil {
+				t.Fatalf("loading renewal: %v", err)
+			}
+			if renewal.Status != tt.renewal {
+				t.Errorf("renewal status = %q, want %q", renewal.Status, tt.renewal)
+			}
+
+			var got models.SignalSubscription
+			db.First(&got, sub.ID)
+			if got.RenewalAttempts != tt.wantAttempts {
+				t.Errorf("renewal attempts = %d, want %d", got.RenewalAttempts, tt.wantAttempts)
+			}
+			if got.AutoRenew != tt.wantRenew {
+				t.Errorf("auto renew = %v, want %v", got.AutoRenew, tt.wantRenew)
+			}
+			if tt.wantNext > 0 && !got.NextRenewalAt.Equal(now.Add(tt.wantNext)) {
+				t.Errorf("next renewal at %v, want %v", got.NextRenewalAt, now.Add(tt.wantNext))
+			}
+			if tt.renewal == "active" && (got.RenewedByID == nil || *got.RenewedByID != renewal.ID) {
+				t.Errorf("subscription not continued by renewal %d", renewal.ID)
+			}
+
+			// A renewal still waiting on the provider is never charged again
+			if tt.renewal == "pending" {
+				if err := h.renewDueSubscriptions(now.Add(2 * renewalClaim)); err != nil {
+					t.Fatal(err)
+				}
+				if len(provider.Charged) != 1 {
+					t.Errorf("charged %d times while the renewal was pending, want 1", len(provider.Charged))
+				}
+			}
+		})
+	}
+}
+
+func TestSettlePendingRenewals(t *testing.T) {
+	tests := []struct {
+		name      string
+		verified  *payment.ChargeResult // nil when the provider never saw the charge
+		verifyErr error
+		want      string
+	}{
+		{name: "charge went through", verified: &payment.ChargeResult{Status: payment.ChargeSuccess, Amount: 10000, Currency: "GHS"}, want: "active"},
+		{name: "charge declined", verified: &payment.ChargeResult{Status: payment.ChargeFailed}, want: "failed"},
+		{name: "charge still pending", verified: &payment.ChargeResult{Status: payment.ChargePending}, want: "pending"},
+		{name: "charge unknown to the provider", want: "failed"},
+		{name: "provider unavailable", verifyErr: &payment.APIError{StatusCode: 503}, want: "pending"},
+		{name: "provider credentials rejected", verifyErr: &payment.APIError{StatusCode: 401}, want: "pending"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "subscription")
+			now := time.Now()
+			sub := renewalFixture(t, db, now, 0)
+
+			renewal := models.SignalSubscription{
+				UserID:            sub.UserID,
+				Plan:              sub.Plan,
+				Amount:            sub.Amount,
+				Currency:          sub.Currency,
+				Status:            "pending",
+				PaymentID:         "SIG-renewal",
+				AutoRenew:         true,
+				AuthorizationCode: sub.AuthorizationCode,
+				RenewalOfID:       &sub.ID,
+			}
+			if err := db.Create(&renewal).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			provider := payment.NewFakeProvider()
+			if tt.verified != nil {
+				provider.Verified[renewal.PaymentID] = *tt.verified
+			}
+			provider.VerifyErr = tt.verifyErr
+			h := &SubscriptionHandler{db: db, provider: provider}
+
+			if err := h.settlePendingRenewals(now.Add(renewalSettleWait + time.Minute)); err != nil {
+				t.Fatalf("settlePendingRenewals: %v", err)
+			}
+
+			db.First(&renewal, renewal.ID)
+			if renewal.Status != tt.want {
+				t.Errorf("renewal status = %q, want %q", renewal.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteSubscriptionPaymentLate(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		releaseHold bool // The wallet hold was released before the payment arrived
+		spendHold   bool // and the money spent
+		activated   bool
+		wantStatus  string
+		wantWallet  int64
+	}{
+		{name: "wallet hold still held", status: "pending", activated: true, wantStatus: "active"},
+		{name: "wallet hold released but balance left", status: "pending", releaseHold: true, activated: true, wantStatus: "active"},
+		{name: "wallet hold released and spent", status: "pending", releaseHold: true, spendHold: true, wantStatus: "failed", wantWallet: 6000},
+		{name: "repeated webhook", status: "active", wantStatus: "active"},
+		{name: "declined checkout", status: "failed", wantStatus: "failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "subscription")
+			now := time.Now()
+			testdb.Plan(t, db, "monthly", 1, 10000)
+			user := testdb.User(t, db, "Late Payer")
+			reference := "SIG-late"
+
+			// 40.00 of the 100.00 comes from the wallet
+			wallettest.Hold(t, db, user.ID, 4000, reference)
+			if tt.releaseHold {
+				wallettest.Release(t, db, reference)
+			}
+			if tt.spendHold {
+				wallettest.Spend(t, db, user.ID, 4000)
+			}
+
+			sub := models.SignalSubscription{
+				UserID:       user.ID,
+				Plan:         "monthly",
+				Amount:       10000,
+				WalletAmount: 4000,
+				Currency:     "GHS",
+				Status:       tt.status,
+				PaymentID:    reference,
+			}
+			if err := db.Create(&sub).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			var activated bool
+			err := db.Transaction(func(tx *gorm.DB) error {
+				var err error
+				_, activated, err = CompleteSubscriptionPayment(tx, reference, 6000, "GHS", payment.ChannelCard, Authorization{}, now)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("CompleteSubscriptionPayment: %v", err)
+			}
+			if activated != tt.activated {
+				t.Errorf("activated = %v, want %v", activated, tt.activated)
+			}
+
+			db.First(&sub, sub.ID)
+			if sub.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", sub.Status, tt.wantStatus)
+			}
+			if balance := wallettest.Balance(t, db, user.ID); balance != tt.wantWallet {
+				t.Errorf("wallet balance = %d, want %d", balance, tt.wantWallet)
+			}
+		})
+	}
+}
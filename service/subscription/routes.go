@@ -10,6 +10,7 @@ import (
 	"gorm.io/gorm"
 	"github.com/KAsare1/Kodefx-server/cmd/models"
 	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/payment"
 )
 
 // Response is a standardized API response structure
@@ -24,8 +25,8 @@ type SubscriptionFilter struct {
 	UserID     uint
 	Plan       string
 	Status     string
-	MinAmount  float64
-	MaxAmount  float64
+	MinAmount  int64 // Minor units
+	MaxAmount  int64 // Minor units
 	StartDate  time.Time
 	EndDate    time.Time
 	IsExpired  *bool // Pointer to handle three states: nil (not filtered), true, false
@@ -39,12 +40,19 @@ type SubscriptionResponse struct {
 
 // SubscriptionHandler handles subscription-related HTTP requests
 type SubscriptionHandler struct {
-	db *gorm.DB
+	db       *gorm.DB
+	provider payment.Provider
 }
 
-// NewSubscriptionHandler creates a new subscription handler
+// NewSubscriptionHandler creates a new subscription handler and starts the renewal worker
 func NewSubscriptionHandler(db *gorm.DB) *SubscriptionHandler {
-	return &SubscriptionHandler{db: db}
+	h := &SubscriptionHandler{
+		db:       db,
+		provider: payment.NewProvider(),
+	}
+	go h.runRenewals()
+
+	return h
 }
 
 // RegisterRoutes registers all subscription routes
@@ -60,6 +68,19 @@ func (h *SubscriptionHandler) RegisterRoutes(router *mux.Router) {
 	// User subscription routes
 	subscriptionRouter.HandleFunc("/user/{userID:[0-9]+}", utils.AuthMiddleware(h.GetUserSubscriptions)).Methods("GET")
 	subscriptionRouter.HandleFunc("/user/{userID:[0-9]+}/active", utils.AuthMiddleware(h.GetActiveSubscription)).Methods("GET")
+
+	// Plan catalog
+	subscriptionRouter.HandleFunc("/plans", h.GetPlans).Methods("GET")
+	subscriptionRouter.HandleFunc("/plans", utils.AdminMiddleware(h.db, h.CreatePlan)).Methods("POST")
+	subscriptionRouter.HandleFunc("/plans/{code}", utils.AdminMiddleware(h.db, h.UpdatePlan)).Methods("PUT")
+	subscriptionRouter.HandleFunc("/plans/{code}", utils.AdminMiddleware(h.db, h.DeactivatePlan)).Methods("DELETE")
+
+	// Recurring billing
+	subscriptionRouter.HandleFunc("/{id:[0-9]+}/auto-renew", utils.AuthMiddleware(h.SetAutoRenew)).Methods("PATCH")
+
+	// Plan upgrades and downgrades
+	subscriptionRouter.HandleFunc("/{id:[0-9]+}/change-plan", utils.AuthMiddleware(h.QuotePlanChange)).Methods("GET")
+	subscriptionRouter.HandleFunc("/{id:[0-9]+}/change-plan", utils.AuthMiddleware(h.ChangePlan)).Methods("POST")
 }
 
 // GetSubscriptions handles retrieving subscriptions with various filters
@@ -88,7 +109,7 @@ func (h *SubscriptionHandler) GetSubscriptions(w http.ResponseWriter, r *http.Re
 
 	// Parse amount range filters
 	if minAmountStr := queryParams.Get("min_amount"); minAmountStr != "" {
-		filter.MinAmount, err = strconv.ParseFloat(minAmountStr, 64)
+		filter.MinAmount, err = strconv.ParseInt(minAmountStr, 10, 64)
 		if err != nil {
 			h.respondWithError(w, http.StatusBadRequest, "Invalid min_amount parameter")
 			return
@@ -96,7 +117,7 @@ func (h *SubscriptionHandler) GetSubscriptions(w http.ResponseWriter, r *http.Re
 	}
 
 	if maxAmountStr := queryParams.Get("max_amount"); maxAmountStr != "" {
-		filter.MaxAmount, err = strconv.ParseFloat(maxAmountStr, 64)
+		filter.MaxAmount, err = strconv.ParseInt(maxAmountStr, 10, 64)
 		if err != nil {
 			h.respondWithError(w, http.StatusBadRequest, "Invalid max_amount parameter")
 			return
@@ -293,11 +314,12 @@ func (h *SubscriptionHandler) GetActiveSubscription(w http.ResponseWriter, r *ht
 		return
 	}
 
-	// Find active subscription (not expired and status is active)
+	// Find the subscription currently granting access (active, or past_due within its grace period)
 	now := time.Now()
 	var subscription models.SignalSubscription
 	
-	err = h.db.Where("user_id = ? AND end_date >= ? AND status = ?", userID, now, "active").
+	err = h.db.Scopes(ActiveScope(now)).
+		Where("user_id = ?", userID).
 		Order("end_date DESC").  // Get the subscription that expires the latest
 		Preload("User").
 		First(&subscription).Error
@@ -315,6 +337,71 @@ func (h *SubscriptionHandler) GetActiveSubscription(w http.ResponseWriter, r *ht
 	h.respondWithJSON(w, http.StatusOK, Response{Data: response})
 }
 
+// SetAutoRenew turns automatic renewal on or off for one of the caller's subscriptions
+func (h *SubscriptionHandler) SetAutoRenew(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid subscription ID")
+		return
+	}
+
+	var request struct {
+		AutoRenew bool `json:"auto_renew"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	var subscription models.SignalSubscription
+	if err := h.db.First(&subscription, id).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Subscription not found")
+		return
+	}
+
+	if subscription.UserID != userID {
+		h.respondWithError(w, http.StatusForbidden, "You don't have permission to modify this subscription")
+		return
+	}
+
+	if request.AutoRenew {
+		if subscription.Status != "active" && subscription.Status != "past_due" {
+			h.respondWithError(w, http.StatusConflict, "Only active subscriptions can be renewed automatically")
+			return
+		}
+		if subscription.AuthorizationCode == "" {
+			h.respondWithError(w, http.StatusConflict, "No saved payment method for this subscription. Renew manually to save one")
+			return
+		}
+	}
+
+	updates := map[string]interface{}{
+		"auto_renew": request.AutoRenew,
+	}
+	if request.AutoRenew {
+		// Give the worker a fresh set of retries
+		updates["renewal_attempts"] = 0
+		updates["next_renewal_at"] = time.Time{}
+	}
+
+	if err := h.db.Model(&subscription).Updates(updates).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to update subscription")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: SubscriptionResponse{
+		SignalSubscription: subscription,
+		IsExpired:          subscription.EndDate.Before(time.Now()),
+	}})
+}
+
 // applySubscriptionFilters applies filters to a subscription query
 func (h *SubscriptionHandler) applySubscriptionFilters(query *gorm.DB, filter SubscriptionFilter) *gorm.DB {
 	if filter.UserID != 0 {
@@ -322,7 +409,7 @@ func (h *SubscriptionHandler) applySubscriptionFilters(query *gorm.DB, filter Su
 	}
 
 	if filter.Plan != "" {
-		query = query.Where("plan = ?", filter.Plan)
+		query = query.Where("plan = ?", NormalizePlanCode(filter.Plan))
 	}
 
 	if filter.Status != "" {
@@ -330,11 +417,11 @@ func (h *SubscriptionHandler) applySubscriptionFilters(query *gorm.DB, filter Su
 	}
 
 	if filter.MinAmount != 0 {
-		query = query.Where("amount >= ?", filter.MinAmount)
+		query = query.Where("amount_minor >= ?", filter.MinAmount)
 	}
 
 	if filter.MaxAmount != 0 {
-		query = query.Where("amount <= ?", filter.MaxAmount)
+		query = query.Where("amount_minor <= ?", filter.MaxAmount)
 	}
 
 	if !filter.StartDate.IsZero() {
@@ -12,6 +12,7 @@ import (
 
 	"github.com/KAsare1/Kodefx-server/cmd/models"
 	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/payment"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 )
@@ -21,8 +22,9 @@ type TransactionFilter struct {
 	UserID    uint
 	Method    string
 	Purpose   string
-	MinAmount float64
-	MaxAmount float64
+	Currency  string
+	MinAmount int64 // Minor units
+	MaxAmount int64 // Minor units
 	StartDate time.Time
 	EndDate   time.Time
 }
@@ -44,13 +46,36 @@ type PaginationMeta struct {
 	HasNext      bool  `json:"has_next"`
 }
 
+// CursorMeta contains cursor pagination metadata. Pass NextCursor as ?cursor=
+// to fetch the following page.
+type CursorMeta struct {
+	PerPage    int    `json:"per_page"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasNext    bool   `json:"has_next"`
+}
+
+// PurposeTotal sums the matching transactions for one purpose and currency
+type PurposeTotal struct {
+	Purpose   string `json:"purpose"`
+	Currency  string `json:"currency"`
+	Count     int64  `json:"count"`
+	Total     int64  `json:"total_minor"`
+	Formatted string `json:"total_formatted"`
+}
+
+// TransactionPage is one page of transaction history
+type TransactionPage struct {
+	Data       []models.Transaction `json:"data"`
+	Pagination CursorMeta           `json:"pagination"`
+	Totals     []PurposeTotal       `json:"totals"`
+}
 
 type PaystackTransaction struct {
 	ID        int     `json:"id"`
 	Domain    string  `json:"domain"`
 	Status    string  `json:"status"`
 	Reference string  `json:"reference"`
-	Amount    float64 `json:"amount"`
+	Amount    int64   `json:"amount"` // Minor units
 	Channel   string  `json:"channel"`
 	Currency  string  `json:"currency"`
 	PaidAt    string  `json:"paid_at"`
@@ -96,8 +121,12 @@ func NewTransactionHandler(db *gorm.DB) *TransactionHandler {
 func (h *TransactionHandler) RegisterRoutes(router *mux.Router) {
 	transactionRouter := router.PathPrefix("/transactions").Subrouter()
 
-	transactionRouter.HandleFunc("", utils.AuthMiddleware(h.GetPaystackTransactions)).Methods("GET")
-	transactionRouter.HandleFunc("/batch", utils.AuthMiddleware(h.CreateBatchTransactions)).Methods("POST")
+	transactionRouter.HandleFunc("", utils.AuthMiddleware(h.GetTransactions)).Methods("GET")
+	transactionRouter.HandleFunc("/{id:[0-9]+}", utils.AuthMiddleware(h.GetTransaction)).Methods("GET")
+
+	// Admin only: raw provider listing and manual imports
+	transactionRouter.HandleFunc("/paystack", utils.AdminMiddleware(h.db, h.GetPaystackTransactions)).Methods("GET")
+	transactionRouter.HandleFunc("/batch", utils.AdminMiddleware(h.db, h.CreateBatchTransactions)).Methods("POST")
 }
 
 // ParsePaginationParams extracts and validates pagination parameters from request
@@ -109,7 +138,7 @@ func ParsePaginationParams(r *http.Request) (int, int, error) {
 	if query.Get("page") != "" {
 		parsedPage, err := strconv.Atoi(query.Get("page"))
 		if err != nil || parsedPage < 1 {
-			return 0, 0, err
+			return 0, 0, fmt.Errorf("invalid page parameter")
 		}
 		page = parsedPage
 	}
@@ -119,7 +148,7 @@ func ParsePaginationParams(r *http.Request) (int, int, error) {
 	if query.Get("per_page") != "" {
 		parsedPerPage, err := strconv.Atoi(query.Get("per_page"))
 		if err != nil || parsedPerPage < 1 {
-			return 0, 0, err
+			return 0, 0, fmt.Errorf("invalid per_page parameter")
 		}
 		if parsedPerPage > 100 {
 			perPage = 100 // Cap at 100 to prevent excessive queries
@@ -131,33 +160,52 @@ func ParsePaginationParams(r *http.Request) (int, int, error) {
 	return page, perPage, nil
 }
 
-// GetTransactions handles retrieving transactions with various filters
+// GetTransactions returns transaction history from our own records, newest
+// first. Users only see their own transactions; admins may see everyone's or
+// filter by user_id. Pages are fetched with ?cursor= taken from the previous
+// page's next_cursor, and totals per purpose cover every matching transaction.
 func (h *TransactionHandler) GetTransactions(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	
+
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	isAdmin := utils.IsAdmin(h.db, userID)
+
 	var filter TransactionFilter
-	var err error
-	
+
 	// Parse query parameters
 	queryParams := r.URL.Query()
 
 	// Parse user_id filter
 	if userIDStr := queryParams.Get("user_id"); userIDStr != "" {
-		userID, err := strconv.ParseUint(userIDStr, 10, 32)
-		if err == nil {
-			filter.UserID = uint(userID)
+		parsed, err := strconv.ParseUint(userIDStr, 10, 32)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user_id parameter")
+			return
 		}
+		filter.UserID = uint(parsed)
 	}
 
-	// Parse method filter
-	filter.Method = queryParams.Get("method")
+	// Users can only see their own transactions
+	if !isAdmin {
+		if filter.UserID != 0 && filter.UserID != userID {
+			respondWithError(w, http.StatusForbidden, "You don't have permission to view these transactions")
+			return
+		}
+		filter.UserID = userID
+	}
 
-	// Parse purpose filter
+	// Parse method, purpose and currency filters
+	filter.Method = queryParams.Get("method")
 	filter.Purpose = queryParams.Get("purpose")
+	filter.Currency = utils.NormalizeCurrency(queryParams.Get("currency"))
 
 	// Parse amount range filters
 	if minAmountStr := queryParams.Get("min_amount"); minAmountStr != "" {
-		filter.MinAmount, err = strconv.ParseFloat(minAmountStr, 64)
+		filter.MinAmount, err = strconv.ParseInt(minAmountStr, 10, 64)
 		if err != nil {
 			respondWithError(w, http.StatusBadRequest, "Invalid min_amount parameter")
 			return
@@ -165,7 +213,7 @@ func (h *TransactionHandler) GetTransactions(w http.ResponseWriter, r *http.Requ
 	}
 
 	if maxAmountStr := queryParams.Get("max_amount"); maxAmountStr != "" {
-		filter.MaxAmount, err = strconv.ParseFloat(maxAmountStr, 64)
+		filter.MaxAmount, err = strconv.ParseInt(maxAmountStr, 10, 64)
 		if err != nil {
 			respondWithError(w, http.StatusBadRequest, "Invalid max_amount parameter")
 			return
@@ -174,7 +222,7 @@ func (h *TransactionHandler) GetTransactions(w http.ResponseWriter, r *http.Requ
 
 	// Parse date range filters
 	layout := "2006-01-02"
-	
+
 	if startDateStr := queryParams.Get("start_date"); startDateStr != "" {
 		filter.StartDate, err = time.Parse(layout, startDateStr)
 		if err != nil {
@@ -191,15 +239,112 @@ func (h *TransactionHandler) GetTransactions(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
-	// Build query
-	query := h.db.Model(&models.Transaction{}).Preload("User")
+	// Parse page size and cursor
+	_, perPage, err := ParsePaginationParams(r)
+	if err != nil || perPage < 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid pagination parameters")
+		return
+	}
+
+	var cursor uint64
+	if cursorStr := queryParams.Get("cursor"); cursorStr != "" {
+		cursor, err = strconv.ParseUint(cursorStr, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor parameter")
+			return
+		}
+	}
+
+	// Totals cover the whole filtered history, not just this page
+	var totals []PurposeTotal
+	if err := h.applyTransactionFilters(h.db.Model(&models.Transaction{}), filter).
+		Select("purpose, currency, COUNT(*) AS count, COALESCE(SUM(amount_minor), 0) AS total").
+		Group("purpose, currency").
+		Order("purpose ASC, currency ASC").
+		Scan(&totals).Error; err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transaction totals")
+		return
+	}
+	for i := range totals {
+		totals[i].Formatted = utils.FormatMoney(totals[i].Total, totals[i].Currency)
+	}
+
+	// Fetch one extra row to know whether another page follows
+	query := h.applyTransactionFilters(h.db.Model(&models.Transaction{}), filter)
+	if cursor != 0 {
+		query = query.Where("id < ?", cursor)
+	}
+	if isAdmin {
+		query = query.Preload("User", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "full_name", "email", "role")
+		})
+	}
+
+	transactions := []models.Transaction{}
+	if err := query.Order("id DESC").Limit(perPage + 1).Find(&transactions).Error; err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transactions")
+		return
+	}
+
+	for i := range transactions {
+		transactions[i].MethodLabel = payment.MethodLabel(transactions[i].Method)
+	}
+
+	pagination := CursorMeta{PerPage: perPage}
+	if len(transactions) > perPage {
+		transactions = transactions[:perPage]
+		pagination.HasNext = true
+		pagination.NextCursor = strconv.FormatUint(uint64(transactions[perPage-1].ID), 10)
+	}
+
+	respondWithJSON(w, http.StatusOK, TransactionPage{
+		Data:       transactions,
+		Pagination: pagination,
+		Totals:     totals,
+	})
+}
+
+// GetTransaction returns a single transaction to its owner or an admin
+func (h *TransactionHandler) GetTransaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+
+	var transaction models.Transaction
+	if err := h.db.First(&transaction, id).Error; err != nil {
+		respondWithError(w, http.StatusNotFound, "Transaction not found")
+		return
+	}
 
-	// Apply filters
+	if transaction.UserID != userID && !utils.IsAdmin(h.db, userID) {
+		respondWithError(w, http.StatusForbidden, "You don't have permission to view this transaction")
+		return
+	}
+	transaction.MethodLabel = payment.MethodLabel(transaction.Method)
+
+	respondWithJSON(w, http.StatusOK, transaction)
+}
+
+// applyTransactionFilters narrows query to the transactions matching filter
+func (h *TransactionHandler) applyTransactionFilters(query *gorm.DB, filter TransactionFilter) *gorm.DB {
 	if filter.UserID != 0 {
 		query = query.Where("user_id = ?", filter.UserID)
 	}
 
-	if filter.Method != "" {
+	if filter.Method == payment.ChannelMobileMoney {
+		// Mobile money is stored per network, e.g. mobile_money_mtn
+		query = query.Where("(method = ? OR method LIKE ?)", filter.Method, filter.Method+"\\_%")
+	} else if filter.Method != "" {
 		query = query.Where("method = ?", filter.Method)
 	}
 
@@ -207,12 +352,16 @@ func (h *TransactionHandler) GetTransactions(w http.ResponseWriter, r *http.Requ
 		query = query.Where("purpose LIKE ?", "%"+filter.Purpose+"%")
 	}
 
+	if filter.Currency != "" {
+		query = query.Where("currency = ?", filter.Currency)
+	}
+
 	if filter.MinAmount != 0 {
-		query = query.Where("amount >= ?", filter.MinAmount)
+		query = query.Where("amount_minor >= ?", filter.MinAmount)
 	}
 
 	if filter.MaxAmount != 0 {
-		query = query.Where("amount <= ?", filter.MaxAmount)
+		query = query.Where("amount_minor <= ?", filter.MaxAmount)
 	}
 
 	if !filter.StartDate.IsZero() {
@@ -225,49 +374,14 @@ func (h *TransactionHandler) GetTransactions(w http.ResponseWriter, r *http.Requ
 		query = query.Where("created_at < ?", endDatePlusDay)
 	}
 
-	// Parse pagination parameters (using new consistent helper)
-	page, perPage, err := ParsePaginationParams(r)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid pagination parameters")
-		return
-	}
-	
-	// Calculate offset
-	offset := (page - 1) * perPage
-
-	// Get total count of matching records
-	var totalItems int64
-	query.Count(&totalItems)
-
-	// Execute the query with pagination
-	var transactions []models.Transaction
-	result := query.Limit(perPage).Offset(offset).Find(&transactions)
-	if result.Error != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transactions")
-		return
-	}
-
-	// Calculate pagination metadata
-	totalPages := int(math.Ceil(float64(totalItems) / float64(perPage)))
-	paginationMeta := PaginationMeta{
-		CurrentPage: page,
-		PerPage:     perPage,
-		TotalItems:  totalItems,
-		TotalPages:  totalPages,
-		HasPrevious: page > 1,
-		HasNext:     page < totalPages,
-	}
-
-	// Send response
-	respondWithJSON(w, http.StatusOK, PaginatedResponse{
-		Data:       transactions,
-		Pagination: paginationMeta,
-	})
+	return query
 }
 
 
 
 
+// GetPaystackTransactions lists the first page of transactions straight from
+// Paystack, for reconciling our records against the provider's
 func (h *TransactionHandler) GetPaystackTransactions(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -307,8 +421,8 @@ func (h *TransactionHandler) GetPaystackTransactions(w http.ResponseWriter, r *h
 			continue // Skip this transaction if date parsing fails
 		}
 		
-		// Format amount (convert from kobo/pesewas to cedis)
-		amount := fmt.Sprintf("GHS %.2f", float64(transaction.Amount)/100)
+		// Format amount in the transaction's own currency
+		amount := utils.FormatMoney(transaction.Amount, transaction.Currency)
 		
 		// Extract reference and determine purpose
 		var reference string
@@ -338,6 +452,8 @@ func (h *TransactionHandler) GetPaystackTransactions(w http.ResponseWriter, r *h
 			purpose = "Appointment Booking"
 		} else if strings.HasPrefix(reference, "SIG-") {
 			purpose = "Subscription"
+		} else if strings.HasPrefix(reference, "PKG-") {
+			purpose = "Session Package"
 		}
 		
 		// Create simplified transaction
@@ -423,6 +539,14 @@ func (h *TransactionHandler) CreateBatchTransactions(w http.ResponseWriter, r *h
 		return
 	}
 
+	// Older clients still send the deprecated decimal amount
+	for i := range batchRequest.Transactions {
+		transaction := &batchRequest.Transactions[i]
+		if transaction.Amount == 0 && transaction.LegacyAmount != 0 {
+			transaction.Amount = utils.ToMinor(transaction.LegacyAmount, transaction.Currency)
+		}
+	}
+
 	// Insert transactions into the database
 	if err := h.db.Create(&batchRequest.Transactions).Error; err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to insert transactions")
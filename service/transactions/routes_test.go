@@ -0,0 +1,126 @@
+package transactions
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+)
+
+func TestParsePaginationParams(t *testing.T) {
+	tests := []struct {
+		query       string
+		wantPage    int
+		wantPerPage int
+		wantErr     bool
+	}{
+		{query: "", wantPage: 1, wantPerPage: 10},
+		{query: "page=3&per_page=25", wantPage: 3, wantPerPage: 25},
+		{query: "per_page=500", wantPage: 1, wantPerPage: 100},
+		{query: "page=0", wantErr: true},
+		{query: "page=-2", wantErr: true},
+		{query: "per_page=0", wantErr: true},
+		{query: "per_page=-1", wantErr: true},
+		{query: "page=two", wantErr: true},
+		{query: "per_page=ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		page, perPage, err := ParsePaginationParams(httptest.NewRequest(http.MethodGet, "/transactions?"+tt.query, nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (page != tt.wantPage || perPage != tt.wantPerPage) {
+			t.Errorf("%q: page %d, per page %d; want %d, %d", tt.query, page, perPage, tt.wantPage, tt.wantPerPage)
+		}
+	}
+}
+
+func TestGetTransactions(t *testing.T) {
+	db := testdb.Open(t, "transactions")
+	trader := testdb.User(t, db, "Trader")
+	other := testdb.User(t, db, "Other Trader")
+	admin := testdb.User(t, db, "Admin")
+	db.Model(admin).Update("role", "admin")
+
+	for i := 1; i <= 5; i++ {
+		method := "card"
+		if i%2 == 0 {
+			method = "mobile_money_mtn"
+		}
+		db.Create(&models.Transaction{UserID: trader.ID, Amount: int64(i) * 1000, Currency: "GHS", Method: method, Purpose: "appointment", Reference: fmt.Sprintf("APT-%d", i)})
+	}
+	db.Create(&models.Transaction{UserID: other.ID, Amount: 9000, Currency: "GHS", Method: "card", Purpose: "signal_subscription", Reference: "SIG-1"})
+
+	get := func(userID uint, query string) (*httptest.ResponseRecorder, TransactionPage) {
+		h := &TransactionHandler{db: db}
+		w := httptest.NewRecorder()
+		h.GetTransactions(w, testdb.AsUser(httptest.NewRequest(http.MethodGet, "/transactions?"+query, nil), userID))
+		var page TransactionPage
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, page
+	}
+
+	tests := []struct {
+		name      string
+		userID    uint
+		query     string
+		wantCode  int
+		wantIDs   []uint
+		wantNext  bool
+		wantTotal int64 // Of all matching transactions, not just the page
+	}{
+		{name: "first page", userID: trader.ID, query: "per_page=2", wantCode: http.StatusOK, wantIDs: []uint{5, 4}, wantNext: true, wantTotal: 15000},
+		{name: "next page", userID: trader.ID, query: "per_page=2&cursor=4", wantCode: http.StatusOK, wantIDs: []uint{3, 2}, wantNext: true, wantTotal: 15000},
+		{name: "last page", userID: trader.ID, query: "per_page=2&cursor=2", wantCode: http.StatusOK, wantIDs: []uint{1}, wantTotal: 15000},
+		{name: "page of one", userID: trader.ID, query: "per_page=1", wantCode: http.StatusOK, wantIDs: []uint{5}, wantNext: true, wantTotal: 15000},
+		{name: "mobile money of any network", userID: trader.ID, query: "method=mobile_money", wantCode: http.StatusOK, wantIDs: []uint{4, 2}, wantTotal: 6000},
+		{name: "amount range", userID: trader.ID, query: "min_amount=2000&max_amount=3000", wantCode: http.StatusOK, wantIDs: []uint{3, 2}, wantTotal: 5000},
+		{name: "own transactions only", userID: other.ID, wantCode: http.StatusOK, wantIDs: []uint{6}, wantTotal: 9000},
+		{name: "someone else's", userID: other.ID, query: fmt.Sprintf("user_id=%d", trader.ID), wantCode: http.StatusForbidden},
+		{name: "admin sees everyone", userID: admin.ID, query: "per_page=3", wantCode: http.StatusOK, wantIDs: []uint{6, 5, 4}, wantNext: true, wantTotal: 24000},
+		{name: "zero per page", userID: trader.ID, query: "per_page=0", wantCode: http.StatusBadRequest},
+		{name: "negative per page", userID: trader.ID, query: "per_page=-5", wantCode: http.StatusBadRequest},
+		{name: "zero page", userID: trader.ID, query: "page=0", wantCode: http.StatusBadRequest},
+		{name: "bad cursor", userID: trader.ID, query: "cursor=abc", wantCode: http.StatusBadRequest},
+		{name: "bad date", userID: trader.ID, query: "start_date=yesterday", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, page := get(tt.userID, tt.query)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var ids []uint
+			for _, transaction := range page.Data {
+				ids = append(ids, transaction.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.wantIDs) || page.Pagination.HasNext != tt.wantNext {
+				t.Errorf("got %v (more %v), want %v (more %v)", ids, page.Pagination.HasNext, tt.wantIDs, tt.wantNext)
+			}
+			if tt.wantNext && page.Pagination.NextCursor != fmt.Sprint(tt.wantIDs[len(tt.wantIDs)-1]) {
+				t.Errorf("next cursor = %q after %v", page.Pagination.NextCursor, ids)
+			}
+
+			var total int64
+			for _, purpose := range page.Totals {
+				total += purpose.Total
+			}
+			if total != tt.wantTotal {
+				t.Errorf("totals add up to %d, want %d", total, tt.wantTotal)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/subscription"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrNoEngagement is returned when the user has no appointment or
+	// subscription with the expert that can be reviewed
+	ErrNoEngagement = errors.New("you can only review an expert after a completed session or while subscribed to their signals")
+	// ErrAlreadyReviewed is returned when the engagement already has a review
+	ErrAlreadyReviewed = errors.New("you have already reviewed this engagement; edit your existing review instead")
+)
+
+// reviewableStatuses are the appointment outcomes a trader may review
+var reviewableStatuses = []string{"Completed", "ExpertNoShow"}
+
+// engagement is what a review is left for: exactly one of the IDs is set
+type engagement struct {
+	AppointmentID  *uint
+	SubscriptionID *uint
+}
+
+// findEngagement checks that userID may review expert for the given
+// appointment or subscription. When neither is given, it picks the most
+// recent engagement that has not been reviewed yet.
+func findEngagement(tx *gorm.DB, userID uint, expert *models.Expert, appointmentID, subscriptionID *uint, now time.Time) (*engagement, error) {
+	reviewed := tx.Model(&models.Rating{}).Where("expert_id = ?", expert.ID)
+
+	if subscriptionID == nil {
+		query := tx.Model(&models.Appointment{}).
+			Where("trader_id = ? AND expert_id = ? AND status IN ?", userID, expert.ID, reviewableStatuses)
+		if appointmentID != nil {
+			query = query.Where("id = ?", *appointmentID)
+		}
+
+		var appointment models.Appointment
+		err := query.Where("id NOT IN (?)", reviewed.Session(&gorm.Session{}).Select("appointment_id").Where("appointment_id IS NOT NULL")).
+			Order("end_time DESC").
+			First(&appointment).Error
+		if err == nil {
+			return &engagement{AppointmentID: &appointment.ID}, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if appointmentID != nil {
+			return nil, reviewError(tx, "appointment_id = ?", *appointmentID)
+		}
+	}
+
+	// A subscription counts for an expert once they have posted signals
+	// during it, and is reviewed once per expert
+	query := tx.Model(&models.SignalSubscription{}).
+		Scopes(subscription.ActiveScope(now)).
+		Where("user_id = ?", userID).
+		Where(`EXISTS (SELECT 1 FROM signals WHERE signals.user_id = ? AND signals.deleted_at IS NULL
+			AND signals.created_at >= signal_subscriptions.start_date AND signals.created_at < signal_subscriptions.end_date)`, expert.UserID)
+	if subscriptionID != nil {
+		query = query.Where("id = ?", *subscriptionID)
+	}
+
+	var active models.SignalSubscription
+	err := query.Where("id NOT IN (?)", reviewed.Session(&gorm.Session{}).Select("subscription_id").Where("subscription_id IS NOT NULL")).
+		Order("start_date DESC").
+		First(&active).Error
+	if err == nil {
+		return &engagement{SubscriptionID: &active.ID}, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if subscriptionID != nil {
+		return nil, reviewError(tx.Where("expert_id = ?", expert.ID), "subscription_id = ?", *subscriptionID)
+	}
+	return nil, ErrNoEngagement
+}
+
+// reviewError tells apart an engagement that was already reviewed from one
+// that cannot be reviewed at all
+func reviewError(tx *gorm.DB, query string, id uint) error {
+	var count int64
+	if err := tx.Model(&models.Rating{}).Where(query, id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrAlreadyReviewed
+	}
+	return ErrNoEngagement
+}
+
+// isUniqueViolation reports whether err is Postgres refusing a row that
+// breaks a unique index
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// ReplyToRating sets the expert's public reply to a rating of them. An empty
+// reply removes it.
+func (h *Handler) ReplyToRating(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ratingID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid rating ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Reply string `json:"reply"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var rating models.Rating
+	if err := h.db.Preload("Expert").First(&rating, ratingID).Error; err != nil {
+		http.Error(w, "Rating not found", http.StatusNotFound)
+		return
+	}
+	if rating.Expert == nil || rating.Expert.UserID != userID {
+		http.Error(w, "Only the rated expert can reply", http.StatusForbidden)
+		return
+	}
+
+	rating.Reply = strings.TrimSpace(request.Reply)
+	rating.RepliedAt = nil
+	if rating.Reply != "" {
+		now := time.Now()
+		rating.RepliedAt = &now
+	}
+	if err := h.db.Model(&rating).Updates(map[string]interface{}{
+		"reply":      rating.Reply,
+		"replied_at": rating.RepliedAt,
+	}).Error; err != nil {
+		http.Error(w, "Error saving reply", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rating)
+}
+
+// ReportRating flags a rating as abusive for moderation. Each user can report
+// a rating once.
+func (h *Handler) ReportRating(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ratingID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid rating ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Reason) == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	var rating models.Rating
+	if err := h.db.First(&rating, ratingID).Error; err != nil {
+		http.Error(w, "Rating not found", http.StatusNotFound)
+		return
+	}
+	if rating.UserID == userID {
+		http.Error(w, "You cannot report your own rating", http.StatusBadRequest)
+		return
+	}
+
+	report := models.RatingReport{
+		RatingID:   rating.ID,
+		ReporterID: userID,
+		Reason:     request.Reason,
+		Status:     "open",
+	}
+	result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&report)
+	if result.Error != nil {
+		http.Error(w, "Error reporting rating", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "You have already reported this rating", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// GetRatingReports lists rating reports for admins, open ones by default.
+// ?status= selects upheld or dismissed reports instead.
+func (h *Handler) GetRatingReports(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "open"
+	}
+
+	var reports []models.RatingReport
+	if err := h.db.Preload("Rating").
+		Where("status = ?", status).
+		Order("created_at ASC").
+		Limit(100).
+		Find(&reports).Error; err != nil {
+		http.Error(w, "Error retrieving reports", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// ResolveRatingReport settles a report. Upholding it hides the rating from
+// listings and the expert's average, closing its other open reports too;
+// dismissing it leaves the rating visible, or shows it again if hidden.
+func (h *Handler) ResolveRatingReport(w http.ResponseWriter, r *http.Request) {
+	adminID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	reportID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Action string `json:"action"` // uphold, dismiss
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.Action != "uphold" && request.Action != "dismiss" {
+		http.Error(w, "Action must be uphold or dismiss", http.StatusBadRequest)
+		return
+	}
+
+	tx := h.db.Begin()
+	var report models.RatingReport
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&report, reportID).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+
+	var rating models.Rating
+	if err := tx.First(&rating, report.RatingID).Error; err != nil {
+		tx.Rollback()
+		http.Error(w, "Rating not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	hidden := request.Action == "uphold"
+	resolved := map[string]interface{}{"resolved_by_id": adminID, "resolved_at": now}
+	if hidden {
+		resolved["status"] = "upheld"
+		err = tx.Model(&models.RatingReport{}).
+			Where("rating_id = ? AND (id = ? OR status = ?)", rating.ID, report.ID, "open").
+			Updates(resolved).Error
+	} else {
+		resolved["status"] = "dismissed"
+		err = tx.Model(&report).Updates(resolved).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, "Error resolving report", http.StatusInternalServerError)
+		return
+	}
+
+	if rating.Hidden != hidden {
+		if err := tx.Model(&rating).Update("hidden", hidden).Error; err != nil {
+			tx.Rollback()
+			http.Error(w, "Error resolving report", http.StatusInternalServerError)
+			return
+		}
+		if err := h.updateExpertRatingStats(tx, rating.ExpertID); err != nil {
+			tx.Rollback()
+			http.Error(w, "Error updating expert rating statistics", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		http.Error(w, "Error resolving report", http.StatusInternalServerError)
+		return
+	}
+
+	h.db.First(&report, report.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
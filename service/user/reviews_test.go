@@ -0,0 +1,165 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// closed creates the trader's appointment with the expert, closed with status
+func closed(t *testing.T, db *gorm.DB, expert *models.Expert, traderID uint, status string) *models.Appointment {
+	t.Helper()
+
+	slot := testdb.Slot(t, db, expert, time.Now().Add(-48*time.Hour).Truncate(time.Hour), 10, 5000)
+	appointment := testdb.Appointment(slot, traderID, 1, fmt.Sprintf("APT-%d-%d", traderID, slot.ID))
+	appointment.Status, appointment.PaymentStatus = status, "paid"
+	if err := db.Create(appointment).Error; err != nil {
+		t.Fatal(err)
+	}
+	return appointment
+}
+
+// rate calls RateExpert as userID with body
+func rate(h *Handler, userID, expertID uint, body map[string]interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(body)
+
+	r := testdb.AsUser(httptest.NewRequest(http.MethodPost, "/", &buf), userID)
+	w := httptest.NewRecorder()
+	h.RateExpert(w, mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(expertID)}))
+	return w
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pgconn.PgError{Code: "23505"}, true},
+		{fmt.Errorf("creating rating: %w", &pgconn.PgError{Code: "23505"}), true},
+		{&pgconn.PgError{Code: "23503"}, false}, // Foreign key violation
+		{errors.New(`ERROR: duplicate key value violates unique constraint "idx_ratings_live_appointment"`), false},
+		{gorm.ErrRecordNotFound, false},
+	}
+	for _, tt := range tests {
+		if got := isUniqueViolation(tt.err); got != tt.want {
+			t.Errorf("isUniqueViolation(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFindEngagement(t *testing.T) {
+	db := testdb.Open(t, "user")
+	now := time.Now()
+	expert := testdb.Expert(t, db, "Reviewed Expert")
+	trader := testdb.User(t, db, "Reviewing Trader")
+
+	// Nothing to review yet
+	closed(t, db, expert, trader.ID, "Confirmed")
+	closed(t, db, expert, trader.ID, "NoShow")
+	if _, err := findEngagement(db, trader.ID, expert, nil, nil, now); !errors.Is(err, ErrNoEngagement) {
+		t.Fatalf("error = %v, want %v", err, ErrNoEngagement)
+	}
+
+	completed := closed(t, db, expert, trader.ID, "Completed")
+	got, err := findEngagement(db, trader.ID, expert, nil, nil, now)
+	if err != nil || got.AppointmentID == nil || *got.AppointmentID != completed.ID {
+		t.Fatalf("engagement = %+v, error %v; want appointment %d", got, err, completed.ID)
+	}
+	if err := db.Create(&models.Rating{UserID: trader.ID, ExpertID: expert.ID, Rating: 5, AppointmentID: &completed.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findEngagement(db, trader.ID, expert, &completed.ID, nil, now); !errors.Is(err, ErrAlreadyReviewed) {
+		t.Errorf("reviewing again: error = %v, want %v", err, ErrAlreadyReviewed)
+	}
+
+	// A subscription counts once the expert posts signals during it
+	plan := testdb.Plan(t, db, "monthly", 1, 10000)
+	sub := testdb.Subscription(t, db, trader.ID, plan, now.AddDate(0, 0, -5), now.AddDate(0, 0, 25))
+	if _, err := findEngagement(db, trader.ID, expert, nil, &sub.ID, now); !errors.Is(err, ErrNoEngagement) {
+		t.Errorf("before any signals: error = %v, want %v", err, ErrNoEngagement)
+	}
+	if err := db.Create(&models.Signal{UserID: expert.UserID, Pair: "EURUSD", Action: "buy", StopLoss: 1.05}).Error; err != nil {
+		t.Fatal(err)
+	}
+	got, err = findEngagement(db, trader.ID, expert, nil, nil, now)
+	if err != nil || got.SubscriptionID == nil || *got.SubscriptionID != sub.ID {
+		t.Errorf("engagement = %+v, error %v; want subscription %d", got, err, sub.ID)
+	}
+}
+
+func TestRateExpert(t *testing.T) {
+	db := testdb.Open(t, "user")
+	h := &Handler{db: db}
+	expert := testdb.Expert(t, db, "Rated Expert")
+	trader := testdb.User(t, db, "Rating Trader")
+	first := closed(t, db, expert, trader.ID, "Completed")
+	second := closed(t, db, expert, trader.ID, "ExpertNoShow")
+
+	if w := rate(h, expert.UserID, expert.ID, map[string]interface{}{"rating": 5}); w.Code != http.StatusBadRequest {
+		t.Errorf("rating themselves: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := rate(h, trader.ID, expert.ID, map[string]interface{}{"rating": 6}); w.Code != http.StatusBadRequest {
+		t.Errorf("rating of 6: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	for _, appointment := range []*models.Appointment{first, second} {
+		body := map[string]interface{}{"appointment_id": appointment.ID, "rating": 4}
+		if w := rate(h, trader.ID, expert.ID, body); w.Code != http.StatusCreated {
+			t.Fatalf("reviewing appointment %d: status = %d: %s", appointment.ID, w.Code, w.Body)
+		}
+		if w := rate(h, trader.ID, expert.ID, body); w.Code != http.StatusConflict {
+			t.Errorf("reviewing appointment %d again: status = %d, want %d", appointment.ID, w.Code, http.StatusConflict)
+		}
+	}
+
+	db.First(expert, expert.ID)
+	if expert.TotalRatings != 2 || expert.AverageRating != 4 {
+		t.Errorf("expert rated %v from %d ratings, want 4 from 2", expert.AverageRating, expert.TotalRatings)
+	}
+
+	// A deleted review can be written again
+	db.Where("appointment_id = ?", first.ID).Delete(&models.Rating{})
+	if w := rate(h, trader.ID, expert.ID, map[string]interface{}{"appointment_id": first.ID, "rating": 3}); w.Code != http.StatusCreated {
+		t.Errorf("reviewing after deleting: status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestRateExpertRace(t *testing.T) {
+	db := testdb.Open(t, "user")
+	h := &Handler{db: db}
+	expert := testdb.Expert(t, db, "Popular Expert")
+	trader := testdb.User(t, db, "Eager Trader")
+	appointment := closed(t, db, expert, trader.ID, "Completed")
+
+	codes := make([]int, 8)
+	testdb.Race(len(codes), func(i int) error {
+		codes[i] = rate(h, trader.ID, expert.ID, map[string]interface{}{"appointment_id": appointment.ID, "rating": 5}).Code
+		return nil
+	})
+
+	created := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("status = %d, want %d or %d", code, http.StatusCreated, http.StatusConflict)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d reviews created, want 1", created)
+	}
+}
@@ -18,9 +18,10 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
-	"gopkg.in/gomail.v2"
 
 	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/KAsare1/Kodefx-server/service/subscription"
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -58,10 +59,14 @@ func (h *Handler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/experts/expertise/{expertise}", h.GetExpertsByExpertise).Methods("GET")
     router.HandleFunc("/images/{filename}", h.ServeImage).Methods("GET")
     router.HandleFunc("/certifications/{filename}", h.ServeCertification).Methods("GET")
-    router.HandleFunc("/experts/{id}/rate", h.RateExpert).Methods("POST")
+    router.HandleFunc("/experts/{id}/rate", utils.AuthMiddleware(h.RateExpert)).Methods("POST")
     router.HandleFunc("/experts/{id}/ratings", h.GetExpertRatings).Methods("GET") 
-    router.HandleFunc("/ratings/{id}", h.UpdateRating).Methods("PUT")
-    router.HandleFunc("/ratings/{id}", h.DeleteRating).Methods("DELETE")
+    router.HandleFunc("/ratings/reports", utils.AdminMiddleware(h.db, h.GetRatingReports)).Methods("GET")
+    router.HandleFunc("/ratings/reports/{id}", utils.AdminMiddleware(h.db, h.ResolveRatingReport)).Methods("PATCH")
+    router.HandleFunc("/ratings/{id}", utils.AuthMiddleware(h.UpdateRating)).Methods("PUT")
+    router.HandleFunc("/ratings/{id}", utils.AuthMiddleware(h.DeleteRating)).Methods("DELETE")
+    router.HandleFunc("/ratings/{id}/reply", utils.AuthMiddleware(h.ReplyToRating)).Methods("PUT")
+    router.HandleFunc("/ratings/{id}/report", utils.AuthMiddleware(h.ReportRating)).Methods("POST")
     router.HandleFunc("/users/{id}/ratings", h.GetUserRatings).Methods("GET")
 
 
@@ -272,6 +277,7 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
         Expertise          string   `json:"expertise"`
         Bio                string   `json:"bio"`
         CertificationFiles []string `json:"certification_files"`
+        ReferralCode       string   `json:"referral_code"`
     }
     if err := json.NewDecoder(r.Body).Decode(&registerRequest); err != nil {
         http.Error(w, "Invalid JSON input", http.StatusBadRequest)
@@ -304,6 +310,17 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // Resolve the referring user, if any
+    var referredByID *uint
+    if code := strings.ToUpper(strings.TrimSpace(registerRequest.ReferralCode)); code != "" {
+        var referrer models.User
+        if err := h.db.Select("id").Where("referral_code = ?", code).First(&referrer).Error; err != nil {
+            http.Error(w, "Invalid referral code", http.StatusBadRequest)
+            return
+        }
+        referredByID = &referrer.ID
+    }
+
     // Hash password
     passwordHash, err := bcrypt.GenerateFromPassword([]byte(registerRequest.Password), bcrypt.DefaultCost)
     if err != nil {
@@ -328,6 +345,7 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
         PhoneVerified:       false,
         EmailVerificationCode: verificationCode,
         VerificationExpiry:  verificationExpiry,
+        ReferredByID:        referredByID,
     }
 
     if err := tx.Create(&user).Error; err != nil {
@@ -403,28 +421,8 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 
 // sendVerificationEmail sends a verification email with the 6-digit code
 func sendVerificationEmail(email, code string) error {
-	// Load SMTP configuration from environment variables
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpPort := os.Getenv("SMTP_PORT")
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPass := os.Getenv("SMTP_PASS")
-
-	// Create a new email message
-	m := gomail.NewMessage()
-	m.SetHeader("From", smtpUser)
-	m.SetHeader("To", email)
-	m.SetHeader("Subject", "Email Verification Code")
-	m.SetBody("text/plain", fmt.Sprintf("Your verification code is: %s. Ignore this email if you did not request a verification code.", code))
-
-	// Set up the dialer
-	port, err := strconv.Atoi(smtpPort)
-	if err != nil {
-		return fmt.Errorf("invalid SMTP port: %v", err)
-	}
-	d := gomail.NewDialer(smtpHost, port, smtpUser, smtpPass)
-
-	// Send the email
-	return d.DialAndSend(m)
+	return utils.SendEmail(email, "Email Verification Code",
+		fmt.Sprintf("Your verification code is: %s. Ignore this email if you did not request a verification code.", code), "")
 }
 
 
@@ -498,23 +496,25 @@ func (h *Handler) GetUsers(w http.ResponseWriter, r *http.Request) {
             SubscriptionStatus: "none",
         }
         
-        // Check for active subscription
-        var subscription models.SignalSubscription
-        subResult := h.db.Where("user_id = ? AND status = ? AND end_date > ?", user.ID, "active", time.Now()).
-            First(&subscription)
+        // Check for a subscription currently granting access
+        var activeSub models.SignalSubscription
+        subResult := h.db.Scopes(subscription.ActiveScope(time.Now())).
+            Where("user_id = ?", user.ID).
+            First(&activeSub)
         
         if subResult.Error == nil {
-            userWithSub.SubscriptionStatus = "active"
-            userWithSub.Plan = subscription.Plan
+            userWithSub.SubscriptionStatus = activeSub.Status
+            userWithSub.Plan = activeSub.Plan
         } else {
             // Check for expired subscription
+            var expiredSub models.SignalSubscription
             expiredResult := h.db.Where("user_id = ?", user.ID).
                 Order("end_date DESC").
-                First(&subscription)
+                First(&expiredSub)
             
             if expiredResult.Error == nil {
                 userWithSub.SubscriptionStatus = "expired"
-                userWithSub.Plan = subscription.Plan
+                userWithSub.Plan = expiredSub.Plan
             }
         }
         
@@ -557,15 +557,16 @@ func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
     }
 
     // Find active subscription for the user
-    var subscription models.SignalSubscription
-    subResult := h.db.Where("user_id = ? AND status = ? AND end_date > ?", userID, "active", time.Now()).
+    var activeSub models.SignalSubscription
+    subResult := h.db.Scopes(subscription.ActiveScope(time.Now())).
+        Where("user_id = ?", userID).
         Order("end_date DESC").
-        First(&subscription)
+        First(&activeSub)
     
     if subResult.Error == nil {
-        // User has an active subscription
-        response.Subscription = &subscription
-        response.SubscriptionStatus = "active"
+        // User has an active (or past_due, within grace) subscription
+        response.Subscription = &activeSub
+        response.SubscriptionStatus = activeSub.Status
     } else if subResult.Error == gorm.ErrRecordNotFound {
         // Check if user had a subscription that expired
         var expiredSub models.SignalSubscription
@@ -609,11 +610,16 @@ func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		FullName          string `json:"full_name"`
 		Phone             string `json:"phone"`
 		ProfilePictureURL string `json:"profile_picture_path"`
+		TimeZone          string `json:"time_zone"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
 		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
 		return
 	}
+	if updateData.TimeZone != "" && !utils.IsValidTimeZone(updateData.TimeZone) {
+		http.Error(w, "Unknown time zone; use an IANA name such as Africa/Accra", http.StatusBadRequest)
+		return
+	}
 
 	// Find user by ID
 	var user models.User
@@ -632,6 +638,9 @@ func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	if updateData.ProfilePictureURL != "" {
 		user.ProfilePicturePath = updateData.ProfilePictureURL
 	}
+	if updateData.TimeZone != "" {
+		user.TimeZone = updateData.TimeZone
+	}
 
 	// Save updated user data
 	if err := h.db.Save(&user).Error; err != nil {
@@ -1163,6 +1172,7 @@ func (h *Handler) UpdateExpert(w http.ResponseWriter, r *http.Request) {
     var updateRequest struct {
         Expertise          string `json:"expertise"`
         Bio                string `json:"bio"`
+        TimeZone           string `json:"time_zone"`
         CertificationFiles []struct {
             FileName string `json:"file_name"`
             FilePath string `json:"file_path"`
@@ -1183,6 +1193,13 @@ func (h *Handler) UpdateExpert(w http.ResponseWriter, r *http.Request) {
     // Update fields
     expert.Expertise = updateRequest.Expertise
     expert.Bio = updateRequest.Bio
+    if updateRequest.TimeZone != "" {
+        if !utils.IsValidTimeZone(updateRequest.TimeZone) {
+            http.Error(w, "Unknown time zone; use an IANA name such as Africa/Accra", http.StatusBadRequest)
+            return
+        }
+        expert.TimeZone = updateRequest.TimeZone
+    }
 
     // Handle certification file updates
     if len(updateRequest.CertificationFiles) > 0 {
@@ -1368,7 +1385,16 @@ func (h *Handler) GetExpertsByExpertise(w http.ResponseWriter, r *http.Request)
 
 
 
+// RateExpert reviews an expert for one engagement with them: a completed
+// appointment or a subscription to their signals. The rater is the signed-in
+// user and each engagement can be reviewed once.
 func (h *Handler) RateExpert(w http.ResponseWriter, r *http.Request) {
+    userID, err := utils.GetUserIDFromContext(r.Context())
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
     // Parse expert ID from URL
     vars := mux.Vars(r)
     expertID, err := strconv.ParseUint(vars["id"], 10, 64)
@@ -1379,9 +1405,10 @@ func (h *Handler) RateExpert(w http.ResponseWriter, r *http.Request) {
 
     // Parse request body
     var ratingRequest struct {
-        UserID  uint    `json:"user_id"`
-        Rating  float64 `json:"rating"`
-        Comment string  `json:"comment"`
+        AppointmentID  *uint   `json:"appointment_id"`
+        SubscriptionID *uint   `json:"subscription_id"`
+        Rating         float64 `json:"rating"`
+        Comment        string  `json:"comment"`
     }
     
     if err := json.NewDecoder(r.Body).Decode(&ratingRequest); err != nil {
@@ -1395,12 +1422,6 @@ func (h *Handler) RateExpert(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Validate required fields
-    if ratingRequest.UserID == 0 {
-        http.Error(w, "User ID is required", http.StatusBadRequest)
-        return
-    }
-
     // Check if expert exists
     var expert models.Expert
     if err := h.db.First(&expert, expertID).Error; err != nil {
@@ -1408,15 +1429,8 @@ func (h *Handler) RateExpert(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Check if user exists
-    var user models.User
-    if err := h.db.First(&user, ratingRequest.UserID).Error; err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
-        return
-    }
-
     // Prevent self-rating
-    if expert.UserID == ratingRequest.UserID {
+    if expert.UserID == userID {
         http.Error(w, "Users cannot rate themselves", http.StatusBadRequest)
         return
     }
@@ -1424,40 +1438,43 @@ func (h *Handler) RateExpert(w http.ResponseWriter, r *http.Request) {
     // Begin transaction
     tx := h.db.Begin()
 
-    // Check if user has already rated this expert
-    var existingRating models.Rating
-    result := tx.Where("user_id = ? AND expert_id = ?", ratingRequest.UserID, expertID).First(&existingRating)
-    
-    if result.Error == nil {
-        // Update existing rating
-        existingRating.Rating = ratingRequest.Rating
-        existingRating.Comment = ratingRequest.Comment
-        
-        if err := tx.Save(&existingRating).Error; err != nil {
-            tx.Rollback()
-            http.Error(w, "Error updating rating", http.StatusInternalServerError)
+    // Find the engagement being reviewed
+    engagement, err := findEngagement(tx, userID, &expert, ratingRequest.AppointmentID, ratingRequest.SubscriptionID, time.Now())
+    if err != nil {
+        tx.Rollback()
+        if errors.Is(err, ErrAlreadyReviewed) {
+            http.Error(w, err.Error(), http.StatusConflict)
             return
         }
-    } else if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-        // Create new rating
-        newRating := models.Rating{
-            UserID:   ratingRequest.UserID,
-            ExpertID: uint(expertID),
-            Rating:   ratingRequest.Rating,
-            Comment:  ratingRequest.Comment,
-        }
-        
-        if err := tx.Create(&newRating).Error; err != nil {
-            tx.Rollback()
-            http.Error(w, "Error creating rating", http.StatusInternalServerError)
+        if errors.Is(err, ErrNoEngagement) {
+            http.Error(w, err.Error(), http.StatusForbidden)
             return
         }
-    } else {
-        tx.Rollback()
         http.Error(w, "Database error", http.StatusInternalServerError)
         return
     }
 
+    newRating := models.Rating{
+        UserID:         userID,
+        ExpertID:       uint(expertID),
+        Rating:         ratingRequest.Rating,
+        Comment:        ratingRequest.Comment,
+        AppointmentID:  engagement.AppointmentID,
+        SubscriptionID: engagement.SubscriptionID,
+        Verified:       true,
+    }
+    
+    if err := tx.Create(&newRating).Error; err != nil {
+        tx.Rollback()
+        // A concurrent request reviewed the same engagement first
+        if isUniqueViolation(err) {
+            http.Error(w, ErrAlreadyReviewed.Error(), http.StatusConflict)
+            return
+        }
+        http.Error(w, "Error creating rating", http.StatusInternalServerError)
+        return
+    }
+
     // Update expert's average rating and total count
     if err := h.updateExpertRatingStats(tx, uint(expertID)); err != nil {
         tx.Rollback()
@@ -1472,8 +1489,10 @@ func (h *Handler) RateExpert(w http.ResponseWriter, r *http.Request) {
     }
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
         "message": "Rating submitted successfully",
+        "rating":  newRating,
     })
 }
 
@@ -1503,11 +1522,11 @@ func (h *Handler) GetExpertRatings(w http.ResponseWriter, r *http.Request) {
 
     // Get total count
     var total int64
-    h.db.Model(&models.Rating{}).Where("expert_id = ?", expertID).Count(&total)
+    h.db.Model(&models.Rating{}).Where("expert_id = ? AND hidden = ?", expertID, false).Count(&total)
 
     // Get ratings with user information
     var ratings []models.Rating
-    result := h.db.Where("expert_id = ?", expertID).
+    result := h.db.Where("expert_id = ? AND hidden = ?", expertID, false).
         Preload("User").
         Order("created_at DESC").
         Offset((page - 1) * pageSize).
@@ -1526,6 +1545,9 @@ func (h *Handler) GetExpertRatings(w http.ResponseWriter, r *http.Request) {
             "id":         rating.ID,
             "rating":     rating.Rating,
             "comment":    rating.Comment,
+            "verified":   rating.Verified,
+            "reply":      rating.Reply,
+            "replied_at": rating.RepliedAt,
             "created_at": rating.CreatedAt,
             "updated_at": rating.UpdatedAt,
         }
@@ -1563,11 +1585,16 @@ func (h *Handler) UpdateRating(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    userID, err := utils.GetUserIDFromContext(r.Context())
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
     // Parse request body
     var updateRequest struct {
         Rating  float64 `json:"rating"`
         Comment string  `json:"comment"`
-        UserID  uint    `json:"user_id"` // For authorization
     }
     
     if err := json.NewDecoder(r.Body).Decode(&updateRequest); err != nil {
@@ -1589,7 +1616,7 @@ func (h *Handler) UpdateRating(w http.ResponseWriter, r *http.Request) {
     }
 
     // Check if user owns this rating
-    if rating.UserID != updateRequest.UserID {
+    if rating.UserID != userID {
         http.Error(w, "Unauthorized to update this rating", http.StatusForbidden)
         return
     }
@@ -1636,11 +1663,9 @@ func (h *Handler) DeleteRating(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Get user ID from query parameter (in production, this should come from JWT token)
-    userIDParam := r.URL.Query().Get("user_id")
-    userID, err := strconv.ParseUint(userIDParam, 10, 64)
+    userID, err := utils.GetUserIDFromContext(r.Context())
     if err != nil {
-        http.Error(w, "Valid user ID required", http.StatusBadRequest)
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
 
@@ -1652,7 +1677,7 @@ func (h *Handler) DeleteRating(w http.ResponseWriter, r *http.Request) {
     }
 
     // Check if user owns this rating
-    if rating.UserID != uint(userID) {
+    if rating.UserID != userID {
         http.Error(w, "Unauthorized to delete this rating", http.StatusForbidden)
         return
     }
@@ -1712,11 +1737,11 @@ func (h *Handler) GetUserRatings(w http.ResponseWriter, r *http.Request) {
 
     // Get total count
     var total int64
-    h.db.Model(&models.Rating{}).Where("user_id = ?", userID).Count(&total)
+    h.db.Model(&models.Rating{}).Where("user_id = ? AND hidden = ?", userID, false).Count(&total)
 
     // Get ratings with expert information
     var ratings []models.Rating
-    result := h.db.Where("user_id = ?", userID).
+    result := h.db.Where("user_id = ? AND hidden = ?", userID, false).
         Preload("Expert").
         Preload("Expert.User").
         Order("created_at DESC").
@@ -1736,6 +1761,9 @@ func (h *Handler) GetUserRatings(w http.ResponseWriter, r *http.Request) {
             "id":         rating.ID,
             "rating":     rating.Rating,
             "comment":    rating.Comment,
+            "verified":   rating.Verified,
+            "reply":      rating.Reply,
+            "replied_at": rating.RepliedAt,
             "created_at": rating.CreatedAt,
             "updated_at": rating.UpdatedAt,
         }
@@ -1779,10 +1807,10 @@ func (h *Handler) updateExpertRatingStats(tx *gorm.DB, expertID uint) error {
         TotalRatings  int64
     }
 
-    // Calculate average rating and total count
+    // Calculate average rating and total count, leaving out moderated ratings
     err := tx.Model(&models.Rating{}).
-        Select("AVG(rating) as average_rating, COUNT(*) as total_ratings").
-        Where("expert_id = ?", expertID).
+        Select("COALESCE(AVG(rating), 0) as average_rating, COUNT(*) as total_ratings").
+        Where("expert_id = ? AND hidden = ?", expertID, false).
         Scan(&stats).Error
 
     if err != nil {
@@ -0,0 +1,296 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/cmd/utils"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// releaseInterval is how often expired payment holds are released
+const releaseInterval = 5 * time.Minute
+
+// Response is a standardized API response structure
+type Response struct {
+	Data  interface{} `json:"data,omitempty"`
+	Meta  interface{} `json:"meta,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// WalletSummary is a user's wallet balance in one currency. Amounts are in minor units.
+type WalletSummary struct {
+	UserID    uint   `json:"user_id"`
+	Currency  string `json:"currency"`
+	Balance   int64  `json:"balance_minor"` // Spendable now
+	Held      int64  `json:"held_minor"`    // Set aside for purchases awaiting payment
+	Formatted string `json:"balance_formatted"`
+}
+
+// AdjustmentRequest is the body accepted when an admin credits or debits a wallet
+type AdjustmentRequest struct {
+	Amount      int64  `json:"amount_minor"`
+	Currency    string `json:"currency"`
+	Source      string `json:"source"` // Credits: promo, refund or adjustment
+	Reference   string `json:"reference"`
+	Description string `json:"description"`
+}
+
+// WalletHandler handles wallet HTTP requests
+type WalletHandler struct {
+	db *gorm.DB
+}
+
+// NewWalletHandler creates a new wallet handler and starts releasing expired holds
+func NewWalletHandler(db *gorm.DB) *WalletHandler {
+	h := &WalletHandler{db: db}
+	go h.runHoldReleaser()
+
+	return h
+}
+
+// RegisterRoutes registers all wallet routes
+func (h *WalletHandler) RegisterRoutes(router *mux.Router) {
+	// Caller's own wallet
+	router.HandleFunc("/wallet", utils.AuthMiddleware(h.GetWallet)).Methods("GET")
+	router.HandleFunc("/wallet/statement", utils.AuthMiddleware(h.GetStatement)).Methods("GET")
+
+	// Admin
+	router.HandleFunc("/wallets/{userId:[0-9]+}", utils.AdminMiddleware(h.db, h.GetWallet)).Methods("GET")
+	router.HandleFunc("/wallets/{userId:[0-9]+}/statement", utils.AdminMiddleware(h.db, h.GetStatement)).Methods("GET")
+	router.HandleFunc("/wallets/{userId:[0-9]+}/credits", utils.AdminMiddleware(h.db, h.CreditWallet)).Methods("POST")
+	router.HandleFunc("/wallets/{userId:[0-9]+}/debits", utils.AdminMiddleware(h.db, h.DebitWallet)).Methods("POST")
+}
+
+// walletOwner returns the user whose wallet is addressed: the one in the path
+// on admin routes, otherwise the caller
+func (h *WalletHandler) walletOwner(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	if value, ok := mux.Vars(r)["userId"]; ok {
+		userID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return 0, false
+		}
+		return uint(userID), true
+	}
+
+	userID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return 0, false
+	}
+	return userID, true
+}
+
+// requestCurrency returns the ?currency= query parameter or the default currency
+func requestCurrency(r *http.Request) string {
+	if currency := utils.NormalizeCurrency(r.URL.Query().Get("currency")); currency != "" {
+		return currency
+	}
+	return utils.DefaultCurrency()
+}
+
+// GetWallet returns the wallet balance in ?currency=
+func (h *WalletHandler) GetWallet(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.walletOwner(w, r)
+	if !ok {
+		return
+	}
+	currency := requestCurrency(r)
+
+	balance, err := Available(h.db, userID, currency)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve wallet")
+		return
+	}
+
+	var held int64
+	if err := h.db.Model(&models.WalletEntry{}).
+		Where("user_id = ? AND currency = ? AND source = ? AND status = ?", userID, currency, SourcePayment, HoldHeld).
+		Select("COALESCE(SUM(amount_minor), 0)").
+		Scan(&held).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve wallet")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: WalletSummary{
+		UserID:    userID,
+		Currency:  currency,
+		Balance:   balance,
+		Held:      held,
+		Formatted: utils.FormatMoney(balance, currency),
+	}})
+}
+
+// GetStatement lists wallet entries in ?currency=, newest first. Pages are
+// fetched with ?cursor= taken from the previous page's next_cursor.
+func (h *WalletHandler) GetStatement(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.walletOwner(w, r)
+	if !ok {
+		return
+	}
+
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	query := h.db.Where("user_id = ? AND currency = ?", userID, requestCurrency(r))
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid cursor parameter")
+			return
+		}
+		query = query.Where("id < ?", cursor)
+	}
+
+	entries := []models.WalletEntry{}
+	if err := query.Order("id DESC").Limit(perPage + 1).Find(&entries).Error; err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve wallet statement")
+		return
+	}
+
+	meta := map[string]interface{}{
+		"per_page": perPage,
+		"has_next": false,
+	}
+	if len(entries) > perPage {
+		entries = entries[:perPage]
+		meta["has_next"] = true
+		meta["next_cursor"] = strconv.FormatUint(uint64(entries[perPage-1].ID), 10)
+	}
+
+	h.respondWithJSON(w, http.StatusOK, Response{Data: entries, Meta: meta})
+}
+
+// decodeAdjustment reads and validates an admin credit or debit
+func (h *WalletHandler) decodeAdjustment(w http.ResponseWriter, r *http.Request) (*AdjustmentRequest, bool) {
+	var request AdjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return nil, false
+	}
+
+	if request.Amount <= 0 {
+		h.respondWithError(w, http.StatusBadRequest, "Amount must be positive")
+		return nil, false
+	}
+
+	request.Currency = utils.NormalizeCurrency(request.Currency)
+	if request.Currency == "" {
+		request.Currency = utils.DefaultCurrency()
+	}
+	if !utils.IsSupportedCurrency(request.Currency) {
+		h.respondWithError(w, http.StatusBadRequest, "Unsupported currency")
+		return nil, false
+	}
+
+	if request.Description == "" {
+		h.respondWithError(w, http.StatusBadRequest, "Description is required")
+		return nil, false
+	}
+
+	return &request, true
+}
+
+// CreditWallet adds promotional credit, a refund or a correction to a user's wallet
+func (h *WalletHandler) CreditWallet(w http.ResponseWriter, r *http.Request) {
+	h.adjust(w, r, "credit")
+}
+
+// DebitWallet removes credit from a user's wallet
+func (h *WalletHandler) DebitWallet(w http.ResponseWriter, r *http.Request) {
+	h.adjust(w, r, "debit")
+}
+
+// adjust applies an admin credit or debit to the wallet in the path
+func (h *WalletHandler) adjust(w http.ResponseWriter, r *http.Request, direction string) {
+	adminID, err := utils.GetUserIDFromContext(r.Context())
+	if err != nil {
+		h.respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID, ok := h.walletOwner(w, r)
+	if !ok {
+		return
+	}
+
+	request, ok := h.decodeAdjustment(w, r)
+	if !ok {
+		return
+	}
+
+	if direction == "debit" {
+		request.Source = SourceAdjustment
+	} else if request.Source == "" {
+		request.Source = SourceAdjustment
+	} else if request.Source != SourcePromo && request.Source != SourceRefund && request.Source != SourceAdjustment {
+		h.respondWithError(w, http.StatusBadRequest, "Source must be promo, refund or adjustment")
+		return
+	}
+
+	if err := h.db.First(&models.User{}, userID).Error; err != nil {
+		h.respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	if request.Reference == "" {
+		request.Reference = fmt.Sprintf("WAL-%d-%d", userID, time.Now().UnixNano())
+	}
+
+	var entry *models.WalletEntry
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if direction == "debit" {
+			entry, err = Debit(tx, userID, request.Amount, request.Currency, request.Source, request.Reference, request.Description, &adminID)
+		} else {
+			entry, err = Credit(tx, userID, request.Amount, request.Currency, request.Source, request.Reference, request.Description, &adminID)
+		}
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ErrInsufficientFunds) {
+			h.respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		log.Printf("Error applying wallet %s for user %d: %v", direction, userID, err)
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to update wallet")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusCreated, Response{Data: entry})
+}
+
+// runHoldReleaser periodically returns holds for purchases that were never paid
+func (h *WalletHandler) runHoldReleaser() {
+	ticker := time.NewTicker(releaseInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := releaseExpiredHolds(h.db, time.Now()); err != nil {
+			log.Printf("Error releasing wallet holds: %v", err)
+		}
+	}
+}
+
+// Helper function to respond with an error
+func (h *WalletHandler) respondWithError(w http.ResponseWriter, code int, message string) {
+	h.respondWithJSON(w, code, Response{Error: message})
+}
+
+// Helper function to respond with JSON
+func (h *WalletHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
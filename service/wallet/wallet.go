@@ -0,0 +1,279 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/service/earnings"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Entry sources
+const (
+	SourceReferral   = "referral"   // Credit earned by referring a paying user
+	SourcePromo      = "promo"      // Promotional credit granted by an admin
+	SourceRefund     = "refund"     // Refund of a purchase into the wallet
+	SourceAdjustment = "adjustment" // Manual correction by an admin, either direction
+	SourcePayment    = "payment"    // Debit held for, then captured by, a purchase
+	SourceRelease    = "release"    // Held payment returned after the purchase was abandoned
+)
+
+// Hold statuses of payment debits
+const (
+	HoldHeld     = "held"
+	HoldCaptured = "captured"
+	HoldReleased = "released"
+)
+
+// holdTTL is how long a payment hold waits for its purchase to be paid before
+// it is released. It matches the coupon reservation window.
+const holdTTL = time.Hour
+
+var (
+	// ErrInsufficientFunds is returned when a debit exceeds the wallet balance
+	ErrInsufficientFunds = errors.New("insufficient wallet balance")
+	// ErrInvalidAmount is returned for zero or negative amounts
+	ErrInvalidAmount = errors.New("wallet amount must be positive")
+)
+
+// lockWallet loads the user's wallet in currency for update, creating it on first use
+func lockWallet(tx *gorm.DB, userID uint, currency string) (*models.Wallet, error) {
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.Wallet{UserID: userID, Currency: currency}).Error; err != nil {
+		return nil, err
+	}
+
+	var wallet models.Wallet
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND currency = ?", userID, currency).
+		First(&wallet).Error; err != nil {
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+// move applies entry to the user's wallet and records it. Debits fail with
+// ErrInsufficientFunds rather than take the balance below zero.
+func move(tx *gorm.DB, userID uint, currency string, entry *models.WalletEntry) error {
+	if entry.Amount <= 0 {
+		return ErrInvalidAmount
+	}
+
+	wallet, err := lockWallet(tx, userID, currency)
+	if err != nil {
+		return err
+	}
+
+	balance := wallet.Balance
+	if entry.Direction == "debit" {
+		if balance < entry.Amount {
+			return ErrInsufficientFunds
+		}
+		balance -= entry.Amount
+	} else {
+		balance += entry.Amount
+	}
+
+	if err := tx.Model(wallet).Update("balance_minor", balance).Error; err != nil {
+		return err
+	}
+
+	entry.WalletID = wallet.ID
+	entry.UserID = userID
+	entry.Currency = currency
+	entry.BalanceAfter = balance
+	return tx.Create(entry).Error
+}
+
+// Credit adds funded credit to the user's wallet, such as a referral reward,
+// promotion or refund, and books it against platform revenue in the ledger
+func Credit(tx *gorm.DB, userID uint, amount int64, currency, source, reference, description string, createdByID *uint) (*models.WalletEntry, error) {
+	entry := models.WalletEntry{
+		Direction:   "credit",
+		Source:      source,
+		Amount:      amount,
+		Reference:   reference,
+		Description: description,
+		CreatedByID: createdByID,
+	}
+	if err := move(tx, userID, currency, &entry); err != nil {
+		return nil, err
+	}
+
+	if err := earnings.RecordTransfer(tx, fmt.Sprintf("WAL-%d", entry.ID), "wallet_credit", amount, currency,
+		models.AccountPlatformRevenue, models.AccountUserWallet, description); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// RefundPayment books a card payment that can't be used for its purchase,
+// such as one that arrived after the purchase's wallet hold was released and
+// spent, and credits the whole amount to the user's wallet
+func RefundPayment(tx *gorm.DB, userID uint, amount int64, currency, reference, description string) error {
+	if amount <= 0 {
+		return nil
+	}
+	if err := earnings.RecordPayment(tx, reference, amount, currency, nil, description); err != nil {
+		return err
+	}
+	_, err := Credit(tx, userID, amount, currency, SourceRefund, reference, description, nil)
+	return err
+}
+
+// Debit removes credit from the user's wallet outside of a purchase, such as
+// an admin correction, and returns it to platform revenue in the ledger
+func Debit(tx *gorm.DB, userID uint, amount int64, currency, source, reference, description string, createdByID *uint) (*models.WalletEntry, error) {
+	entry := models.WalletEntry{
+		Direction:   "debit",
+		Source:      source,
+		Amount:      amount,
+		Reference:   reference,
+		Description: description,
+		CreatedByID: createdByID,
+	}
+	if err := move(tx, userID, currency, &entry); err != nil {
+		return nil, err
+	}
+
+	if err := earnings.RecordTransfer(tx, fmt.Sprintf("WAL-%d", entry.ID), "wallet_debit", amount, currency,
+		models.AccountUserWallet, models.AccountPlatformRevenue, description); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Available returns the user's spendable wallet balance in currency
+func Available(db *gorm.DB, userID uint, currency string) (int64, error) {
+	var wallet models.Wallet
+	err := db.Where("user_id = ? AND currency = ?", userID, currency).First(&wallet).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return wallet.Balance, nil
+}
+
+// Hold takes up to amount from the user's wallet towards the purchase paid for
+// by reference and returns how much was taken. The money leaves the balance
+// straight away and is captured when the payment completes, or released if it
+// never does.
+func Hold(tx *gorm.DB, userID uint, amount int64, currency, reference, description string) (int64, error) {
+	wallet, err := lockWallet(tx, userID, currency)
+	if err != nil {
+		return 0, err
+	}
+	if wallet.Balance < amount {
+		amount = wallet.Balance
+	}
+	if amount <= 0 {
+		return 0, nil
+	}
+
+	entry := models.WalletEntry{
+		Direction:   "debit",
+		Source:      SourcePayment,
+		Amount:      amount,
+		Reference:   reference,
+		Description: description,
+		Status:      HoldHeld,
+	}
+	if err := move(tx, userID, currency, &entry); err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+// CaptureHold completes the wallet part of the purchase paid for by reference
+// once the rest of the payment has arrived. A hold that was already released
+// is taken from the wallet again, failing with ErrInsufficientFunds if the
+// money has since been spent. Capturing twice is harmless.
+func CaptureHold(tx *gorm.DB, userID uint, amount int64, currency, reference string) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	var hold models.WalletEntry
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND reference = ? AND source = ? AND status IN ?",
+			userID, reference, SourcePayment, []string{HoldHeld, HoldCaptured}).
+		First(&hold).Error
+	switch {
+	case err == nil && hold.Status == HoldCaptured:
+		return nil
+	case err == nil:
+		if err := tx.Model(&hold).Update("status", HoldCaptured).Error; err != nil {
+			return err
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// The hold was released before the payment arrived
+		hold = models.WalletEntry{
+			Direction:   "debit",
+			Source:      SourcePayment,
+			Amount:      amount,
+			Reference:   reference,
+			Description: "Payment " + reference,
+			Status:      HoldCaptured,
+		}
+		if err := move(tx, userID, currency, &hold); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	// Wallet money replaces cash for this part of the payment
+	return earnings.RecordTransfer(tx, reference+"-WAL", "wallet_spend", amount, currency,
+		models.AccountUserWallet, models.AccountCash, "Wallet payment "+reference)
+}
+
+// ReleaseHold returns the wallet part of an abandoned purchase to the wallet.
+// Holds that were captured or already released are left alone.
+func ReleaseHold(tx *gorm.DB, reference string) error {
+	var hold models.WalletEntry
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("reference = ? AND source = ? AND status = ?", reference, SourcePayment, HoldHeld).
+		First(&hold).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Model(&hold).Update("status", HoldReleased).Error; err != nil {
+		return err
+	}
+
+	return move(tx, hold.UserID, hold.Currency, &models.WalletEntry{
+		Direction:   "credit",
+		Source:      SourceRelease,
+		Amount:      hold.Amount,
+		Reference:   reference,
+		Description: "Returned from unpaid purchase " + reference,
+	})
+}
+
+// releaseExpiredHolds releases every hold still waiting for its payment after holdTTL
+func releaseExpiredHolds(db *gorm.DB, now time.Time) error {
+	var references []string
+	if err := db.Model(&models.WalletEntry{}).
+		Where("source = ? AND status = ? AND created_at < ?", SourcePayment, HoldHeld, now.Add(-holdTTL)).
+		Pluck("reference", &references).Error; err != nil {
+		return err
+	}
+
+	for _, reference := range references {
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return ReleaseHold(tx, reference)
+		}); err != nil {
+			return fmt.Errorf("release %s: %w", reference, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/KAsare1/Kodefx-server/cmd/models"
+	"github.com/KAsare1/Kodefx-server/db/testdb"
+	"gorm.io/gorm"
+)
+
+// available returns the user's GHS balance, failing t on error
+func available(t *testing.T, db *gorm.DB, userID uint) int64 {
+	t.Helper()
+
+	balance, err := Available(db, userID, "GHS")
+	if err != nil {
+		t.Fatalf("Available: %v", err)
+	}
+	return balance
+}
+
+// credit adds amount of promo credit to the user's GHS wallet
+func credit(t *testing.T, db *gorm.DB, userID uint, amount int64) {
+	t.Helper()
+
+	if _, err := Credit(db, userID, amount, "GHS", SourcePromo, fmt.Sprintf("PROMO-%d", amount), "Promo", nil); err != nil {
+		t.Fatalf("Credit: %v", err)
+	}
+}
+
+// hold holds up to amount for reference, failing t on error
+func hold(t *testing.T, db *gorm.DB, userID uint, amount int64, reference string) int64 {
+	t.Helper()
+
+	var held int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		held, err = Hold(tx, userID, amount, "GHS", reference, "Checkout")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Hold: %v", err)
+	}
+	return held
+}
+
+// checkWalletLedger fails t unless the ledger's user_wallet account holds
+// what the users' wallets do
+func checkWalletLedger(t *testing.T, db *gorm.DB) {
+	t.Helper()
+
+	var wallets, ledger int64
+	db.Model(&models.Wallet{}).Select("COALESCE(SUM(balance_minor), 0)").Scan(&wallets)
+	db.Model(&models.LedgerEntry{}).Where("account = ?", models.AccountUserWallet).
+		Select("COALESCE(SUM(credit_minor - debit_minor), 0)").Scan(&ledger)
+	// Held money has left the wallets but is only booked once captured
+	var held int64
+	db.Model(&models.WalletEntry{}).Where("source = ? AND status = ?", SourcePayment, HoldHeld).
+		Select("COALESCE(SUM(amount_minor), 0)").Scan(&held)
+	if wallets+held != ledger {
+		t.Errorf("wallets hold %d with %d held, ledger says %d", wallets, held, ledger)
+	}
+}
+
+func TestCreditAndDebit(t *testing.T) {
+	db := testdb.Open(t, "wallet")
+	user := testdb.User(t, db, "Wallet Owner")
+
+	if got := available(t, db, user.ID); got != 0 {
+		t.Fatalf("new wallet balance = %d", got)
+	}
+
+	entry, err := Credit(db, user.ID, 5000, "GHS", SourceReferral, "REF-1", "Referral", nil)
+	if err != nil || entry.BalanceAfter != 5000 {
+		t.Fatalf("Credit = %+v, %v", entry, err)
+	}
+	entry, err = Debit(db, user.ID, 2000, "GHS", SourceAdjustment, "ADJ-1", "Correction", nil)
+	if err != nil || entry.BalanceAfter != 3000 {
+		t.Fatalf("Debit = %+v, %v", entry, err)
+	}
+
+	tests := []struct {
+		name    string
+		move    func() error
+		wantErr error
+	}{
+		{name: "debit above the balance", move: func() error {
+			_, err := Debit(db, user.ID, 3001, "GHS", SourceAdjustment, "ADJ-2", "Correction", nil)
+			return err
+		}, wantErr: ErrInsufficientFunds},
+		{name: "zero credit", move: func() error {
+			_, err := Credit(db, user.ID, 0, "GHS", SourcePromo, "PROMO-0", "Promo", nil)
+			return err
+		}, wantErr: ErrInvalidAmount},
+		{name: "negative debit", move: func() error {
+			_, err := Debit(db, user.ID, -100, "GHS", SourceAdjustment, "ADJ-3", "Correction", nil)
+			return err
+		}, wantErr: ErrInvalidAmount},
+		{name: "other currency is a separate wallet", move: func() error {
+			_, err := Debit(db, user.ID, 100, "NGN", SourceAdjustment, "ADJ-4", "Correction", nil)
+			return err
+		}, wantErr: ErrInsufficientFunds},
+	}
+	for _, tt := range tests {
+		if err := tt.move(); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if got := available(t, db, user.ID); got != 3000 {
+		t.Errorf("balance = %d, want 3000", got)
+	}
+	checkWalletLedger(t, db)
+}
+
+func TestHold(t *testing.T) {
+	tests := []struct {
+		name        string
+		balance     int64
+		amount      int64
+		wantHeld    int64
+		wantBalance int64
+	}{
+		{name: "part of the balance", balance: 5000, amount: 3000, wantHeld: 3000, wantBalance: 2000},
+		{name: "more than the balance", balance: 5000, amount: 8000, wantHeld: 5000, wantBalance: 0},
+		{name: "empty wallet", amount: 3000, wantHeld: 0, wantBalance: 0},
+		{name: "nothing asked", balance: 5000, amount: 0, wantHeld: 0, wantBalance: 5000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "wallet")
+			user := testdb.User(t, db, "Wallet Owner")
+			if tt.balance > 0 {
+				credit(t, db, user.ID, tt.balance)
+			}
+
+			if held := hold(t, db, user.ID, tt.amount, "APT-1"); held != tt.wantHeld {
+				t.Errorf("held %d, want %d", held, tt.wantHeld)
+			}
+			if got := available(t, db, user.ID); got != tt.wantBalance {
+				t.Errorf("balance = %d, want %d", got, tt.wantBalance)
+			}
+			checkWalletLedger(t, db)
+		})
+	}
+}
+
+func TestCaptureHold(t *testing.T) {
+	tests := []struct {
+		name        string
+		release     bool  // The hold was released before the payment arrived
+		spent       int64 // and this much spent since
+		wantErr     error
+		wantBalance int64
+	}{
+		{name: "held", wantBalance: 2000},
+		{name: "released, still in the wallet", release: true, wantBalance: 2000},
+		{name: "released and spent", release: true, spent: 4000, wantErr: ErrInsufficientFunds, wantBalance: 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t, "wallet")
+			user := testdb.User(t, db, "Wallet Owner")
+			credit(t, db, user.ID, 5000)
+			hold(t, db, user.ID, 3000, "APT-1")
+			if tt.release {
+				if err := ReleaseHold(db, "APT-1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.spent > 0 {
+				if _, err := Debit(db, user.ID, tt.spent, "GHS", SourceAdjustment, "ADJ-1", "Spent", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The payment webhook may arrive twice
+			for i := 0; i < 2; i++ {
+				err := db.Transaction(func(tx *gorm.DB) error {
+					return CaptureHold(tx, user.ID, 3000, "GHS", "APT-1")
+				})
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("CaptureHold error = %v, want %v", err, tt.wantErr)
+				}
+			}
+
+			if got := available(t, db, user.ID); got != tt.wantBalance {
+				t.Errorf("balance = %d, want %d", got, tt.wantBalance)
+			}
+			var spends int64
+			db.Model(&models.LedgerJournal{}).Where("kind = ?", "wallet_spend").Count(&spends)
+			want := int64(1)
+			if tt.wantErr != nil {
+				want = 0
+			}
+			if spends != want {
+				t.Errorf("%d wallet_spend journals, want %d", spends, want)
+			}
+			checkWalletLedger(t, db)
+		})
+	}
+}
+
+func TestReleaseHold(t *testing.T) {
+	db := testdb.Open(t, "wallet")
+	user := testdb.User(t, db, "Wallet Owner")
+	credit(t, db, user.ID, 5000)
+	hold(t, db, user.ID, 3000, "APT-1")
+	hold(t, db, user.ID, 1000, "APT-2")
+	if err := CaptureHold(db, user.ID, 1000, "GHS", "APT-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Released once however often it is asked; captured holds stay spent
+	for _, reference := range []string{"APT-1", "APT-1", "APT-2", "APT-unknown"} {
+		if err := ReleaseHold(db, reference); err != nil {
+			t.Fatalf("ReleaseHold(%s): %v", reference, err)
+		}
+	}
+
+	if got := available(t, db, user.ID); got != 4000 {
+		t.Errorf("balance = %d, want 4000", got)
+	}
+	checkWalletLedger(t, db)
+}
+
+func TestReleaseExpiredHolds(t *testing.T) {
+	db := testdb.Open(t, "wallet")
+	user := testdb.User(t, db, "Wallet Owner")
+	credit(t, db, user.ID, 5000)
+	hold(t, db, user.ID, 2000, "APT-old")
+	hold(t, db, user.ID, 1000, "APT-new")
+	now := time.Now()
+	db.Model(&models.WalletEntry{}).Where("reference = ?", "APT-old").UpdateColumn("created_at", now.Add(-2*holdTTL))
+
+	if err := releaseExpiredHolds(db, now); err != nil {
+		t.Fatal(err)
+	}
+
+	var old, recent models.WalletEntry
+	db.Where("reference = ? AND source = ?", "APT-old", SourcePayment).First(&old)
+	db.Where("reference = ? AND source = ?", "APT-new", SourcePayment).First(&recent)
+	if old.Status != HoldReleased || recent.Status != HoldHeld {
+		t.Errorf("old hold %s, recent hold %s; want released and held", old.Status, recent.Status)
+	}
+	if got := available(t, db, user.ID); got != 4000 {
+		t.Errorf("balance = %d, want 4000", got)
+	}
+}
+
+func TestRefundPayment(t *testing.T) {
+	db := testdb.Open(t, "wallet")
+	user := testdb.User(t, db, "Wallet Owner")
+
+	for i := 0; i < 2; i++ { // A zero refund changes nothing
+		amount := int64(7000 * i)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return RefundPayment(tx, user.ID, amount, "GHS", fmt.Sprintf("APT-%d", i), "Late payment")
+		})
+		if err != nil {
+			t.Fatalf("RefundPayment: %v", err)
+		}
+	}
+
+	if got := available(t, db, user.ID); got != 7000 {
+		t.Errorf("balance = %d, want 7000", got)
+	}
+	// The card payment is booked as received before it is credited
+	var payments int64
+	db.Model(&models.LedgerJournal{}).Where("reference = ? AND kind = ?", "APT-1", "payment").Count(&payments)
+	if payments != 1 {
+		t.Errorf("%d payment journals for the refunded payment, want 1", payments)
+	}
+	checkWalletLedger(t, db)
+}
+
+func TestHoldRace(t *testing.T) {
+	db := testdb.Open(t, "wallet")
+	user := testdb.User(t, db, "Wallet Owner")
+	credit(t, db, user.ID, 5000)
+
+	held := make([]int64, 5)
+	errs := testdb.Race(len(held), func(i int) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			held[i], err = Hold(tx, user.ID, 2000, "GHS", fmt.Sprintf("APT-%d", i), "Checkout")
+			return err
+		})
+	})
+
+	var total int64
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("hold %d: %v", i, err)
+		}
+		total += held[i]
+	}
+	if total != 5000 {
+		t.Errorf("held %d in total, want the whole 5000 and no more", total)
+	}
+	if got := available(t, db, user.ID); got != 0 {
+		t.Errorf("balance = %d, want 0", got)
+	}
+}
@@ -0,0 +1,62 @@
+// Package wallettest sets up wallet balances and holds for tests of the
+// payment flows that use them.
+package wallettest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/KAsare1/Kodefx-server/service/wallet"
+	"gorm.io/gorm"
+)
+
+// Hold credits amount to the user's GHS wallet and holds it for the payment
+// reference, as a checkout paying partly from the wallet does
+func Hold(t *testing.T, db *gorm.DB, userID uint, amount int64, reference string) {
+	t.Helper()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if _, err := wallet.Credit(tx, userID, amount, "GHS", wallet.SourcePromo, "PROMO-"+reference, "Promo", nil); err != nil {
+			return err
+		}
+		_, err := wallet.Hold(tx, userID, amount, "GHS", reference, "Checkout "+reference)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("holding wallet credit for %s: %v", reference, err)
+	}
+}
+
+// Release returns the hold for reference to the wallet, as an expired
+// checkout does
+func Release(t *testing.T, db *gorm.DB, reference string) {
+	t.Helper()
+
+	if err := db.Transaction(func(tx *gorm.DB) error { return wallet.ReleaseHold(tx, reference) }); err != nil {
+		t.Fatalf("releasing wallet hold %s: %v", reference, err)
+	}
+}
+
+// Spend debits amount from the user's GHS wallet
+func Spend(t *testing.T, db *gorm.DB, userID uint, amount int64) {
+	t.Helper()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := wallet.Debit(tx, userID, amount, "GHS", wallet.SourceAdjustment, fmt.Sprintf("SPEND-%d", userID), "Spent", nil)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("spending wallet credit: %v", err)
+	}
+}
+
+// Balance returns what the user can spend from their GHS wallet
+func Balance(t *testing.T, db *gorm.DB, userID uint) int64 {
+	t.Helper()
+
+	balance, err := wallet.Available(db, userID, "GHS")
+	if err != nil {
+		t.Fatalf("reading wallet balance: %v", err)
+	}
+	return balance
+}